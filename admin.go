@@ -0,0 +1,143 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ServeAdminHTTP serves the operational endpoints on ln until ctx is cancelled:
+// /healthz reports that the process is alive, and /readyz reports whether the
+// server can answer queries, returning 503 until an upstream exchange has
+// succeeded when forwarding. /metrics exposes the server's metrics in the
+// Prometheus text format, and /topnames lists the most queried names, one
+// "count name" line each, limited by the n parameter (default 10). /recent
+// lists the last answered queries, newest first, one "time client name type
+// rcode" line each. /upstreams lists the resolvers forwarded to, one
+// "resolver up|down successes failures latency last-error" line each, the
+// last error quoted. POST /maintenance turns maintenance mode on, answering
+// every query with the rcode parameter (default REFUSED) and the ede text,
+// and DELETE /maintenance turns it off.
+func (s *Server) ServeAdminHTTP(ctx context.Context, ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+	mux.HandleFunc("GET /recent", func(w http.ResponseWriter, r *http.Request) {
+		for _, query := range s.RecentQueries() {
+			fmt.Fprintf(w, "%s %s %s %s %d\n", query.Time.Format(time.RFC3339Nano), query.Client, fqdn(query.Name), typeName(query.Type), query.Rcode)
+		}
+	})
+	mux.HandleFunc("GET /upstreams", func(w http.ResponseWriter, r *http.Request) {
+		for _, stats := range s.UpstreamStats() {
+			state := "up"
+			if stats.Down {
+				state = "down"
+			}
+			fmt.Fprintf(w, "%s %s %d %d %s %q\n", stats.Resolver, state, stats.Successes, stats.Failures, stats.Latency, stats.LastError)
+		}
+	})
+	mux.HandleFunc("POST /maintenance", func(w http.ResponseWriter, r *http.Request) {
+		rcode := RCODE_REFUSED
+		if param := r.FormValue("rcode"); param != "" {
+			n, err := strconv.ParseUint(param, 10, 4)
+			if err != nil {
+				http.Error(w, "invalid rcode", http.StatusBadRequest)
+				return
+			}
+			rcode = uint8(n)
+		}
+		s.SetMaintenanceMode(true, rcode, r.FormValue("ede"))
+		slog.Warn("Maintenance mode on", "rcode", rcode)
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("DELETE /maintenance", func(w http.ResponseWriter, r *http.Request) {
+		s.SetMaintenanceMode(false, 0, "")
+		slog.Warn("Maintenance mode off")
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /topnames", func(w http.ResponseWriter, r *http.Request) {
+		n := 10
+		if param := r.URL.Query().Get("n"); param != "" {
+			var err error
+			if n, err = strconv.Atoi(param); err != nil || n < 0 {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		for _, name := range s.TopNames(n) {
+			fmt.Fprintf(w, "%d %s\n", name.Count, fqdn(name.Name))
+		}
+	})
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	slog.Info("Serving admin HTTP", "addr", ln.Addr())
+	err := srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Ready reports whether the server can answer queries: always when it only
+// answers locally, and when forwarding once an upstream exchange has
+// succeeded or a zone has records to answer from.
+func (s *Server) Ready() bool {
+	cfg := s.snapshot()
+	return !cfg.shouldForwardQuery() || s.upstreamReady.Load() || cfg.zoneLoaded()
+}
+
+// zoneLoaded reports whether Zone or one of the Views has records.
+func (s *Server) zoneLoaded() bool {
+	if !s.opts.Zone.empty() {
+		return true
+	}
+	for _, zone := range s.opts.Views {
+		if zone != nil && !zone.empty() {
+			return true
+		}
+	}
+	return false
+}
+
+// Probe checks that the resolver answers by forwarding a root NS query,
+// marking the server ready on success.
+func (s *Server) Probe(ctx context.Context) error {
+	s = s.snapshot()
+	if !s.shouldForwardQuery() {
+		return nil
+	}
+
+	// forwardQuery gives the probe its ID and checks the response matches it.
+	probeBytes, err := NewQuery("", TYPE_NS, CLASS_IN).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if _, _, err := s.forwardQuery(ctx, probeBytes, maxUDPMessageSize); err != nil {
+		return err
+	}
+
+	s.upstreamReady.Store(true)
+	return nil
+}
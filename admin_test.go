@@ -0,0 +1,131 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHTTPReflectsReadiness(t *testing.T) {
+	resolver := startMockResolver(t, answerWith())
+	server := NewServer(Options{Resolver: resolver})
+	base := startAdminHTTP(t, server)
+
+	assert.Equal(t, http.StatusOK, getStatus(t, base+"/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, getStatus(t, base+"/readyz"))
+
+	require.NoError(t, server.Probe(context.Background()))
+
+	assert.Equal(t, http.StatusOK, getStatus(t, base+"/readyz"))
+}
+
+func TestAdminHTTPReadyWithoutForwarding(t *testing.T) {
+	server := NewServer(Options{Zone: NewZone()})
+	base := startAdminHTTP(t, server)
+
+	assert.Equal(t, http.StatusOK, getStatus(t, base+"/readyz"))
+	assert.Equal(t, http.StatusNotFound, getStatus(t, base+"/unknown"))
+}
+
+func TestProbeFailsWithUnreachableResolver(t *testing.T) {
+	server := NewServer(Options{Resolver: "127.0.0.1:53535"})
+
+	assert.Error(t, server.Probe(context.Background()))
+	assert.False(t, server.Ready())
+}
+
+func TestLoadedZoneMarksServerReady(t *testing.T) {
+	server := NewServer(Options{Resolver: "127.0.0.1:53535"})
+	require.False(t, server.Ready(), "an empty zone shouldn't make a forwarding server ready")
+
+	zone := NewZone()
+	zone.Add(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60))
+	server = NewServer(Options{Resolver: "127.0.0.1:53535", Zone: zone})
+	assert.True(t, server.Ready(), "a zone should make the server ready without a reachable resolver")
+
+	views := map[Transport]*Zone{TransportDoH: zone}
+	server = NewServer(Options{Resolver: "127.0.0.1:53535", Views: views})
+	assert.True(t, server.Ready())
+}
+
+func TestSuccessfulForwardMarksServerReady(t *testing.T) {
+	resolver := startMockResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60)))
+	server := NewServer(Options{Resolver: resolver})
+	require.False(t, server.Ready())
+
+	queryType(t, server, "example.com", TYPE_A, nil)
+
+	assert.True(t, server.Ready())
+}
+
+func startAdminHTTP(t *testing.T, server *Server) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.ServeAdminHTTP(ctx, ln)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return "http://" + ln.Addr().String()
+}
+
+func getStatus(t *testing.T, url string) int {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestProbeIDsFollowIDStrategy(t *testing.T) {
+	var mu sync.Mutex
+	var ids []uint16
+	resolver := startMockResolver(t, func(query Message) Message {
+		mu.Lock()
+		ids = append(ids, query.Header.ID)
+		mu.Unlock()
+		return answerWith()(query)
+	})
+
+	monotonic := NewServer(Options{Resolver: resolver, IDStrategy: IDStrategyMonotonic})
+	random := NewServer(Options{Resolver: resolver})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, monotonic.Probe(context.Background()))
+	}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, random.Probe(context.Background()))
+	}
+
+	response := queryType(t, monotonic, "example.com", TYPE_A, nil)
+	assert.Equal(t, uint16(1), response.Header.ID, "client responses echo the query ID")
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, ids, 7)
+	assert.Equal(t, []uint16{1, 2, 3}, ids[:3])
+	for _, id := range ids[3:6] {
+		assert.NotZero(t, id)
+	}
+}
+
+func TestMonotonicIDsSkipZero(t *testing.T) {
+	server := NewServer(Options{IDStrategy: IDStrategyMonotonic})
+	server.lastID.Store(1<<16 - 1)
+
+	assert.Equal(t, uint16(1), server.nextID())
+}
@@ -0,0 +1,95 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// as112TTL is the TTL of the records served for AS112 zones, a week as in the
+// zone file of RFC 6304 section 3.3.
+const as112TTL = 604800
+
+// as112Zones are the zones the AS112 project sinks (RFC 6304 section 3.4 and
+// RFC 7535): the reverse zones of the private and link-local IPv4 ranges, and
+// the zone for delegations to AS112 servers.
+var as112Zones = func() []string {
+	zones := []string{"10.in-addr.arpa", "168.192.in-addr.arpa", "254.169.in-addr.arpa", "empty.as112.arpa"}
+	for octet := 16; octet <= 31; octet++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa", octet))
+	}
+	return zones
+}()
+
+// as112Zone returns the AS112 zone holding name, if any.
+func as112Zone(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, zone := range as112Zones {
+		if nameMatches(name, zone) {
+			return zone, true
+		}
+	}
+	return "", false
+}
+
+// as112SOA and as112NS are the records every AS112 zone holds at its apex.
+func as112SOA(zone string) Answer {
+	return NewSOAAnswer(zone, "prisoner.iana.org", "hostmaster.root-servers.org", 1, 604800, 60, 604800, as112TTL, as112TTL)
+}
+
+func as112NS(zone string) []Answer {
+	return []Answer{
+		NewNSAnswer(zone, "blackhole-1.iana.org", as112TTL),
+		NewNSAnswer(zone, "blackhole-2.iana.org", as112TTL),
+	}
+}
+
+// lookupAS112 answers the query like an AS112 server would, if every question
+// is under an AS112 zone: the zones are empty, so only their apex SOA and NS
+// records exist and every other name is NXDOMAIN. Negative answers carry the
+// zone's SOA in the authority section.
+func (s *Server) lookupAS112(query Message) (answers, authorities []Answer, rcode uint8, ok bool) {
+	if !s.opts.HandleAS112 || len(query.Questions) == 0 {
+		return nil, nil, 0, false
+	}
+
+	answers = make([]Answer, 0)
+	rcode = RCODE_NO_ERROR
+	var soa Answer
+	for i, question := range query.Questions {
+		zone, ok := as112Zone(question.Name)
+		if !ok {
+			return nil, nil, 0, false
+		}
+		if i == 0 {
+			soa = as112SOA(zone)
+		}
+		if zoneKey(question.Name) != zone {
+			rcode = RCODE_NAME_ERROR
+			continue
+		}
+		if question.Type == TYPE_SOA || question.Type == TYPE_ANY {
+			answers = append(answers, as112SOA(zone))
+		}
+		if question.Type == TYPE_NS || question.Type == TYPE_ANY {
+			answers = append(answers, as112NS(zone)...)
+		}
+	}
+	if rcode != RCODE_NO_ERROR || len(answers) == 0 {
+		authorities = []Answer{soa}
+	}
+	return answers, authorities, rcode, true
+}
+
+// handleAS112Query answers queries for AS112 zones locally, so reverse lookups
+// of private addresses never reach the resolver.
+func (s *Server) handleAS112Query(ctx context.Context, msg Message, answers, authorities []Answer, rcode uint8, maxSize int) ([]byte, error) {
+	logger(ctx).Debug("Answering AS112 name locally", "name", msg.Questions[0].Name, "rcode", rcode)
+	msg.SetError(rcode, nil)
+	msg.Header.SetAuthoritative(true)
+	msg.Answers = answers
+	msg.Authorities = authorities
+	msg.Header.AnswerCount = uint16(len(answers))
+	msg.Header.AuthorityCount = uint16(len(authorities))
+	return marshalResponse(ctx, msg, maxSize)
+}
@@ -0,0 +1,46 @@
+package dnsserver
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleAS112(t *testing.T) {
+	var asked atomic.Int64
+	resolver := startMockResolver(t, func(query Message) Message {
+		asked.Add(1)
+		return answerWith()(query)
+	})
+	server := NewServer(Options{Resolver: resolver, HandleAS112: true})
+
+	response := queryType(t, server, "4.3.2.10.in-addr.arpa", TYPE_PTR, nil)
+	assert.Equal(t, RCODE_NAME_ERROR, response.Header.ResponseCode())
+	assert.True(t, response.Header.Authoritative())
+	assert.Empty(t, response.Answers)
+	require.Len(t, response.Authorities, 1)
+	assert.Equal(t, TYPE_SOA, response.Authorities[0].Type)
+	assert.Equal(t, "10.in-addr.arpa", response.Authorities[0].Name)
+
+	apex := queryType(t, server, "20.172.in-addr.arpa", TYPE_NS, nil)
+	assert.Equal(t, RCODE_NO_ERROR, apex.Header.ResponseCode())
+	require.Len(t, apex.Answers, 2)
+	host, _, err := readName(apex.Answers[0].Data, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "blackhole-1.iana.org", host)
+
+	noData := queryType(t, server, "168.192.in-addr.arpa", TYPE_A, nil)
+	assert.Equal(t, RCODE_NO_ERROR, noData.Header.ResponseCode())
+	assert.Empty(t, noData.Answers)
+	require.Len(t, noData.Authorities, 1)
+	assert.Equal(t, int64(0), asked.Load(), "AS112 names shouldn't be forwarded")
+
+	queryType(t, server, "1.2.0.192.in-addr.arpa", TYPE_PTR, nil)
+	queryType(t, server, "4.3.2.32.172.in-addr.arpa", TYPE_PTR, nil)
+	assert.Equal(t, int64(2), asked.Load(), "other reverse names should still be forwarded")
+
+	queryType(t, NewServer(Options{Resolver: resolver}), "4.3.2.10.in-addr.arpa", TYPE_PTR, nil)
+	assert.Equal(t, int64(3), asked.Load(), "AS112 handling is off by default")
+}
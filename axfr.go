@@ -0,0 +1,169 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// axfrTimeout bounds a whole zone transfer from the primary.
+const axfrTimeout = 30 * time.Second
+
+// minZoneRefresh is the least a secondary zone waits between transfers,
+// whatever its SOA's refresh and retry intervals say, so that a zero one
+// doesn't have it transfer the zone again and again.
+const minZoneRefresh = time.Minute
+
+// soaTimers are the fields of an SOA record that drive a secondary's refreshes.
+type soaTimers struct {
+	serial, refresh, retry, expire uint32
+}
+
+func parseSOATimers(data []byte) (soaTimers, error) {
+	_, offset, err := readName(data, 0)
+	if err != nil {
+		return soaTimers{}, err
+	}
+	_, offset, err = readName(data, offset)
+	if err != nil {
+		return soaTimers{}, err
+	}
+	if offset+20 != len(data) {
+		return soaTimers{}, errors.New("invalid SOA record data")
+	}
+	return soaTimers{
+		serial:  binary.BigEndian.Uint32(data[offset:]),
+		refresh: binary.BigEndian.Uint32(data[offset+4:]),
+		retry:   binary.BigEndian.Uint32(data[offset+8:]),
+		expire:  binary.BigEndian.Uint32(data[offset+12:]),
+	}, nil
+}
+
+func seconds(n uint32) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+// refreshWait is how long to wait for n seconds of an SOA refresh or retry
+// interval, at least minZoneRefresh.
+func refreshWait(n uint32) time.Duration {
+	return max(seconds(n), minZoneRefresh)
+}
+
+// TransferZoneFrom pulls zone from the primary server at addr with an AXFR
+// (RFC 5936) over TCP and serves it authoritatively from the server's Zone.
+// It returns once the first transfer completes, and then keeps the copy fresh
+// in the background per the SOA timers: it transfers again every refresh
+// interval, every retry interval after a failure, though never more often
+// than once a minute, and stops answering for the zone once expire has
+// passed without a successful transfer. Refreshing stops when ctx is
+// cancelled.
+func (s *Server) TransferZoneFrom(ctx context.Context, primary, zone string) error {
+	timers, err := s.transferZone(ctx, primary, zone)
+	if err != nil {
+		return err
+	}
+	go s.refreshZone(ctx, primary, zone, timers)
+	return nil
+}
+
+func (s *Server) refreshZone(ctx context.Context, primary, zone string, timers soaTimers) {
+	lastTransfer := s.now()
+	wait := refreshWait(timers.refresh)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		refreshed, err := s.transferZone(ctx, primary, zone)
+		if err == nil {
+			timers, lastTransfer, wait = refreshed, s.now(), refreshWait(refreshed.refresh)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		logger(ctx).Warn("Zone refresh failed", "zone", zone, "primary", primary, "error", err)
+		if s.now().Sub(lastTransfer) >= seconds(timers.expire) {
+			logger(ctx).Error("Zone expired, no longer answering for it", "zone", zone, "primary", primary)
+			s.snapshot().opts.Zone.replace(zone, nil)
+		}
+		wait = refreshWait(timers.retry)
+	}
+}
+
+// transferZone performs one AXFR and, if it succeeds, replaces the zone's
+// records with the transferred ones.
+func (s *Server) transferZone(ctx context.Context, primary, zone string) (soaTimers, error) {
+	ctx, cancel := context.WithTimeout(ctx, axfrTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", primary)
+	if err != nil {
+		return soaTimers{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	query := Message{
+		Header:    NewHeader(s.nextID(), 0, 1, 0, 0, 0),
+		Questions: []Question{{Name: zone, Type: TYPE_AXFR, Class: CLASS_IN}},
+	}
+	queryBytes, err := query.MarshalBinary()
+	if err != nil {
+		return soaTimers{}, err
+	}
+	if err := writeTCPMessage(conn, queryBytes); err != nil {
+		return soaTimers{}, err
+	}
+
+	// The transfer is a stream of messages whose records start with the zone's
+	// SOA and end with the same SOA again.
+	var records []Answer
+	var timers soaTimers
+	for {
+		responseBytes, err := readTCPMessage(conn)
+		if err != nil {
+			return soaTimers{}, fmt.Errorf("reading zone transfer: %w", err)
+		}
+		response, err := NewMessageFromBytes(responseBytes)
+		if err != nil {
+			return soaTimers{}, err
+		}
+		if response.Header.ID != query.Header.ID {
+			return soaTimers{}, errors.New("zone transfer response ID mismatch")
+		}
+		if rcode := response.Header.ResponseCode(); rcode != RCODE_NO_ERROR {
+			return soaTimers{}, fmt.Errorf("zone transfer refused with rcode %d", rcode)
+		}
+
+		for _, record := range response.Answers {
+			if len(records) == 0 {
+				if record.Type != TYPE_SOA || zoneKey(record.Name) != zoneKey(zone) {
+					return soaTimers{}, errors.New("zone transfer doesn't start with the zone's SOA")
+				}
+				timers, err = parseSOATimers(record.Data)
+				if err != nil {
+					return soaTimers{}, err
+				}
+			} else if record.Type == TYPE_SOA && zoneKey(record.Name) == zoneKey(zone) {
+				s.snapshot().opts.Zone.replace(zone, records)
+				logger(ctx).Info("Transferred zone", "zone", zone, "primary", primary, "serial", timers.serial, "records", len(records))
+				return timers, nil
+			}
+			if nameMatches(record.Name, zone) {
+				records = append(records, record)
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startMockPrimary serves an AXFR of records over TCP, splitting the stream
+// into one message per record like many primaries do.
+func startMockPrimary(t *testing.T, records []Answer) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				queryBytes, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				query, err := NewMessageFromBytes(queryBytes)
+				if err != nil || query.Questions[0].Type != TYPE_AXFR {
+					return
+				}
+				for _, record := range append(records, records[0]) {
+					response := query
+					response.AddAnswers([]Answer{record})
+					response.SetResponse(1)
+					responseBytes, err := response.MarshalBinary()
+					if err != nil {
+						return
+					}
+					writeTCPMessage(conn, responseBytes)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func testSecondaryZone(a net.IP) []Answer {
+	return []Answer{
+		NewSOAAnswer("example.com", "ns1.example.com", "hostmaster.example.com", 2024010101, 3600, 600, 86400, 300, 3600),
+		{Name: "example.com", Type: TYPE_NS, Class: CLASS_IN, TTL: 3600, Data: appendName(nil, "ns1.example.com")},
+		NewAAnswer("www.example.com", a, 300),
+	}
+}
+
+func TestTransferZoneFromServesTransferredRecords(t *testing.T) {
+	primary := startMockPrimary(t, testSecondaryZone(net.ParseIP("192.0.2.1")))
+	server := NewServer(Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, server.TransferZoneFrom(ctx, primary, "example.com"))
+
+	response := queryType(t, server, "www.example.com", TYPE_A, nil)
+	assert.True(t, response.Header.Authoritative())
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 1}, response.Answers[0].Data)
+
+	soa := queryType(t, server, "example.com", TYPE_SOA, nil)
+	require.Len(t, soa.Answers, 1, "the closing SOA shouldn't be stored twice")
+}
+
+func TestTransferZoneReplacesOldRecords(t *testing.T) {
+	server := NewServer(Options{})
+	ctx := context.Background()
+
+	_, err := server.transferZone(ctx, startMockPrimary(t, testSecondaryZone(net.ParseIP("192.0.2.1"))), "example.com")
+	require.NoError(t, err)
+	timers, err := server.transferZone(ctx, startMockPrimary(t, testSecondaryZone(net.ParseIP("192.0.2.2"))), "example.com")
+	require.NoError(t, err)
+
+	assert.Equal(t, soaTimers{serial: 2024010101, refresh: 3600, retry: 600, expire: 86400}, timers)
+	response := queryType(t, server, "www.example.com", TYPE_A, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 2}, response.Answers[0].Data)
+}
+
+func TestTransferZoneFromZeroRefresh(t *testing.T) {
+	logs := captureLogs(t)
+	records := testSecondaryZone(net.ParseIP("192.0.2.1"))
+	records[0] = NewSOAAnswer("example.com", "ns1.example.com", "hostmaster.example.com", 2024010101, 0, 0, 86400, 300, 3600)
+	primary := startMockPrimary(t, records)
+	server := NewServer(Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, server.TransferZoneFrom(ctx, primary, "example.com"))
+	time.Sleep(100 * time.Millisecond)
+
+	var transfers int
+	for _, line := range logs.lines(t) {
+		if line["msg"] == "Transferred zone" {
+			transfers++
+		}
+	}
+	assert.Equal(t, 1, transfers, "a zero refresh interval shouldn't transfer the zone in a loop")
+	assert.Equal(t, minZoneRefresh, refreshWait(0))
+	assert.Equal(t, time.Hour, refreshWait(3600))
+}
+
+func TestTransferZoneFromFailsWithoutPrimary(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = NewServer(Options{}).TransferZoneFrom(ctx, addr, "example.com")
+
+	assert.Error(t, err)
+}
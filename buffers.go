@@ -0,0 +1,102 @@
+package dnsserver
+
+import (
+	"context"
+	"sync"
+)
+
+// udpBufferSize is the size of the buffers UDP queries are read into.
+const udpBufferSize = 1024
+
+// forwardBufferSize is the size of the buffers forwarded UDP responses are
+// read into: the largest UDP payload, so no response a resolver sends is cut
+// short, whatever size it was offered.
+const forwardBufferSize = maxTCPMessageSize
+
+// bufferPool recycles the buffers UDP messages are read into when
+// ReuseBuffers is set, keeping query and forwarded response buffers apart
+// since they differ in size. A nil pool allocates a fresh buffer every time.
+type bufferPool struct {
+	queries   sync.Pool
+	responses sync.Pool
+}
+
+// get returns a buffer to read a query into.
+func (p *bufferPool) get() *[]byte {
+	if p != nil {
+		if buf, ok := p.queries.Get().(*[]byte); ok {
+			return buf
+		}
+	}
+	buf := make([]byte, udpBufferSize)
+	return &buf
+}
+
+// getResponse returns a buffer to read a forwarded response into.
+func (p *bufferPool) getResponse() *[]byte {
+	if p != nil {
+		if buf, ok := p.responses.Get().(*[]byte); ok {
+			return buf
+		}
+	}
+	buf := make([]byte, forwardBufferSize)
+	return &buf
+}
+
+func (p *bufferPool) put(buf *[]byte) {
+	switch {
+	case p == nil:
+	case len(*buf) == forwardBufferSize:
+		p.responses.Put(buf)
+	default:
+		p.queries.Put(buf)
+	}
+}
+
+// bufferLease holds the pooled buffers of one UDP query: the one the query
+// was read into and any a forwarded response was read into. The response
+// written to the client can be a slice of either, so they all go back to the
+// pool together, only once that write is done.
+type bufferLease struct {
+	pool *bufferPool
+	bufs []*[]byte
+}
+
+// newBufferLease returns a lease holding query's buffer, if any.
+func newBufferLease(pool *bufferPool, query *[]byte) *bufferLease {
+	lease := &bufferLease{pool: pool}
+	if query != nil {
+		lease.bufs = append(lease.bufs, query)
+	}
+	return lease
+}
+
+// get returns a buffer to read a forwarded response into that stays valid
+// until the lease is released. A nil lease, as for TCP queries, hands out a
+// buffer of its own.
+func (l *bufferLease) get() []byte {
+	if l == nil {
+		return make([]byte, forwardBufferSize)
+	}
+	buf := l.pool.getResponse()
+	l.bufs = append(l.bufs, buf)
+	return *buf
+}
+
+func (l *bufferLease) release() {
+	for _, buf := range l.bufs {
+		l.pool.put(buf)
+	}
+	l.bufs = nil
+}
+
+type bufferLeaseKey struct{}
+
+func withBufferLease(ctx context.Context, lease *bufferLease) context.Context {
+	return context.WithValue(ctx, bufferLeaseKey{}, lease)
+}
+
+func bufferLeaseFrom(ctx context.Context) *bufferLease {
+	lease, _ := ctx.Value(bufferLeaseKey{}).(*bufferLease)
+	return lease
+}
@@ -0,0 +1,131 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReusedBuffersKeepConcurrentResponsesApart(t *testing.T) {
+	resolver := startMockResolver(t, func(query Message) Message {
+		var i int
+		fmt.Sscanf(query.Questions[0].Name, "h%d.example.com", &i)
+		return answerWith(NewAAnswer(query.Questions[0].Name, net.IPv4(192, 0, 2, byte(i)), 60))(query)
+	})
+	server := NewServer(Options{Resolver: resolver, ReuseBuffers: true})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.ListenAndServe(ctx, conn)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	const queries = 50
+	for i := 1; i <= queries; i++ {
+		msg := Message{
+			Header:    NewHeader(uint16(i), 0, 1, 0, 0, 0),
+			Questions: []Question{{Name: fmt.Sprintf("h%d.example.com", i), Type: TYPE_A, Class: CLASS_IN}},
+		}
+		queryBytes, err := msg.MarshalBinary()
+		require.NoError(t, err)
+		_, err = client.Write(queryBytes)
+		require.NoError(t, err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxUDPMessageSize)
+	seen := make(map[uint16]bool)
+	for len(seen) < queries {
+		n, err := client.Read(buf)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(buf[:n])
+		require.NoError(t, err)
+
+		id := response.Header.ID
+		require.Len(t, response.Answers, 1)
+		assert.Equal(t, fmt.Sprintf("h%d.example.com", id), response.Answers[0].Name)
+		assert.Equal(t, []byte{192, 0, 2, byte(id)}, response.Answers[0].Data)
+		seen[id] = true
+	}
+}
+
+func TestBufferLeaseReleasesEveryBuffer(t *testing.T) {
+	pool := &bufferPool{}
+	query := pool.get()
+	lease := newBufferLease(pool, query)
+	response := lease.get()
+
+	assert.Len(t, *query, udpBufferSize)
+	assert.Len(t, response, forwardBufferSize, "forwarded responses should get buffers that fit any UDP payload")
+	assert.Len(t, lease.bufs, 2)
+	lease.release()
+	assert.Empty(t, lease.bufs)
+	assert.Len(t, *pool.get(), udpBufferSize, "released buffers should go back to the pool of their size")
+	assert.Len(t, *pool.getResponse(), forwardBufferSize)
+
+	var noLease *bufferLease
+	assert.Len(t, noLease.get(), forwardBufferSize)
+}
+
+// BenchmarkForwardedQueryBuffers compares the buffers a forwarded UDP query
+// reads into when each is allocated per call against reusing pooled ones.
+func BenchmarkForwardedQueryBuffers(b *testing.B) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(b, err)
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, maxUDPMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			buf[2] |= 0x80 // QR
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	queryBytes := createTestQuery()
+
+	b.Run("per-call", func(b *testing.B) {
+		server := NewServer(Options{Resolver: conn.LocalAddr().String()})
+		b.ReportAllocs()
+		for b.Loop() {
+			buf := server.buffers.get()
+			n := copy(*buf, queryBytes)
+			query := append([]byte{}, (*buf)[:n]...)
+			if _, err := server.handleQuery(context.Background(), query, nil, TransportUDP, maxUDPMessageSize); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		server := NewServer(Options{Resolver: conn.LocalAddr().String(), ReuseBuffers: true})
+		b.ReportAllocs()
+		for b.Loop() {
+			buf := server.buffers.get()
+			n := copy(*buf, queryBytes)
+			lease := newBufferLease(server.buffers, buf)
+			if _, err := server.handleQuery(withBufferLease(context.Background(), lease), (*buf)[:n], nil, TransportUDP, maxUDPMessageSize); err != nil {
+				b.Fatal(err)
+			}
+			lease.release()
+		}
+	})
+}
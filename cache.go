@@ -0,0 +1,268 @@
+package dnsserver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// questionKey identifies the single question of a message, names compared
+// case-insensitively, along with its DO bit, since DNSSEC-aware clients get
+// the signatures others don't.
+type questionKey struct {
+	name     string
+	qtype    uint16
+	class    uint16
+	dnssecOK bool
+}
+
+func questionKeyOf(msg Message) (questionKey, bool) {
+	if len(msg.Questions) != 1 {
+		return questionKey{}, false
+	}
+	q := msg.Questions[0]
+	opt, hasOPT := msg.OPT()
+	return questionKey{name: zoneKey(q.Name), qtype: q.Type, class: q.Class, dnssecOK: hasOPT && opt.DNSSECOK}, true
+}
+
+const (
+	// hotCacheHits is how many hits make an entry hot within its lifetime,
+	// for AdaptiveCacheTTL.
+	hotCacheHits = 10
+	// defaultMaxTTL bounds how long AdaptiveCacheTTL keeps hot entries when
+	// MaxTTL isn't set.
+	defaultMaxTTL = time.Hour
+)
+
+type cacheEntry struct {
+	rcode       uint8
+	answers     []Answer
+	authorities []Answer
+	stored      time.Time
+	expires     time.Time
+	// ttl is the lifetime the records gave the entry, and hits how many
+	// lookups it answered since it was stored or last extended.
+	ttl  time.Duration
+	hits int
+	// extended marks an entry served past its records' TTL.
+	extended bool
+	// authenticData is the AD bit of the response, for the resolver's
+	// validation to carry over to the answers given from the cache.
+	authenticData bool
+}
+
+// responseCache keeps forwarded responses to answer the same question again
+// until the lowest TTL among their records runs out. With a positive maxTTL,
+// entries hot enough to answer hotCacheHits lookups in their lifetime are
+// extended by a tenth of it when they expire instead, until maxTTL after they
+// were stored, sparing the resolver re-fetching popular names. A nil cache
+// keeps nothing. When full, it drops the entry used least recently.
+type responseCache struct {
+	mu      sync.Mutex
+	size    int
+	maxTTL  time.Duration
+	entries map[questionKey]*list.Element
+	// recent orders the entries' cacheItems from the most recently used.
+	recent *list.List
+}
+
+type cacheItem struct {
+	key   questionKey
+	entry cacheEntry
+}
+
+// adaptiveMaxTTL returns the maxTTL of the cache opts configure, zero when
+// AdaptiveCacheTTL is off.
+func adaptiveMaxTTL(opts Options) time.Duration {
+	switch {
+	case !opts.AdaptiveCacheTTL:
+		return 0
+	case opts.MaxTTL <= 0:
+		return defaultMaxTTL
+	}
+	return opts.MaxTTL
+}
+
+func newResponseCache(size int, maxTTL time.Duration) *responseCache {
+	if size <= 0 {
+		return nil
+	}
+	return &responseCache{size: size, maxTTL: maxTTL, entries: make(map[questionKey]*list.Element), recent: list.New()}
+}
+
+// store caches a response received at now. Like for StaleIfError, only
+// answers and NXDOMAIN are kept, and records with a zero TTL aren't.
+func (c *responseCache) store(response Message, now time.Time) {
+	if c == nil {
+		return
+	}
+	key, ok := questionKeyOf(response)
+	rcode := response.Header.ResponseCode()
+	if !ok || response.Header.Truncated() ||
+		!(rcode == RCODE_NAME_ERROR || rcode == RCODE_NO_ERROR && len(response.Answers) > 0) {
+		return
+	}
+
+	entry := cacheEntry{
+		rcode:         rcode,
+		answers:       cloneRecords(response.Answers),
+		authorities:   cloneRecords(response.Authorities),
+		stored:        now,
+		authenticData: response.Header.AuthenticData(),
+	}
+	ttl, found := uint32(0), false
+	for _, section := range [][]Answer{entry.answers, entry.authorities} {
+		for _, record := range section {
+			if !found || record.TTL < ttl {
+				ttl, found = record.TTL, true
+			}
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	entry.ttl = time.Duration(ttl) * time.Second
+	entry.expires = now.Add(entry.ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exists := c.entries[key]; exists {
+		element.Value.(*cacheItem).entry = entry
+		c.recent.MoveToFront(element)
+		return
+	}
+	if len(c.entries) >= c.size {
+		oldest := c.recent.Back()
+		delete(c.entries, oldest.Value.(*cacheItem).key)
+		c.recent.Remove(oldest)
+	}
+	c.entries[key] = c.recent.PushFront(&cacheItem{key: key, entry: entry})
+}
+
+// lookup returns the response cached for the query, if it hasn't expired by now.
+func (c *responseCache) lookup(query Message, now time.Time) (cacheEntry, bool) {
+	if c == nil {
+		return cacheEntry{}, false
+	}
+	key, ok := questionKeyOf(query)
+	if !ok {
+		return cacheEntry{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	item := element.Value.(*cacheItem)
+	if !now.Before(item.entry.expires) && !c.extend(&item.entry, now) {
+		delete(c.entries, key)
+		c.recent.Remove(element)
+		return cacheEntry{}, false
+	}
+	item.entry.hits++
+	c.recent.MoveToFront(element)
+	return item.entry, true
+}
+
+// extend gives an expired hot entry another tenth of its lifetime, reporting
+// whether it did. The entry must then be hot again to be extended further.
+func (c *responseCache) extend(entry *cacheEntry, now time.Time) bool {
+	if c.maxTTL <= 0 || entry.hits < hotCacheHits {
+		return false
+	}
+	limit := entry.stored.Add(c.maxTTL)
+	expires := now.Add(max(entry.ttl/10, time.Second))
+	if expires.After(limit) {
+		expires = limit
+	}
+	if !now.Before(expires) {
+		return false
+	}
+	entry.expires, entry.hits, entry.extended = expires, 0, true
+	return true
+}
+
+// handleCachedQuery answers the query from the cache, its records' TTLs
+// lowered by the time they spent there, or to what is left of the extension of
+// an entry kept past them. It reports false on a miss.
+func (s *Server) handleCachedQuery(ctx context.Context, msg Message, clientIP net.IP, maxSize int) ([]byte, bool, error) {
+	now := s.now()
+	entry, ok := s.cache.lookup(msg, now)
+	if !ok {
+		return nil, false, nil
+	}
+	s.metrics.cacheHits.Add(1)
+	logger(ctx).Debug("Answering from the cache", "name", msg.Questions[0].Name)
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	remaining := uint32(entry.expires.Sub(now) / time.Second)
+	msg.SetError(entry.rcode, nil)
+	msg.Header.SetAuthenticData(entry.authenticData)
+	msg.Answers = cloneRecords(entry.answers)
+	msg.Authorities = cloneRecords(entry.authorities)
+	for _, section := range [][]Answer{msg.Answers, msg.Authorities} {
+		for i := range section {
+			if entry.extended {
+				section[i].TTL = min(section[i].TTL, remaining)
+			} else {
+				section[i].TTL -= min(section[i].TTL, elapsed)
+			}
+		}
+	}
+	msg.Header.AnswerCount = uint16(len(msg.Answers))
+	msg.Header.AuthorityCount = uint16(len(msg.Authorities))
+	s.filterAddresses(ctx, &msg, clientIP)
+	s.capAnswers(ctx, &msg)
+	s.normalizeTTLs(&msg)
+	s.jitterTTLs(&msg)
+
+	responseBytes, err := marshalResponse(ctx, msg, maxSize)
+	return responseBytes, true, err
+}
+
+// Prewarm fills the cache with the A and AAAA records of PrewarmNames, so
+// the first clients asking for them after a restart don't wait for the
+// resolver. It is meant to run once the resolver answers, before serving,
+// and returns the errors of the names it couldn't resolve.
+func (s *Server) Prewarm(ctx context.Context) error {
+	s = s.snapshot()
+	if s.cache == nil || !s.shouldForwardQuery() {
+		return nil
+	}
+
+	var errs []error
+	for _, name := range s.opts.PrewarmNames {
+		for _, qtype := range []uint16{TYPE_A, TYPE_AAAA} {
+			if err := s.prewarm(ctx, name, qtype); err != nil {
+				errs = append(errs, fmt.Errorf("prewarming %s %s: %w", name, typeName(qtype), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) prewarm(ctx context.Context, name string, qtype uint16) error {
+	queryBytes, err := NewQuery(name, qtype, CLASS_IN).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	s.metrics.forwarded.Add(1)
+	responseBytes, _, err := s.forwardQuery(ctx, queryBytes, maxTCPMessageSize)
+	if err != nil {
+		s.metrics.forwardErrors.Add(1)
+		return err
+	}
+	response, err := NewMessageFromBytes(responseBytes)
+	if err != nil {
+		return err
+	}
+	s.cache.store(response, s.now())
+	return nil
+}
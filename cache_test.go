@@ -0,0 +1,218 @@
+package dnsserver
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingResolver answers every A query with 192.0.2.1 for 300 seconds,
+// counting the queries it gets.
+func countingResolver(t *testing.T) (string, *atomic.Int64) {
+	var asked atomic.Int64
+	resolver := startMockResolver(t, func(query Message) Message {
+		asked.Add(1)
+		if query.Questions[0].Type != TYPE_A {
+			query.SetError(RCODE_NO_ERROR, nil)
+			return query
+		}
+		return answerWith(NewAAnswer(query.Questions[0].Name, net.ParseIP("192.0.2.1"), 300))(query)
+	})
+	return resolver, &asked
+}
+
+func TestResponseCache(t *testing.T) {
+	resolver, asked := countingResolver(t)
+	now := time.Now()
+	server := NewServer(Options{Resolver: resolver, CacheSize: 10})
+	server.clock = func() time.Time { return now }
+
+	response := queryType(t, server, "example.com", TYPE_A, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, int64(1), asked.Load())
+
+	now = now.Add(100 * time.Second)
+	response = queryType(t, server, "EXAMPLE.com", TYPE_A, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, int64(1), asked.Load(), "a cached answer shouldn't be forwarded")
+	assert.Equal(t, uint32(200), response.Answers[0].TTL, "the TTL should count down in the cache")
+	assert.Equal(t, []byte{192, 0, 2, 1}, response.Answers[0].Data)
+	assert.Equal(t, uint64(1), server.metrics.cacheHits.Load())
+
+	queryType(t, server, "example.com", TYPE_AAAA, nil)
+	assert.Equal(t, int64(2), asked.Load(), "a NODATA response shouldn't be cached")
+	queryType(t, server, "example.com", TYPE_AAAA, nil)
+	assert.Equal(t, int64(3), asked.Load())
+
+	now = now.Add(200 * time.Second)
+	queryType(t, server, "example.com", TYPE_A, nil)
+	assert.Equal(t, int64(4), asked.Load(), "an expired answer should be forwarded again")
+}
+
+func TestResponseCacheSize(t *testing.T) {
+	cache := newResponseCache(2, 0)
+	now := time.Now()
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		msg := createTestQueryMessage(name)
+		msg.AddAnswers([]Answer{NewAAnswer(name, net.ParseIP("192.0.2.1"), 300)})
+		msg.SetResponse(1)
+		cache.store(msg, now)
+	}
+	assert.Len(t, cache.entries, 2)
+	_, ok := cache.lookup(createTestQueryMessage("c.example.com"), now)
+	assert.True(t, ok, "the latest response should be kept")
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newResponseCache(2, 0)
+	now := time.Now()
+	store := func(name string) {
+		msg := createTestQueryMessage(name)
+		msg.AddAnswers([]Answer{NewAAnswer(name, net.ParseIP("192.0.2.1"), 300)})
+		msg.SetResponse(1)
+		cache.store(msg, now)
+	}
+	store("a.example.com")
+	store("b.example.com")
+	_, ok := cache.lookup(createTestQueryMessage("a.example.com"), now)
+	require.True(t, ok)
+
+	store("c.example.com")
+	_, ok = cache.lookup(createTestQueryMessage("a.example.com"), now)
+	assert.True(t, ok, "a recently used entry should be kept")
+	_, ok = cache.lookup(createTestQueryMessage("b.example.com"), now)
+	assert.False(t, ok, "the least recently used entry should make room")
+	assert.Len(t, cache.entries, 2)
+	assert.Equal(t, 2, cache.recent.Len())
+}
+
+func TestResponseCacheKeysOnDNSSECOK(t *testing.T) {
+	cache := newResponseCache(10, 0)
+	now := time.Now()
+	signed := createTestQueryMessage("example.com")
+	signed.AddAnswers([]Answer{NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300)})
+	signed.SetResponse(1)
+	// Resolvers echo the query's DO bit in their response.
+	signed.SetOPT(OPT{UDPSize: 4096, DNSSECOK: true})
+	cache.store(signed, now)
+
+	_, ok := cache.lookup(createTestQueryMessage("example.com"), now)
+	assert.False(t, ok, "a DO=1 response shouldn't answer a DO=0 query")
+	query := createTestQueryMessage("example.com")
+	query.SetOPT(OPT{UDPSize: 4096, DNSSECOK: true})
+	_, ok = cache.lookup(query, now)
+	assert.True(t, ok)
+}
+
+func TestResponseCacheDisabled(t *testing.T) {
+	resolver, asked := countingResolver(t)
+	server := NewServer(Options{Resolver: resolver})
+
+	queryType(t, server, "example.com", TYPE_A, nil)
+	queryType(t, server, "example.com", TYPE_A, nil)
+	assert.Equal(t, int64(2), asked.Load())
+}
+
+func TestCacheBypassSubnetsSkipCache(t *testing.T) {
+	resolver, asked := countingResolver(t)
+	server := NewServer(Options{Resolver: resolver, CacheSize: 10, CacheBypassSubnets: []string{"192.0.2.0/24"}})
+	client, debugging := net.ParseIP("198.51.100.1"), net.ParseIP("192.0.2.1")
+
+	queryType(t, server, "example.com", TYPE_A, client)
+	queryType(t, server, "example.com", TYPE_A, debugging)
+	assert.Equal(t, int64(2), asked.Load(), "a bypassing client should be forwarded despite the fresh cache entry")
+	queryType(t, server, "example.com", TYPE_A, client)
+	assert.Equal(t, int64(2), asked.Load(), "other clients should still hit the cache")
+}
+
+func TestPrewarm(t *testing.T) {
+	resolver, asked := countingResolver(t)
+	server := NewServer(Options{
+		Resolver:     resolver,
+		CacheSize:    10,
+		PrewarmNames: []string{"www.example.com", "api.example.com"},
+	})
+
+	require.NoError(t, server.Prewarm(t.Context()))
+	assert.Equal(t, int64(4), asked.Load(), "each name should be forwarded for A and AAAA")
+	for _, name := range []string{"www.example.com", "api.example.com"} {
+		_, ok := server.cache.lookup(createTestQueryMessage(name), time.Now())
+		assert.True(t, ok, name)
+
+		response := queryType(t, server, name, TYPE_A, nil)
+		require.Len(t, response.Answers, 1)
+	}
+	assert.Equal(t, int64(4), asked.Load(), "prewarmed names should be answered without the resolver")
+}
+
+func TestPrewarmReportsFailures(t *testing.T) {
+	server := NewServer(Options{Resolver: closedUDPAddr(t), CacheSize: 10, PrewarmNames: []string{"www.example.com"}})
+
+	err := server.Prewarm(t.Context())
+	assert.ErrorContains(t, err, "www.example.com")
+}
+
+func TestResponseCacheKeepsUnknownTypesOpaque(t *testing.T) {
+	// Type 65280 is private use; its data looks like a compression pointer
+	// to make sure it isn't read as one.
+	const privateType = 65280
+	data := []byte{0xC0, 12, 0, 1, 0xFF, 'x'}
+	resolver := startMockResolver(t, answerWith(Answer{
+		Name: "example.com", Type: privateType, Class: CLASS_IN, TTL: 300, Length: uint16(len(data)), Data: data,
+	}))
+	server := NewServer(Options{Resolver: resolver, CacheSize: 10})
+	now := time.Now()
+	server.clock = func() time.Time { return now }
+
+	query := createTestQueryMessage("example.com")
+	query.Questions[0].Type = privateType
+	queryBytes, err := query.MarshalBinary()
+	require.NoError(t, err)
+
+	forwarded, err := server.handleQuery(t.Context(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	cached, err := server.handleQuery(t.Context(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), server.metrics.cacheHits.Load())
+
+	assert.Equal(t, forwarded[12:], cached[12:], "the cached response should match the forwarded one past the header")
+	response, err := NewMessageFromBytes(cached)
+	require.NoError(t, err)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, data, response.Answers[0].Data)
+	assert.Equal(t, "example.com.\t300\tIN\tTYPE65280\t\\# 6 c00c0001ff78", response.Answers[0].String())
+}
+
+func TestAdaptiveCacheTTL(t *testing.T) {
+	resolver, asked := countingResolver(t)
+	now := time.Now()
+	server := NewServer(Options{Resolver: resolver, CacheSize: 10, AdaptiveCacheTTL: true, MaxTTL: 330 * time.Second})
+	server.clock = func() time.Time { return now }
+
+	queryType(t, server, "hot.example.com", TYPE_A, nil)
+	queryType(t, server, "cold.example.com", TYPE_A, nil)
+	for i := 0; i < hotCacheHits; i++ {
+		queryType(t, server, "hot.example.com", TYPE_A, nil)
+	}
+	queryType(t, server, "cold.example.com", TYPE_A, nil)
+	require.Equal(t, int64(2), asked.Load())
+
+	now = now.Add(310 * time.Second)
+	response := queryType(t, server, "hot.example.com", TYPE_A, nil)
+	assert.Equal(t, int64(2), asked.Load(), "a hot entry should be served past its TTL")
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, uint32(20), response.Answers[0].TTL, "the records should get the TTL left to the extension")
+	queryType(t, server, "cold.example.com", TYPE_A, nil)
+	assert.Equal(t, int64(3), asked.Load(), "a cold entry should expire with its TTL")
+
+	for i := 0; i < hotCacheHits; i++ {
+		queryType(t, server, "hot.example.com", TYPE_A, nil)
+	}
+	now = now.Add(25 * time.Second)
+	queryType(t, server, "hot.example.com", TYPE_A, nil)
+	assert.Equal(t, int64(4), asked.Load(), "MaxTTL should bound the extensions")
+}
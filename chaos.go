@@ -0,0 +1,92 @@
+package dnsserver
+
+import (
+	"context"
+	"os"
+	"runtime/debug"
+	"strings"
+)
+
+// handleChaosQuery answers CHAOS-class (CH) queries. These are server
+// identification queries such as "version.bind" that never touch forwarding or
+// local answers, so they are kept apart from the IN-class path.
+func (s *Server) handleChaosQuery(ctx context.Context, msg Message, maxSize int) ([]byte, error) {
+	answers := make([]Answer, 0)
+	for _, question := range msg.Questions {
+		text, ok := chaosText(question.Name)
+		if !ok {
+			logger(ctx).Debug("Refusing unknown CHAOS query", "name", question.Name)
+			msg.SetError(RCODE_REFUSED, nil)
+			return marshalResponse(ctx, msg, maxSize)
+		}
+		if question.Type != TYPE_TXT && question.Type != TYPE_ANY {
+			continue
+		}
+
+		a := NewTXTAnswer(question.Name, 0, text)
+		a.Class = CLASS_CH
+		answers = append(answers, a)
+	}
+
+	msg.AddAnswers(answers)
+	msg.SetResponse(len(answers))
+	return marshalResponse(ctx, msg, maxSize)
+}
+
+func chaosText(name string) (string, bool) {
+	switch strings.ToLower(strings.TrimSuffix(name, ".")) {
+	case "version.bind", "version.server":
+		return serverVersion(), true
+	case "hostname.bind", "id.server":
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", false
+		}
+		return hostname, true
+	case "authors.bind":
+		return "davidalecrim1", true
+	}
+	return "", false
+}
+
+// serverVersion reports the server's module version from the build info.
+func serverVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dnsserver"
+	}
+	return "dnsserver " + info.Main.Version
+}
+
+// serverBuild reports the server's version with the VCS commit it was built
+// from, when the build info records one.
+func serverBuild() string {
+	version := serverVersion()
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && setting.Value != "" {
+			return version + " commit " + setting.Value
+		}
+	}
+	return version
+}
+
+// lookupVersionTXT answers a query for VersionTXTName with the server's build,
+// the IN-class counterpart of version.bind for tools that can't ask CHAOS.
+// Types other than TXT get no answers.
+func (s *Server) lookupVersionTXT(query Message) ([]Answer, bool) {
+	if s.opts.VersionTXTName == "" || len(query.Questions) != 1 {
+		return nil, false
+	}
+	question := query.Questions[0]
+	if question.Class != CLASS_IN || zoneKey(question.Name) != zoneKey(s.opts.VersionTXTName) {
+		return nil, false
+	}
+	if question.Type != TYPE_TXT && question.Type != TYPE_ANY {
+		return []Answer{}, true
+	}
+	return []Answer{NewTXTAnswer(question.Name, 0, serverBuild())}, true
+}
@@ -0,0 +1,91 @@
+package dnsserver
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleChaosQuery(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"version.bind", serverVersion()},
+		{"hostname.bind", hostname},
+		{"id.server", hostname},
+		{"authors.bind", "davidalecrim1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(Options{Resolver: "127.0.0.1:53535"})
+
+			response := chaosQuery(t, server, tt.name)
+
+			require.Equal(t, RCODE_NO_ERROR, response.Header.ResponseCode())
+			require.Len(t, response.Answers, 1)
+			assert.Equal(t, CLASS_CH, response.Answers[0].Class)
+			assert.Equal(t, TYPE_TXT, response.Answers[0].Type)
+
+			texts, err := readCharacterStrings(response.Answers[0].Data)
+			require.NoError(t, err)
+			assert.Equal(t, []string{tt.want}, texts)
+		})
+	}
+}
+
+func TestHandleChaosQueryUnknownName(t *testing.T) {
+	server := NewServer(Options{})
+
+	response := chaosQuery(t, server, "example.com")
+
+	assert.Equal(t, RCODE_REFUSED, response.Header.ResponseCode())
+	assert.Empty(t, response.Answers)
+}
+
+func chaosQuery(t *testing.T, server *Server, name string) Message {
+	msg := Message{
+		Header:    NewHeader(1, 0, 1, 0, 0, 0),
+		Questions: []Question{{Name: name, Type: TYPE_TXT, Class: CLASS_CH}},
+	}
+	queryBytes, err := msg.MarshalBinary()
+	require.NoError(t, err)
+
+	responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	return response
+}
+
+func TestVersionTXTName(t *testing.T) {
+	server := NewServer(Options{Resolver: "127.0.0.1:53535", VersionTXTName: "version.dnsserver.local"})
+
+	response := queryType(t, server, "Version.DNSServer.local.", TYPE_TXT, nil)
+	require.Equal(t, RCODE_NO_ERROR, response.Header.ResponseCode())
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, CLASS_IN, response.Answers[0].Class)
+	texts, err := readCharacterStrings(response.Answers[0].Data)
+	require.NoError(t, err)
+	require.Len(t, texts, 1)
+	assert.Contains(t, texts[0], serverVersion())
+
+	response = queryType(t, server, "version.dnsserver.local", TYPE_A, nil)
+	assert.Equal(t, RCODE_NO_ERROR, response.Header.ResponseCode())
+	assert.Empty(t, response.Answers)
+}
+
+func TestVersionTXTNameDisabled(t *testing.T) {
+	server := NewServer(Options{})
+
+	_, ok := server.lookupVersionTXT(Message{Questions: []Question{{Name: "version.dnsserver.local", Type: TYPE_TXT, Class: CLASS_IN}}})
+	assert.False(t, ok)
+}
@@ -8,7 +8,9 @@ import (
 	"log/slog"
 	"net"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -23,13 +25,87 @@ func main() {
 		log.Fatal(err)
 	}
 
+	ln, err := net.Listen("tcp", ":2053")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	resolver := flag.String("resolver", "", "The resolver to forward requests to")
+	forwardProtocol := flag.String("forward-protocol", dnsserver.ForwardProtocolUDP, "Protocol used to forward requests: udp, tcp or udp-then-tcp")
+	maxNameLength := flag.Int("max-name-length", 0, "Refuse query names longer than this many bytes (0 disables)")
+	maxLabels := flag.Int("max-labels", 0, "Refuse query names with more than this many labels (0 disables)")
+	zoneFile := flag.String("zone", "", "Zone file to answer authoritatively from, in RFC 1035 master file format")
+	dnstapSocket := flag.String("dnstap-socket", "", "Unix socket of a dnstap collector to log queries and responses to")
+	adminAddr := flag.String("admin", "", "Address to serve the admin HTTP endpoints on, e.g. :8080 (disabled when empty)")
+	cacheSize := flag.Int("cache-size", 0, "Cache up to this many forwarded responses (0 disables)")
+	prewarm := flag.String("prewarm", "", "Comma-separated names to cache before serving, with -cache-size")
 	flag.Parse()
 
 	opts := dnsserver.Options{
-		Resolver: *resolver,
+		Resolver:        *resolver,
+		ForwardProtocol: *forwardProtocol,
+		MaxNameLength:   *maxNameLength,
+		MaxLabels:       *maxLabels,
+		DnstapSocket:    *dnstapSocket,
+		CacheSize:       *cacheSize,
+	}
+	if *prewarm != "" {
+		opts.PrewarmNames = strings.Split(*prewarm, ",")
+	}
+
+	if *zoneFile != "" {
+		zone, err := loadZone(*zoneFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Zone = zone
 	}
 
 	s := dnsserver.NewServer(opts)
+	defer s.Close()
+
+	if *adminAddr != "" {
+		adminLn, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go s.ServeAdminHTTP(ctx, adminLn)
+		go probeUntilReady(ctx, s)
+	}
+
+	if len(opts.PrewarmNames) > 0 {
+		probeUntilReady(ctx, s)
+		if err := s.Prewarm(ctx); err != nil {
+			slog.Warn("Cache prewarm incomplete", "error", err)
+		}
+	}
+
+	go s.ListenAndServeTCP(ctx, ln)
 	s.ListenAndServe(ctx, conn)
 }
+
+func loadZone(path string) (*dnsserver.Zone, error) {
+	zone := dnsserver.NewZone()
+	if err := zone.LoadFile(path, ""); err != nil {
+		return nil, err
+	}
+	return zone, nil
+}
+
+// probeUntilReady retries the upstream probe until it succeeds, so readiness
+// doesn't wait for the first client query.
+func probeUntilReady(ctx context.Context, s *dnsserver.Server) {
+	for {
+		err := s.Probe(ctx)
+		if err == nil {
+			return
+		}
+		slog.Warn("Upstream probe failed", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
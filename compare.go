@@ -0,0 +1,113 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CompareWithReference answers query with the server and sends it to the
+// reference resolver too, then returns the differences between the two
+// responses, or "" when they agree. Responses are compared normalized: IDs
+// and TTLs are ignored, records are compared as sets per section, and the OPT
+// record is left out. Each difference is a line of the normalized form,
+// prefixed with "-" when only the reference has it and "+" when only the
+// server does.
+//
+// It is meant for testing the server's answers, forwarded ones especially,
+// against a resolver known to be right.
+func (s *Server) CompareWithReference(query Message, reference string) (string, error) {
+	queryBytes, err := query.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+
+	ownBytes, err := s.handleQuery(context.Background(), queryBytes, nil, TransportTCP, maxTCPMessageSize)
+	if err != nil {
+		return "", fmt.Errorf("server: %w", err)
+	}
+	referenceBytes, err := exchangeUDP(reference, queryBytes)
+	if err != nil {
+		return "", fmt.Errorf("reference: %w", err)
+	}
+
+	own, err := NewMessageFromBytes(ownBytes)
+	if err != nil {
+		return "", fmt.Errorf("server: %w", err)
+	}
+	ref, err := NewMessageFromBytes(referenceBytes)
+	if err != nil {
+		return "", fmt.Errorf("reference: %w", err)
+	}
+	return diffNormalized(normalizeResponse(ref), normalizeResponse(own)), nil
+}
+
+// exchangeUDP sends queryBytes to addr and waits a second for its response.
+func exchangeUDP(addr string, queryBytes []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(queryBytes); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxTCPMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if isResponseTo(queryBytes, buf[:n]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// normalizeResponse renders the parts of a response that matter to a client
+// as sorted lines, one per flag set and record.
+func normalizeResponse(msg Message) []string {
+	lines := []string{
+		"rcode " + fmt.Sprint(msg.Header.ResponseCode()),
+		fmt.Sprintf("flags aa=%t tc=%t", msg.Header.Authoritative(), msg.Header.Truncated()),
+	}
+	for _, q := range msg.Questions {
+		lines = append(lines, fmt.Sprintf("question %s %s %s", fqdn(strings.ToLower(q.Name)), className(q.Class), typeName(q.Type)))
+	}
+	for _, section := range []struct {
+		name    string
+		records []Answer
+	}{{"answer", msg.Answers}, {"authority", msg.Authorities}, {"additional", msg.Additionals}} {
+		for _, record := range section.records {
+			if record.Type == TYPE_OPT {
+				continue
+			}
+			record.TTL = 0
+			record.Name = strings.ToLower(record.Name)
+			lines = append(lines, section.name+" "+record.String())
+		}
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// diffNormalized lists the lines only in want with "-" and those only in got with "+".
+func diffNormalized(want, got []string) string {
+	var diff strings.Builder
+	for _, line := range want {
+		if !slices.Contains(got, line) {
+			fmt.Fprintf(&diff, "-%s\n", line)
+		}
+	}
+	for _, line := range got {
+		if !slices.Contains(want, line) {
+			fmt.Fprintf(&diff, "+%s\n", line)
+		}
+	}
+	return diff.String()
+}
@@ -0,0 +1,53 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareWithReference(t *testing.T) {
+	reference := startMockResolver(t, answerWith(
+		NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300),
+		NewAAnswer("example.com", net.ParseIP("192.0.2.2"), 300),
+	))
+	query := NewQuery("example.com", TYPE_A, CLASS_IN)
+
+	// Same records in another order and with other TTLs: no semantic difference.
+	faithful := startMockResolver(t, answerWith(
+		NewAAnswer("example.com", net.ParseIP("192.0.2.2"), 42),
+		NewAAnswer("EXAMPLE.com", net.ParseIP("192.0.2.1"), 42),
+	))
+	diff, err := NewServer(Options{Resolver: faithful}).CompareWithReference(query, reference)
+	require.NoError(t, err)
+	assert.Empty(t, diff)
+
+	mangling := startMockResolver(t, answerWith(
+		NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300),
+		NewAAnswer("example.com", net.ParseIP("192.0.2.99"), 300),
+	))
+	diff, err = NewServer(Options{Resolver: mangling}).CompareWithReference(query, reference)
+	require.NoError(t, err)
+	assert.Equal(t, "-answer example.com.\t0\tIN\tA\t192.0.2.2\n+answer example.com.\t0\tIN\tA\t192.0.2.99\n", diff)
+}
+
+func TestCompareWithReferenceFlagsRcodeDifferences(t *testing.T) {
+	reference := startMockResolver(t, func(query Message) Message {
+		query.SetError(RCODE_NAME_ERROR, nil)
+		return query
+	})
+	server := NewServer(Options{})
+
+	diff, err := server.CompareWithReference(NewQuery("nowhere.example.com", TYPE_A, CLASS_IN), reference)
+	require.NoError(t, err)
+	assert.Contains(t, diff, "-rcode 3\n")
+	assert.Contains(t, diff, "+rcode 0\n")
+	assert.Contains(t, diff, "+answer nowhere.example.com.")
+}
+
+func TestCompareWithReferenceUnreachable(t *testing.T) {
+	_, err := NewServer(Options{}).CompareWithReference(NewQuery("example.com", TYPE_A, CLASS_IN), "127.0.0.1:53535")
+	assert.Error(t, err)
+}
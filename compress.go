@@ -0,0 +1,120 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+)
+
+// maxCompressionOffset is the largest offset a 14-bit compression pointer can reach.
+const maxCompressionOffset = 0x3FFF
+
+// messageEncoder writes a full message, compressing repeated names with
+// pointers to their earlier occurrence (RFC 1035 4.1.4).
+type messageEncoder struct {
+	buf   []byte
+	start int // where the message begins in buf
+	names map[string]int
+}
+
+// encoders recycles message encoders, compression map included, so encoding
+// into a reused buffer allocates nothing.
+var encoders = sync.Pool{New: func() any {
+	return &messageEncoder{names: make(map[string]int)}
+}}
+
+// newMessageEncoder returns an encoder appending to buf, to be released once
+// its buffer has been taken.
+func newMessageEncoder(buf []byte) *messageEncoder {
+	e := encoders.Get().(*messageEncoder)
+	e.buf, e.start = buf, len(buf)
+	return e
+}
+
+// release returns the encoder to the pool, forgetting the message it wrote.
+func (e *messageEncoder) release() {
+	e.buf = nil
+	clear(e.names)
+	encoders.Put(e)
+}
+
+// appendName writes name, replacing its longest already-written suffix with a pointer.
+// Each suffix is a substring of name, so walking the labels allocates nothing.
+func (e *messageEncoder) appendName(name string) {
+	suffix := strings.TrimSuffix(name, ".")
+	for more := suffix != ""; more; {
+		if offset, ok := e.names[suffix]; ok {
+			e.buf = binary.BigEndian.AppendUint16(e.buf, 0xC000|uint16(offset))
+			return
+		}
+		if offset := len(e.buf) - e.start; offset <= maxCompressionOffset {
+			e.names[suffix] = offset
+		}
+		var label string
+		label, suffix, more = strings.Cut(suffix, ".")
+		e.buf = append(e.buf, byte(len(label)))
+		e.buf = append(e.buf, label...)
+	}
+	e.buf = append(e.buf, 0)
+}
+
+func (e *messageEncoder) appendQuestion(q Question) {
+	e.appendName(q.Name)
+	e.buf = binary.BigEndian.AppendUint16(e.buf, q.Type)
+	e.buf = binary.BigEndian.AppendUint16(e.buf, q.Class)
+}
+
+func (e *messageEncoder) appendRecord(a Answer) {
+	if a.Type == TYPE_OPT {
+		// The OPT owner is always the root (RFC 6891), a single zero byte that
+		// is never compressed nor offered as a compression target.
+		e.buf = append(e.buf, 0)
+	} else {
+		e.appendName(a.Name)
+	}
+	e.buf = binary.BigEndian.AppendUint16(e.buf, a.Type)
+	e.buf = binary.BigEndian.AppendUint16(e.buf, a.Class)
+	e.buf = binary.BigEndian.AppendUint32(e.buf, a.TTL)
+
+	lengthAt := len(e.buf)
+	e.buf = append(e.buf, 0, 0)
+	if !e.appendCompressedData(a) {
+		e.buf = append(e.buf[:lengthAt+2], a.Data...)
+	}
+	binary.BigEndian.PutUint16(e.buf[lengthAt:], uint16(len(e.buf)-lengthAt-2))
+}
+
+// appendCompressedData writes the record data of the RFC 1035 types whose
+// embedded names may be compressed. It reports false if it wrote nothing, in
+// which case the data is copied as-is.
+func (e *messageEncoder) appendCompressedData(a Answer) bool {
+	var prefix, names int
+	switch a.Type {
+	case TYPE_NS, TYPE_CNAME, TYPE_PTR:
+		names = 1
+	case TYPE_MX:
+		prefix, names = 2, 1
+	case TYPE_SOA:
+		names = 2
+	default:
+		return false
+	}
+
+	if len(a.Data) < prefix {
+		return false
+	}
+	start := len(e.buf)
+	e.buf = append(e.buf, a.Data[:prefix]...)
+	offset := prefix
+	for i := 0; i < names; i++ {
+		name, next, err := readName(a.Data, offset)
+		if err != nil {
+			e.buf = e.buf[:start]
+			return false
+		}
+		e.appendName(name)
+		offset = next
+	}
+	e.buf = append(e.buf, a.Data[offset:]...)
+	return true
+}
@@ -0,0 +1,264 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// dnstap message types (dnstap.proto, Message.Type) logged by the server.
+const (
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// dnstap socket families and protocols (dnstap.proto).
+const (
+	dnstapINET  = 1
+	dnstapINET6 = 2
+	dnstapUDP   = 1
+	dnstapTCP   = 2
+)
+
+// Frame Streams control frame types and fields.
+const (
+	fstrmControlAccept = 1
+	fstrmControlStart  = 2
+	fstrmControlStop   = 3
+	fstrmControlReady  = 4
+	fstrmFieldContent  = 1
+)
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// dnstapQueueSize bounds the messages waiting to be written. When the output
+// can't keep up, further messages are dropped rather than delaying queries.
+const dnstapQueueSize = 1024
+
+// dnstapMessage is one logged DNS message, encoded by the writer goroutine so
+// the query path only pays for a channel send.
+type dnstapMessage struct {
+	kind         int
+	protocol     int
+	queryAddr    net.Addr
+	responseAddr net.Addr
+	message      []byte
+	at           time.Time
+}
+
+// dnstapLogger writes dnstap (https://dnstap.info) messages as a Frame Streams
+// data stream. A nil logger logs nothing.
+type dnstapLogger struct {
+	w        io.WriteCloser
+	mu       sync.RWMutex // guards closed against sends racing close
+	closed   bool
+	messages chan dnstapMessage
+	done     chan struct{}
+	identity []byte
+	version  []byte
+}
+
+// newDnstapSocketLogger connects to a dnstap collector listening on a Unix
+// socket, negotiating the content type with the bidirectional handshake.
+func newDnstapSocketLogger(path string) (*dnstapLogger, error) {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if err := writeFstrmControl(conn, fstrmControlReady, dnstapContentType); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if control, err := readFstrmControl(conn); err != nil || control != fstrmControlAccept {
+		conn.Close()
+		return nil, errors.Join(errors.New("dnstap collector didn't accept the stream"), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return newDnstapLogger(conn)
+}
+
+// newDnstapFileLogger appends a unidirectional dnstap stream to a file.
+func newDnstapFileLogger(path string) (*dnstapLogger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return newDnstapLogger(f)
+}
+
+func newDnstapLogger(w io.WriteCloser) (*dnstapLogger, error) {
+	if err := writeFstrmControl(w, fstrmControlStart, dnstapContentType); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	identity, _ := os.Hostname()
+	l := &dnstapLogger{
+		w:        w,
+		messages: make(chan dnstapMessage, dnstapQueueSize),
+		done:     make(chan struct{}),
+		identity: []byte(identity),
+		version:  []byte(serverVersion()),
+	}
+	go l.run()
+	return l, nil
+}
+
+// log queues a copy of message for writing, dropping it if the queue is full.
+// The copy lets callers reuse the buffer as soon as log returns.
+func (l *dnstapLogger) log(kind, protocol int, queryAddr, responseAddr net.Addr, message []byte) {
+	if l == nil {
+		return
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.messages <- dnstapMessage{kind, protocol, queryAddr, responseAddr, append([]byte(nil), message...), time.Now()}:
+	default:
+	}
+}
+
+func (l *dnstapLogger) run() {
+	defer close(l.done)
+	for m := range l.messages {
+		frame := m.encode(l.identity, l.version)
+		buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(frame)), uint32(len(frame)))
+		if _, err := l.w.Write(append(buf, frame...)); err != nil {
+			slog.Error("Error writing dnstap message, disabling dnstap", "error", err)
+			for range l.messages {
+			}
+			return
+		}
+	}
+}
+
+// close writes the queued messages, ends the stream and closes the output.
+func (l *dnstapLogger) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.messages)
+	l.mu.Unlock()
+
+	<-l.done
+	err := writeFstrmControl(l.w, fstrmControlStop, "")
+	return errors.Join(err, l.w.Close())
+}
+
+// encode renders the message as a dnstap.Dnstap protobuf.
+func (m dnstapMessage) encode(identity, version []byte) []byte {
+	var msg []byte
+	msg = appendProtoVarint(msg, 1, uint64(m.kind))
+
+	queryIP, queryPort := addrPort(m.queryAddr)
+	responseIP, responsePort := addrPort(m.responseAddr)
+	family := dnstapINET
+	if queryIP.Is6() || responseIP.Is6() {
+		family = dnstapINET6
+	}
+	msg = appendProtoVarint(msg, 2, uint64(family))
+	msg = appendProtoVarint(msg, 3, uint64(m.protocol))
+	if queryIP.IsValid() {
+		msg = appendProtoBytes(msg, 4, queryIP.AsSlice())
+		msg = appendProtoVarint(msg, 6, uint64(queryPort))
+	}
+	if responseIP.IsValid() {
+		msg = appendProtoBytes(msg, 5, responseIP.AsSlice())
+		msg = appendProtoVarint(msg, 7, uint64(responsePort))
+	}
+
+	if m.kind == dnstapClientQuery || m.kind == dnstapForwarderQuery {
+		msg = appendProtoVarint(msg, 8, uint64(m.at.Unix()))
+		msg = appendProtoFixed32(msg, 9, uint32(m.at.Nanosecond()))
+		msg = appendProtoBytes(msg, 10, m.message)
+	} else {
+		msg = appendProtoVarint(msg, 12, uint64(m.at.Unix()))
+		msg = appendProtoFixed32(msg, 13, uint32(m.at.Nanosecond()))
+		msg = appendProtoBytes(msg, 14, m.message)
+	}
+
+	var frame []byte
+	frame = appendProtoBytes(frame, 1, identity)
+	frame = appendProtoBytes(frame, 2, version)
+	frame = appendProtoBytes(frame, 14, msg)
+	return appendProtoVarint(frame, 15, 1) // Dnstap.Type MESSAGE
+}
+
+func addrPort(addr net.Addr) (netip.Addr, uint16) {
+	if addr == nil {
+		return netip.Addr{}, 0
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, 0
+	}
+	return addrPort.Addr().Unmap(), addrPort.Port()
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoFixed32(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// writeFstrmControl writes a Frame Streams control frame, with a content type
+// field unless contentType is empty.
+func writeFstrmControl(w io.Writer, control uint32, contentType string) error {
+	payload := binary.BigEndian.AppendUint32(nil, control)
+	if contentType != "" {
+		payload = binary.BigEndian.AppendUint32(payload, fstrmFieldContent)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(contentType)))
+		payload = append(payload, contentType...)
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 4, 8+len(payload)), uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// readFstrmControl reads a Frame Streams control frame and returns its type.
+func readFstrmControl(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return 0, errors.New("expected a Frame Streams control frame")
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 4 || length > 512 {
+		return 0, errors.New("invalid Frame Streams control frame length")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
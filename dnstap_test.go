@@ -0,0 +1,169 @@
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// protoFields decodes the top-level fields of a protobuf message, keeping
+// the raw bytes of length-delimited fields and the value of the others.
+func protoFields(t *testing.T, b []byte) map[int][]any {
+	fields := make(map[int][]any)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		require.Positive(t, n)
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			require.Positive(t, n)
+			fields[field] = append(fields[field], v)
+			b = b[n:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			require.Positive(t, n)
+			fields[field] = append(fields[field], b[n:n+int(length)])
+			b = b[n+int(length):]
+		case 5:
+			fields[field] = append(fields[field], binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+// startDnstapCollector accepts one bidirectional Frame Streams connection on a
+// Unix socket and returns the dnstap frames it received once the stream stops.
+func startDnstapCollector(t *testing.T) (string, <-chan [][]byte) {
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	frames := make(chan [][]byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if control, err := readFstrmControl(conn); err != nil || control != fstrmControlReady {
+			return
+		}
+		writeFstrmControl(conn, fstrmControlAccept, dnstapContentType)
+		if control, err := readFstrmControl(conn); err != nil || control != fstrmControlStart {
+			return
+		}
+
+		var received [][]byte
+		for {
+			var length uint32
+			if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+				return
+			}
+			if length == 0 {
+				// a control frame, which can only be STOP here
+				io.CopyN(io.Discard, conn, 4)
+				var control uint32
+				binary.Read(conn, binary.BigEndian, &control)
+				frames <- received
+				return
+			}
+			frame := make([]byte, length)
+			if _, err := io.ReadFull(conn, frame); err != nil {
+				return
+			}
+			received = append(received, frame)
+		}
+	}()
+	return path, frames
+}
+
+func TestDnstapLogsClientAndForwarderMessages(t *testing.T) {
+	socket, frames := startDnstapCollector(t)
+	resolver := startMockResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60)))
+	server := NewServer(Options{Resolver: resolver, DnstapSocket: socket})
+	require.NotNil(t, server.dnstap)
+
+	conn := &mockPacketConn{}
+	client := &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40000}
+	queryBytes := createTestEDNSQuery("example.com")
+	server.handleUDPQuery(context.Background(), conn, client, queryBytes)
+	require.NoError(t, server.Close())
+
+	var received [][]byte
+	select {
+	case received = <-frames:
+	case <-time.After(time.Second):
+		t.Fatal("dnstap stream wasn't stopped")
+	}
+
+	wantTypes := []uint64{dnstapClientQuery, dnstapForwarderQuery, dnstapForwarderResponse, dnstapClientResponse}
+	require.Len(t, received, len(wantTypes))
+	for i, frame := range received {
+		dnstap := protoFields(t, frame)
+		assert.Equal(t, []any{uint64(1)}, dnstap[15], "Dnstap.type should be MESSAGE")
+		require.Len(t, dnstap[14], 1)
+		message := protoFields(t, dnstap[14][0].([]byte))
+
+		assert.Equal(t, []any{wantTypes[i]}, message[1])
+		assert.Equal(t, []any{uint64(dnstapINET)}, message[2])
+		assert.Equal(t, []any{uint64(dnstapUDP)}, message[3])
+
+		switch wantTypes[i] {
+		case dnstapClientQuery:
+			assert.Equal(t, []any{[]byte{198, 51, 100, 7}}, message[4])
+			assert.Equal(t, []any{uint64(40000)}, message[6])
+			assert.Equal(t, []any{queryBytes}, message[10])
+		case dnstapClientResponse:
+			assert.Equal(t, []any{[]byte{198, 51, 100, 7}}, message[4])
+			require.Len(t, conn.writtenData, 1)
+			assert.Equal(t, []any{conn.writtenData[0]}, message[14])
+		case dnstapForwarderQuery:
+			assert.Len(t, message[10], 1)
+			assert.NotEmpty(t, message[8], "query time")
+		case dnstapForwarderResponse:
+			assert.Len(t, message[14], 1)
+			assert.NotEmpty(t, message[12], "response time")
+		}
+	}
+}
+
+func TestDnstapFileStartsAndStopsStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	server := NewServer(Options{DnstapFile: path})
+	require.NotNil(t, server.dnstap)
+	server.handleUDPQuery(context.Background(), &mockPacketConn{}, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}, createTestQuery())
+	require.NoError(t, server.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	r := bytes.NewReader(data)
+	control, err := readFstrmControl(r)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(fstrmControlStart), control)
+	for range 2 {
+		var length uint32
+		require.NoError(t, binary.Read(r, binary.BigEndian, &length))
+		require.Positive(t, length)
+		_, err := r.Seek(int64(length), io.SeekCurrent)
+		require.NoError(t, err)
+	}
+	control, err = readFstrmControl(r)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(fstrmControlStop), control)
+}
@@ -0,0 +1,104 @@
+//go:build quic
+
+package dnsserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DoQ application error codes (RFC 9250 section 8.4).
+const (
+	doqNoError       = quic.ApplicationErrorCode(0x0)
+	doqInternalError = quic.ApplicationErrorCode(0x1)
+	doqProtocolError = quic.ApplicationErrorCode(0x2)
+)
+
+// doqALPN is the ALPN token identifying DNS over QUIC.
+const doqALPN = "doq"
+
+// ListenAndServeQUIC serves DNS over QUIC (RFC 9250) on conn until ctx is
+// cancelled. Every query arrives on its own bidirectional stream as a
+// length-prefixed message, like over TCP, and the response is written back on
+// that stream. tlsConfig must hold the server's certificate; the "doq" ALPN
+// token is added to it. 0-RTT is not accepted, so replayed early data can't
+// make the server resolve queries again.
+//
+// DoQ support needs the quic build tag.
+func (s *Server) ListenAndServeQUIC(ctx context.Context, conn net.PacketConn, tlsConfig *tls.Config) error {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{doqALPN}
+
+	idleTimeout := s.snapshot().opts.TCPIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultTCPIdleTimeout
+	}
+	ln, err := quic.Listen(conn, tlsConfig, &quic.Config{MaxIdleTimeout: idleTimeout})
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	for {
+		qconn, err := ln.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				slog.Info("Received interrupt signal, shutting down QUIC listener...")
+				return nil
+			}
+			return err
+		}
+		go s.serveQUICConn(ctx, qconn)
+	}
+}
+
+func (s *Server) serveQUICConn(ctx context.Context, conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			conn.CloseWithError(doqNoError, "")
+			return
+		}
+		go s.serveQUICStream(ctx, conn, stream)
+	}
+}
+
+// serveQUICStream answers the single query of a stream. The client must send
+// it with ID 0 (RFC 9250 section 4.2.1); a client that doesn't, or that sends
+// a truncated message, breaks the protocol and loses the connection.
+func (s *Server) serveQUICStream(ctx context.Context, conn *quic.Conn, stream *quic.Stream) {
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+
+	queryBytes, err := readTCPMessage(stream)
+	if err != nil {
+		slog.Debug("Error reading DoQ query", "error", err, "addr", conn.RemoteAddr())
+		conn.CloseWithError(doqProtocolError, "invalid query stream")
+		return
+	}
+	if header, err := NewHeaderFromBytes(queryBytes); err == nil && header.ID != 0 {
+		conn.CloseWithError(doqProtocolError, "query ID must be 0")
+		return
+	}
+
+	queryCtx := withQueryID(ctx)
+	logger(queryCtx).Debug("Received DoQ request", "n", len(queryBytes), "addr", conn.RemoteAddr())
+	responseBytes, err := s.handleQuery(queryCtx, queryBytes, addrIP(conn.RemoteAddr()), TransportDoQ, maxTCPMessageSize)
+	if err != nil {
+		if !errors.Is(err, errQueryDropped) {
+			stream.CancelWrite(quic.StreamErrorCode(doqInternalError))
+		}
+		return
+	}
+	if err := writeTCPMessage(stream, responseBytes); err != nil {
+		logger(queryCtx).Debug("Error writing DoQ response", "error", err, "addr", conn.RemoteAddr())
+		return
+	}
+	s.metrics.responses.Add(1)
+}
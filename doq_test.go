@@ -0,0 +1,108 @@
+//go:build quic
+
+package dnsserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoQRoundTrip(t *testing.T) {
+	server := NewServer(Options{})
+	addr := startDoQServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{doqALPN}}, nil)
+	require.NoError(t, err)
+	defer conn.CloseWithError(doqNoError, "")
+
+	for _, name := range []string{"one.example.com", "two.example.com"} {
+		query := NewQuery(name, TYPE_A, CLASS_IN)
+		query.Header.ID = 0
+		queryBytes, err := query.MarshalBinary()
+		require.NoError(t, err)
+
+		stream, err := conn.OpenStreamSync(ctx)
+		require.NoError(t, err)
+		require.NoError(t, writeTCPMessage(stream, queryBytes))
+		require.NoError(t, stream.Close())
+
+		responseBytes, err := readTCPMessage(stream)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+
+		assert.False(t, response.Header.IsQuery())
+		assert.Zero(t, response.Header.ID)
+		require.Len(t, response.Answers, 1)
+		assert.Equal(t, name, response.Answers[0].Name)
+	}
+}
+
+func TestDoQRejectsNonzeroID(t *testing.T) {
+	addr := startDoQServer(t, NewServer(Options{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{doqALPN}}, nil)
+	require.NoError(t, err)
+
+	stream, err := conn.OpenStreamSync(ctx)
+	require.NoError(t, err)
+	require.NoError(t, writeTCPMessage(stream, createTestQuery()))
+	require.NoError(t, stream.Close())
+
+	_, err = readTCPMessage(stream)
+	var appErr *quic.ApplicationError
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, doqProtocolError, appErr.ErrorCode)
+}
+
+func startDoQServer(t *testing.T, server *Server) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.ListenAndServeQUIC(ctx, conn, testTLSConfig(t))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		conn.Close()
+	})
+	return conn.LocalAddr().String()
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
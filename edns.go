@@ -0,0 +1,343 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"slices"
+)
+
+// ednsUDPSize is the UDP payload size the server advertises in its OPT
+// records and the largest UDP response it sends unless UDPBufferSize says
+// otherwise: 1232 bytes, as DNS Flag Day 2020 recommends, fits a datagram in
+// the 1280-byte minimum IPv6 MTU, so responses are never IP fragmented.
+const ednsUDPSize = 1232
+
+// EDNS option codes this server understands.
+var (
+	EDNS_OPTION_NSID           = uint16(3)
+	EDNS_OPTION_COOKIE         = uint16(10)
+	EDNS_OPTION_PADDING        = uint16(12)
+	EDNS_OPTION_EXTENDED_ERROR = uint16(15)
+	// EDNS_OPTION_SERVER_TIME is a private option, from the local use range
+	// of RFC 6891, asking for the server's clock: the response carries its
+	// Unix time in seconds as 8 bytes, to spot skew breaking DNSSEC validation.
+	EDNS_OPTION_SERVER_TIME = uint16(65500)
+)
+
+// Extended DNS Error info codes (RFC 8914).
+var (
+	EDE_OTHER                 = uint16(0)
+	EDE_STALE_ANSWER          = uint16(3)
+	EDE_FORGED_ANSWER         = uint16(4)
+	EDE_CACHED_ERROR          = uint16(13)
+	EDE_NOT_READY             = uint16(14)
+	EDE_BLOCKED               = uint16(15)
+	EDE_CENSORED              = uint16(16)
+	EDE_FILTERED              = uint16(17)
+	EDE_PROHIBITED            = uint16(18)
+	EDE_STALE_NXDOMAIN_ANSWER = uint16(19)
+	EDE_NOT_AUTHORITATIVE     = uint16(20)
+	EDE_NOT_SUPPORTED         = uint16(21)
+	EDE_NO_REACHABLE_AUTH     = uint16(22)
+	EDE_NETWORK_ERROR         = uint16(23)
+	EDE_INVALID_DATA          = uint16(24)
+)
+
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// OPT is the decoded form of the EDNS pseudo-record (RFC 6891). On the wire it
+// is an Answer of type 41 whose Class carries the UDP payload size and whose TTL
+// carries the extended rcode, version and flags.
+type OPT struct {
+	UDPSize       uint16
+	ExtendedRcode uint8
+	Version       uint8
+	DNSSECOK      bool
+	Options       []EDNSOption
+}
+
+func (o OPT) Answer() Answer {
+	ttl := uint32(o.ExtendedRcode)<<24 | uint32(o.Version)<<16
+	if o.DNSSECOK {
+		ttl |= 1 << 15
+	}
+
+	data := make([]byte, 0)
+	for _, option := range o.Options {
+		data = binary.BigEndian.AppendUint16(data, option.Code)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(option.Data)))
+		data = append(data, option.Data...)
+	}
+
+	return Answer{
+		Name:   "",
+		Type:   TYPE_OPT,
+		Class:  o.UDPSize,
+		TTL:    ttl,
+		Length: uint16(len(data)),
+		Data:   data,
+	}
+}
+
+func NewOPTFromAnswer(a Answer) (OPT, error) {
+	if a.Type != TYPE_OPT {
+		return OPT{}, errors.New("not an OPT record")
+	}
+
+	opt := OPT{
+		UDPSize:       a.Class,
+		ExtendedRcode: uint8(a.TTL >> 24),
+		Version:       uint8(a.TTL >> 16),
+		DNSSECOK:      a.TTL&(1<<15) != 0,
+	}
+
+	data := a.Data
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return OPT{}, errors.New("invalid EDNS option")
+		}
+		code := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+length {
+			return OPT{}, errors.New("invalid EDNS option length")
+		}
+		opt.Options = append(opt.Options, EDNSOption{Code: code, Data: append([]byte{}, data[4:4+length]...)})
+		data = data[4+length:]
+	}
+
+	return opt, nil
+}
+
+// Option returns the EDNS option with the given code, if present.
+func (o OPT) Option(code uint16) (EDNSOption, bool) {
+	for _, option := range o.Options {
+		if option.Code == code {
+			return option, true
+		}
+	}
+	return EDNSOption{}, false
+}
+
+// ExtendedError is an Extended DNS Error (RFC 8914) explaining why a response
+// carries the rcode it does.
+type ExtendedError struct {
+	Code uint16
+	Text string
+}
+
+func (e ExtendedError) Option() EDNSOption {
+	data := binary.BigEndian.AppendUint16(nil, e.Code)
+	return EDNSOption{Code: EDNS_OPTION_EXTENDED_ERROR, Data: append(data, e.Text...)}
+}
+
+func NewExtendedErrorFromOption(option EDNSOption) (ExtendedError, error) {
+	if option.Code != EDNS_OPTION_EXTENDED_ERROR || len(option.Data) < 2 {
+		return ExtendedError{}, errors.New("invalid extended error option")
+	}
+	return ExtendedError{
+		Code: binary.BigEndian.Uint16(option.Data[0:2]),
+		Text: string(option.Data[2:]),
+	}, nil
+}
+
+// OPT returns the message's EDNS record, if it has one.
+func (m Message) OPT() (OPT, bool) {
+	for _, record := range m.Additionals {
+		if record.Type == TYPE_OPT {
+			opt, err := NewOPTFromAnswer(record)
+			if err != nil {
+				return OPT{}, false
+			}
+			return opt, true
+		}
+	}
+	return OPT{}, false
+}
+
+// SetOPT replaces the message's EDNS record, adding one if it has none.
+func (m *Message) SetOPT(opt OPT) {
+	record := opt.Answer()
+	for i := range m.Additionals {
+		if m.Additionals[i].Type == TYPE_OPT {
+			m.Additionals[i] = record
+			return
+		}
+	}
+	m.Additionals = append(m.Additionals, record)
+	m.Header.AdditionalCount = uint16(len(m.Additionals))
+}
+
+// ExtendedError returns the Extended DNS Error attached to the message, if any.
+func (m Message) ExtendedError() (ExtendedError, bool) {
+	opt, ok := m.OPT()
+	if !ok {
+		return ExtendedError{}, false
+	}
+	option, ok := opt.Option(EDNS_OPTION_EXTENDED_ERROR)
+	if !ok {
+		return ExtendedError{}, false
+	}
+	ede, err := NewExtendedErrorFromOption(option)
+	if err != nil {
+		return ExtendedError{}, false
+	}
+	return ede, true
+}
+
+// serverOwnedEDNSOptions are negotiated by the server with each of its own
+// clients, so an upstream's values for them must not be relayed.
+var serverOwnedEDNSOptions = map[uint16]bool{
+	EDNS_OPTION_NSID:        true,
+	EDNS_OPTION_COOKIE:      true,
+	EDNS_OPTION_PADDING:     true,
+	EDNS_OPTION_SERVER_TIME: true,
+}
+
+// requestsOption reports whether the query asks for a server option, with an
+// empty option of that code.
+func requestsOption(query Message, code uint16) bool {
+	opt, ok := query.OPT()
+	if !ok {
+		return false
+	}
+	option, ok := opt.Option(code)
+	return ok && len(option.Data) == 0
+}
+
+// serverOptions returns the options the server answers the query with: its
+// NSID and, with EnableTimeOption, its clock, for the clients asking for them.
+func (s *Server) serverOptions(query Message) []EDNSOption {
+	var options []EDNSOption
+	if s.opts.NSID != "" && requestsOption(query, EDNS_OPTION_NSID) {
+		options = append(options, EDNSOption{Code: EDNS_OPTION_NSID, Data: []byte(s.opts.NSID)})
+	}
+	if s.opts.EnableTimeOption && requestsOption(query, EDNS_OPTION_SERVER_TIME) {
+		now := binary.BigEndian.AppendUint64(nil, uint64(s.now().Unix()))
+		options = append(options, EDNSOption{Code: EDNS_OPTION_SERVER_TIME, Data: now})
+	}
+	return options
+}
+
+// addOptions adds options to the OPT record of an encoded response, replacing
+// any it already has with the same codes.
+func addOptions(ctx context.Context, responseBytes []byte, maxSize int, options []EDNSOption) ([]byte, error) {
+	response, err := NewMessageFromBytes(responseBytes)
+	if err != nil {
+		return nil, err
+	}
+	opt, ok := response.OPT()
+	if !ok {
+		opt = OPT{UDPSize: ednsUDPSize}
+	}
+	opt.Options = slices.DeleteFunc(opt.Options, func(o EDNSOption) bool {
+		return slices.ContainsFunc(options, func(added EDNSOption) bool { return added.Code == o.Code })
+	})
+	opt.Options = append(opt.Options, options...)
+	response.SetOPT(opt)
+	return marshalResponse(ctx, response, maxSize)
+}
+
+// udpPayloadSize returns the UDP payload size opts configure, ednsUDPSize when
+// UDPBufferSize is unset or invalid.
+func udpPayloadSize(opts Options) int {
+	switch {
+	case opts.UDPBufferSize == 0:
+		return ednsUDPSize
+	case opts.UDPBufferSize < maxUDPMessageSize || opts.UDPBufferSize > maxTCPMessageSize:
+		slog.Error("Ignoring invalid UDPBufferSize", "size", opts.UDPBufferSize)
+		return ednsUDPSize
+	}
+	return opts.UDPBufferSize
+}
+
+// advertiseUDPSize sets the UDP payload size in the OPT record of an encoded
+// response, for the responses of a server with its own UDPBufferSize, since
+// they are built advertising ednsUDPSize.
+func advertiseUDPSize(ctx context.Context, responseBytes []byte, size, maxSize int) ([]byte, error) {
+	response, err := NewMessageFromBytes(responseBytes)
+	if err != nil {
+		return nil, err
+	}
+	opt, ok := response.OPT()
+	if !ok || int(opt.UDPSize) == size {
+		return responseBytes, nil
+	}
+	opt.UDPSize = uint16(size)
+	response.SetOPT(opt)
+	return marshalResponse(ctx, response, maxSize)
+}
+
+// offerUDPSize sets the UDP payload size the OPT record of an encoded query
+// advertises to size, in place, so a forwarded query offers the resolver what
+// the server takes rather than what its client asked for. A query without
+// an OPT record is left alone.
+func offerUDPSize(queryBytes []byte, size int) {
+	header, err := NewHeaderFromBytes(queryBytes)
+	if err != nil {
+		return
+	}
+	offset := 12
+	for range header.QuestionsCount {
+		if _, offset, err = readQuestion(queryBytes, offset); err != nil {
+			return
+		}
+	}
+	for range int(header.AnswerCount) + int(header.AuthorityCount) + int(header.AdditionalCount) {
+		record, next, err := readRecord(queryBytes, offset)
+		if err != nil {
+			return
+		}
+		if record.Type == TYPE_OPT {
+			// The UDP size is the class, after the owner name and type.
+			_, nameEnd, _ := readName(queryBytes, offset)
+			binary.BigEndian.PutUint16(queryBytes[nameEnd+2:], uint16(size))
+			return
+		}
+		offset = next
+	}
+}
+
+// clientUDPSize is the largest UDP response the client sending query accepts:
+// the payload size its OPT record advertises, or 512 bytes without EDNS. Sizes
+// below 512 are treated as 512 (RFC 6891 section 6.2.5).
+func clientUDPSize(query Message) int {
+	opt, ok := query.OPT()
+	if !ok {
+		return maxUDPMessageSize
+	}
+	return max(int(opt.UDPSize), maxUDPMessageSize)
+}
+
+// relayOPT prepares the OPT record of a forwarded response for the client.
+// Options the server doesn't manage are preserved as-is, server-owned ones are
+// dropped and the advertised UDP size is replaced by the server's own.
+// It reports whether the message changed.
+func relayOPT(msg *Message) bool {
+	opt, ok := msg.OPT()
+	if !ok {
+		return false
+	}
+
+	changed := opt.UDPSize != ednsUDPSize
+	options := make([]EDNSOption, 0, len(opt.Options))
+	for _, option := range opt.Options {
+		if serverOwnedEDNSOptions[option.Code] {
+			changed = true
+			continue
+		}
+		options = append(options, option)
+	}
+	if !changed {
+		return false
+	}
+
+	opt.UDPSize = ednsUDPSize
+	opt.Options = options
+	msg.SetOPT(opt)
+	return true
+}
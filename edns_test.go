@@ -0,0 +1,309 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOPTRoundTrip(t *testing.T) {
+	opt := OPT{
+		UDPSize:  1232,
+		Version:  0,
+		DNSSECOK: true,
+		Options: []EDNSOption{
+			{Code: EDNS_OPTION_NSID, Data: []byte{}},
+			ExtendedError{Code: EDE_PROHIBITED, Text: "nope"}.Option(),
+		},
+	}
+
+	msg := Message{
+		Header:    NewHeader(1234, 0, 1, 0, 0, 0),
+		Questions: []Question{{Name: "example.com", Type: TYPE_A, Class: CLASS_IN}},
+	}
+	msg.SetOPT(opt)
+
+	buf, err := msg.MarshalBinary()
+	require.NoError(t, err)
+
+	got, err := NewMessageFromBytes(buf)
+	require.NoError(t, err)
+	require.Equal(t, uint16(1), got.Header.AdditionalCount)
+
+	gotOPT, ok := got.OPT()
+	require.True(t, ok)
+	require.Equal(t, uint16(1232), gotOPT.UDPSize)
+	require.True(t, gotOPT.DNSSECOK)
+	require.Len(t, gotOPT.Options, 2)
+
+	ede, ok := got.ExtendedError()
+	require.True(t, ok)
+	require.Equal(t, EDE_PROHIBITED, ede.Code)
+	require.Equal(t, "nope", ede.Text)
+}
+
+func TestSetErrorKeepsOPTOnlyForEDNSQueries(t *testing.T) {
+	query := createTestQueryMessage("example.com")
+	query.SetError(RCODE_REFUSED, &ExtendedError{Code: EDE_BLOCKED})
+	require.Empty(t, query.Additionals)
+	require.Equal(t, uint16(0), query.Header.AdditionalCount)
+
+	ednsQuery := createTestQueryMessage("example.com")
+	ednsQuery.SetOPT(OPT{UDPSize: 4096})
+	ednsQuery.SetError(RCODE_REFUSED, &ExtendedError{Code: EDE_BLOCKED})
+	require.Equal(t, RCODE_REFUSED, ednsQuery.Header.ResponseCode())
+	ede, ok := ednsQuery.ExtendedError()
+	require.True(t, ok)
+	require.Equal(t, EDE_BLOCKED, ede.Code)
+}
+
+func createTestQueryMessage(name string) Message {
+	return Message{
+		Header:    NewHeader(12345, 0, 1, 0, 0, 0),
+		Questions: []Question{{Name: name, Type: TYPE_A, Class: CLASS_IN}},
+	}
+}
+
+func createTestEDNSQuery(name string) []byte {
+	msg := createTestQueryMessage(name)
+	msg.SetOPT(OPT{UDPSize: 4096})
+	msgBytes, _ := msg.MarshalBinary()
+	return msgBytes
+}
+
+func TestForwardedResponsePreservesUnknownEDNSOptions(t *testing.T) {
+	unknown := EDNSOption{Code: 65001, Data: []byte("keep me")}
+	resolver := startMockResolver(t, func(query Message) Message {
+		query.AddAnswers([]Answer{NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60)})
+		query.Header.SetQuery(false)
+		query.Header.AnswerCount = 1
+		query.SetOPT(OPT{
+			UDPSize: 4096,
+			Options: []EDNSOption{
+				unknown,
+				{Code: EDNS_OPTION_COOKIE, Data: []byte("0123456789abcdef")},
+				{Code: EDNS_OPTION_PADDING, Data: make([]byte, 32)},
+			},
+		})
+		return query
+	})
+	server := NewServer(Options{Resolver: resolver})
+
+	responseBytes, err := server.handleQuery(context.Background(), createTestEDNSQuery("example.com"), nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	require.Len(t, response.Answers, 1)
+
+	opt, ok := response.OPT()
+	require.True(t, ok)
+	require.Equal(t, uint16(ednsUDPSize), opt.UDPSize)
+	require.Equal(t, []EDNSOption{unknown}, opt.Options)
+}
+
+func TestOPTOwnerIsEncodedAsUncompressedRoot(t *testing.T) {
+	for _, name := range []string{"", "example.com"} {
+		msg := createTestQueryMessage("example.com")
+		msg.AddAnswers([]Answer{NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60)})
+		msg.SetResponse(1)
+		opt := OPT{UDPSize: 1232}.Answer()
+		// an OPT built with a stray owner must still go out as the root
+		opt.Name = name
+		msg.Additionals = []Answer{opt}
+		msg.Header.AdditionalCount = 1
+
+		buf, err := msg.MarshalBinary()
+		require.NoError(t, err)
+
+		// an OPT without options is the last 11 bytes: root, type, class, TTL and rdlength
+		record := buf[len(buf)-11:]
+		require.Equal(t, byte(0), record[0], "owner %q", name)
+		require.Equal(t, []byte{0, 41}, record[1:3], "owner %q", name)
+
+		got, err := NewMessageFromBytes(buf)
+		require.NoError(t, err)
+		gotOPT, ok := got.OPT()
+		require.True(t, ok)
+		require.Equal(t, uint16(1232), gotOPT.UDPSize)
+	}
+}
+
+func createTestNSIDQuery(name string) []byte {
+	msg := createTestQueryMessage(name)
+	msg.SetOPT(OPT{UDPSize: 4096, Options: []EDNSOption{{Code: EDNS_OPTION_NSID, Data: []byte{}}}})
+	msgBytes, _ := msg.MarshalBinary()
+	return msgBytes
+}
+
+func responseNSID(t *testing.T, responseBytes []byte) (string, bool) {
+	t.Helper()
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	opt, ok := response.OPT()
+	require.True(t, ok)
+	option, ok := opt.Option(EDNS_OPTION_NSID)
+	return string(option.Data), ok
+}
+
+func TestNSID(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60))
+	server := NewServer(Options{Zone: zone, NSID: "node-7.ams"})
+
+	responseBytes, err := server.handleQuery(context.Background(), createTestNSIDQuery("example.com"), nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	nsid, ok := responseNSID(t, responseBytes)
+	require.True(t, ok)
+	require.Equal(t, "node-7.ams", nsid)
+
+	responseBytes, err = server.handleQuery(context.Background(), createTestEDNSQuery("example.com"), nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	_, ok = responseNSID(t, responseBytes)
+	require.False(t, ok, "the NSID should only be sent to clients asking for it")
+
+	responseBytes, err = NewServer(Options{Zone: zone}).handleQuery(context.Background(), createTestNSIDQuery("example.com"), nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	_, ok = responseNSID(t, responseBytes)
+	require.False(t, ok, "without an NSID configured there is nothing to send")
+}
+
+func TestNSIDReplacesUpstreamNSID(t *testing.T) {
+	resolver := startMockResolver(t, func(query Message) Message {
+		query = answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60))(query)
+		query.SetOPT(OPT{UDPSize: 4096, Options: []EDNSOption{{Code: EDNS_OPTION_NSID, Data: []byte("upstream")}}})
+		return query
+	})
+
+	responseBytes, err := NewServer(Options{Resolver: resolver, NSID: "edge-1"}).handleQuery(context.Background(), createTestNSIDQuery("example.com"), nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	nsid, ok := responseNSID(t, responseBytes)
+	require.True(t, ok)
+	require.Equal(t, "edge-1", nsid)
+
+	responseBytes, err = NewServer(Options{Resolver: resolver}).handleQuery(context.Background(), createTestNSIDQuery("example.com"), nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	_, ok = responseNSID(t, responseBytes)
+	require.False(t, ok, "the resolver's NSID identifies it, not this server")
+}
+
+func TestServerTimeOption(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60))
+	query := createTestQueryMessage("example.com")
+	query.SetOPT(OPT{UDPSize: 4096, Options: []EDNSOption{{Code: EDNS_OPTION_SERVER_TIME, Data: []byte{}}}})
+	queryBytes, err := query.MarshalBinary()
+	require.NoError(t, err)
+
+	serverTime := func(server *Server) (EDNSOption, bool) {
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		require.Len(t, response.Answers, 1)
+		opt, ok := response.OPT()
+		require.True(t, ok)
+		return opt.Option(EDNS_OPTION_SERVER_TIME)
+	}
+
+	before := time.Now().Unix()
+	option, ok := serverTime(NewServer(Options{Zone: zone, EnableTimeOption: true}))
+	require.True(t, ok)
+	require.Len(t, option.Data, 8)
+	at := int64(binary.BigEndian.Uint64(option.Data))
+	require.GreaterOrEqual(t, at, before)
+	require.LessOrEqual(t, at, time.Now().Unix())
+
+	_, ok = serverTime(NewServer(Options{Zone: zone}))
+	require.False(t, ok, "the option is only answered when enabled")
+}
+
+func TestUDPBufferSize(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60))
+	for i := 0; i < 20; i++ {
+		zone.Add(NewTXTAnswer("big.example.com", 60, string(make([]byte, 100))))
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	respond := func(server *Server, name string, qtype uint16) (Message, int) {
+		query := createTestQueryMessage(name)
+		query.Questions[0].Type = qtype
+		query.SetOPT(OPT{UDPSize: 4096})
+		queryBytes, err := query.MarshalBinary()
+		require.NoError(t, err)
+		conn := &mockPacketConn{}
+		server.handleUDPQuery(context.Background(), conn, addr, queryBytes)
+		require.Len(t, conn.writtenData, 1)
+		response, err := NewMessageFromBytes(conn.writtenData[0])
+		require.NoError(t, err)
+		return response, len(conn.writtenData[0])
+	}
+
+	server := NewServer(Options{Zone: zone})
+	response, _ := respond(server, "example.com", TYPE_A)
+	opt, ok := response.OPT()
+	require.True(t, ok)
+	require.Equal(t, uint16(1232), opt.UDPSize)
+
+	response, size := respond(server, "big.example.com", TYPE_TXT)
+	require.True(t, response.Header.Truncated(), "a response past 1232 bytes should be truncated")
+	require.LessOrEqual(t, size, 1232)
+
+	server = NewServer(Options{Zone: zone, UDPBufferSize: 4000})
+	response, _ = respond(server, "example.com", TYPE_A)
+	opt, ok = response.OPT()
+	require.True(t, ok)
+	require.Equal(t, uint16(4000), opt.UDPSize)
+	response, _ = respond(server, "big.example.com", TYPE_TXT)
+	require.False(t, response.Header.Truncated())
+	require.Len(t, response.Answers, 20)
+
+	server = NewServer(Options{Zone: zone, UDPBufferSize: 100})
+	response, _ = respond(server, "example.com", TYPE_A)
+	opt, ok = response.OPT()
+	require.True(t, ok)
+	require.Equal(t, uint16(ednsUDPSize), opt.UDPSize, "an invalid size should be ignored")
+}
+
+func TestForwardedLargeResponse(t *testing.T) {
+	var offered atomic.Int32
+	resolver := startMockResolver(t, func(query Message) Message {
+		if opt, ok := query.OPT(); ok {
+			offered.Store(int32(opt.UDPSize))
+		}
+		answers := make([]Answer, 120)
+		for i := range answers {
+			answers[i] = NewAAnswer(query.Questions[0].Name, net.IPv4(192, 0, 2, byte(i)), 60)
+		}
+		return answerWith(answers...)(query)
+	})
+	server := NewServer(Options{Resolver: resolver})
+	query := createTestQueryMessage("example.com")
+	query.SetOPT(OPT{UDPSize: 4096})
+	queryBytes, err := query.MarshalBinary()
+	require.NoError(t, err)
+
+	responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportTCP, maxTCPMessageSize)
+	require.NoError(t, err)
+	require.Greater(t, len(responseBytes), udpBufferSize)
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	require.Equal(t, RCODE_NO_ERROR, response.Header.ResponseCode())
+	require.False(t, response.Header.Truncated())
+	require.Len(t, response.Answers, 120, "a response past 1024 bytes should be read whole")
+	require.Equal(t, int32(ednsUDPSize), offered.Load(), "the resolver should be offered the server's UDP size, not the client's")
+
+	conn := &mockPacketConn{}
+	server.handleUDPQuery(context.Background(), conn, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}, queryBytes)
+	require.Len(t, conn.writtenData, 1)
+	require.LessOrEqual(t, len(conn.writtenData[0]), ednsUDPSize)
+	response, err = NewMessageFromBytes(conn.writtenData[0])
+	require.NoError(t, err)
+	require.True(t, response.Header.Truncated(), "a UDP client should get TC past the server's UDP size")
+}
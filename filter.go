@@ -0,0 +1,111 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+// filteredSOATTL is the TTL of the SOA synthesized for responses emptied by filtering.
+const filteredSOATTL = 60
+
+func (s *Server) shouldFilterAddresses(clientIP net.IP) bool {
+	if !s.opts.FilterA && !s.opts.FilterAAAA {
+		return false
+	}
+	return len(s.opts.FilterSubnets) == 0 || subnetsContain(s.filterSubnets, clientIP)
+}
+
+// filterAddresses removes the address record types disabled by FilterA and
+// FilterAAAA from the answer section. A response left with no answers becomes
+// NODATA with an SOA in the authority section, so clients cache the negative
+// answer. It reports whether the message changed.
+func (s *Server) filterAddresses(ctx context.Context, msg *Message, clientIP net.IP) bool {
+	if !s.shouldFilterAddresses(clientIP) || len(msg.Answers) == 0 {
+		return false
+	}
+
+	kept := make([]Answer, 0, len(msg.Answers))
+	for _, answer := range msg.Answers {
+		if (s.opts.FilterA && answer.Type == TYPE_A) || (s.opts.FilterAAAA && answer.Type == TYPE_AAAA) {
+			continue
+		}
+		kept = append(kept, answer)
+	}
+	if len(kept) == len(msg.Answers) {
+		return false
+	}
+
+	logger(ctx).Debug("Filtered address records from response", "removed", len(msg.Answers)-len(kept), "client", clientIP)
+	msg.Answers = kept
+	msg.Header.AnswerCount = uint16(len(kept))
+
+	if len(kept) == 0 && len(msg.Questions) > 0 && !hasRecordType(msg.Authorities, TYPE_SOA) {
+		msg.Authorities = append(msg.Authorities, syntheticSOA(msg.Questions[0].Name))
+		msg.Header.AuthorityCount = uint16(len(msg.Authorities))
+	}
+	return true
+}
+
+// capAnswers keeps the first MaxAnswersPerResponse records of each set in the
+// answer section, a set being the records of one name and type. Zone address
+// records rotate, so the records kept change across queries; forwarded
+// responses keep the resolver's order. Sets an RRSIG in the answers covers
+// are left whole, since their signature would no longer verify. It reports
+// whether the message changed.
+func (s *Server) capAnswers(ctx context.Context, msg *Message) bool {
+	limit := s.opts.MaxAnswersPerResponse
+	if limit <= 0 || len(msg.Answers) <= limit {
+		return false
+	}
+
+	type set struct {
+		name  string
+		rtype uint16
+	}
+	signed := make(map[set]bool)
+	for _, answer := range msg.Answers {
+		if answer.Type == TYPE_RRSIG && len(answer.Data) >= 2 {
+			signed[set{zoneKey(answer.Name), binary.BigEndian.Uint16(answer.Data)}] = true
+		}
+	}
+	counts := make(map[set]int)
+	kept := make([]Answer, 0, len(msg.Answers))
+	for _, answer := range msg.Answers {
+		key := set{zoneKey(answer.Name), answer.Type}
+		counts[key]++
+		if counts[key] > limit && answer.Type != TYPE_RRSIG && !signed[key] {
+			continue
+		}
+		kept = append(kept, answer)
+	}
+	if len(kept) == len(msg.Answers) {
+		return false
+	}
+
+	logger(ctx).Debug("Capped answer records in response", "removed", len(msg.Answers)-len(kept))
+	msg.Answers = kept
+	msg.Header.AnswerCount = uint16(len(kept))
+	return true
+}
+
+// syntheticSOA builds an SOA for a locally generated negative answer, owned by
+// the name's parent domain since the real zone apex isn't known.
+func syntheticSOA(name string) Answer {
+	labels := nameToLabels(strings.ToLower(name))
+	if len(labels) > 2 {
+		labels = labels[len(labels)-2:]
+	}
+	zone := strings.Join(labels, ".")
+	return NewSOAAnswer(zone, zone, "hostmaster."+zone, 1, 3600, 600, 86400, filteredSOATTL, filteredSOATTL)
+}
+
+func hasRecordType(records []Answer, recordType uint16) bool {
+	for _, record := range records {
+		if record.Type == recordType {
+			return true
+		}
+	}
+	return false
+}
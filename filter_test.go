@@ -0,0 +1,127 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterAAAATurnsForwardedAnswerIntoNoData(t *testing.T) {
+	resolver := startMockResolver(t, answerWith(NewAAAAAnswer("example.com", net.ParseIP("2001:db8::1"), 300)))
+	server := NewServer(Options{Resolver: resolver, FilterAAAA: true})
+
+	response := queryType(t, server, "example.com", TYPE_AAAA, net.ParseIP("192.0.2.10"))
+
+	assert.Equal(t, RCODE_NO_ERROR, response.Header.ResponseCode())
+	assert.Empty(t, response.Answers)
+	require.Len(t, response.Authorities, 1)
+	assert.Equal(t, TYPE_SOA, response.Authorities[0].Type)
+	assert.Equal(t, "example.com", response.Authorities[0].Name)
+}
+
+func TestFilterAAAALocalAnswer(t *testing.T) {
+	server := NewServer(Options{FilterAAAA: true})
+
+	response := queryType(t, server, "example.com", TYPE_AAAA, nil)
+
+	assert.Empty(t, response.Answers)
+	require.Len(t, response.Authorities, 1)
+	assert.Equal(t, TYPE_SOA, response.Authorities[0].Type)
+
+	response = queryType(t, server, "example.com", TYPE_A, nil)
+	assert.Len(t, response.Answers, 1)
+}
+
+func TestFilterAAAAOnlyForConfiguredSubnets(t *testing.T) {
+	resolver := startMockResolver(t, answerWith(NewAAAAAnswer("example.com", net.ParseIP("2001:db8::1"), 300)))
+	server := NewServer(Options{Resolver: resolver, FilterAAAA: true, FilterSubnets: []string{"10.0.0.0/8"}})
+
+	filtered := queryType(t, server, "example.com", TYPE_AAAA, net.ParseIP("10.1.2.3"))
+	assert.Empty(t, filtered.Answers)
+
+	unfiltered := queryType(t, server, "example.com", TYPE_AAAA, net.ParseIP("192.0.2.10"))
+	require.Len(t, unfiltered.Answers, 1)
+	assert.Equal(t, TYPE_AAAA, unfiltered.Answers[0].Type)
+}
+
+func queryType(t *testing.T, server *Server, name string, qtype uint16, clientIP net.IP) Message {
+	t.Helper()
+
+	msg := Message{
+		Header:    NewHeader(1, 0, 1, 0, 0, 0),
+		Questions: []Question{{Name: name, Type: qtype, Class: CLASS_IN}},
+	}
+	queryBytes, err := msg.MarshalBinary()
+	require.NoError(t, err)
+
+	responseBytes, err := server.handleQuery(context.Background(), queryBytes, clientIP, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	return response
+}
+
+func TestMaxAnswersPerResponse(t *testing.T) {
+	const addresses, limit = 500, 5
+	zone := NewZone()
+	for i := 0; i < addresses; i++ {
+		zone.Add(NewAAnswer("lb.example.com", net.IPv4(10, 0, byte(i/256), byte(i%256)), 60))
+	}
+	server := NewServer(Options{Zone: zone, MaxAnswersPerResponse: limit})
+
+	seen := make(map[string]bool)
+	var first []Answer
+	for i := 0; i < addresses; i++ {
+		response := queryType(t, server, "lb.example.com", TYPE_A, nil)
+		require.Len(t, response.Answers, limit)
+		assert.Equal(t, uint16(limit), response.Header.AnswerCount)
+		if i == 0 {
+			first = response.Answers
+		} else if i == 1 {
+			assert.NotEqual(t, first, response.Answers, "the records returned should rotate across queries")
+		}
+		for _, answer := range response.Answers {
+			seen[net.IP(answer.Data).String()] = true
+		}
+	}
+	assert.Len(t, seen, addresses, "every address should get its turn")
+}
+
+func TestMaxAnswersPerResponseForwarded(t *testing.T) {
+	answers := make([]Answer, 0, 20)
+	for i := 0; i < cap(answers); i++ {
+		answers = append(answers, NewAAnswer("example.com", net.IPv4(192, 0, 2, byte(i)), 300))
+	}
+	resolver := startMockResolver(t, answerWith(answers...))
+	server := NewServer(Options{Resolver: resolver, MaxAnswersPerResponse: 3})
+
+	response := queryType(t, server, "example.com", TYPE_A, nil)
+	assert.Len(t, response.Answers, 3)
+}
+
+func TestCapAnswersLeavesSignedSetsWhole(t *testing.T) {
+	server := NewServer(Options{MaxAnswersPerResponse: 1})
+	rrsig := Answer{Name: "example.com", Type: TYPE_RRSIG, Class: CLASS_IN, TTL: 60, Data: []byte{0, byte(TYPE_A), 13, 2}}
+	msg := createTestQueryMessage("example.com")
+	msg.AddAnswers([]Answer{
+		NewCNAMEAnswer("example.com", "target.example.com", 60),
+		NewAAnswer("target.example.com", net.ParseIP("192.0.2.1"), 60),
+		NewAAnswer("target.example.com", net.ParseIP("192.0.2.2"), 60),
+	})
+	msg.SetResponse(3)
+
+	assert.True(t, server.capAnswers(context.Background(), &msg))
+	assert.Len(t, msg.Answers, 2, "the CNAME should be kept along with one address")
+
+	msg.AddAnswers([]Answer{
+		NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60),
+		NewAAnswer("example.com", net.ParseIP("192.0.2.2"), 60),
+		rrsig,
+	})
+	msg.SetResponse(3)
+	assert.False(t, server.capAnswers(context.Background(), &msg), "a signed set should be left whole")
+}
@@ -0,0 +1,55 @@
+package dnsserver
+
+import "math/rand/v2"
+
+// jitterTTLs lowers the TTLs of the answer section by a random share of up to
+// TTLJitter, so clients that cached the same records don't all expire them at
+// once. One factor is drawn per response, keeping the TTLs of an RRset equal.
+// It reports whether the message changed.
+func (s *Server) jitterTTLs(msg *Message) bool {
+	jitter := min(s.opts.TTLJitter, 1)
+	if jitter <= 0 || len(msg.Answers) == 0 {
+		return false
+	}
+
+	factor := rand.Float64() * jitter
+	changed := false
+	for i := range msg.Answers {
+		ttl := msg.Answers[i].TTL
+		reduced := ttl - uint32(float64(ttl)*factor)
+		if reduced != ttl {
+			msg.Answers[i].TTL = reduced
+			changed = true
+		}
+	}
+	return changed
+}
+
+// normalizeTTLs sets the TTL of every record in the message, the OPT pseudo-record
+// aside, to the smallest among them when NormalizeTTL is set. It reports whether
+// the message changed.
+func (s *Server) normalizeTTLs(msg *Message) bool {
+	if !s.opts.NormalizeTTL {
+		return false
+	}
+	sections := [][]Answer{msg.Answers, msg.Authorities, msg.Additionals}
+	lowest, found := uint32(0), false
+	for _, section := range sections {
+		for _, record := range section {
+			if record.Type != TYPE_OPT && (!found || record.TTL < lowest) {
+				lowest, found = record.TTL, true
+			}
+		}
+	}
+
+	changed := false
+	for _, section := range sections {
+		for i := range section {
+			if section[i].Type != TYPE_OPT && section[i].TTL != lowest {
+				section[i].TTL = lowest
+				changed = true
+			}
+		}
+	}
+	return changed
+}
@@ -0,0 +1,78 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLJitterStaysWithinBounds(t *testing.T) {
+	const ttl, jitter = 300, 0.2
+	zone := NewZone()
+	zone.Add(
+		NewAAnswer("www.example.com", net.ParseIP("192.0.2.1"), ttl),
+		NewAAnswer("www.example.com", net.ParseIP("192.0.2.2"), ttl),
+	)
+	server := NewServer(Options{Zone: zone, TTLJitter: jitter})
+
+	seen := make(map[uint32]bool)
+	for i := 0; i < 200; i++ {
+		response := queryType(t, server, "www.example.com", TYPE_A, nil)
+		require.Len(t, response.Answers, 2)
+		got := response.Answers[0].TTL
+		assert.GreaterOrEqual(t, got, uint32(ttl*(1-jitter)))
+		assert.LessOrEqual(t, got, uint32(ttl))
+		assert.Equal(t, got, response.Answers[1].TTL, "records of an RRset should keep equal TTLs")
+		seen[got] = true
+	}
+	assert.Greater(t, len(seen), 1, "TTLs should vary across queries")
+}
+
+func TestTTLJitterOnForwardedResponses(t *testing.T) {
+	resolver := startMockResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 1000)))
+	server := NewServer(Options{Resolver: resolver, TTLJitter: 0.5})
+
+	for i := 0; i < 20; i++ {
+		response := queryType(t, server, "example.com", TYPE_A, nil)
+		require.Len(t, response.Answers, 1)
+		assert.GreaterOrEqual(t, response.Answers[0].TTL, uint32(500))
+		assert.LessOrEqual(t, response.Answers[0].TTL, uint32(1000))
+	}
+}
+
+func TestTTLJitterNeverGoesNegative(t *testing.T) {
+	server := NewServer(Options{TTLJitter: 5})
+	msg := Message{Answers: []Answer{NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 1), NewAAnswer("example.com", net.ParseIP("192.0.2.2"), 0)}}
+
+	server.jitterTTLs(&msg)
+
+	assert.LessOrEqual(t, msg.Answers[0].TTL, uint32(1))
+	assert.Equal(t, uint32(0), msg.Answers[1].TTL)
+}
+
+func TestNormalizeTTL(t *testing.T) {
+	resolver := startMockResolver(t, answerWith(
+		NewCNAMEAnswer("www.example.com", "example.com", 300),
+		NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 30),
+	))
+
+	response := queryType(t, NewServer(Options{Resolver: resolver, NormalizeTTL: true}), "www.example.com", TYPE_A, nil)
+	require.Len(t, response.Answers, 2)
+	assert.Equal(t, uint32(30), response.Answers[0].TTL)
+	assert.Equal(t, uint32(30), response.Answers[1].TTL)
+
+	response = queryType(t, NewServer(Options{Resolver: resolver}), "www.example.com", TYPE_A, nil)
+	require.Len(t, response.Answers, 2)
+	assert.Equal(t, uint32(300), response.Answers[0].TTL)
+}
+
+func TestNormalizeTTLSkipsOPT(t *testing.T) {
+	server := NewServer(Options{NormalizeTTL: true})
+	msg := Message{Answers: []Answer{NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60)}}
+	msg.SetOPT(OPT{UDPSize: 1232})
+
+	assert.False(t, server.normalizeTTLs(&msg))
+	assert.Equal(t, uint32(60), msg.Answers[0].TTL)
+}
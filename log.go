@@ -0,0 +1,29 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+)
+
+type queryIDKey struct{}
+
+// withQueryID tags ctx with a fresh correlation ID for a single query, so its
+// log lines can be told apart from those of queries handled concurrently.
+func withQueryID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queryIDKey{}, fmt.Sprintf("%08x", rand.Uint32()))
+}
+
+func queryID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(queryIDKey{}).(string)
+	return id, ok
+}
+
+// logger returns the default logger, annotated with the query's correlation ID when ctx has one.
+func logger(ctx context.Context) *slog.Logger {
+	if id, ok := queryID(ctx); ok {
+		return slog.Default().With("query_id", id)
+	}
+	return slog.Default()
+}
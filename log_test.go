@@ -0,0 +1,129 @@
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLogLinesShareCorrelationID(t *testing.T) {
+	logs := captureLogs(t)
+	server := NewServer(Options{Resolver: "127.0.0.1:53535"})
+
+	conn := &mockPacketConn{
+		readData: [][]byte{createTestQuery()},
+		readAddr: []net.Addr{&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	server.ListenAndServe(ctx, conn)
+	require.NotEmpty(t, conn.writtenData)
+
+	ids := make(map[string]int)
+	for _, line := range logs.lines(t) {
+		if id, ok := line["query_id"].(string); ok {
+			ids[id]++
+		}
+	}
+
+	require.Len(t, ids, 1)
+	for _, count := range ids {
+		// received, forwarding error and sending the SERVFAIL response
+		assert.GreaterOrEqual(t, count, 3)
+	}
+}
+
+func TestDiscardedForwardedResponseLogsCorrelationID(t *testing.T) {
+	logs := captureLogs(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxUDPMessageSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query, err := NewMessageFromBytes(buf[:n])
+		if err != nil {
+			return
+		}
+		response := answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60))(query)
+		response.Header.ID++
+		stale, _ := response.MarshalBinary()
+		conn.WriteTo(stale, addr)
+		response.Header.ID--
+		answer, _ := response.MarshalBinary()
+		conn.WriteTo(answer, addr)
+	}()
+
+	server := NewServer(Options{Resolver: conn.LocalAddr().String()})
+	ctx := withQueryID(context.Background())
+	_, _, err = server.forwardQuery(ctx, createTestQuery(), maxUDPMessageSize)
+	require.NoError(t, err)
+
+	id, _ := queryID(ctx)
+	var discarded bool
+	for _, line := range logs.lines(t) {
+		if line["msg"] == "Discarding forwarded response that doesn't match the query" {
+			discarded = true
+			assert.Equal(t, id, line["query_id"])
+		}
+	}
+	assert.True(t, discarded)
+}
+
+func TestWithQueryIDIsUniquePerQuery(t *testing.T) {
+	first, _ := queryID(withQueryID(context.Background()))
+	second, _ := queryID(withQueryID(context.Background()))
+
+	assert.NotEmpty(t, first)
+	assert.NotEqual(t, first, second)
+}
+
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) lines(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var lines []map[string]any
+	for _, raw := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if raw == "" {
+			continue
+		}
+		line := make(map[string]any)
+		require.NoError(t, json.Unmarshal([]byte(raw), &line))
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// captureLogs replaces the default logger with a JSON one writing to the
+// returned buffer for the duration of the test.
+func captureLogs(t *testing.T) *logBuffer {
+	logs := &logBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
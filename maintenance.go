@@ -0,0 +1,42 @@
+package dnsserver
+
+import (
+	"context"
+)
+
+// maintenanceMode is the response every query gets during planned maintenance.
+type maintenanceMode struct {
+	rcode uint8
+	ede   string
+}
+
+// SetMaintenanceMode makes the server answer every query with rcode, and a
+// Not Ready Extended DNS Error carrying ede when it isn't empty, until it is
+// called again with on false. It is meant for planned outages, where clients
+// should get a controlled answer while the server keeps running. It is safe to
+// call at any time, and applies to every later query.
+func (s *Server) SetMaintenanceMode(on bool, rcode uint8, ede string) {
+	if !on {
+		s.maintenance.Store(nil)
+		return
+	}
+	s.maintenance.Store(&maintenanceMode{rcode: rcode, ede: ede})
+}
+
+// handleMaintenanceQuery answers the query with the maintenance response, if
+// the server is in maintenance mode.
+func (s *Server) handleMaintenanceQuery(ctx context.Context, query Message, maxSize int) ([]byte, bool, error) {
+	mode := s.maintenance.Load()
+	if mode == nil {
+		return nil, false, nil
+	}
+	logger(ctx).Debug("Answering query in maintenance mode", "rcode", mode.rcode)
+
+	var ede *ExtendedError
+	if mode.ede != "" {
+		ede = &ExtendedError{Code: EDE_NOT_READY, Text: mode.ede}
+	}
+	query.SetError(mode.rcode, ede)
+	responseBytes, err := marshalResponse(ctx, query, maxSize)
+	return responseBytes, true, err
+}
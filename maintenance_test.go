@@ -0,0 +1,78 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	resolver := startMockResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300)))
+	zone := NewZone()
+	zone.Add(NewAAnswer("local.example", net.ParseIP("192.0.2.2"), 60))
+	server := NewServer(Options{Resolver: resolver, Zone: zone})
+	query := func(name string) Message {
+		msg := createTestQueryMessage(name)
+		msg.SetOPT(OPT{UDPSize: 4096})
+		queryBytes, err := msg.MarshalBinary()
+		require.NoError(t, err)
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		return response
+	}
+
+	server.SetMaintenanceMode(true, RCODE_REFUSED, "planned maintenance until 02:00 UTC")
+	for _, name := range []string{"example.com", "local.example"} {
+		response := query(name)
+		assert.Equal(t, RCODE_REFUSED, response.Header.ResponseCode(), name)
+		assert.Empty(t, response.Answers, name)
+		ede, ok := response.ExtendedError()
+		require.True(t, ok, name)
+		assert.Equal(t, EDE_NOT_READY, ede.Code)
+		assert.Equal(t, "planned maintenance until 02:00 UTC", ede.Text)
+	}
+
+	server.SetMaintenanceMode(false, 0, "")
+	for _, name := range []string{"example.com", "local.example"} {
+		response := query(name)
+		assert.Equal(t, RCODE_NO_ERROR, response.Header.ResponseCode(), name)
+		assert.Len(t, response.Answers, 1, name)
+	}
+}
+
+func TestAdminHTTPMaintenance(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewAAnswer("local.example", net.ParseIP("192.0.2.2"), 60))
+	server := NewServer(Options{Zone: zone})
+	base := startAdminHTTP(t, server)
+
+	resp, err := http.PostForm(base+"/maintenance", url.Values{"rcode": {"2"}})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	response := queryType(t, server, "local.example", TYPE_A, nil)
+	assert.Equal(t, RCODE_SERVER_FAILURE, response.Header.ResponseCode())
+	_, ok := response.ExtendedError()
+	assert.False(t, ok, "no EDE was given")
+
+	resp, err = http.PostForm(base+"/maintenance", url.Values{"rcode": {"bogus"}})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodDelete, base+"/maintenance", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	response = queryType(t, server, "local.example", TYPE_A, nil)
+	assert.Equal(t, RCODE_NO_ERROR, response.Header.ResponseCode())
+}
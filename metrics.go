@@ -0,0 +1,137 @@
+package dnsserver
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// sizeBuckets are the upper bounds, in bytes, of the message size histograms:
+// powers of two from 16 up to the largest TCP message.
+var sizeBuckets = [...]uint64{16, 32, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+
+// sizeHistogram counts message sizes into sizeBuckets. Its zero value is
+// ready to use and it is safe for concurrent use.
+type sizeHistogram struct {
+	counts [len(sizeBuckets) + 1]atomic.Uint64 // the last one is +Inf
+	sum    atomic.Uint64
+}
+
+func (h *sizeHistogram) observe(size int) {
+	i := 0
+	for i < len(sizeBuckets) && uint64(size) > sizeBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(uint64(size))
+}
+
+// write renders the histogram in the Prometheus text format, with cumulative buckets.
+func (h *sizeHistogram) write(w io.Writer, name, labels string) {
+	cumulative := uint64(0)
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(sizeBuckets) {
+			le = strconv.FormatUint(sizeBuckets[i], 10)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum{%s} %d\n", name, labels, h.sum.Load())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, cumulative)
+}
+
+// metrics holds the server's counters and histograms. Its zero value is ready to use.
+type metrics struct {
+	queries       atomic.Uint64
+	malformed     atomic.Uint64
+	responses     atomic.Uint64
+	forwarded     atomic.Uint64
+	forwardErrors atomic.Uint64
+	refused       atomic.Uint64
+	dropped       atomic.Uint64
+	tcpRejected   atomic.Uint64
+	stale         atomic.Uint64
+	cacheHits     atomic.Uint64
+	writeFailed   atomic.Uint64
+
+	udpQuerySize    sizeHistogram
+	tcpQuerySize    sizeHistogram
+	udpResponseSize sizeHistogram
+	tcpResponseSize sizeHistogram
+}
+
+// counter is a named counter of metrics, for exposition.
+type counter struct {
+	name, help string
+	value      *atomic.Uint64
+}
+
+func (m *metrics) counters() []counter {
+	return []counter{
+		{"queries", "Queries received.", &m.queries},
+		{"malformed", "Queries that couldn't be parsed.", &m.malformed},
+		{"responses", "Responses sent.", &m.responses},
+		{"forwarded", "Queries forwarded to the resolver.", &m.forwarded},
+		{"forward_errors", "Forwarded queries the resolver didn't answer.", &m.forwardErrors},
+		{"refused", "Queries refused by policy.", &m.refused},
+		{"dropped", "Queries dropped without a response.", &m.dropped},
+		{"tcp_rejected", "TCP connections closed over MaxTCPConns or MaxTCPAcceptRate.", &m.tcpRejected},
+		{"stale", "Queries answered with stale records after the resolver failed.", &m.stale},
+		{"cache_hits", "Forwarded queries answered from the cache.", &m.cacheHits},
+		{"write_failed", "Responses that couldn't be written to the client.", &m.writeFailed},
+	}
+}
+
+func (m *metrics) querySize(transport string) *sizeHistogram {
+	if transport == "tcp" {
+		return &m.tcpQuerySize
+	}
+	return &m.udpQuerySize
+}
+
+func (m *metrics) responseSize(transport string) *sizeHistogram {
+	if transport == "tcp" {
+		return &m.tcpResponseSize
+	}
+	return &m.udpResponseSize
+}
+
+// writeMetrics renders the server's metrics in the Prometheus text format.
+func (s *Server) writeMetrics(w io.Writer) {
+	for _, c := range s.metrics.counters() {
+		fmt.Fprintf(w, "# HELP dns_%s_total %s\n", c.name, c.help)
+		fmt.Fprintf(w, "# TYPE dns_%s_total counter\n", c.name)
+		fmt.Fprintf(w, "dns_%s_total %d\n", c.name, c.value.Load())
+	}
+	fmt.Fprintln(w, "# HELP dns_query_size_bytes Size of received queries in bytes.")
+	fmt.Fprintln(w, "# TYPE dns_query_size_bytes histogram")
+	for _, transport := range []string{"udp", "tcp"} {
+		s.metrics.querySize(transport).write(w, "dns_query_size_bytes", fmt.Sprintf("transport=%q", transport))
+	}
+	fmt.Fprintln(w, "# HELP dns_response_size_bytes Size of sent responses in bytes.")
+	fmt.Fprintln(w, "# TYPE dns_response_size_bytes histogram")
+	for _, transport := range []string{"udp", "tcp"} {
+		s.metrics.responseSize(transport).write(w, "dns_response_size_bytes", fmt.Sprintf("transport=%q", transport))
+	}
+}
+
+var (
+	expvarOnce sync.Once
+	expvarMap  *expvar.Map
+)
+
+// publishExpvar publishes the server's counters in the "dnsserver" expvar map.
+// The map is process-wide, so the last server to publish owns it.
+func (s *Server) publishExpvar() {
+	expvarOnce.Do(func() {
+		expvarMap = expvar.NewMap("dnsserver")
+	})
+	for _, c := range s.metrics.counters() {
+		value := c.value
+		expvarMap.Set(c.name, expvar.Func(func() any { return value.Load() }))
+	}
+}
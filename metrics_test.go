@@ -0,0 +1,93 @@
+package dnsserver
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeHistogramBuckets(t *testing.T) {
+	var h sizeHistogram
+	for _, size := range []int{10, 16, 17, 512, 513, 70000} {
+		h.observe(size)
+	}
+
+	var out strings.Builder
+	h.write(&out, "size", `transport="udp"`)
+
+	assert.Contains(t, out.String(), `size_bucket{transport="udp",le="16"} 2`)
+	assert.Contains(t, out.String(), `size_bucket{transport="udp",le="32"} 3`)
+	assert.Contains(t, out.String(), `size_bucket{transport="udp",le="512"} 4`)
+	assert.Contains(t, out.String(), `size_bucket{transport="udp",le="1024"} 5`)
+	assert.Contains(t, out.String(), `size_bucket{transport="udp",le="65536"} 5`)
+	assert.Contains(t, out.String(), `size_bucket{transport="udp",le="+Inf"} 6`)
+	assert.Contains(t, out.String(), `size_sum{transport="udp"} 71068`)
+	assert.Contains(t, out.String(), `size_count{transport="udp"} 6`)
+}
+
+func TestMessageSizeHistogramsPopulate(t *testing.T) {
+	server := NewServer(Options{})
+	small := createTestQuery()
+	large := createTestEDNSQuery(strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + ".example.com")
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	conn := &mockPacketConn{
+		readData: [][]byte{small, small, large},
+		readAddr: []net.Addr{addr, addr, addr},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	server.ListenAndServe(ctx, conn)
+
+	var out strings.Builder
+	server.writeMetrics(&out)
+	metrics := out.String()
+	assert.Contains(t, metrics, `dns_query_size_bytes_count{transport="udp"} 3`)
+	assert.Contains(t, metrics, `dns_query_size_bytes_bucket{transport="udp",le="64"} 2`)
+	assert.Contains(t, metrics, `dns_query_size_bytes_bucket{transport="udp",le="256"} 3`)
+	assert.Contains(t, metrics, `dns_response_size_bytes_count{transport="udp"} 3`)
+	assert.Contains(t, metrics, `dns_query_size_bytes_count{transport="tcp"} 0`)
+}
+
+func TestAdminHTTPServesMetrics(t *testing.T) {
+	server := NewServer(Options{})
+	base := startAdminHTTP(t, server)
+
+	resp, err := http.Get(base + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "# TYPE dns_query_size_bytes histogram")
+}
+
+func TestExposeExpvarPublishesCounters(t *testing.T) {
+	server := NewServer(Options{ExposeExpvar: true, MaxLabels: 3})
+	for i := 0; i < 3; i++ {
+		queryType(t, server, "www.example.com", TYPE_A, nil)
+	}
+	queryType(t, server, "a.b.c.example.com", TYPE_A, nil)
+	_, err := server.handleQuery(context.Background(), []byte{0, 1}, nil, TransportUDP, maxUDPMessageSize)
+	require.Error(t, err)
+
+	published, ok := expvar.Get("dnsserver").(*expvar.Map)
+	require.True(t, ok)
+	assert.Equal(t, "4", published.Get("queries").String())
+	assert.Equal(t, "1", published.Get("refused").String())
+	assert.Equal(t, "1", published.Get("malformed").String())
+	assert.Equal(t, "0", published.Get("forwarded").String())
+
+	var out strings.Builder
+	server.writeMetrics(&out)
+	assert.Contains(t, out.String(), "dns_queries_total 4\n")
+}
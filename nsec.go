@@ -0,0 +1,215 @@
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxNSECEntries bounds how many NSEC records are kept for AggressiveNSEC.
+const maxNSECEntries = 1000
+
+// nsecEntry is an NSEC record learned from a forwarded NXDOMAIN, proving that
+// no name sorts between owner and next, with the SOA of its zone for the
+// negative answers it synthesizes.
+type nsecEntry struct {
+	owner, next string
+	nsec, soa   Answer
+	// sigs are the RRSIG records covering nsec and soa, for clients that
+	// validate.
+	sigs    []Answer
+	expires time.Time
+}
+
+// covers reports whether name falls strictly between the entry's owner and
+// next name. The last NSEC of a zone points back at the apex and covers the
+// names sorting after its owner.
+func (e nsecEntry) covers(name string) bool {
+	if canonicalCompare(e.owner, e.next) >= 0 {
+		return canonicalCompare(name, e.owner) > 0 && nameMatches(name, e.next)
+	}
+	return canonicalCompare(name, e.owner) > 0 && canonicalCompare(name, e.next) < 0
+}
+
+// nsecCache keeps the NSEC records of authenticated NXDOMAIN responses, to
+// answer NXDOMAIN for other names they prove don't exist without asking the
+// resolver again (RFC 8198). A nil cache keeps nothing.
+type nsecCache struct {
+	mu      sync.Mutex
+	entries []nsecEntry
+}
+
+func newNSECCache(enabled bool) *nsecCache {
+	if !enabled {
+		return nil
+	}
+	return &nsecCache{}
+}
+
+// store keeps the NSEC records of a response received at now. The server
+// doesn't validate DNSSEC itself, so only responses the resolver marked as
+// validated with the AD bit take part.
+func (c *nsecCache) store(response Message, now time.Time) {
+	if c == nil || response.Header.ResponseCode() != RCODE_NAME_ERROR || !response.Header.AuthenticData() {
+		return
+	}
+	soaIndex := slices.IndexFunc(response.Authorities, func(a Answer) bool { return a.Type == TYPE_SOA })
+	if soaIndex < 0 {
+		return
+	}
+	soa := response.Authorities[soaIndex]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = slices.DeleteFunc(c.entries, func(e nsecEntry) bool { return !now.Before(e.expires) })
+	for _, record := range response.Authorities {
+		if record.Type != TYPE_NSEC {
+			continue
+		}
+		next, _, err := readName(record.Data, 0)
+		if err != nil {
+			continue
+		}
+		entry := nsecEntry{
+			owner: zoneKey(record.Name),
+			next:  zoneKey(next),
+			nsec:  cloneRecords([]Answer{record})[0],
+			soa:   cloneRecords([]Answer{soa})[0],
+			sigs: cloneRecords(append(
+				signaturesOf(response.Authorities, record.Name, TYPE_NSEC),
+				signaturesOf(response.Authorities, soa.Name, TYPE_SOA)...)),
+			expires: now.Add(time.Duration(min(record.TTL, soa.TTL)) * time.Second),
+		}
+		c.entries = slices.DeleteFunc(c.entries, func(e nsecEntry) bool { return e.owner == entry.owner })
+		if len(c.entries) >= maxNSECEntries {
+			c.entries = c.entries[1:]
+		}
+		c.entries = append(c.entries, entry)
+	}
+}
+
+// signaturesOf returns the RRSIG records among records covering the owner's
+// records of type covered.
+func signaturesOf(records []Answer, owner string, covered uint16) []Answer {
+	var sigs []Answer
+	for _, record := range records {
+		if record.Type == TYPE_RRSIG && len(record.Data) >= 2 &&
+			binary.BigEndian.Uint16(record.Data) == covered && zoneKey(record.Name) == zoneKey(owner) {
+			sigs = append(sigs, record)
+		}
+	}
+	return sigs
+}
+
+// prove returns the NSEC records proving that name doesn't exist: one covering
+// the name and one covering the wildcard at its closest encloser, which may be
+// the same record.
+func (c *nsecCache) prove(name string, now time.Time) ([]nsecEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	name = zoneKey(name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	covering, ok := c.covering(name, now)
+	if !ok {
+		return nil, false
+	}
+	encloser := commonAncestor(name, covering.owner)
+	if other := commonAncestor(name, covering.next); len(other) > len(encloser) {
+		encloser = other
+	}
+	wildcard, ok := c.covering(strings.TrimSuffix("*."+encloser, "."), now)
+	if !ok {
+		return nil, false
+	}
+	if wildcard.owner == covering.owner {
+		return []nsecEntry{covering}, true
+	}
+	return []nsecEntry{covering, wildcard}, true
+}
+
+func (c *nsecCache) covering(name string, now time.Time) (nsecEntry, bool) {
+	for _, entry := range c.entries {
+		if now.Before(entry.expires) && entry.covers(name) {
+			return entry, true
+		}
+	}
+	return nsecEntry{}, false
+}
+
+// handleAggressiveNSECQuery answers NXDOMAIN from cached NSEC records when
+// they prove the query's name doesn't exist, reporting false when they don't.
+func (s *Server) handleAggressiveNSECQuery(ctx context.Context, msg Message, maxSize int) ([]byte, bool, error) {
+	if len(msg.Questions) != 1 || msg.Questions[0].Class != CLASS_IN {
+		return nil, false, nil
+	}
+	now := s.now()
+	proof, ok := s.nsec.prove(msg.Questions[0].Name, now)
+	if !ok {
+		return nil, false, nil
+	}
+	logger(ctx).Debug("Answering NXDOMAIN from cached NSEC records", "name", msg.Questions[0].Name)
+
+	// Every record gets the TTL left to the proof that expires first.
+	remaining := proof[0].expires
+	for _, entry := range proof[1:] {
+		if entry.expires.Before(remaining) {
+			remaining = entry.expires
+		}
+	}
+	ttl := uint32(remaining.Sub(now) / time.Second)
+
+	opt, hasOPT := msg.OPT()
+	msg.SetError(RCODE_NAME_ERROR, nil)
+	msg.Header.SetAuthenticData(true)
+	msg.Authorities = []Answer{proof[0].soa}
+	for _, entry := range proof {
+		msg.Authorities = append(msg.Authorities, entry.nsec)
+	}
+	if hasOPT && opt.DNSSECOK {
+		for _, entry := range proof {
+			for _, sig := range entry.sigs {
+				if !slices.ContainsFunc(msg.Authorities, func(a Answer) bool {
+					return a.Type == TYPE_RRSIG && a.Name == sig.Name && bytes.Equal(a.Data, sig.Data)
+				}) {
+					msg.Authorities = append(msg.Authorities, sig)
+				}
+			}
+		}
+	}
+	for i := range msg.Authorities {
+		msg.Authorities[i].TTL = ttl
+	}
+	msg.Header.AuthorityCount = uint16(len(msg.Authorities))
+
+	responseBytes, err := marshalResponse(ctx, msg, maxSize)
+	return responseBytes, true, err
+}
+
+// canonicalCompare orders names canonically (RFC 4034 section 6.1): label by
+// label from the root, each compared case-insensitively as bytes.
+func canonicalCompare(a, b string) int {
+	la, lb := nameToLabels(zoneKey(a)), nameToLabels(zoneKey(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// commonAncestor returns the longest name both a and b are equal to or under.
+func commonAncestor(a, b string) string {
+	la, lb := nameToLabels(a), nameToLabels(b)
+	n := 0
+	for n < len(la) && n < len(lb) && la[len(la)-1-n] == lb[len(lb)-1-n] {
+		n++
+	}
+	return strings.Join(la[len(la)-n:], ".")
+}
@@ -0,0 +1,145 @@
+package dnsserver
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newNSECAnswer(owner, next string, ttl uint32, types ...uint16) Answer {
+	data := appendTypeBitmap(appendName(nil, next), types)
+	return Answer{Name: owner, Type: TYPE_NSEC, Class: CLASS_IN, TTL: ttl, Length: uint16(len(data)), Data: data}
+}
+
+// nxdomainResolver answers NXDOMAIN with NSEC records proving that nothing
+// sorts between example.com and a.example.com, nor between a.example.com and
+// d.example.com, counting the queries it gets.
+func nxdomainResolver(t *testing.T, authenticated bool) (string, *atomic.Int64) {
+	var asked atomic.Int64
+	resolver := startMockResolver(t, func(query Message) Message {
+		asked.Add(1)
+		query.SetError(RCODE_NAME_ERROR, nil)
+		query.Header.SetAuthenticData(authenticated)
+		query.Authorities = []Answer{
+			NewSOAAnswer("example.com", "ns.example.com", "hostmaster.example.com", 1, 3600, 600, 86400, 300, 300),
+			newNSECAnswer("example.com", "a.example.com", 300, TYPE_SOA, TYPE_NS, TYPE_NSEC),
+			newNSECAnswer("a.example.com", "d.example.com", 300, TYPE_A, TYPE_NSEC),
+		}
+		query.Header.AuthorityCount = uint16(len(query.Authorities))
+		return query
+	})
+	return resolver, &asked
+}
+
+func TestAggressiveNSEC(t *testing.T) {
+	resolver, asked := nxdomainResolver(t, true)
+	now := time.Now()
+	server := NewServer(Options{Resolver: resolver, AggressiveNSEC: true})
+	server.clock = func() time.Time { return now }
+
+	response := queryType(t, server, "b.example.com", TYPE_A, nil)
+	assert.Equal(t, RCODE_NAME_ERROR, response.Header.ResponseCode())
+	assert.Equal(t, int64(1), asked.Load())
+
+	now = now.Add(100 * time.Second)
+	response = queryType(t, server, "c.example.com", TYPE_AAAA, nil)
+	assert.Equal(t, RCODE_NAME_ERROR, response.Header.ResponseCode())
+	assert.True(t, response.Header.AuthenticData())
+	assert.Equal(t, int64(1), asked.Load(), "a name in a cached NSEC gap shouldn't be forwarded")
+	require.Len(t, response.Authorities, 3)
+	assert.Equal(t, TYPE_SOA, response.Authorities[0].Type)
+	assert.Equal(t, "a.example.com", response.Authorities[1].Name)
+	assert.Equal(t, "example.com", response.Authorities[2].Name, "the wildcard should be proven absent too")
+	for _, record := range response.Authorities {
+		assert.Equal(t, uint32(200), record.TTL)
+	}
+
+	queryType(t, server, "e.example.com", TYPE_A, nil)
+	assert.Equal(t, int64(2), asked.Load(), "a name outside the cached gaps should be forwarded")
+	queryType(t, server, "a.example.com", TYPE_A, nil)
+	assert.Equal(t, int64(3), asked.Load(), "an NSEC owner exists, so it should be forwarded")
+
+	now = now.Add(time.Hour)
+	queryType(t, server, "c.example.com", TYPE_A, nil)
+	assert.Equal(t, int64(4), asked.Load(), "expired NSEC records shouldn't be used")
+}
+
+func TestAggressiveNSECNeedsAuthenticatedResponses(t *testing.T) {
+	resolver, asked := nxdomainResolver(t, false)
+	server := NewServer(Options{Resolver: resolver, AggressiveNSEC: true})
+
+	queryType(t, server, "b.example.com", TYPE_A, nil)
+	queryType(t, server, "c.example.com", TYPE_A, nil)
+	assert.Equal(t, int64(2), asked.Load())
+}
+
+func TestAggressiveNSECDisabled(t *testing.T) {
+	resolver, asked := nxdomainResolver(t, true)
+	server := NewServer(Options{Resolver: resolver})
+
+	queryType(t, server, "b.example.com", TYPE_A, nil)
+	queryType(t, server, "c.example.com", TYPE_A, nil)
+	assert.Equal(t, int64(2), asked.Load())
+}
+
+func TestCacheBypassSubnets(t *testing.T) {
+	resolver, asked := nxdomainResolver(t, true)
+	server := NewServer(Options{Resolver: resolver, AggressiveNSEC: true, CacheBypassSubnets: []string{"192.0.2.0/24"}})
+	client, debugging := net.ParseIP("198.51.100.1"), net.ParseIP("192.0.2.1")
+
+	queryType(t, server, "b.example.com", TYPE_A, client)
+	require.Equal(t, int64(1), asked.Load())
+
+	response := queryType(t, server, "c.example.com", TYPE_A, debugging)
+	assert.Equal(t, RCODE_NAME_ERROR, response.Header.ResponseCode())
+	assert.Equal(t, int64(2), asked.Load(), "a bypassing client should be forwarded despite the cached NSEC gap")
+	queryType(t, server, "c.example.com", TYPE_A, client)
+	assert.Equal(t, int64(2), asked.Load(), "other clients should still be answered from the cache")
+}
+
+func TestCacheBypassNoStore(t *testing.T) {
+	resolver, asked := nxdomainResolver(t, true)
+	server := NewServer(Options{
+		Resolver:           resolver,
+		AggressiveNSEC:     true,
+		CacheBypassSubnets: []string{"192.0.2.0/24"},
+		CacheBypassNoStore: true,
+	})
+
+	queryType(t, server, "b.example.com", TYPE_A, net.ParseIP("192.0.2.1"))
+	queryType(t, server, "c.example.com", TYPE_A, net.ParseIP("198.51.100.1"))
+	assert.Equal(t, int64(2), asked.Load(), "responses to a bypassing client shouldn't be cached")
+}
+
+func TestNSECEntryCovers(t *testing.T) {
+	last := nsecEntry{owner: "z.example.com", next: "example.com"}
+	assert.True(t, last.covers("zz.example.com"))
+	assert.True(t, last.covers("a.z.example.com"))
+	assert.False(t, last.covers("a.example.com"))
+	assert.False(t, last.covers("zz.example.org"), "the last NSEC only covers names in its zone")
+
+	gap := nsecEntry{owner: "a.example.com", next: "d.example.com"}
+	assert.True(t, gap.covers("B.example.com"))
+	assert.True(t, gap.covers("x.a.example.com"))
+	assert.False(t, gap.covers("d.example.com"))
+	assert.False(t, gap.covers("a.example.com"))
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// The canonical order example of RFC 4034 section 6.1.
+	ordered := []string{
+		"example", "a.example", "yljkjljk.a.example", "Z.a.example",
+		"zABC.a.EXAMPLE", "z.example", "*.z.example",
+	}
+	for i := 1; i < len(ordered); i++ {
+		assert.Negative(t, canonicalCompare(ordered[i-1], ordered[i]), "%s < %s", ordered[i-1], ordered[i])
+		assert.Positive(t, canonicalCompare(ordered[i], ordered[i-1]))
+	}
+	assert.Zero(t, canonicalCompare("Example.COM.", "example.com"))
+	assert.Equal(t, "example.com", commonAncestor("b.example.com", "a.example.com"))
+	assert.Equal(t, "", commonAncestor("example.com", "example.org"))
+}
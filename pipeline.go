@@ -0,0 +1,190 @@
+package dnsserver
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+)
+
+// Stages of the resolution pipeline, for PipelineOrder. A query goes through
+// them in order until one answers it; CHAOS-class queries are answered ahead
+// of all of them.
+const (
+	// StageZone answers from Zone, or the transport's view.
+	StageZone = "zone"
+	// StageSynthesizers answers the types registered with RegisterType.
+	StageSynthesizers = "synthesizers"
+	// StageVersion answers VersionTXTName.
+	StageVersion = "version"
+	// StagePTRTemplates answers reverse names of the PTRTemplates subnets.
+	StagePTRTemplates = "ptr-templates"
+	// StageSpecialNames answers the special-use names of HandleSpecialNames.
+	StageSpecialNames = "special-names"
+	// StageAS112 answers the AS112 zones of HandleAS112.
+	StageAS112 = "as112"
+	// StageForward answers from the cache or the resolvers, when there are any.
+	StageForward = "forward"
+	// StageCatchAll answers CatchAllIP, when set.
+	StageCatchAll = "catch-all"
+	// StageLocal answers every query, refusing it under RefuseOpenResolver
+	// or with the local answers otherwise, so the stages after it never run.
+	StageLocal = "local"
+)
+
+// defaultPipeline is the order the stages run in unless PipelineOrder says
+// otherwise.
+var defaultPipeline = []string{
+	StageZone,
+	StageSynthesizers,
+	StageVersion,
+	StagePTRTemplates,
+	StageSpecialNames,
+	StageAS112,
+	StageForward,
+	StageCatchAll,
+	StageLocal,
+}
+
+// stage answers query when it can, reporting whether it did.
+type stage func(s *Server, ctx context.Context, query Message, queryBytes []byte, clientIP net.IP, maxSize int) ([]byte, bool, error)
+
+var stages = map[string]stage{
+	StageZone:         (*Server).zoneStage,
+	StageSynthesizers: (*Server).synthesizerStage,
+	StageVersion:      (*Server).versionStage,
+	StagePTRTemplates: (*Server).ptrTemplateStage,
+	StageSpecialNames: (*Server).specialNameStage,
+	StageAS112:        (*Server).as112Stage,
+	StageForward:      (*Server).forwardStage,
+	StageCatchAll:     (*Server).catchAllStage,
+	StageLocal:        (*Server).localStage,
+}
+
+// parsePipeline returns the stages in the order names puts them, followed by
+// the stages names leaves out in their default order. Unknown and repeated
+// names are logged and ignored.
+func parsePipeline(names []string) []stage {
+	order := make([]string, 0, len(defaultPipeline))
+	for _, name := range names {
+		switch {
+		case stages[name] == nil:
+			slog.Error("Ignoring unknown pipeline stage", "stage", name)
+		case slices.Contains(order, name):
+			slog.Error("Ignoring repeated pipeline stage", "stage", name)
+		default:
+			order = append(order, name)
+		}
+	}
+	for _, name := range defaultPipeline {
+		if !slices.Contains(order, name) {
+			order = append(order, name)
+		}
+	}
+	pipeline := make([]stage, len(order))
+	for i, name := range order {
+		pipeline[i] = stages[name]
+	}
+	return pipeline
+}
+
+func (s *Server) zoneStage(ctx context.Context, query Message, _ []byte, clientIP net.IP, maxSize int) ([]byte, bool, error) {
+	answers, ok, err := s.lookupZone(query)
+	if err != nil {
+		logger(ctx).Warn("Error following zone CNAME chain", "error", err, "name", query.Questions[0].Name)
+		query.SetError(RCODE_SERVER_FAILURE, &ExtendedError{Code: EDE_OTHER, Text: err.Error()})
+		responseBytes, err := marshalResponse(ctx, query, maxSize)
+		return responseBytes, true, err
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	responseBytes, err := s.handleZoneQuery(ctx, query, answers, clientIP, maxSize)
+	return responseBytes, true, err
+}
+
+func (s *Server) synthesizerStage(ctx context.Context, query Message, _ []byte, clientIP net.IP, maxSize int) ([]byte, bool, error) {
+	answers, rcode, ok, err := s.synthesize(query, clientIP)
+	if err != nil {
+		logger(ctx).Error("Error synthesizing answers", "error", err, "name", query.Questions[0].Name)
+		query.SetError(RCODE_SERVER_FAILURE, nil)
+		responseBytes, err := marshalResponse(ctx, query, maxSize)
+		return responseBytes, true, err
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	responseBytes, err := s.handleSynthesizedQuery(ctx, query, answers, rcode, clientIP, maxSize)
+	return responseBytes, true, err
+}
+
+func (s *Server) versionStage(ctx context.Context, query Message, _ []byte, clientIP net.IP, maxSize int) ([]byte, bool, error) {
+	answers, ok := s.lookupVersionTXT(query)
+	if !ok {
+		return nil, false, nil
+	}
+	responseBytes, err := s.handleSynthesizedQuery(ctx, query, answers, RCODE_NO_ERROR, clientIP, maxSize)
+	return responseBytes, true, err
+}
+
+func (s *Server) ptrTemplateStage(ctx context.Context, query Message, _ []byte, clientIP net.IP, maxSize int) ([]byte, bool, error) {
+	answers, ok := s.lookupPTRTemplate(query)
+	if !ok {
+		return nil, false, nil
+	}
+	responseBytes, err := s.handleSynthesizedQuery(ctx, query, answers, RCODE_NO_ERROR, clientIP, maxSize)
+	return responseBytes, true, err
+}
+
+func (s *Server) specialNameStage(ctx context.Context, query Message, _ []byte, _ net.IP, maxSize int) ([]byte, bool, error) {
+	answers, rcode, ok := s.lookupSpecialName(query)
+	if !ok {
+		return nil, false, nil
+	}
+	responseBytes, err := s.handleSpecialNameQuery(ctx, query, answers, rcode, maxSize)
+	return responseBytes, true, err
+}
+
+func (s *Server) as112Stage(ctx context.Context, query Message, _ []byte, _ net.IP, maxSize int) ([]byte, bool, error) {
+	answers, authorities, rcode, ok := s.lookupAS112(query)
+	if !ok {
+		return nil, false, nil
+	}
+	responseBytes, err := s.handleAS112Query(ctx, query, answers, authorities, rcode, maxSize)
+	return responseBytes, true, err
+}
+
+func (s *Server) forwardStage(ctx context.Context, query Message, queryBytes []byte, clientIP net.IP, maxSize int) ([]byte, bool, error) {
+	if !s.shouldForwardQuery() {
+		return nil, false, nil
+	}
+	if s.opts.HonorRD && !query.Header.RecursionDesired() {
+		logger(ctx).Debug("Refusing to recurse for a query without RD", "questions", query.Questions)
+		s.metrics.refused.Add(1)
+		query.SetError(RCODE_REFUSED, &ExtendedError{Code: EDE_NOT_AUTHORITATIVE})
+		responseBytes, err := marshalResponse(ctx, query, maxSize)
+		return responseBytes, true, err
+	}
+	responseBytes, err := s.handleForwardedQuery(ctx, query, queryBytes, clientIP, maxSize)
+	return responseBytes, true, err
+}
+
+func (s *Server) catchAllStage(ctx context.Context, query Message, _ []byte, clientIP net.IP, maxSize int) ([]byte, bool, error) {
+	if s.catchAllIP == nil {
+		return nil, false, nil
+	}
+	responseBytes, err := s.handleCatchAllQuery(ctx, query, clientIP, maxSize)
+	return responseBytes, true, err
+}
+
+func (s *Server) localStage(ctx context.Context, query Message, _ []byte, clientIP net.IP, maxSize int) ([]byte, bool, error) {
+	if s.opts.RefuseOpenResolver && query.Header.RecursionDesired() {
+		logger(ctx).Debug("Refusing recursion without a resolver", "questions", query.Questions)
+		s.metrics.refused.Add(1)
+		query.SetError(RCODE_REFUSED, &ExtendedError{Code: EDE_PROHIBITED})
+		responseBytes, err := marshalResponse(ctx, query, maxSize)
+		return responseBytes, true, err
+	}
+	responseBytes, err := s.handleLocalQuery(ctx, query, clientIP, maxSize)
+	return responseBytes, true, err
+}
@@ -0,0 +1,49 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelineOrder(t *testing.T) {
+	resolver := startMockResolver(t, func(query Message) Message {
+		return answerWith(NewAAnswer(query.Questions[0].Name, net.ParseIP("192.0.2.1"), 300))(query)
+	})
+	zone := NewZone()
+	zone.Add(NewAAnswer("www.example.com", net.ParseIP("192.0.2.2"), 60))
+
+	server := NewServer(Options{Zone: zone, Resolver: resolver})
+	response := queryType(t, server, "www.example.com", TYPE_A, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 2}, response.Answers[0].Data, "the zone should answer ahead of forwarding by default")
+
+	server = NewServer(Options{Zone: zone, Resolver: resolver, PipelineOrder: []string{StageForward, StageZone}})
+	response = queryType(t, server, "www.example.com", TYPE_A, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 1}, response.Answers[0].Data, "forwarding first should answer from the resolver")
+
+	server = NewServer(Options{Zone: zone, CatchAllIP: "192.0.2.3", PipelineOrder: []string{StageCatchAll}})
+	response = queryType(t, server, "www.example.com", TYPE_A, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 3}, response.Answers[0].Data)
+	response = queryType(t, server, "localhost", TYPE_A, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 3}, response.Answers[0].Data, "the catch-all listed first should answer ahead of the special names")
+}
+
+func TestParsePipeline(t *testing.T) {
+	logs := captureLogs(t)
+	pipeline := parsePipeline([]string{StageLocal, "bogus", StageLocal})
+	assert.Len(t, pipeline, len(defaultPipeline), "every stage should be in the pipeline once")
+
+	var ignored []any
+	for _, line := range logs.lines(t) {
+		if line["level"] == "ERROR" {
+			ignored = append(ignored, line["stage"])
+		}
+	}
+	assert.Equal(t, []any{"bogus", StageLocal}, ignored)
+}
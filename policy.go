@@ -0,0 +1,132 @@
+package dnsserver
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// checkQueryPolicy reports whether the query must be refused before it is
+// resolved, along with the Extended DNS Error explaining why. Some policies
+// only apply to some transports.
+func (s *Server) checkQueryPolicy(ctx context.Context, query Message, transport Transport) (*ExtendedError, bool) {
+	for _, q := range query.Questions {
+		if s.opts.RequireTCPForANY && q.Type == TYPE_ANY && transport == TransportUDP {
+			logger(ctx).Info("Refusing ANY query over UDP", "name", q.Name)
+			return &ExtendedError{Code: EDE_PROHIBITED, Text: "ANY queries require TCP"}, true
+		}
+		if s.exceedsNameLimits(q.Name) {
+			logger(ctx).Info("Refusing query exceeding name limits", "name", q.Name)
+			return &ExtendedError{Code: EDE_PROHIBITED, Text: "query name exceeds policy limits"}, true
+		}
+		if s.tunnels.observe(q, s.now()) {
+			logger(ctx).Info("Refusing query under domain suspected of tunneling", "name", q.Name)
+			return &ExtendedError{Code: EDE_BLOCKED, Text: "suspected DNS tunneling"}, true
+		}
+	}
+	return nil, false
+}
+
+// suspiciousHeader describes what is wrong with a query's header, or returns ""
+// if nothing is. Clients never set QR or AA, and a standard query carries no
+// answers, so such messages are probably spoofed, reflected or probing.
+func suspiciousHeader(h Header) string {
+	switch {
+	case !h.IsQuery():
+		return "QR bit set"
+	case h.Authoritative():
+		return "AA bit set"
+	case h.Flags>>11&0xF == 0 && h.AnswerCount > 0: // NOTIFY and UPDATE legitimately carry records
+		return "query carries answers"
+	}
+	return ""
+}
+
+// checkQueryHeader logs queries with a suspicious header and, under
+// StrictQueryValidation, reports what to do with them: a message with the QR
+// bit is dropped, since answering a response could start a loop with whoever
+// sent it, and any other is refused.
+func (s *Server) checkQueryHeader(ctx context.Context, query Message, clientIP net.IP) (drop, refuse bool) {
+	reason := suspiciousHeader(query.Header)
+	if reason == "" {
+		return false, false
+	}
+	logger(ctx).Warn("Received query with a suspicious header", "reason", reason, "client", clientIP)
+	if !s.opts.StrictQueryValidation {
+		return false, false
+	}
+	return !query.Header.IsQuery(), query.Header.IsQuery()
+}
+
+func (s *Server) exceedsNameLimits(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if s.opts.MaxNameLength > 0 && len(name) > s.opts.MaxNameLength {
+		return true
+	}
+	if s.opts.MaxLabels > 0 && len(nameToLabels(name)) > s.opts.MaxLabels {
+		return true
+	}
+	return false
+}
+
+// parseSubnets parses CIDR strings, accepting bare IPs as single-host subnets.
+// Invalid entries are logged and skipped.
+func parseSubnets(cidrs []string) []*net.IPNet {
+	subnets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				subnets = append(subnets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			slog.Error("Ignoring invalid subnet", "subnet", cidr, "error", err)
+			continue
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets
+}
+
+func subnetsContain(subnets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP extracts the IP address from a client's network address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// nameMatches reports whether name is suffix or one of its subdomains, ignoring case.
+func nameMatches(name, suffix string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	suffix = strings.ToLower(strings.TrimSuffix(suffix, "."))
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
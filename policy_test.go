@@ -0,0 +1,120 @@
+package dnsserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryExceedingNameLimitsIsRefused(t *testing.T) {
+	server := NewServer(Options{MaxNameLength: 100, MaxLabels: 10})
+
+	longName := strings.Repeat("a", 63) + "." + strings.Repeat("b", 50) + ".com"
+	responseBytes, err := server.handleQuery(context.Background(), createTestEDNSQuery("x.1.2.3.4.5.6.7.8.9.10.11.tunnel.example.com"), nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	assert.Equal(t, RCODE_REFUSED, response.Header.ResponseCode())
+	assert.Empty(t, response.Answers)
+
+	ede, ok := response.ExtendedError()
+	require.True(t, ok)
+	assert.Equal(t, EDE_PROHIBITED, ede.Code)
+
+	responseBytes, err = server.handleQuery(context.Background(), createTestEDNSQuery(longName), nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	response, err = NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	assert.Equal(t, RCODE_REFUSED, response.Header.ResponseCode())
+}
+
+func TestQueryWithinNameLimitsIsAnswered(t *testing.T) {
+	server := NewServer(Options{MaxNameLength: 100, MaxLabels: 10})
+
+	responseBytes, err := server.handleQuery(context.Background(), createTestQuery(), nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	assert.Equal(t, RCODE_NO_ERROR, response.Header.ResponseCode())
+	assert.Len(t, response.Answers, 1)
+}
+
+func TestRequireTCPForANYDependsOnTransport(t *testing.T) {
+	server := NewServer(Options{RequireTCPForANY: true})
+	query := createTestQueryMessage("example.com")
+	query.Questions[0].Type = TYPE_ANY
+	queryBytes, err := query.MarshalBinary()
+	require.NoError(t, err)
+
+	rcode := func(transport Transport, maxSize int) uint8 {
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, transport, maxSize)
+		require.NoError(t, err)
+		header, err := NewHeaderFromBytes(responseBytes)
+		require.NoError(t, err)
+		return header.ResponseCode()
+	}
+
+	assert.Equal(t, RCODE_REFUSED, rcode(TransportUDP, maxUDPMessageSize))
+	assert.Equal(t, RCODE_NO_ERROR, rcode(TransportTCP, maxTCPMessageSize))
+	assert.Equal(t, RCODE_NO_ERROR, rcode(TransportDoT, maxTCPMessageSize))
+}
+
+func TestSuspiciousQueryHeaders(t *testing.T) {
+	tests := map[string]struct {
+		mutate     func(msg *Message)
+		wantRCode  uint8
+		wantDrop   bool
+		wantReason string
+	}{
+		"QR bit": {
+			mutate:     func(msg *Message) { msg.Header.SetQuery(false) },
+			wantDrop:   true,
+			wantReason: "QR bit set",
+		},
+		"AA bit": {
+			mutate:     func(msg *Message) { msg.Header.SetAuthoritative(true) },
+			wantRCode:  RCODE_REFUSED,
+			wantReason: "AA bit set",
+		},
+		"answers": {
+			mutate:     func(msg *Message) { msg.AddAnswers([]Answer{NewAAnswer("example.com", []byte{192, 0, 2, 1}, 60)}) },
+			wantRCode:  RCODE_REFUSED,
+			wantReason: "query carries answers",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			query := createTestQueryMessage("example.com")
+			tt.mutate(&query)
+			query.Header.AnswerCount = uint16(len(query.Answers))
+			queryBytes, err := query.MarshalBinary()
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantReason, suspiciousHeader(query.Header))
+
+			lenient := NewServer(Options{})
+			_, err = lenient.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+			assert.NoError(t, err, "without StrictQueryValidation the query is only logged")
+
+			strict := NewServer(Options{StrictQueryValidation: true})
+			responseBytes, err := strict.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+			if tt.wantDrop {
+				assert.ErrorIs(t, err, errQueryDropped)
+				return
+			}
+			require.NoError(t, err)
+			response, err := NewMessageFromBytes(responseBytes)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantRCode, response.Header.ResponseCode())
+			assert.False(t, response.Header.Authoritative())
+			assert.Empty(t, response.Answers)
+		})
+	}
+
+	assert.Empty(t, suspiciousHeader(createTestQueryMessage("example.com").Header))
+}
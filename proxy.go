@@ -0,0 +1,117 @@
+package dnsserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Header is the longest a version 1 header line can be, CRLF included.
+const maxProxyV1Header = 107
+
+var errNoProxyHeader = errors.New("connection doesn't start with a PROXY protocol header")
+
+// readProxyHeader reads the PROXY protocol header (version 1 or 2) a load
+// balancer sends ahead of the client's stream, and returns the client address
+// it carries. It returns a nil address when the header doesn't name one, as
+// for the balancer's own health checks, meaning the peer is the client. A
+// stream starting with anything else is an error rather than read as DNS.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch start[0] {
+	case 'P':
+		return readProxyV1Header(r)
+	case proxyV2Signature[0]:
+		return readProxyV2Header(r)
+	}
+	return nil, errNoProxyHeader
+}
+
+// readProxyV1Header reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n".
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyV1Header {
+			return nil, errors.New("PROXY header too long")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errNoProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("malformed PROXY header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("malformed PROXY header address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads the binary header: the signature, the version and
+// command, the address family, the length of the rest and then the addresses,
+// followed by TLVs this server has no use for.
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, errNoProxyHeader
+	}
+	versionCommand, family := header[12], header[13]
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", versionCommand>>4)
+	}
+	rest := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command comes from the balancer itself, not on a client's behalf.
+	if versionCommand&0xF == 0 {
+		return nil, nil
+	}
+	var size int
+	switch family >> 4 {
+	case 1: // AF_INET
+		size = net.IPv4len
+	case 2: // AF_INET6
+		size = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(rest) < 2*size+4 {
+		return nil, errors.New("PROXY header addresses are too short")
+	}
+	ip := net.IP(rest[:size])
+	port := binary.BigEndian.Uint16(rest[2*size:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
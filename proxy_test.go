@@ -0,0 +1,107 @@
+package dnsserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2Header builds a PROXY protocol version 2 header for a TCP over IPv4
+// connection from src.
+func proxyV2Header(src net.IP, port uint16) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11) // version 2 PROXY, TCP over IPv4
+	header = binary.BigEndian.AppendUint16(header, 12)
+	header = append(header, src.To4()...)
+	header = append(header, 192, 0, 2, 53)
+	header = binary.BigEndian.AppendUint16(header, port)
+	return binary.BigEndian.AppendUint16(header, 53)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := map[string]struct {
+		header string
+		want   string
+	}{
+		"v1 IPv4":    {"PROXY TCP4 203.0.113.7 192.0.2.53 56324 53\r\n", "203.0.113.7:56324"},
+		"v1 IPv6":    {"PROXY TCP6 2001:db8::7 2001:db8::53 56324 53\r\n", "[2001:db8::7]:56324"},
+		"v1 unknown": {"PROXY UNKNOWN\r\n", ""},
+		"v2 IPv4":    {string(proxyV2Header(net.ParseIP("203.0.113.7"), 56324)), "203.0.113.7:56324"},
+		"v2 local":   {string(proxyV2Signature) + "\x20\x00\x00\x00", ""},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(test.header + "rest"))
+			addr, err := readProxyHeader(r)
+			require.NoError(t, err)
+			if test.want == "" {
+				assert.Nil(t, addr)
+			} else {
+				assert.Equal(t, test.want, addr.String())
+			}
+			rest, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, "rest", string(rest), "the stream should continue right after the header")
+		})
+	}
+
+	for _, bad := range []string{"\x00\x1d", "PROXY TCP4 nonsense\r\n", "PROXY " + strings.Repeat("x", 200), "\r\n\r\nnot the signature"} {
+		_, err := readProxyHeader(bufio.NewReader(strings.NewReader(bad)))
+		assert.Error(t, err, "%q", bad)
+	}
+}
+
+func TestExpectProxyProtocol(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewAAAAAnswer("example.com", net.ParseIP("2001:db8::1"), 60))
+	server := NewServer(Options{
+		Zone:                zone,
+		ExpectProxyProtocol: true,
+		FilterAAAA:          true,
+		FilterSubnets:       []string{"203.0.113.0/24"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ListenAndServeTCP(ctx, ln)
+
+	query := func(header []byte) (Message, error) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		msg := createTestQueryMessage("example.com")
+		msg.Questions[0].Type = TYPE_AAAA
+		queryBytes, err := msg.MarshalBinary()
+		require.NoError(t, err)
+		_, err = conn.Write(header)
+		require.NoError(t, err)
+		require.NoError(t, writeTCPMessage(conn, queryBytes))
+		responseBytes, err := readTCPMessage(conn)
+		if err != nil {
+			return Message{}, err
+		}
+		return NewMessageFromBytes(responseBytes)
+	}
+
+	filtered, err := query(proxyV2Header(net.ParseIP("203.0.113.7"), 40000))
+	require.NoError(t, err)
+	assert.Empty(t, filtered.Answers, "the client address from the header should pick the filter")
+
+	unfiltered, err := query(proxyV2Header(net.ParseIP("198.51.100.1"), 40000))
+	require.NoError(t, err)
+	assert.Len(t, unfiltered.Answers, 1)
+
+	_, err = query(nil)
+	assert.Error(t, err, "a connection without the header should be closed")
+}
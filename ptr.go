@@ -0,0 +1,107 @@
+package dnsserver
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ptrTemplateTTL is the TTL of the PTR records generated from PTRTemplates.
+const ptrTemplateTTL = 3600
+
+// PTRTemplate generates the PTR records of every address in CIDR from
+// NameTemplate, in which {last-octet} stands for the address's last byte in
+// decimal and {ip} for the whole address with its dots or colons turned into
+// dashes, as in host-{last-octet}.lab.local.
+type PTRTemplate struct {
+	CIDR         string
+	NameTemplate string
+}
+
+type ptrTemplate struct {
+	subnet *net.IPNet
+	name   string
+}
+
+func parsePTRTemplates(templates []PTRTemplate) []ptrTemplate {
+	parsed := make([]ptrTemplate, 0, len(templates))
+	for _, template := range templates {
+		_, subnet, err := net.ParseCIDR(template.CIDR)
+		if err != nil {
+			slog.Error("Ignoring PTR template with an invalid subnet", "subnet", template.CIDR, "error", err)
+			continue
+		}
+		parsed = append(parsed, ptrTemplate{subnet: subnet, name: template.NameTemplate})
+	}
+	return parsed
+}
+
+// expand returns the template's name for ip.
+func (t ptrTemplate) expand(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	dashed := strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+	return strings.NewReplacer(
+		"{last-octet}", strconv.Itoa(int(ip[len(ip)-1])),
+		"{ip}", dashed,
+	).Replace(t.name)
+}
+
+// reverseNameIP returns the address a reverse lookup name stands for, under
+// in-addr.arpa or ip6.arpa, or nil when it doesn't name a whole address.
+func reverseNameIP(name string) net.IP {
+	labels := nameToLabels(zoneKey(name))
+	switch {
+	case len(labels) == 6 && labels[4] == "in-addr" && labels[5] == "arpa":
+		ip := make(net.IP, net.IPv4len)
+		for i := range ip {
+			n, err := strconv.ParseUint(labels[3-i], 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[i] = byte(n)
+		}
+		return ip
+	case len(labels) == 34 && labels[32] == "ip6" && labels[33] == "arpa":
+		ip := make(net.IP, net.IPv6len)
+		for i := 0; i < 32; i++ {
+			nibble, err := strconv.ParseUint(labels[31-i], 16, 4)
+			if err != nil || len(labels[31-i]) != 1 {
+				return nil
+			}
+			ip[i/2] |= byte(nibble) << (4 * (1 - i%2))
+		}
+		return ip
+	}
+	return nil
+}
+
+// lookupPTRTemplate generates the PTR records asked for by a query whose
+// questions are all reverse lookups of addresses within PTRTemplates.
+func (s *Server) lookupPTRTemplate(query Message) ([]Answer, bool) {
+	if len(s.ptrTemplates) == 0 || len(query.Questions) == 0 {
+		return nil, false
+	}
+
+	answers := make([]Answer, 0, len(query.Questions))
+	for _, question := range query.Questions {
+		if question.Type != TYPE_PTR || question.Class != CLASS_IN {
+			return nil, false
+		}
+		ip := reverseNameIP(question.Name)
+		if ip == nil {
+			return nil, false
+		}
+		i := 0
+		for i < len(s.ptrTemplates) && !s.ptrTemplates[i].subnet.Contains(ip) {
+			i++
+		}
+		if i == len(s.ptrTemplates) {
+			return nil, false
+		}
+		answers = append(answers, NewPTRAnswer(question.Name, s.ptrTemplates[i].expand(ip), s.typeTTL(TYPE_PTR, ptrTemplateTTL)))
+	}
+	return answers, true
+}
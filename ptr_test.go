@@ -0,0 +1,67 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ptrTarget(t *testing.T, answer Answer) string {
+	t.Helper()
+	require.Equal(t, TYPE_PTR, answer.Type)
+	name, _, err := readName(answer.Data, 0)
+	require.NoError(t, err)
+	return name
+}
+
+func TestPTRTemplates(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewPTRAnswer("1.0.0.10.in-addr.arpa", "gateway.lab.local", 300))
+	server := NewServer(Options{
+		Zone: zone,
+		PTRTemplates: []PTRTemplate{
+			{CIDR: "10.0.0.0/24", NameTemplate: "host-{last-octet}.lab.local"},
+			{CIDR: "10.0.0.0/8", NameTemplate: "ip-{ip}.lab.local"},
+			{CIDR: "2001:db8::/64", NameTemplate: "v6-{ip}.lab.local"},
+		},
+	})
+
+	response := queryType(t, server, "42.0.0.10.in-addr.arpa", TYPE_PTR, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, "host-42.lab.local", ptrTarget(t, response.Answers[0]))
+	assert.Equal(t, uint32(ptrTemplateTTL), response.Answers[0].TTL)
+
+	response = queryType(t, server, "7.1.20.10.in-addr.arpa", TYPE_PTR, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, "ip-10-20-1-7.lab.local", ptrTarget(t, response.Answers[0]), "the first matching template should win")
+
+	response = queryType(t, server, "1.0.0.10.in-addr.arpa", TYPE_PTR, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, "gateway.lab.local", ptrTarget(t, response.Answers[0]), "zone records should take precedence")
+
+	reverse := "5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"
+	response = queryType(t, server, reverse, TYPE_PTR, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, "v6-2001-db8--5.lab.local", ptrTarget(t, response.Answers[0]))
+
+	_, ok := server.snapshot().lookupPTRTemplate(Message{Questions: []Question{{Name: "1.0.168.192.in-addr.arpa", Type: TYPE_PTR, Class: CLASS_IN}}})
+	assert.False(t, ok, "addresses outside the templates shouldn't get generated names")
+	_, ok = server.snapshot().lookupPTRTemplate(Message{Questions: []Question{{Name: "42.0.0.10.in-addr.arpa", Type: TYPE_A, Class: CLASS_IN}}})
+	assert.False(t, ok, "only PTR queries should get generated names")
+}
+
+func TestReverseNameIP(t *testing.T) {
+	assert.Equal(t, net.ParseIP("10.0.0.42").To4(), reverseNameIP("42.0.0.10.IN-ADDR.ARPA."))
+	assert.Equal(t, net.ParseIP("2001:db8::1"), reverseNameIP("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"))
+	for _, name := range []string{
+		"0.10.in-addr.arpa",
+		"256.0.0.10.in-addr.arpa",
+		"x.0.0.10.in-addr.arpa",
+		"10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.ip6.arpa",
+		"example.com",
+	} {
+		assert.Nil(t, reverseNameIP(name), name)
+	}
+}
@@ -0,0 +1,87 @@
+package dnsserver
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RecentQuery is a query the server answered, as kept by RecentQueries.
+type RecentQuery struct {
+	Time   time.Time
+	Client net.IP
+	Name   string
+	Type   uint16
+	Rcode  uint8
+}
+
+// recentQueries is a ring buffer holding the last answered queries. A nil
+// buffer keeps nothing.
+type recentQueries struct {
+	mu      sync.Mutex
+	entries []RecentQuery
+	next    int
+	full    bool
+}
+
+func newRecentQueries(size int) *recentQueries {
+	if size <= 0 {
+		return nil
+	}
+	return &recentQueries{entries: make([]RecentQuery, size)}
+}
+
+func (r *recentQueries) record(query RecentQuery) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = query
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the kept queries, newest first.
+func (r *recentQueries) list() []RecentQuery {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	queries := make([]RecentQuery, n)
+	for i := range queries {
+		queries[i] = r.entries[(r.next-1-i+len(r.entries))%len(r.entries)]
+	}
+	return queries
+}
+
+// recordRecent keeps the answered query in the RecentBufferSize ring buffer.
+func (s *Server) recordRecent(query Message, clientIP net.IP, responseBytes []byte) {
+	if s.recent == nil || len(query.Questions) == 0 {
+		return
+	}
+	response, err := NewHeaderFromBytes(responseBytes)
+	if err != nil {
+		return
+	}
+	s.recent.record(RecentQuery{
+		Time:   s.now(),
+		Client: clientIP,
+		Name:   query.Questions[0].Name,
+		Type:   query.Questions[0].Type,
+		Rcode:  response.ResponseCode(),
+	})
+}
+
+// RecentQueries returns the last queries the server answered, newest first,
+// up to RecentBufferSize of them.
+func (s *Server) RecentQueries() []RecentQuery {
+	return s.recent.list()
+}
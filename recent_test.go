@@ -0,0 +1,73 @@
+package dnsserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecentQueriesNewestFirst(t *testing.T) {
+	server := NewServer(Options{RecentBufferSize: 3, MaxLabels: 3})
+
+	client := net.ParseIP("198.51.100.7")
+	for i := 0; i < 4; i++ {
+		queryType(t, server, fmt.Sprintf("host%d.example.com", i), TYPE_AAAA, client)
+	}
+	queryType(t, server, "too.many.labels.example.com", TYPE_A, client)
+
+	recent := server.RecentQueries()
+	require.Len(t, recent, 3)
+	assert.Equal(t, "too.many.labels.example.com", recent[0].Name)
+	assert.Equal(t, RCODE_REFUSED, recent[0].Rcode)
+	assert.Equal(t, "host3.example.com", recent[1].Name)
+	assert.Equal(t, TYPE_AAAA, recent[1].Type)
+	assert.Equal(t, "host2.example.com", recent[2].Name)
+	assert.True(t, client.Equal(recent[2].Client))
+	assert.False(t, recent[0].Time.Before(recent[1].Time))
+
+	base := startAdminHTTP(t, server)
+	resp, err := http.Get(base + "/recent")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	require.Len(t, lines, 3)
+	assert.True(t, strings.HasSuffix(lines[0], " 198.51.100.7 too.many.labels.example.com. A 5"), lines[0])
+}
+
+func TestRecentQueriesBeforeWrapping(t *testing.T) {
+	recent := newRecentQueries(5)
+	recent.record(RecentQuery{Name: "a"})
+	recent.record(RecentQuery{Name: "b"})
+
+	got := recent.list()
+	require.Len(t, got, 2)
+	assert.Equal(t, "b", got[0].Name)
+	assert.Equal(t, "a", got[1].Name)
+	assert.Nil(t, NewServer(Options{}).RecentQueries())
+}
+
+func TestRecentQueriesConcurrent(t *testing.T) {
+	recent := newRecentQueries(16)
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				recent.record(RecentQuery{Name: fmt.Sprintf("%d-%d", i, j)})
+				recent.list()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, recent.list(), 16)
+}
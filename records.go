@@ -0,0 +1,204 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// NewAAnswer builds an IN-class A record for an IPv4 address.
+func NewAAnswer(name string, ip net.IP, ttl uint32) Answer {
+	data := append([]byte{}, ip.To4()...)
+	return Answer{Name: name, Type: TYPE_A, Class: CLASS_IN, TTL: ttl, Length: uint16(len(data)), Data: data}
+}
+
+// NewAAAAAnswer builds an IN-class AAAA record for an IPv6 address.
+func NewAAAAAnswer(name string, ip net.IP, ttl uint32) Answer {
+	data := append([]byte{}, ip.To16()...)
+	return Answer{Name: name, Type: TYPE_AAAA, Class: CLASS_IN, TTL: ttl, Length: uint16(len(data)), Data: data}
+}
+
+// NewCNAMEAnswer builds an IN-class CNAME record aliasing name to target.
+func NewCNAMEAnswer(name, target string, ttl uint32) Answer {
+	data := appendName(nil, target)
+	return Answer{Name: name, Type: TYPE_CNAME, Class: CLASS_IN, TTL: ttl, Length: uint16(len(data)), Data: data}
+}
+
+// NewNSAnswer builds an IN-class NS record naming host a name server for name.
+func NewNSAnswer(name, host string, ttl uint32) Answer {
+	data := appendName(nil, host)
+	return Answer{Name: name, Type: TYPE_NS, Class: CLASS_IN, TTL: ttl, Length: uint16(len(data)), Data: data}
+}
+
+// NewPTRAnswer builds an IN-class PTR record pointing name at target.
+func NewPTRAnswer(name, target string, ttl uint32) Answer {
+	data := appendName(nil, target)
+	return Answer{Name: name, Type: TYPE_PTR, Class: CLASS_IN, TTL: ttl, Length: uint16(len(data)), Data: data}
+}
+
+// NewTXTAnswer builds an IN-class TXT record. Each text becomes one or more
+// length-prefixed character-strings of at most 255 bytes.
+func NewTXTAnswer(name string, ttl uint32, texts ...string) Answer {
+	data := make([]byte, 0)
+	for _, text := range texts {
+		data = appendCharacterString(data, text)
+	}
+	return Answer{
+		Name:   name,
+		Type:   TYPE_TXT,
+		Class:  CLASS_IN,
+		TTL:    ttl,
+		Length: uint16(len(data)),
+		Data:   data,
+	}
+}
+
+func appendCharacterString(data []byte, text string) []byte {
+	for len(text) > 255 {
+		data = append(data, 255)
+		data = append(data, text[:255]...)
+		text = text[255:]
+	}
+	data = append(data, byte(len(text)))
+	return append(data, text...)
+}
+
+// readCharacterStrings decodes the length-prefixed character-strings making up
+// TXT-like record data.
+func readCharacterStrings(data []byte) ([]string, error) {
+	var texts []string
+	for len(data) > 0 {
+		length := int(data[0])
+		if 1+length > len(data) {
+			return nil, errors.New("character-string exceeds record data")
+		}
+		texts = append(texts, string(data[1:1+length]))
+		data = data[1+length:]
+	}
+	return texts, nil
+}
+
+// NewHINFOAnswer builds an IN-class HINFO record describing a host's CPU and
+// operating system.
+func NewHINFOAnswer(name, cpu, os string, ttl uint32) Answer {
+	data := appendCharacterString(nil, cpu)
+	data = appendCharacterString(data, os)
+	return Answer{
+		Name:   name,
+		Type:   TYPE_HINFO,
+		Class:  CLASS_IN,
+		TTL:    ttl,
+		Length: uint16(len(data)),
+		Data:   data,
+	}
+}
+
+// NewSOAAnswer builds an IN-class SOA record.
+func NewSOAAnswer(name, mname, rname string, serial, refresh, retry, expire, minimum, ttl uint32) Answer {
+	data := appendName(nil, mname)
+	data = appendName(data, rname)
+	for _, v := range []uint32{serial, refresh, retry, expire, minimum} {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	return Answer{
+		Name:   name,
+		Type:   TYPE_SOA,
+		Class:  CLASS_IN,
+		TTL:    ttl,
+		Length: uint16(len(data)),
+		Data:   data,
+	}
+}
+
+var typeNames = map[uint16]string{
+	TYPE_A:      "A",
+	TYPE_NS:     "NS",
+	TYPE_CNAME:  "CNAME",
+	TYPE_SOA:    "SOA",
+	TYPE_NULL:   "NULL",
+	TYPE_PTR:    "PTR",
+	TYPE_HINFO:  "HINFO",
+	TYPE_MX:     "MX",
+	TYPE_TXT:    "TXT",
+	TYPE_AAAA:   "AAAA",
+	TYPE_SRV:    "SRV",
+	TYPE_DNAME:  "DNAME",
+	TYPE_OPT:    "OPT",
+	TYPE_DS:     "DS",
+	TYPE_RRSIG:  "RRSIG",
+	TYPE_NSEC:   "NSEC",
+	TYPE_DNSKEY: "DNSKEY",
+	TYPE_HTTPS:  "HTTPS",
+	TYPE_AXFR:   "AXFR",
+	TYPE_ANY:    "ANY",
+}
+
+func typeName(t uint16) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+func className(c uint16) string {
+	switch c {
+	case CLASS_IN:
+		return "IN"
+	case CLASS_CH:
+		return "CH"
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// String renders the record in zone file presentation format. Data of types
+// without a known layout, NULL included, uses the generic \# form of RFC 3597.
+func (a Answer) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", fqdn(a.Name), a.TTL, className(a.Class), typeName(a.Type), a.dataString())
+}
+
+func (a Answer) dataString() string {
+	data := a.Data
+	switch {
+	case a.Type == TYPE_A && len(data) == net.IPv4len, a.Type == TYPE_AAAA && len(data) == net.IPv6len:
+		return net.IP(data).String()
+	case a.Type == TYPE_NS || a.Type == TYPE_CNAME || a.Type == TYPE_PTR || a.Type == TYPE_DNAME:
+		if name, _, err := readName(data, 0); err == nil {
+			return fqdn(name)
+		}
+	case a.Type == TYPE_MX && len(data) > 2:
+		if name, _, err := readName(data, 2); err == nil {
+			return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(data), fqdn(name))
+		}
+	case a.Type == TYPE_TXT || a.Type == TYPE_HINFO:
+		if texts, err := readCharacterStrings(data); err == nil {
+			quoted := make([]string, len(texts))
+			for i, text := range texts {
+				quoted[i] = strconv.Quote(text)
+			}
+			return strings.Join(quoted, " ")
+		}
+	case a.Type == TYPE_SOA:
+		mname, offset, err := readName(data, 0)
+		if err != nil {
+			break
+		}
+		rname, offset, err := readName(data, offset)
+		if err != nil || offset+20 != len(data) {
+			break
+		}
+		values := make([]string, 5)
+		for i := range values {
+			values[i] = strconv.FormatUint(uint64(binary.BigEndian.Uint32(data[offset+4*i:])), 10)
+		}
+		return fmt.Sprintf("%s %s %s", fqdn(mname), fqdn(rname), strings.Join(values, " "))
+	}
+	return fmt.Sprintf("\\# %d %s", len(data), hex.EncodeToString(data))
+}
@@ -0,0 +1,67 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNULLRecordRoundTrips(t *testing.T) {
+	// rdata that would be misread as a name or character-strings if special-cased
+	rdata := []byte{0xC0, 0x0C, 0x00, 0x03, 'f', 'o', 'o', 0xFF}
+	msg := createTestQueryMessage("tunnel.example.com")
+	msg.AddAnswers([]Answer{{Name: "tunnel.example.com", Type: TYPE_NULL, Class: CLASS_IN, TTL: 30, Length: uint16(len(rdata)), Data: rdata}})
+	msg.SetResponse(1)
+
+	encoded, err := msg.MarshalBinary()
+	require.NoError(t, err)
+	decoded, err := NewMessageFromBytes(encoded)
+	require.NoError(t, err)
+
+	require.Len(t, decoded.Answers, 1)
+	assert.Equal(t, TYPE_NULL, decoded.Answers[0].Type)
+	assert.Equal(t, rdata, decoded.Answers[0].Data)
+	assert.Equal(t, uint16(len(rdata)), decoded.Answers[0].Length)
+
+	reencoded, err := decoded.MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, encoded, reencoded)
+}
+
+func TestAnswerString(t *testing.T) {
+	tests := []struct {
+		answer Answer
+		want   string
+	}{
+		{NewAAnswer("www.example.com", net.ParseIP("192.0.2.1"), 300), "www.example.com.\t300\tIN\tA\t192.0.2.1"},
+		{NewAAAAAnswer("www.example.com", net.ParseIP("2001:db8::1"), 300), "www.example.com.\t300\tIN\tAAAA\t2001:db8::1"},
+		{NewTXTAnswer("example.com", 60, "hello world"), "example.com.\t60\tIN\tTXT\t\"hello world\""},
+		{NewSOAAnswer("example.com", "ns.example.com", "hostmaster.example.com", 1, 2, 3, 4, 5, 60), "example.com.\t60\tIN\tSOA\tns.example.com. hostmaster.example.com. 1 2 3 4 5"},
+		{Answer{Name: "example.com", Type: TYPE_NULL, Class: CLASS_IN, TTL: 0, Data: []byte{0xDE, 0xAD, 0xBE, 0xEF}}, "example.com.\t0\tIN\tNULL\t\\# 4 deadbeef"},
+		{Answer{Name: "example.com", Type: 65280, Class: CLASS_IN, TTL: 0, Data: []byte{1}}, "example.com.\t0\tIN\tTYPE65280\t\\# 1 01"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.answer.String())
+	}
+}
+
+func TestHINFORecordRoundTrips(t *testing.T) {
+	msg := createTestQueryMessage("host.example.com")
+	msg.AddAnswers([]Answer{NewHINFOAnswer("host.example.com", "INTEL", "LINUX", 300)})
+	msg.SetResponse(1)
+
+	encoded, err := msg.MarshalBinary()
+	require.NoError(t, err)
+	decoded, err := NewMessageFromBytes(encoded)
+	require.NoError(t, err)
+
+	require.Len(t, decoded.Answers, 1)
+	assert.Equal(t, TYPE_HINFO, decoded.Answers[0].Type)
+	texts, err := readCharacterStrings(decoded.Answers[0].Data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"INTEL", "LINUX"}, texts)
+	assert.Equal(t, "host.example.com.\t300\tIN\tHINFO\t\"INTEL\" \"LINUX\"", decoded.Answers[0].String())
+}
@@ -0,0 +1,83 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+)
+
+// nameRewrite maps a name and its subdomains onto another name.
+type nameRewrite struct {
+	from, to string
+}
+
+// parseNameRewrites normalizes NameRewrites, ordering the most specific rules first.
+func parseNameRewrites(rewrites map[string]string) []nameRewrite {
+	rules := make([]nameRewrite, 0, len(rewrites))
+	for from, to := range rewrites {
+		rules = append(rules, nameRewrite{from: zoneKey(from), to: zoneKey(to)})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return len(rules[i].from) > len(rules[j].from)
+	})
+	return rules
+}
+
+// replaceSuffix replaces suffix, which name must match, with replacement.
+func replaceSuffix(name, suffix, replacement string) string {
+	prefix := strings.TrimSuffix(strings.TrimSuffix(name, suffix), ".")
+	if prefix == "" {
+		return replacement
+	}
+	return prefix + "." + replacement
+}
+
+// rewriteQuestions applies NameRewrites to the query's questions, returning
+// the rules that matched.
+func (s *Server) rewriteQuestions(query *Message) []nameRewrite {
+	var applied []nameRewrite
+	for i, question := range query.Questions {
+		name := zoneKey(question.Name)
+		for _, rule := range s.rewrites {
+			if nameMatches(name, rule.from) {
+				query.Questions[i].Name = replaceSuffix(name, rule.from, rule.to)
+				applied = append(applied, rule)
+				break
+			}
+		}
+	}
+	return applied
+}
+
+// handleRewrittenQuery resolves a query whose names were rewritten, then
+// restores the client's names in the response so the rewrite stays invisible.
+func (s *Server) handleRewrittenQuery(ctx context.Context, query Message, original []Question, rules []nameRewrite, clientIP net.IP, maxSize int) ([]byte, error) {
+	logger(ctx).Debug("Rewrote query name", "from", original[0].Name, "to", query.Questions[0].Name)
+	queryBytes, err := query.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	responseBytes, err := s.resolveQuery(ctx, query, queryBytes, clientIP, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := NewMessageFromBytes(responseBytes)
+	if err != nil {
+		return nil, err
+	}
+	response.Questions = original
+	for _, section := range [][]Answer{response.Answers, response.Authorities, response.Additionals} {
+		for i := range section {
+			name := zoneKey(section[i].Name)
+			for _, rule := range rules {
+				if nameMatches(name, rule.to) {
+					section[i].Name = replaceSuffix(name, rule.to, rule.from)
+					break
+				}
+			}
+		}
+	}
+	return marshalResponse(ctx, response, maxSize)
+}
@@ -0,0 +1,45 @@
+package dnsserver
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameRewritesAreInvisibleToClients(t *testing.T) {
+	var mu sync.Mutex
+	var upstreamNames []string
+	resolver := startMockResolver(t, func(query Message) Message {
+		mu.Lock()
+		upstreamNames = append(upstreamNames, query.Questions[0].Name)
+		mu.Unlock()
+		return answerWith(NewAAnswer(query.Questions[0].Name, net.ParseIP("192.0.2.1"), 60))(query)
+	})
+	server := NewServer(Options{Resolver: resolver, NameRewrites: map[string]string{
+		"old.example.com":     "new.example.com",
+		"api.old.example.com": "api.elsewhere.net",
+	}})
+
+	tests := []struct {
+		query, upstream string
+	}{
+		{"Old.Example.com", "new.example.com"},
+		{"www.old.example.com", "www.new.example.com"},
+		{"api.old.example.com", "api.elsewhere.net"},
+		{"unrelated.example.com", "unrelated.example.com"},
+	}
+	for _, tt := range tests {
+		response := queryType(t, server, tt.query, TYPE_A, nil)
+
+		mu.Lock()
+		assert.Equal(t, tt.upstream, upstreamNames[len(upstreamNames)-1])
+		mu.Unlock()
+		require.Len(t, response.Questions, 1)
+		assert.Equal(t, tt.query, response.Questions[0].Name)
+		require.Len(t, response.Answers, 1)
+		assert.Equal(t, zoneKey(tt.query), zoneKey(response.Answers[0].Name))
+	}
+}
@@ -2,35 +2,582 @@ package dnsserver
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+const (
+	// maxUDPMessageSize is the classic DNS limit for a UDP payload without EDNS.
+	maxUDPMessageSize = 512
+	// maxTCPMessageSize is the largest message the 2-byte TCP length prefix can describe.
+	maxTCPMessageSize = 65535
+)
+
+// maxUDPQueries caps how many UDP queries the server handles at once, over
+// all its listeners. The read loops wait for a slot when every one is taken,
+// so a flood backs up in the socket's receive buffer rather than piling up
+// goroutines and forwarding sockets. It leaves room for maxTarpitted queries
+// held in the tarpit.
+const maxUDPQueries = 4 * maxTarpitted
+
+// catchAllTTL is the TTL of answers synthesized from CatchAllIP.
+const catchAllTTL = 60
+
+// defaultZoneTTL is the TTL of zone records loaded without one when neither
+// TTLByType nor DefaultTTL gives their type one.
+const defaultZoneTTL = 3600
+
+// errQueryDropped is returned by handleQuery when a query deliberately gets no response.
+var errQueryDropped = errors.New("query dropped")
+
+// errNoResolvers reports that a query had no resolver to be forwarded to.
+var errNoResolvers = errors.New("no resolver to forward to")
+
+// errResolverRefused reports that nothing listens at the resolver's address, as
+// signalled by an ICMP port unreachable, so failing over to another resolver
+// needn't wait out the forwarding timeout.
+var errResolverRefused = errors.New("resolver refused the query")
+
+// errForwardedTruncated reports that a forwarded UDP response filled the
+// buffer it was read into, so it was most likely cut short.
+var errForwardedTruncated = errors.New("forwarded response filled the read buffer")
+
+// errForwardLimit reports that MaxConcurrentForwards queries were already
+// being forwarded for as long as a query waits.
+var errForwardLimit = errors.New("too many queries forwarded at once")
+
+// Protocols for exchanging forwarded queries with the resolver.
+const (
+	// ForwardProtocolUDP forwards over UDP, retrying over TCP only when the
+	// response is truncated and the client's transport can take the full answer.
+	ForwardProtocolUDP = "udp"
+	// ForwardProtocolTCP always forwards over TCP.
+	ForwardProtocolTCP = "tcp"
+	// ForwardProtocolUDPThenTCP forwards over UDP like ForwardProtocolUDP, and
+	// also retries over TCP when the UDP exchange fails.
+	ForwardProtocolUDPThenTCP = "udp-then-tcp"
+)
+
+// Strategies for the IDs of messages the server originates itself.
+const (
+	// IDStrategyRandom picks random IDs, so off-path attackers can't guess them.
+	IDStrategyRandom = "random"
+	// IDStrategyMonotonic counts IDs up from 1, so they are easy to follow in
+	// captures and logs while debugging.
+	IDStrategyMonotonic = "monotonic"
+)
+
+// Strategies for picking which resolver a query is forwarded to.
+const (
+	// ResolverStrategyOrdered tries the resolvers in the order they are
+	// configured, moving on to the next one when one fails.
+	ResolverStrategyOrdered = "ordered"
+	// ResolverStrategyConsistentHash sends each name to the same resolver,
+	// chosen by hashing it, so a pool of caching resolvers doesn't each cache
+	// every name. The names of a resolver that fails move to the others.
+	ResolverStrategyConsistentHash = "consistent-hash"
+)
+
+// Transport identifies how a query reached the server, for policies that
+// depend on it.
+type Transport int
+
+const (
+	TransportUDP Transport = iota
+	TransportTCP
+	TransportDoT
+	TransportDoH
+	TransportDoQ
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportUDP:
+		return "udp"
+	case TransportTCP:
+		return "tcp"
+	case TransportDoT:
+		return "dot"
+	case TransportDoH:
+		return "doh"
+	case TransportDoQ:
+		return "doq"
+	}
+	return "unknown"
+}
+
+// Encrypted reports whether the transport protects queries from on-path observers.
+func (t Transport) Encrypted() bool {
+	return t == TransportDoT || t == TransportDoH || t == TransportDoQ
+}
+
 type Options struct {
+	// Resolver is the address of the resolver to forward queries to. A missing
+	// port defaults to 53, and IPv6 addresses with a port go in brackets.
+	// Invalid addresses are ignored.
 	Resolver string
+	// Resolvers are more resolvers to forward to besides Resolver. A query
+	// tries them in the order ResolverStrategy picks, until one answers.
+	Resolvers []string
+	// ResolverGroups are tiers of resolvers tried after Resolver and Resolvers:
+	// a query moves on to the next group only once every resolver of the
+	// previous ones failed, such as local resolvers falling back to public
+	// ones. Within a group, resolvers are tried in the order ResolverStrategy
+	// picks.
+	ResolverGroups [][]string
+	// ResolverStrategy is one of the ResolverStrategy constants, defaulting to
+	// ordered.
+	ResolverStrategy string
+	// ForwardProtocol is one of the ForwardProtocol constants, defaulting to UDP.
+	ForwardProtocol string
+	// MaxConcurrentForwards caps the queries forwarded at once, to spare the
+	// resolvers and the server's ephemeral ports. A query over the cap waits
+	// up to forwardSlotWait for another to finish, then gets SERVFAIL with a
+	// Not Ready Extended DNS Error. Zero means no cap.
+	MaxConcurrentForwards int
+	// HonorRD refuses to forward queries that don't set RD, whose clients
+	// asked for an iterative answer the server can't give for names it isn't
+	// authoritative for. They get REFUSED with a Not Authoritative Extended
+	// DNS Error. Zone and synthesized answers are still given.
+	HonorRD bool
+	// MaxAnswersPerResponse caps how many records of each name and type a
+	// response's answer section holds, sparing clients that struggle with
+	// hundreds of round-robin addresses. Zone address records rotate, so
+	// the ones returned change across queries. Zero means no cap.
+	MaxAnswersPerResponse int
+	// RefuseOpenResolver refuses queries that set RD for names the server has
+	// no answer of its own for when it doesn't forward, instead of answering
+	// them locally, so scanners probing with ". NS" and the like don't take it
+	// for an open resolver. They get REFUSED with a Prohibited Extended DNS
+	// Error. CatchAllIP answers are still given.
+	RefuseOpenResolver bool
+
+	// MaxNameLength and MaxLabels are policy limits on query names, stricter than
+	// the protocol's 255/63, used to block tunneling over DNS. Zero disables them.
+	MaxNameLength int
+	MaxLabels     int
+
+	TunnelDetection TunnelDetection
+
+	// FilterA and FilterAAAA strip A or AAAA records from responses, answering
+	// NODATA instead. They apply to clients in FilterSubnets, or to every client
+	// when no subnets are configured.
+	FilterA       bool
+	FilterAAAA    bool
+	FilterSubnets []string
+
+	// TarpitNames are names (and their subdomains) whose queries are held for
+	// TarpitDuration and then dropped without an answer, to slow abusers down
+	// without reflecting traffic at them.
+	TarpitNames    []string
+	TarpitDuration time.Duration
+
+	// Zone holds records answered authoritatively, ahead of forwarding. An empty
+	// zone is created when none is given, for TransferZoneFrom to fill.
+	Zone *Zone
+
+	// PipelineOrder reorders the stages resolving a query, named by the Stage
+	// constants: a query goes through the stages it lists in that order,
+	// then the others in their default order, zone, synthesizers, version,
+	// ptr-templates, special-names, as112, forward, catch-all, local, until
+	// one answers. Listing forward before zone, say, answers from the
+	// resolvers names the zone also holds.
+	PipelineOrder []string
+
+	// Views holds zones answering in place of Zone for the queries arriving
+	// over their transport, giving split-horizon answers by transport, say an
+	// internal view for DoH clients. Transports without a view use Zone, and
+	// TransferZoneFrom always fills Zone.
+	Views map[Transport]*Zone
+
+	// UDPBufferSize is the UDP payload size the server advertises in EDNS and
+	// the largest UDP response it sends, whatever larger size clients
+	// advertise. Bigger responses are truncated, setting TC for the client to
+	// retry over TCP, rather than sent as datagrams IP would fragment. It
+	// defaults to 1232 bytes, which fits the minimum IPv6 MTU.
+	UDPBufferSize int
+
+	// TCPIdleTimeout bounds how long a TCP client may take to send its next
+	// message, defaulting to 10 seconds.
+	TCPIdleTimeout time.Duration
+
+	// ExpectProxyProtocol reads the PROXY protocol header (version 1 or 2) a
+	// TCP load balancer sends ahead of each connection, taking the client
+	// address from it for policy, logging and dnstap. Connections that don't
+	// start with one are closed rather than read as DNS.
+	ExpectProxyProtocol bool
+
+	// DefaultTTL is the TTL of the answers the server makes up, for
+	// CatchAllIP, PTRTemplates and local answers, and of zone records loaded
+	// without one, replacing the built-in TTL of each. Zero keeps the
+	// built-in ones, and 3600 for zone records.
+	DefaultTTL uint32
+	// TTLByType overrides DefaultTTL for some record types, such as a short
+	// TTL for A records behind a load balancer and a long one for NS.
+	TTLByType map[uint16]uint32
+
+	// TTLJitter randomly lowers answer TTLs by up to this fraction (0 to 1), to
+	// spread out when clients' cached copies expire.
+	TTLJitter float64
+
+	// IncludeAuthority adds the zone's NS records and their glue addresses to
+	// positive authoritative A and AAAA answers. Responses are lean by default,
+	// since most clients have no use for them.
+	IncludeAuthority bool
+	// AdditionalHTTPS adds the zone's HTTPS records for the name of positive
+	// authoritative A and AAAA answers to their additional section, sparing
+	// clients that look both up a round trip.
+	AdditionalHTTPS bool
+	// PerClientRotation orders the zone's A and AAAA records by a hash of the
+	// client's address instead of by weighted round-robin, so each client
+	// always gets the same lead record, sparing clients that cache only the
+	// first one, while different clients still spread over all of them.
+	PerClientRotation bool
+
+	// HandleSpecialNames answers the special-use names of RFC 6761 locally:
+	// localhost and its reverse names resolve to loopback, and names under
+	// invalid, test and example get NXDOMAIN. Nil means enabled.
+	HandleSpecialNames *bool
+	// HandleAS112 answers the zones the AS112 project sinks locally, such as
+	// the reverse zones of 10.0.0.0/8 and 192.168.0.0/16, with their empty
+	// zone's SOA and NS records and NXDOMAIN for every other name, so reverse
+	// lookups of private addresses don't flood the resolver.
+	HandleAS112 bool
+
+	// ForceTCPForSubnets lists client subnets that are always answered over UDP
+	// with an empty truncated response, so they must retry over TCP where
+	// spoofed source addresses can't be used for amplification.
+	ForceTCPForSubnets []string
+
+	// CatchAllIP, when set, answers every name that isn't in the zone with this
+	// address instead of the local answers, as for a captive portal or a
+	// development wildcard. An IPv4 address answers A queries and an IPv6 one
+	// AAAA queries, any other type gets NODATA. Forwarding takes precedence.
+	CatchAllIP string
+
+	// NameRewrites maps query names, and their subdomains, onto the names
+	// actually looked up or forwarded, such as old.example.com to
+	// new.example.com. Responses carry the client's names again. Matching is
+	// case-insensitive and the most specific rule wins.
+	NameRewrites map[string]string
+
+	// ExposeExpvar publishes the server's counters in the "dnsserver" map of
+	// the standard expvar package, served by any expvar HTTP handler.
+	ExposeExpvar bool
+
+	// DnstapSocket is the Unix socket of a dnstap collector, and DnstapFile a
+	// file to append a dnstap stream to. Client queries and responses and the
+	// exchanges with the resolver are logged to either, off the query path.
+	DnstapSocket string
+	DnstapFile   string
+
+	// RequireTCPForANY refuses ANY queries arriving over UDP, where their large
+	// responses make them the favorite of amplification attacks.
+	RequireTCPForANY bool
+
+	// IDStrategy is one of the IDStrategy constants, defaulting to random. It
+	// picks the IDs of the queries the server sends, its own such as probes
+	// and zone transfers as well as forwarded ones: responses always echo the
+	// client's ID.
+	IDStrategy string
+
+	// ReuseBuffers recycles the buffers UDP queries and forwarded UDP
+	// responses are read into across queries, instead of allocating new ones
+	// for each. It matters most to forwarding servers, since every forwarded
+	// response is read into a 64 KiB buffer to fit the largest UDP payload.
+	ReuseBuffers bool
+
+	// TrackTopNames, when positive, counts queries by name for TopNames,
+	// keeping at most that many names.
+	TrackTopNames int
+
+	// MaxChainDepth bounds how many CNAME records a zone answer follows,
+	// defaulting to 16. Longer chains, and chains that loop, get SERVFAIL.
+	// DNAME records and referrals aren't followed, so the limit doesn't
+	// apply to them.
+	MaxChainDepth int
+
+	// StrictQueryValidation drops messages with the QR bit set and refuses
+	// queries with the AA bit set or carrying answers, instead of answering
+	// them. They are logged either way.
+	StrictQueryValidation bool
+
+	// MaxTCPConns caps the TCP connections served at once. Connections over
+	// the cap are closed as soon as they are accepted. Zero means no cap.
+	MaxTCPConns int
+
+	// MaxTCPAcceptRate caps how many TCP connections are accepted per second,
+	// allowing bursts of as many. Connections over the rate are closed as soon
+	// as they are accepted. Zero means no cap.
+	MaxTCPAcceptRate int
+
+	// AnswerDuplicateQuestions answers a question asked more than once in a
+	// message once for each time it is asked. By default repeats are dropped
+	// and the question is answered once.
+	AnswerDuplicateQuestions bool
+
+	// NormalizeTTL lowers the TTLs of every record in a forwarded response to
+	// the smallest among them, so everything learned from one response expires
+	// together rather than going stale piecemeal. It shapes what clients get,
+	// not what the server keeps: the cache holds the resolver's own TTLs, and
+	// responses from the cache are normalized as they are sent, once their
+	// TTLs have counted down.
+	NormalizeTTL bool
+
+	// CacheSize, when positive, caches up to that many forwarded responses,
+	// answering the same question from the cache until the lowest TTL among
+	// their records runs out. Answers and NXDOMAIN are cached.
+	CacheSize int
+	// AdaptiveCacheTTL keeps cached responses that answer many queries past
+	// their records' TTL, a tenth of it at a time for as long as they stay
+	// that popular, up to MaxTTL after they were fetched, defaulting to an
+	// hour. Their records are served with the TTL left to the extension.
+	AdaptiveCacheTTL bool
+	MaxTTL           time.Duration
+	// PrewarmNames are the names whose A and AAAA records Prewarm caches.
+	PrewarmNames []string
+
+	// StaleIfError keeps the last answer forwarded for each question and,
+	// when the resolver later fails to answer it, serves that instead of
+	// SERVFAIL for up to MaxStaleTTL past its expiry (RFC 8767), defaulting
+	// to one day. Stale records carry a 30 second TTL and a stale answer
+	// Extended DNS Error. Fresh answers are always tried first.
+	StaleIfError bool
+	MaxStaleTTL  time.Duration
+
+	// AggressiveNSEC keeps the NSEC records of forwarded NXDOMAIN responses
+	// and answers NXDOMAIN for other names they prove don't exist, wildcard
+	// included, without forwarding (RFC 8198). The server doesn't validate
+	// DNSSEC, so only responses the resolver validated, setting the AD bit,
+	// are used. NSEC3 records aren't.
+	AggressiveNSEC bool
+
+	// CacheBypassSubnets lists client subnets whose queries are always
+	// forwarded, never answered from the cache nor the records StaleIfError
+	// and AggressiveNSEC keep, to tell whether a problem comes from those.
+	// Their responses are still kept unless CacheBypassNoStore is set.
+	CacheBypassSubnets []string
+	CacheBypassNoStore bool
+
+	// PTRTemplates generate the PTR records of whole subnets, for reverse
+	// lookups the zone has no records for. The first template whose subnet
+	// holds the address wins.
+	PTRTemplates []PTRTemplate
+
+	// NSID identifies the server, such as one node of an anycast fleet, to
+	// clients asking for it with the EDNS NSID option (RFC 5001).
+	NSID string
+	// EnableTimeOption answers clients sending the private
+	// EDNS_OPTION_SERVER_TIME option with the server's clock, to debug
+	// clock skew. It is off by default since the option isn't standard.
+	EnableTimeOption bool
+
+	// VersionTXTName, when set, answers IN-class TXT queries for that name
+	// with the server's version and commit, for fleet inventory with tools
+	// that don't ask CHAOS-class version.bind.
+	VersionTXTName string
+
+	// SlowQueryThreshold, when positive, logs every query whose handling
+	// takes longer at warn level, whatever level the other query logs are
+	// at, with its name, type, client, the resolver it went to and the time
+	// spent on the resolvers and locally.
+	SlowQueryThreshold time.Duration
+
+	// RecentBufferSize, when positive, keeps that many of the last answered
+	// queries in memory for RecentQueries, for live debugging without logs.
+	RecentBufferSize int
 }
 
+// Server answers DNS queries. Its options are an immutable snapshot: each
+// query runs against the snapshot current when it arrived, and UpdateOptions
+// swaps in a new one for later queries. Everything stateful lives in the
+// serverState all snapshots share.
 type Server struct {
-	opts Options
+	opts          Options
+	filterSubnets []*net.IPNet
+	forceTCP      []*net.IPNet
+	cacheBypass   []*net.IPNet
+	catchAllIP    net.IP
+	rewrites      []nameRewrite
+	ptrTemplates  []ptrTemplate
+	udpSize       int
+	views         map[Transport]*Server
+	pipeline      []stage
+	// frozen marks a snapshot, as opposed to the Server NewServer returns.
+	frozen bool
+	*serverState
+}
+
+// serverState holds what outlives an options update: counters, caches,
+// outputs and the current options snapshot.
+type serverState struct {
+	latest        atomic.Pointer[Server]
+	clock         func() time.Time
+	tunnels       *tunnelDetector
+	tarpitted     atomic.Int64
+	upstreamReady atomic.Bool
+	metrics       metrics
+	dnstap        *dnstapLogger
+	lastID        atomic.Uint32
+	buffers       *bufferPool
+	topNames      *topNames
+	recent        *recentQueries
+	synthMu       sync.RWMutex
+	synthesizers  map[uint16]Synthesizer
+	cache         *responseCache
+	forwardSlots  chan struct{}
+	udpSlots      chan struct{}
+	stale         *staleStore
+	nsec          *nsecCache
+	health        resolverHealth
+	maintenance   atomic.Pointer[maintenanceMode]
 }
 
 func NewServer(opts Options) *Server {
-	return &Server{opts: opts}
+	if opts.Zone == nil {
+		opts.Zone = NewZone()
+	}
+	state := &serverState{
+		tunnels:  newTunnelDetector(opts.TunnelDetection),
+		topNames: newTopNames(opts.TrackTopNames),
+		recent:   newRecentQueries(opts.RecentBufferSize),
+		cache:    newResponseCache(opts.CacheSize, adaptiveMaxTTL(opts)),
+		stale:    newStaleStore(opts.StaleIfError, opts.MaxStaleTTL),
+		nsec:     newNSECCache(opts.AggressiveNSEC),
+		udpSlots: make(chan struct{}, maxUDPQueries),
+	}
+	if opts.MaxConcurrentForwards > 0 {
+		state.forwardSlots = make(chan struct{}, opts.MaxConcurrentForwards)
+	}
+	snapshot := newSnapshot(opts, state)
+	state.latest.Store(snapshot)
+	s := *snapshot
+	s.frozen = false
+
+	if opts.ReuseBuffers {
+		s.buffers = &bufferPool{}
+	}
+	if opts.ExposeExpvar {
+		s.publishExpvar()
+	}
+	if err := s.openDnstap(); err != nil {
+		slog.Error("Error opening dnstap output, dnstap disabled", "error", err)
+	}
+	return &s
+}
+
+// newSnapshot builds the options snapshot of opts sharing state.
+func newSnapshot(opts Options, state *serverState) *Server {
+	normalizeResolvers(&opts)
+	snapshot := &Server{
+		opts:          opts,
+		filterSubnets: parseSubnets(opts.FilterSubnets),
+		forceTCP:      parseSubnets(opts.ForceTCPForSubnets),
+		cacheBypass:   parseSubnets(opts.CacheBypassSubnets),
+		catchAllIP:    net.ParseIP(opts.CatchAllIP),
+		rewrites:      parseNameRewrites(opts.NameRewrites),
+		ptrTemplates:  parsePTRTemplates(opts.PTRTemplates),
+		udpSize:       udpPayloadSize(opts),
+		pipeline:      parsePipeline(opts.PipelineOrder),
+		frozen:        true,
+		serverState:   state,
+	}
+	snapshot.views = zoneViews(snapshot)
+	return snapshot
+}
+
+// UpdateOptions replaces the server's options for the queries that arrive
+// from now on. Queries in flight finish with the options they started with,
+// so none sees some old options and some new ones. A nil Zone keeps the
+// current zone. The options that set up the server's machinery keep the
+// values NewServer got: TunnelDetection, ExposeExpvar, DnstapSocket,
+// DnstapFile, ReuseBuffers, TrackTopNames, RecentBufferSize, CacheSize,
+// AdaptiveCacheTTL, MaxTTL, StaleIfError, MaxStaleTTL, AggressiveNSEC and
+// MaxConcurrentForwards. TCP listeners read MaxTCPConns and MaxTCPAcceptRate when
+// they start, and connections their idle timeout when they are accepted.
+func (s *Server) UpdateOptions(opts Options) {
+	if opts.Zone == nil {
+		opts.Zone = s.snapshot().opts.Zone
+	}
+	s.latest.Store(newSnapshot(opts, s.serverState))
+}
+
+// snapshot returns the options snapshot a query should run against: the
+// current one, or s itself when s already is a snapshot.
+func (s *Server) snapshot() *Server {
+	if s.frozen {
+		return s
+	}
+	return s.latest.Load()
+}
+
+func (s *Server) openDnstap() error {
+	var err error
+	switch {
+	case s.opts.DnstapSocket != "":
+		s.dnstap, err = newDnstapSocketLogger(s.opts.DnstapSocket)
+	case s.opts.DnstapFile != "":
+		s.dnstap, err = newDnstapFileLogger(s.opts.DnstapFile)
+	}
+	return err
+}
+
+// nextID returns a non-zero ID for a message the server originates.
+func (s *Server) nextID() uint16 {
+	if s.opts.IDStrategy == IDStrategyMonotonic {
+		for {
+			if id := uint16(s.lastID.Add(1)); id != 0 {
+				return id
+			}
+		}
+	}
+	return randomID()
+}
+
+// Close releases the server's outputs, flushing pending dnstap messages.
+// It should be called once the listeners have returned.
+func (s *Server) Close() error {
+	return s.dnstap.close()
+}
+
+// now returns the current time from the server's clock, which tests can replace.
+func (s *Server) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
 }
 
 func (s *Server) shouldForwardQuery() bool {
-	return s.opts.Resolver != ""
+	return len(s.resolvers()) > 0
+}
+
+func (s *Server) forwardProtocol() string {
+	if s.opts.ForwardProtocol == "" {
+		return ForwardProtocolUDP
+	}
+	return s.opts.ForwardProtocol
 }
 
 func (s *Server) ListenAndServe(ctx context.Context, conn net.PacketConn) {
 	defer conn.Close()
 
-	if s.shouldForwardQuery() {
-		slog.Info("Forwarding requests to resolver", "resolver", s.opts.Resolver)
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+
+	if cfg := s.snapshot(); cfg.shouldForwardQuery() {
+		slog.Info("Forwarding requests to resolvers", "resolvers", cfg.resolvers(), "protocol", s.forwardProtocol())
 	}
 
-	buf := make([]byte, 1024)
+	buf := s.buffers.get()
 	for {
 		select {
 		case <-ctx.Done():
@@ -38,7 +585,7 @@ func (s *Server) ListenAndServe(ctx context.Context, conn net.PacketConn) {
 			return
 		default:
 			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-			n, addr, err := conn.ReadFrom(buf)
+			n, addr, err := conn.ReadFrom(*buf)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
@@ -47,68 +594,447 @@ func (s *Server) ListenAndServe(ctx context.Context, conn net.PacketConn) {
 				return
 			}
 
-			slog.Debug("Received request", "n", n, "addr", addr, "buf", buf[:n])
-
-			if s.shouldForwardQuery() {
-				s.handleForwardedQuery(conn, addr, buf[:n])
-			} else {
-				s.handleLocalQuery(conn, addr, buf[:n])
+			queryCtx := withQueryID(ctx)
+			logger(queryCtx).Debug("Received request", "n", n, "addr", addr, "buf", (*buf)[:n])
+			s.metrics.querySize("udp").observe(n)
+			// The buffer now belongs to the query and is released once its
+			// response has been written. The next datagram gets another one.
+			lease := newBufferLease(s.buffers, buf)
+			queryBytes := (*buf)[:n]
+			// The OS silently cuts datagrams down to the buffer, so one that
+			// fills it was most likely bigger.
+			handle := s.handleUDPQuery
+			if n == len(*buf) {
+				handle = s.handleTruncatedUDPQuery
 			}
+			select {
+			case s.udpSlots <- struct{}{}:
+			case <-ctx.Done():
+				lease.release()
+				slog.Info("Received interrupt signal, shutting down...")
+				return
+			}
+			buf = s.buffers.get()
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				defer func() { <-s.udpSlots }()
+				defer lease.release()
+				handle(withBufferLease(queryCtx, lease), conn, addr, queryBytes)
+			}()
 		}
 	}
 }
 
-func (s *Server) handleLocalQuery(conn net.PacketConn, addr net.Addr, queryBytes []byte) {
-	msg, err := NewMessageFromBytes(queryBytes)
-	if err != nil {
-		slog.Error("Error parsing message", "error", err)
-		return
+func (s *Server) handleUDPQuery(ctx context.Context, conn net.PacketConn, addr net.Addr, queryBytes []byte) {
+	s = s.snapshot()
+	s.dnstap.log(dnstapClientQuery, dnstapUDP, addr, conn.LocalAddr(), queryBytes)
+	clientIP := addrIP(addr)
+	handle := s.handleQuery
+	if subnetsContain(s.forceTCP, clientIP) {
+		handle = s.handleForcedTCPQuery
 	}
 
-	msg.ProcessQuestions()
-	msgBytes, err := msg.MarshalBinary()
+	responseBytes, err := handle(ctx, queryBytes, clientIP, TransportUDP, s.udpSize)
 	if err != nil {
-		slog.Error("Error marshalling message", "error", err)
 		return
 	}
+	s.writeUDPResponse(ctx, conn, addr, responseBytes)
+}
 
-	slog.Debug("Sending response", "msg", msg, "msgBytes", msgBytes)
-	conn.WriteTo(msgBytes, addr)
+// writeUDPResponse sends a response to addr. A client that went away, such as
+// one an earlier response got ICMP unreachable for, makes the write fail;
+// that only costs this response, so it is counted and logged at debug.
+func (s *Server) writeUDPResponse(ctx context.Context, conn net.PacketConn, addr net.Addr, responseBytes []byte) {
+	if _, err := conn.WriteTo(responseBytes, addr); err != nil {
+		s.metrics.writeFailed.Add(1)
+		logger(ctx).Debug("Error writing response", "error", err, "client", addr)
+		return
+	}
+	s.dnstap.log(dnstapClientResponse, dnstapUDP, addr, conn.LocalAddr(), responseBytes)
+	s.metrics.responses.Add(1)
+	s.metrics.responseSize("udp").observe(len(responseBytes))
 }
 
-func (s *Server) handleForwardedQuery(conn net.PacketConn, addr net.Addr, queryBytes []byte) {
-	responseBytes, err := s.forwardQuery(queryBytes)
+// handleTruncatedUDPQuery answers a datagram that filled the whole read
+// buffer, and so was probably cut short, with an empty response with the TC
+// bit set, instead of failing to parse the rest of it. The client retries
+// over TCP, where the query arrives whole.
+func (s *Server) handleTruncatedUDPQuery(ctx context.Context, conn net.PacketConn, addr net.Addr, queryBytes []byte) {
+	logger(ctx).Warn("Oversized datagram truncated, asking the client to retry over TCP", "size", len(queryBytes), "client", addr)
+	s.metrics.malformed.Add(1)
+	header, err := NewHeaderFromBytes(queryBytes)
+	if err != nil || !header.IsQuery() {
+		return
+	}
+
+	// Only the opcode and RD bits carry over from the query.
+	msg := Message{Header: Header{ID: header.ID, Flags: header.Flags & 0x7900}}
+	if header.QuestionsCount > 0 {
+		if question, _, err := readQuestion(queryBytes, 12); err == nil {
+			msg.Questions = []Question{question}
+			msg.Header.QuestionsCount = 1
+		}
+	}
+	msg.Header.SetQuery(false)
+	msg.Header.SetTruncated(true)
+
+	responseBytes, err := marshalResponse(ctx, msg, maxUDPMessageSize)
 	if err != nil {
-		slog.Error("Error forwarding query, continuing with local processing", "error", err, "resolver", s.opts.Resolver)
-		s.handleForwardingError(conn, addr, queryBytes)
 		return
 	}
-	slog.Debug("Sending response that was forwarded", "responseBytes", responseBytes)
-	conn.WriteTo(responseBytes, addr)
+	s.writeUDPResponse(ctx, conn, addr, responseBytes)
 }
 
-func (s *Server) handleForwardingError(conn net.PacketConn, addr net.Addr, queryBytes []byte) {
+// handleForcedTCPQuery answers a UDP query from a ForceTCPForSubnets client
+// with no records and the TC bit set, whatever the response would have been.
+func (s *Server) handleForcedTCPQuery(ctx context.Context, queryBytes []byte, clientIP net.IP, transport Transport, maxSize int) ([]byte, error) {
 	msg, err := NewMessageFromBytes(queryBytes)
 	if err != nil {
-		slog.Error("Error parsing message", "error", err)
-		return
+		logger(ctx).Error("Error parsing message", "error", err)
+		return nil, err
 	}
 
-	msg.Header.SetResponseCode(RCODE_SERVER_FAILURE)
-	msg.Header.SetQuery(false)
-	msg.Header.AdditionalCount = 0
-	raw, err := msg.MarshalBinary()
+	logger(ctx).Debug("Forcing client to retry over TCP", "client", clientIP)
+	msg.SetError(RCODE_NO_ERROR, nil)
+	msg.Header.SetTruncated(true)
+	return marshalResponse(ctx, msg, maxSize)
+}
+
+// handleQuery builds the response to queryBytes for any transport, which is
+// passed along for the policy checks.
+// The response is always built in full and only truncated to maxSize when encoded,
+// so a client retrying over TCP after a truncated UDP answer gets every record.
+// Over UDP, maxSize is further limited to the size the client advertises.
+func (s *Server) handleQuery(ctx context.Context, queryBytes []byte, clientIP net.IP, transport Transport, maxSize int) ([]byte, error) {
+	s = s.snapshot()
+	query, err := NewMessageFromBytes(queryBytes)
 	if err != nil {
-		slog.Error("Error marshalling message", "error", err)
-		return
+		s.metrics.malformed.Add(1)
+		logger(ctx).Error("Error parsing message", "error", err)
+		return nil, err
+	}
+	s.metrics.queries.Add(1)
+	if transport == TransportUDP {
+		maxSize = min(maxSize, clientUDPSize(query))
+	}
+	var timing *queryTiming
+	start := s.now()
+	if s.opts.SlowQueryThreshold > 0 {
+		ctx, timing = withQueryTiming(ctx)
+	}
+
+	responseBytes, err := s.answerQuery(ctx, query, queryBytes, clientIP, transport, maxSize)
+	if options := s.serverOptions(query); err == nil && len(options) > 0 {
+		responseBytes, err = addOptions(ctx, responseBytes, maxSize, options)
+	}
+	if err == nil && s.udpSize != ednsUDPSize {
+		responseBytes, err = advertiseUDPSize(ctx, responseBytes, s.udpSize, maxSize)
+	}
+	if err == nil {
+		s.recordRecent(query, clientIP, responseBytes)
+	}
+	if timing != nil {
+		s.logSlowQuery(ctx, query, clientIP, transport, responseBytes, s.now().Sub(start), timing)
+	}
+	return responseBytes, err
+}
+
+// answerQuery runs a parsed query through the policy checks and on to resolveQuery.
+func (s *Server) answerQuery(ctx context.Context, query Message, queryBytes []byte, clientIP net.IP, transport Transport, maxSize int) ([]byte, error) {
+	if responseBytes, ok, err := s.handleMaintenanceQuery(ctx, query, maxSize); ok {
+		return responseBytes, err
+	}
+	var err error
+	if !s.opts.AnswerDuplicateQuestions && dedupeQuestions(&query) {
+		// Forwarding relays the query's bytes, so they must lose the repeats too.
+		if queryBytes, err = query.MarshalBinary(); err != nil {
+			return nil, err
+		}
+	}
+	for _, question := range query.Questions {
+		s.topNames.record(question.Name)
+	}
+
+	drop, refuse := s.checkQueryHeader(ctx, query, clientIP)
+	if drop {
+		s.metrics.dropped.Add(1)
+		return nil, errQueryDropped
+	}
+	if refuse {
+		s.metrics.refused.Add(1)
+		query.Header.SetAuthoritative(false)
+		query.SetError(RCODE_REFUSED, nil)
+		return marshalResponse(ctx, query, maxSize)
+	}
+
+	if s.shouldTarpit(query) {
+		s.metrics.dropped.Add(1)
+		s.tarpit(ctx, query, clientIP)
+		return nil, errQueryDropped
+	}
+
+	if ede, refused := s.checkQueryPolicy(ctx, query, transport); refused {
+		s.metrics.refused.Add(1)
+		query.SetError(RCODE_REFUSED, ede)
+		return marshalResponse(ctx, query, maxSize)
+	}
+
+	s = s.view(transport)
+	original := append([]Question{}, query.Questions...)
+	if rules := s.rewriteQuestions(&query); len(rules) > 0 {
+		return s.handleRewrittenQuery(ctx, query, original, rules, clientIP, maxSize)
+	}
+	return s.resolveQuery(ctx, query, queryBytes, clientIP, maxSize)
+}
+
+// dedupeQuestions drops the questions that repeat an earlier one, comparing
+// names case-insensitively, and reports whether there were any.
+func dedupeQuestions(query *Message) bool {
+	unique := make([]Question, 0, len(query.Questions))
+	for _, question := range query.Questions {
+		if !slices.ContainsFunc(unique, func(q Question) bool {
+			return q.Type == question.Type && q.Class == question.Class && zoneKey(q.Name) == zoneKey(question.Name)
+		}) {
+			unique = append(unique, question)
+		}
+	}
+	if len(unique) == len(query.Questions) {
+		return false
+	}
+	query.Questions = unique
+	query.Header.QuestionsCount = uint16(len(unique))
+	return true
+}
+
+// resolveQuery answers a query that passed the policy checks, from the first
+// stage of the pipeline that has an answer for it.
+func (s *Server) resolveQuery(ctx context.Context, query Message, queryBytes []byte, clientIP net.IP, maxSize int) ([]byte, error) {
+	if len(query.Questions) > 0 && query.Questions[0].Class == CLASS_CH {
+		return s.handleChaosQuery(ctx, query, maxSize)
+	}
+	for _, stage := range s.pipeline {
+		if responseBytes, ok, err := stage(s, ctx, query, queryBytes, clientIP, maxSize); ok {
+			return responseBytes, err
+		}
+	}
+	// Every pipeline ends up with the local stage, which always answers.
+	return s.handleLocalQuery(ctx, query, clientIP, maxSize)
+}
+
+// typeTTL returns the TTL of answers of rtype the server makes up: TTLByType's
+// for the type, else DefaultTTL, else fallback, the answer's own default.
+func (s *Server) typeTTL(rtype uint16, fallback uint32) uint32 {
+	if ttl, ok := s.opts.TTLByType[rtype]; ok {
+		return ttl
+	}
+	if s.opts.DefaultTTL > 0 {
+		return s.opts.DefaultTTL
+	}
+	return fallback
+}
+
+// zoneTTL is the inheritedTTL of zone records loaded without a TTL.
+func (s *Server) zoneTTL(rtype uint16) uint32 {
+	return s.typeTTL(rtype, defaultZoneTTL)
+}
+
+func (s *Server) handleLocalQuery(ctx context.Context, msg Message, clientIP net.IP, maxSize int) ([]byte, error) {
+	msg.ProcessQuestions()
+	for i := range msg.Answers {
+		msg.Answers[i].TTL = s.typeTTL(msg.Answers[i].Type, msg.Answers[i].TTL)
+	}
+	s.filterAddresses(ctx, &msg, clientIP)
+	s.jitterTTLs(&msg)
+	return marshalResponse(ctx, msg, maxSize)
+}
+
+// handleCatchAllQuery answers every question with CatchAllIP.
+func (s *Server) handleCatchAllQuery(ctx context.Context, msg Message, clientIP net.IP, maxSize int) ([]byte, error) {
+	answers := make([]Answer, 0)
+	for _, question := range msg.Questions {
+		var answer Answer
+		switch {
+		case question.Type == TYPE_A && s.catchAllIP.To4() != nil:
+			answer = NewAAnswer(question.Name, s.catchAllIP, s.typeTTL(TYPE_A, catchAllTTL))
+		case question.Type == TYPE_AAAA && s.catchAllIP.To4() == nil:
+			answer = NewAAAAAnswer(question.Name, s.catchAllIP, s.typeTTL(TYPE_AAAA, catchAllTTL))
+		default:
+			continue
+		}
+		answers = append(answers, answer)
+	}
+
+	msg.AddAnswers(answers)
+	msg.SetResponse(len(answers))
+	s.filterAddresses(ctx, &msg, clientIP)
+	s.jitterTTLs(&msg)
+	return marshalResponse(ctx, msg, maxSize)
+}
+
+func (s *Server) handleForwardedQuery(ctx context.Context, query Message, queryBytes []byte, clientIP net.IP, maxSize int) ([]byte, error) {
+	if len(query.Questions) > 1 {
+		return s.handleSplitForwardedQuery(ctx, query, clientIP, maxSize)
+	}
+
+	bypass := subnetsContain(s.cacheBypass, clientIP)
+	if bypass {
+		logger(ctx).Debug("Bypassing cached records for client", "client", clientIP)
+	} else if responseBytes, ok, err := s.handleCachedQuery(ctx, query, clientIP, maxSize); ok {
+		return responseBytes, err
+	} else if responseBytes, ok, err := s.handleAggressiveNSECQuery(ctx, query, maxSize); ok {
+		return responseBytes, err
+	}
+
+	s.metrics.forwarded.Add(1)
+	responseBytes, resolver, err := s.forwardQuery(ctx, queryBytes, maxSize)
+	if err != nil {
+		s.metrics.forwardErrors.Add(1)
+		logger(ctx).Error("Error forwarding query, continuing with local processing", "error", err, "resolvers", s.resolvers())
+		return s.handleForwardingError(ctx, query, err, clientIP, maxSize, bypass)
+	}
+	s.upstreamReady.Store(true)
+
+	response, err := NewMessageFromBytes(responseBytes)
+	if err != nil {
+		logger(ctx).Error("Error parsing forwarded response", "error", err, "resolver", resolver)
+		return s.handleForwardingError(ctx, query, err, clientIP, maxSize, bypass)
+	}
+	if !bypass || !s.opts.CacheBypassNoStore {
+		s.cache.store(response, s.now())
+		s.stale.store(response, s.now())
+		s.nsec.store(response, s.now())
+	}
+
+	// The upstream's bytes are relayed untouched unless the server has to adjust the response.
+	changed := s.filterAddresses(ctx, &response, clientIP)
+	changed = s.capAnswers(ctx, &response) || changed
+	changed = relayOPT(&response) || changed
+	changed = s.normalizeTTLs(&response) || changed
+	changed = s.jitterTTLs(&response) || changed
+	// Whatever the upstream sent, a UDP client must not get more than it
+	// advertised: re-encoding truncates the response and sets TC.
+	if changed || len(responseBytes) > maxSize {
+		return marshalResponse(ctx, response, maxSize)
+	}
+
+	logger(ctx).Debug("Sending response that was forwarded", "responseBytes", responseBytes)
+	return responseBytes, nil
+}
+
+// handleSplitForwardedQuery forwards each question of a multi-question query
+// in parallel as a query of its own, since resolvers only answer the first
+// question of a message, and merges the answers into one response. The response takes
+// the first question's rcode, or SERVFAIL when any of the questions failed.
+func (s *Server) handleSplitForwardedQuery(ctx context.Context, query Message, clientIP net.IP, maxSize int) ([]byte, error) {
+	logger(ctx).Debug("Splitting multi-question query to forward", "questions", len(query.Questions))
+
+	parts := make([]Message, len(query.Questions))
+	errs := make([]error, len(query.Questions))
+	var wg sync.WaitGroup
+	for i, question := range query.Questions {
+		// The parts read their responses at once, so each gets a lease of its
+		// own, held until the merged response is encoded.
+		partCtx := ctx
+		if lease := bufferLeaseFrom(ctx); lease != nil {
+			partLease := newBufferLease(lease.pool, nil)
+			defer partLease.release()
+			partCtx = withBufferLease(ctx, partLease)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			single := query
+			single.Questions = []Question{question}
+			single.Header.QuestionsCount = 1
+			singleBytes, err := single.MarshalBinary()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			// Parts are taken whole; the merged response is truncated to maxSize.
+			responseBytes, err := s.handleForwardedQuery(partCtx, single, singleBytes, clientIP, maxTCPMessageSize)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			parts[i], errs[i] = NewMessageFromBytes(responseBytes)
+		}()
+	}
+	wg.Wait()
+
+	rcode, authentic := RCODE_NO_ERROR, true
+	var answers, authorities []Answer
+	for i, part := range parts {
+		authentic = authentic && errs[i] == nil && part.Header.AuthenticData()
+		switch {
+		case errs[i] != nil:
+			logger(ctx).Error("Error forwarding split question", "error", errs[i], "name", query.Questions[i].Name)
+			rcode = RCODE_SERVER_FAILURE
+			continue
+		case part.Header.ResponseCode() == RCODE_SERVER_FAILURE:
+			rcode = RCODE_SERVER_FAILURE
+		case i == 0:
+			rcode = part.Header.ResponseCode()
+		}
+		answers = append(answers, part.Answers...)
+		authorities = append(authorities, part.Authorities...)
 	}
 
-	slog.Debug("Sending response that was forwarded", "responseBytes", raw)
-	conn.WriteTo(raw, addr)
+	query.SetError(rcode, nil)
+	// The merged response is only authentic if the resolver validated every part.
+	query.Header.SetAuthenticData(authentic)
+	query.Answers = answers
+	query.Authorities = authorities
+	query.Header.AnswerCount = uint16(len(answers))
+	query.Header.AuthorityCount = uint16(len(authorities))
+	return marshalResponse(ctx, query, maxSize)
 }
 
-func (s *Server) forwardQuery(queryBytes []byte) ([]byte, error) {
-	conn, err := net.Dial("udp", s.opts.Resolver)
+// handleForwardingError answers a query the resolver failed to answer with
+// err, with stale records when StaleIfError has some and SERVFAIL otherwise.
+// Clients bypassing the cached records always get SERVFAIL.
+func (s *Server) handleForwardingError(ctx context.Context, msg Message, err error, clientIP net.IP, maxSize int, bypass bool) ([]byte, error) {
+	if !bypass {
+		if responseBytes, ok, err := s.handleStaleQuery(ctx, msg, clientIP, maxSize); ok {
+			return responseBytes, err
+		}
+	}
+	msg.SetError(RCODE_SERVER_FAILURE, forwardingErrorEDE(err))
+	return marshalResponse(ctx, msg, maxSize)
+}
+
+// forwardingErrorEDE explains a SERVFAIL caused by err, telling clients the
+// failure is transient: Not Ready when the server forwards too much already
+// or, with how long until the resolvers are tried again, when they were all
+// marked down already, Network Error otherwise.
+func forwardingErrorEDE(err error) *ExtendedError {
+	if errors.Is(err, errForwardLimit) {
+		return &ExtendedError{Code: EDE_NOT_READY, Text: err.Error()}
+	}
+	var open *circuitOpenError
+	if errors.As(err, &open) {
+		return &ExtendedError{
+			Code: EDE_NOT_READY,
+			Text: fmt.Sprintf("resolvers unavailable, retry after %ds", int(open.retryAfter.Round(time.Second)/time.Second)),
+		}
+	}
+	return &ExtendedError{Code: EDE_NETWORK_ERROR}
+}
+
+func marshalResponse(ctx context.Context, msg Message, maxSize int) ([]byte, error) {
+	msgBytes, err := msg.MarshalTruncated(maxSize)
+	if err != nil {
+		logger(ctx).Error("Error marshalling message", "error", err)
+		return nil, err
+	}
+
+	logger(ctx).Debug("Sending response", "msg", msg, "msgBytes", msgBytes)
+	return msgBytes, nil
+}
+
+func (s *Server) forwardQueryUDP(ctx context.Context, resolver string, queryBytes []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", resolver)
 	if err != nil {
 		return nil, err
 	}
@@ -116,15 +1042,87 @@ func (s *Server) forwardQuery(queryBytes []byte) ([]byte, error) {
 
 	conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
 	_, err = conn.Write(queryBytes)
+	if isTransientWriteError(err) {
+		logger(ctx).Debug("Retrying forwarded query write", "error", err, "resolver", resolver)
+		_, err = conn.Write(queryBytes)
+	}
 	if err != nil {
 		return nil, err
 	}
+	s.dnstap.log(dnstapForwarderQuery, dnstapUDP, conn.LocalAddr(), conn.RemoteAddr(), queryBytes)
 
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+	// Keep reading until the deadline for a datagram that answers this query,
+	// so a stale response to an earlier query or a spoofed packet can't take
+	// the place of the real answer.
+	buf := bufferLeaseFrom(ctx).get()
+	for {
+		n, err := conn.Read(buf)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("%w: %w", errResolverRefused, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isResponseTo(queryBytes, buf[:n]) {
+			s.dnstap.log(dnstapForwarderResponse, dnstapUDP, conn.LocalAddr(), conn.RemoteAddr(), buf[:n])
+			// The OS silently cuts datagrams down to the buffer, so one that
+			// fills it was most likely bigger.
+			if n == len(buf) {
+				return nil, errForwardedTruncated
+			}
+			return buf[:n], nil
+		}
+		logger(ctx).Debug("Discarding forwarded response that doesn't match the query", "resolver", resolver, "n", n)
+	}
+}
+
+// isTransientWriteError reports whether a failed write is worth one more try:
+// the socket's buffers were briefly full or the call was interrupted, unlike
+// an unreachable resolver, which the next resolver is better placed to handle.
+func isTransientWriteError(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR)
+}
+
+// isResponseTo reports whether responseBytes is a response to queryBytes: it
+// has the QR bit, the query's ID and the exact same first question, letter
+// case included.
+func isResponseTo(queryBytes, responseBytes []byte) bool {
+	query, err := NewHeaderFromBytes(queryBytes)
 	if err != nil {
-		return nil, err
+		return false
+	}
+	response, err := NewHeaderFromBytes(responseBytes)
+	if err != nil || response.ID != query.ID || response.IsQuery() {
+		return false
+	}
+	if query.QuestionsCount == 0 {
+		return true
+	}
+	if response.QuestionsCount == 0 {
+		return false
+	}
+
+	want, _, err := readQuestion(queryBytes, 12)
+	if err != nil {
+		return false
 	}
+	got, _, err := readQuestion(responseBytes, 12)
+	return err == nil && got == want
+}
 
-	return buf[:n], nil
+// setMessageID overwrites the ID of a raw DNS message in place, sparing a
+// decode and re-encode. Messages too short for a header are left alone.
+func setMessageID(msgBytes []byte, id uint16) {
+	if len(msgBytes) >= 12 {
+		binary.BigEndian.PutUint16(msgBytes, id)
+	}
+}
+
+// isTruncated reports whether the TC bit is set in a raw DNS message.
+func isTruncated(msgBytes []byte) bool {
+	h, err := NewHeaderFromBytes(msgBytes)
+	if err != nil {
+		return false
+	}
+	return h.Truncated()
 }
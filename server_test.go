@@ -2,7 +2,13 @@ package dnsserver
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -29,81 +35,139 @@ func TestShouldForwardQuery(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			server := &Server{opts: Options{Resolver: tt.resolver}}
+			server := NewServer(Options{Resolver: tt.resolver})
 			result := server.shouldForwardQuery()
 			assert.Equal(t, tt.expected, result)
 		})
 	}
 }
 
-func TestHandleLocalQuery(t *testing.T) {
-	server := &Server{opts: Options{}}
+func TestHandleUDPQuery(t *testing.T) {
+	server := NewServer(Options{})
 
 	conn := &mockPacketConn{}
 	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
 
 	queryBytes := createTestQuery()
 
-	server.handleLocalQuery(conn, addr, queryBytes)
+	server.handleUDPQuery(context.Background(), conn, addr, queryBytes)
 
-	assert.NotEmpty(t, conn.writtenData)
+	responses := parseWritten(t, conn)
+	require.Len(t, responses, 1)
+	assert.False(t, responses[0].Header.IsQuery())
+	assert.Equal(t, uint16(12345), responses[0].Header.ID)
+	require.Len(t, responses[0].Answers, 1)
+	assert.Equal(t, []byte{8, 8, 8, 8}, responses[0].Answers[0].Data)
 	require.NotEmpty(t, conn.writtenAddr)
 	assert.Equal(t, addr, conn.writtenAddr[0])
 }
 
-func TestHandleLocalQueryWithInvalidMessage(t *testing.T) {
-	server := &Server{opts: Options{}}
+func TestHandleUDPQueryWithInvalidMessage(t *testing.T) {
+	server := NewServer(Options{})
 
 	conn := &mockPacketConn{}
 	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
 
 	invalidQuery := []byte{0, 0, 0, 0}
 
-	server.handleLocalQuery(conn, addr, invalidQuery)
+	server.handleUDPQuery(context.Background(), conn, addr, invalidQuery)
 
 	assert.Empty(t, conn.writtenData)
 }
 
-func TestHandleForwardedQuery(t *testing.T) {
-	server := &Server{opts: Options{Resolver: "127.0.0.1:53535"}}
+func TestHandleUDPQueryWriteFailure(t *testing.T) {
+	logs := captureLogs(t)
+	server := NewServer(Options{})
 
-	conn := &mockPacketConn{}
+	conn := &mockPacketConn{writeError: &net.OpError{Op: "write", Net: "udp", Err: syscall.ECONNREFUSED}}
 	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
 
+	server.handleUDPQuery(context.Background(), conn, addr, createTestQuery())
+
+	assert.Equal(t, uint64(1), server.metrics.writeFailed.Load())
+	assert.Equal(t, uint64(0), server.metrics.responses.Load())
+	var logged bool
+	for _, line := range logs.lines(t) {
+		if line["msg"] == "Error writing response" {
+			logged = true
+			assert.Equal(t, "DEBUG", line["level"])
+			assert.Contains(t, line, "client")
+		}
+	}
+	assert.True(t, logged, "the failed write should be logged")
+}
+
+func TestIsTransientWriteError(t *testing.T) {
+	assert.True(t, isTransientWriteError(&net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", syscall.ENOBUFS)}))
+	assert.True(t, isTransientWriteError(syscall.EAGAIN))
+	assert.False(t, isTransientWriteError(syscall.ECONNREFUSED))
+	assert.False(t, isTransientWriteError(nil))
+}
+
+func TestHandleLocalQuery(t *testing.T) {
+	server := NewServer(Options{})
+
+	query, err := NewMessageFromBytes(createTestQuery())
+	require.NoError(t, err)
+
+	responseBytes, err := server.handleLocalQuery(context.Background(), query, nil, maxUDPMessageSize)
+
+	require.NoError(t, err)
+	assert.NotEmpty(t, responseBytes)
+}
+
+func TestHandleQueryWithInvalidMessage(t *testing.T) {
+	server := NewServer(Options{})
+
+	invalidQuery := []byte{0, 0, 0, 0}
+
+	responseBytes, err := server.handleQuery(context.Background(), invalidQuery, nil, TransportUDP, maxUDPMessageSize)
+
+	assert.Error(t, err)
+	assert.Empty(t, responseBytes)
+}
+
+func TestHandleForwardedQuery(t *testing.T) {
+	server := NewServer(Options{Resolver: "127.0.0.1:53535"})
+
 	queryBytes := createTestQuery()
+	query, err := NewMessageFromBytes(queryBytes)
+	require.NoError(t, err)
 
-	server.handleForwardedQuery(conn, addr, queryBytes)
+	responseBytes, err := server.handleForwardedQuery(context.Background(), query, queryBytes, nil, maxUDPMessageSize)
 
-	assert.NotEmpty(t, conn.writtenData)
+	require.NoError(t, err)
+	assert.NotEmpty(t, responseBytes)
 }
 
 func TestHandleForwardingError(t *testing.T) {
-	server := &Server{opts: Options{Resolver: "invalid-resolver:53"}}
+	server := NewServer(Options{Resolver: "invalid-resolver:53"})
 
-	conn := &mockPacketConn{}
-	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	query, err := NewMessageFromBytes(createTestQuery())
+	require.NoError(t, err)
 
-	queryBytes := createTestQuery()
+	responseBytes, err := server.handleForwardingError(context.Background(), query, errNoResolvers, nil, maxUDPMessageSize, false)
 
-	server.handleForwardingError(conn, addr, queryBytes)
+	require.NoError(t, err)
+	assert.NotEmpty(t, responseBytes)
 
-	assert.NotEmpty(t, conn.writtenData)
-	require.NotEmpty(t, conn.writtenAddr)
-	assert.Equal(t, addr, conn.writtenAddr[0])
+	h, err := NewHeaderFromBytes(responseBytes)
+	require.NoError(t, err)
+	assert.Equal(t, RCODE_SERVER_FAILURE, h.ResponseCode())
 }
 
 func TestForwardQuery(t *testing.T) {
-	server := &Server{opts: Options{Resolver: "127.0.0.1:53535"}}
+	server := NewServer(Options{Resolver: "127.0.0.1:53535"})
 
 	queryBytes := createTestQuery()
 
-	_, err := server.forwardQuery(queryBytes)
+	_, _, err := server.forwardQuery(context.Background(), queryBytes, maxUDPMessageSize)
 
 	assert.Error(t, err)
 }
 
 func TestListenAndServeWithContextCancellation(t *testing.T) {
-	server := &Server{opts: Options{}}
+	server := NewServer(Options{})
 
 	conn := &mockPacketConn{}
 	ctx, cancel := context.WithCancel(context.Background())
@@ -119,7 +183,7 @@ func TestListenAndServeWithContextCancellation(t *testing.T) {
 }
 
 func TestListenAndServeLocalMode(t *testing.T) {
-	server := &Server{opts: Options{}}
+	server := NewServer(Options{})
 
 	conn := &mockPacketConn{
 		readData: [][]byte{createTestQuery()},
@@ -131,11 +195,47 @@ func TestListenAndServeLocalMode(t *testing.T) {
 
 	server.ListenAndServe(ctx, conn)
 
-	assert.NotEmpty(t, conn.writtenData)
+	responses := parseWritten(t, conn)
+	require.Len(t, responses, 1)
+	assert.Equal(t, RCODE_NO_ERROR, responses[0].Header.ResponseCode())
+	require.Len(t, responses[0].Answers, 1)
+	assert.Equal(t, "example.com", responses[0].Answers[0].Name)
+}
+
+func TestListenAndServeBoundsConcurrentQueries(t *testing.T) {
+	server := NewServer(Options{})
+	server.udpSlots = make(chan struct{}, 2)
+	var active, peak atomic.Int64
+	server.RegisterType(TYPE_TXT, func(q Question, clientIP net.IP) ([]Answer, uint8, error) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for current := peak.Load(); n > current && !peak.CompareAndSwap(current, n); current = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		return []Answer{NewTXTAnswer(q.Name, 60, "slow")}, RCODE_NO_ERROR, nil
+	})
+
+	conn := &mockPacketConn{}
+	for range 5 {
+		query := createTestQueryMessage("example.com")
+		query.Questions[0].Type = TYPE_TXT
+		queryBytes, err := query.MarshalBinary()
+		require.NoError(t, err)
+		conn.readData = append(conn.readData, queryBytes)
+		conn.readAddr = append(conn.readAddr, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	server.ListenAndServe(ctx, conn)
+
+	assert.Len(t, parseWritten(t, conn), 5, "every query should be answered once a slot frees up")
+	assert.Equal(t, int64(2), peak.Load(), "no more queries than there are slots should be handled at once")
 }
 
 func TestListenAndServeForwardingMode(t *testing.T) {
-	server := &Server{opts: Options{Resolver: "127.0.0.1:53535"}}
+	server := NewServer(Options{Resolver: "127.0.0.1:53535"})
 
 	conn := &mockPacketConn{
 		readData: [][]byte{createTestQuery()},
@@ -147,11 +247,13 @@ func TestListenAndServeForwardingMode(t *testing.T) {
 
 	server.ListenAndServe(ctx, conn)
 
-	assert.NotEmpty(t, conn.writtenData)
+	responses := parseWritten(t, conn)
+	require.Len(t, responses, 1)
+	assert.Equal(t, RCODE_SERVER_FAILURE, responses[0].Header.ResponseCode(), "nothing answers at the resolver")
 }
 
 func TestListenAndServeWithReadTimeout(t *testing.T) {
-	server := &Server{opts: Options{}}
+	server := NewServer(Options{})
 
 	conn := &mockPacketConn{
 		readTimeout: true,
@@ -168,7 +270,7 @@ func TestListenAndServeWithReadTimeout(t *testing.T) {
 }
 
 func TestListenAndServeWithReadError(t *testing.T) {
-	server := &Server{opts: Options{}}
+	server := NewServer(Options{})
 
 	conn := &mockPacketConn{
 		readError: true,
@@ -195,6 +297,49 @@ func createTestQuery() []byte {
 	return msgBytes
 }
 
+// startMockResolver runs a UDP resolver on a random local port that answers
+// every query with respond(query) and returns its address.
+func startMockResolver(t *testing.T, respond func(query Message) Message) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxTCPMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := NewMessageFromBytes(buf[:n])
+			if err != nil {
+				continue
+			}
+			response := respond(query)
+			responseBytes, err := response.MarshalBinary()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(responseBytes, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// answerWith returns a mock resolver responder that answers with the given records.
+func answerWith(answers ...Answer) func(query Message) Message {
+	return func(query Message) Message {
+		query.Additionals = nil
+		query.Header.AdditionalCount = 0
+		query.AddAnswers(answers)
+		query.SetResponse(len(answers))
+		return query
+	}
+}
+
 type timeoutError struct{}
 
 func (t *timeoutError) Error() string   { return "timeout" }
@@ -202,6 +347,7 @@ func (t *timeoutError) Timeout() bool   { return true }
 func (t *timeoutError) Temporary() bool { return false }
 
 type mockPacketConn struct {
+	mu          sync.Mutex
 	writtenData [][]byte
 	writtenAddr []net.Addr
 	readData    [][]byte
@@ -209,6 +355,7 @@ type mockPacketConn struct {
 	readIndex   int
 	readTimeout bool
 	readError   bool
+	writeError  error
 	closed      bool
 }
 
@@ -234,11 +381,31 @@ func (m *mockPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 }
 
 func (m *mockPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.writeError != nil {
+		return 0, m.writeError
+	}
 	m.writtenData = append(m.writtenData, append([]byte{}, p...))
 	m.writtenAddr = append(m.writtenAddr, addr)
 	return len(p), nil
 }
 
+// parseWritten decodes every packet written to conn.
+func parseWritten(t *testing.T, conn *mockPacketConn) []Message {
+	t.Helper()
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	messages := make([]Message, 0, len(conn.writtenData))
+	for _, data := range conn.writtenData {
+		msg, err := NewMessageFromBytes(data)
+		require.NoError(t, err)
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
 func (m *mockPacketConn) Close() error {
 	m.closed = true
 	return nil
@@ -259,3 +426,552 @@ func (m *mockPacketConn) SetReadDeadline(t time.Time) error {
 func (m *mockPacketConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
+
+func TestForceTCPForSubnets(t *testing.T) {
+	server := NewServer(Options{ForceTCPForSubnets: []string{"192.0.2.0/24"}})
+
+	query := func(ip string) Message {
+		conn := &mockPacketConn{}
+		server.handleUDPQuery(context.Background(), conn, &net.UDPAddr{IP: net.ParseIP(ip), Port: 12345}, createTestQuery())
+		responses := parseWritten(t, conn)
+		require.Len(t, responses, 1)
+		return responses[0]
+	}
+
+	forced := query("192.0.2.10")
+	assert.True(t, forced.Header.Truncated())
+	assert.Empty(t, forced.Answers)
+	require.Len(t, forced.Questions, 1)
+
+	other := query("198.51.100.10")
+	assert.False(t, other.Header.Truncated())
+	assert.NotEmpty(t, other.Answers)
+
+	// TCP clients in the subnet get the full answer
+	responseBytes, err := server.handleQuery(context.Background(), createTestQuery(), net.ParseIP("192.0.2.10"), TransportTCP, maxTCPMessageSize)
+	require.NoError(t, err)
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	assert.NotEmpty(t, response.Answers)
+}
+
+func TestCatchAllIPAnswersUnconfiguredNames(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewAAnswer("www.example.com", net.ParseIP("192.0.2.1"), 300))
+	server := NewServer(Options{Zone: zone, CatchAllIP: "198.51.100.7"})
+
+	response := queryType(t, server, "anything.at.all.example.org", TYPE_A, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{198, 51, 100, 7}, response.Answers[0].Data)
+	assert.Equal(t, "anything.at.all.example.org", response.Answers[0].Name)
+
+	noData := queryType(t, server, "anything.example.org", TYPE_AAAA, nil)
+	assert.Equal(t, RCODE_NO_ERROR, noData.Header.ResponseCode())
+	assert.Empty(t, noData.Answers)
+
+	zoned := queryType(t, server, "www.example.com", TYPE_A, nil)
+	require.Len(t, zoned.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 1}, zoned.Answers[0].Data)
+}
+
+func TestCatchAllIPv6(t *testing.T) {
+	server := NewServer(Options{CatchAllIP: "2001:db8::7"})
+
+	response := queryType(t, server, "dev.internal", TYPE_AAAA, nil)
+
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, net.ParseIP("2001:db8::7"), net.IP(response.Answers[0].Data))
+}
+
+func TestForwardQueryUDPSkipsNonMatchingResponses(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query, err := NewMessageFromBytes(buf[:n])
+		if err != nil {
+			return
+		}
+
+		respond := func(msg Message) {
+			msgBytes, _ := msg.MarshalBinary()
+			conn.WriteTo(msgBytes, addr)
+		}
+		junk := answerWith(NewAAnswer("example.com", net.ParseIP("203.0.113.66"), 60))(query)
+		junk.Header.ID++
+		respond(junk)
+		recased := answerWith(NewAAnswer("example.com", net.ParseIP("203.0.113.66"), 60))(query)
+		recased.Questions = []Question{query.Questions[0]}
+		recased.Questions[0].Name = strings.ToUpper(recased.Questions[0].Name)
+		respond(recased)
+		conn.WriteTo([]byte{0xFF}, addr)
+		respond(answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60))(query))
+	}()
+
+	server := NewServer(Options{Resolver: conn.LocalAddr().String()})
+	response := queryType(t, server, "example.com", TYPE_A, nil)
+
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 1}, response.Answers[0].Data)
+}
+
+func TestForwardedResponseFitsClientUDPSize(t *testing.T) {
+	big := NewTXTAnswer("example.com", 60, strings.Repeat("x", 200), strings.Repeat("y", 200), strings.Repeat("z", 200), strings.Repeat("w", 255))
+	resolver := startMockResolver(t, answerWith(big))
+	server := NewServer(Options{Resolver: resolver})
+
+	exchange := func(opt *OPT) (Message, int) {
+		msg := Message{
+			Header:    NewHeader(7, 0, 1, 0, 0, 0),
+			Questions: []Question{{Name: "example.com", Type: TYPE_TXT, Class: CLASS_IN}},
+		}
+		if opt != nil {
+			msg.SetOPT(*opt)
+		}
+		queryBytes, err := msg.MarshalBinary()
+		require.NoError(t, err)
+
+		conn := &mockPacketConn{}
+		server.handleUDPQuery(context.Background(), conn, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}, queryBytes)
+		require.Len(t, conn.writtenData, 1)
+		response, err := NewMessageFromBytes(conn.writtenData[0])
+		require.NoError(t, err)
+		return response, len(conn.writtenData[0])
+	}
+
+	for name, opt := range map[string]*OPT{"no EDNS": nil, "EDNS 512": {UDPSize: 512}} {
+		t.Run(name, func(t *testing.T) {
+			response, size := exchange(opt)
+			assert.LessOrEqual(t, size, maxUDPMessageSize)
+			assert.True(t, response.Header.Truncated())
+			assert.Empty(t, response.Answers)
+		})
+	}
+
+	full, size := exchange(&OPT{UDPSize: 1232})
+	assert.False(t, full.Header.Truncated())
+	require.Len(t, full.Answers, 1)
+	assert.Equal(t, 900, size)
+}
+
+func TestDuplicateQuestions(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300))
+	query := Message{
+		Header: NewHeader(7, 0, 2, 0, 0, 0),
+		Questions: []Question{
+			{Name: "example.com", Type: TYPE_A, Class: CLASS_IN},
+			{Name: "EXAMPLE.com", Type: TYPE_A, Class: CLASS_IN},
+		},
+	}
+	queryBytes, err := query.MarshalBinary()
+	require.NoError(t, err)
+
+	t.Run("answered once by default", func(t *testing.T) {
+		server := NewServer(Options{Zone: zone})
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(1), response.Header.QuestionsCount)
+		assert.Equal(t, uint16(1), response.Header.AnswerCount)
+		require.Len(t, response.Answers, 1)
+		assert.Equal(t, "192.0.2.1", net.IP(response.Answers[0].Data).String())
+	})
+
+	t.Run("answered per question", func(t *testing.T) {
+		server := NewServer(Options{Zone: zone, AnswerDuplicateQuestions: true})
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(2), response.Header.QuestionsCount)
+		assert.Len(t, response.Answers, 2)
+	})
+
+	t.Run("forwarded once", func(t *testing.T) {
+		asked := make(chan int, 1)
+		resolver := startMockResolver(t, func(query Message) Message {
+			asked <- len(query.Questions)
+			return answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.2"), 300))(query)
+		})
+		server := NewServer(Options{Resolver: resolver})
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		assert.Equal(t, 1, <-asked)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(1), response.Header.QuestionsCount)
+		assert.Len(t, response.Answers, 1)
+	})
+}
+
+func TestForwardQueryToClosedPortFailsFast(t *testing.T) {
+	server := NewServer(Options{Resolver: closedUDPAddr(t)})
+
+	start := time.Now()
+	_, _, err := server.forwardQuery(context.Background(), createTestQuery(), maxUDPMessageSize)
+
+	require.ErrorIs(t, err, errResolverRefused)
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "a refused query shouldn't wait for the forwarding timeout")
+}
+
+func TestUpdateOptionsGivesQueriesConsistentSnapshots(t *testing.T) {
+	// Each configuration rewrites alias.example.com to a name only its own zone
+	// holds, so a query mixing one's rewrite with the other's zone would get
+	// the local fallback answer instead.
+	configs := make([]Options, 2)
+	for i := range configs {
+		name := fmt.Sprintf("n%d.example.com", i)
+		zone := NewZone()
+		zone.Add(NewAAnswer(name, net.IPv4(192, 0, 2, byte(i)), 300))
+		configs[i] = Options{Zone: zone, NameRewrites: map[string]string{"alias.example.com": name}}
+	}
+	server := NewServer(configs[0])
+
+	done := make(chan struct{})
+	var updates sync.WaitGroup
+	updates.Add(1)
+	go func() {
+		defer updates.Done()
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				server.UpdateOptions(configs[i%2])
+			}
+		}
+	}()
+
+	var queries sync.WaitGroup
+	for range 4 {
+		queries.Add(1)
+		go func() {
+			defer queries.Done()
+			for range 200 {
+				response := queryType(t, server, "alias.example.com", TYPE_A, nil)
+				if assert.Len(t, response.Answers, 1) {
+					assert.Contains(t, []string{"192.0.2.0", "192.0.2.1"}, net.IP(response.Answers[0].Data).String())
+				}
+			}
+		}()
+	}
+	queries.Wait()
+	close(done)
+	updates.Wait()
+}
+
+func TestUpdateOptionsKeepsZoneAndState(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300))
+	server := NewServer(Options{Zone: zone, TrackTopNames: 10})
+	queryType(t, server, "example.com", TYPE_A, nil)
+
+	server.UpdateOptions(Options{FilterA: true})
+	response := queryType(t, server, "example.com", TYPE_A, nil)
+
+	assert.Empty(t, response.Answers, "the new options should apply")
+	assert.True(t, response.Header.Authoritative(), "the zone should be kept")
+	assert.Equal(t, []NameCount{{Name: "example.com", Count: 2}}, server.TopNames(10))
+	assert.Equal(t, uint64(2), server.metrics.queries.Load())
+}
+
+func TestListenAndServeAnswersBufferFillingDatagramWithTC(t *testing.T) {
+	server := NewServer(Options{})
+	query := createTestQueryMessage("example.com")
+	query.Header.SetRecursionDesired(true)
+	queryBytes, err := query.MarshalBinary()
+	require.NoError(t, err)
+	// What's left of a bigger datagram the OS cut down to the buffer.
+	oversized := append(queryBytes, make([]byte, udpBufferSize-len(queryBytes))...)
+	oversized[7] = 3 // claims more answers than fit
+
+	conn := &mockPacketConn{
+		readData: [][]byte{oversized},
+		readAddr: []net.Addr{&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	server.ListenAndServe(ctx, conn)
+
+	responses := parseWritten(t, conn)
+	require.Len(t, responses, 1)
+	response := responses[0]
+	assert.True(t, response.Header.Truncated())
+	assert.False(t, response.Header.IsQuery())
+	assert.True(t, response.Header.RecursionDesired())
+	assert.Equal(t, query.Header.ID, response.Header.ID)
+	assert.Equal(t, query.Questions, response.Questions)
+	assert.Empty(t, response.Answers)
+	assert.Equal(t, uint64(1), server.metrics.malformed.Load())
+}
+
+func TestHonorRD(t *testing.T) {
+	var asked atomic.Int64
+	resolver := startMockResolver(t, func(query Message) Message {
+		asked.Add(1)
+		return answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300))(query)
+	})
+	zone := NewZone()
+	zone.Add(NewAAnswer("local.example", net.ParseIP("192.0.2.2"), 60))
+	server := NewServer(Options{Resolver: resolver, HonorRD: true, Zone: zone})
+
+	query := func(name string, rd bool) Message {
+		msg := createTestQueryMessage(name)
+		msg.Header.SetRecursionDesired(rd)
+		msg.SetOPT(OPT{UDPSize: 4096})
+		queryBytes, err := msg.MarshalBinary()
+		require.NoError(t, err)
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		return response
+	}
+
+	iterative := query("example.com", false)
+	assert.Equal(t, RCODE_REFUSED, iterative.Header.ResponseCode())
+	assert.Empty(t, iterative.Answers)
+	ede, ok := iterative.ExtendedError()
+	require.True(t, ok)
+	assert.Equal(t, EDE_NOT_AUTHORITATIVE, ede.Code)
+	assert.Equal(t, int64(0), asked.Load(), "a query without RD shouldn't be forwarded")
+
+	local := query("local.example", false)
+	assert.Equal(t, RCODE_NO_ERROR, local.Header.ResponseCode())
+	assert.Len(t, local.Answers, 1, "zone names should still be answered")
+
+	recursive := query("example.com", true)
+	assert.Len(t, recursive.Answers, 1)
+	assert.Equal(t, int64(1), asked.Load())
+}
+
+func TestRefuseOpenResolver(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewAAnswer("local.example", net.ParseIP("192.0.2.2"), 60))
+	server := NewServer(Options{RefuseOpenResolver: true, Zone: zone})
+
+	query := func(name string, qtype uint16, rd bool) Message {
+		msg := createTestQueryMessage(name)
+		msg.Questions[0].Type = qtype
+		msg.Header.SetRecursionDesired(rd)
+		msg.SetOPT(OPT{UDPSize: 4096})
+		queryBytes, err := msg.MarshalBinary()
+		require.NoError(t, err)
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		return response
+	}
+
+	for _, name := range []string{"", "com", "example.com"} {
+		probe := query(name, TYPE_NS, true)
+		assert.Equal(t, RCODE_REFUSED, probe.Header.ResponseCode(), name)
+		assert.Empty(t, probe.Answers, name)
+		ede, ok := probe.ExtendedError()
+		require.True(t, ok, name)
+		assert.Equal(t, EDE_PROHIBITED, ede.Code, name)
+	}
+	assert.Equal(t, uint64(3), server.metrics.refused.Load())
+
+	local := query("local.example", TYPE_A, true)
+	assert.Equal(t, RCODE_NO_ERROR, local.Header.ResponseCode())
+	assert.Len(t, local.Answers, 1, "zone names should still be answered")
+
+	iterative := query("example.com", TYPE_A, false)
+	assert.Equal(t, RCODE_NO_ERROR, iterative.Header.ResponseCode(), "a query without RD isn't asking for recursion")
+}
+
+func TestSetMessageID(t *testing.T) {
+	original := createTestQuery()
+	msgBytes := append([]byte(nil), original...)
+
+	setMessageID(msgBytes, 0xBEEF)
+	assert.Equal(t, original[2:], msgBytes[2:], "only the ID should change")
+	h, err := NewHeaderFromBytes(msgBytes)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(0xBEEF), h.ID)
+
+	short := []byte{1, 2, 3}
+	setMessageID(short, 0xBEEF)
+	assert.Equal(t, []byte{1, 2, 3}, short)
+}
+
+func TestForwardedQueriesGetTheirOwnID(t *testing.T) {
+	var upstreamID atomic.Uint32
+	resolver := startMockResolver(t, func(query Message) Message {
+		upstreamID.Store(uint32(query.Header.ID))
+		return answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300))(query)
+	})
+	server := NewServer(Options{Resolver: resolver, IDStrategy: IDStrategyMonotonic})
+
+	response := queryType(t, server, "example.com", TYPE_A, nil)
+	assert.Equal(t, uint16(1), response.Header.ID, "the response should get the client's ID back")
+	assert.Len(t, response.Answers, 1)
+	server.lastID.Store(41)
+	queryType(t, server, "example.com", TYPE_A, nil)
+	assert.Equal(t, uint32(42), upstreamID.Load(), "the forwarded query should carry an ID from IDStrategy")
+}
+
+func TestForwardMultiQuestionQuerySplits(t *testing.T) {
+	var multi atomic.Bool
+	resolver := startMockResolver(t, func(query Message) Message {
+		if len(query.Questions) != 1 {
+			multi.Store(true)
+		}
+		switch name := query.Questions[0].Name; name {
+		case "broken.example.com":
+			query.SetError(RCODE_SERVER_FAILURE, nil)
+			return query
+		case "a.example.com":
+			return answerWith(NewAAnswer(name, net.ParseIP("192.0.2.1"), 300))(query)
+		default:
+			return answerWith(NewAAAAAnswer(name, net.ParseIP("2001:db8::1"), 300))(query)
+		}
+	})
+	server := NewServer(Options{Resolver: resolver})
+
+	query := func(questions ...Question) Message {
+		msg := Message{Header: NewHeader(7, 0, uint16(len(questions)), 0, 0, 0), Questions: questions}
+		queryBytes, err := msg.MarshalBinary()
+		require.NoError(t, err)
+		responseBytes, err := server.handleQuery(t.Context(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		return response
+	}
+
+	response := query(
+		Question{Name: "a.example.com", Type: TYPE_A, Class: CLASS_IN},
+		Question{Name: "b.example.com", Type: TYPE_AAAA, Class: CLASS_IN},
+	)
+	assert.False(t, multi.Load(), "the resolver should only get single-question queries")
+	assert.Equal(t, RCODE_NO_ERROR, response.Header.ResponseCode())
+	assert.Equal(t, uint16(7), response.Header.ID)
+	assert.Len(t, response.Questions, 2)
+	require.Len(t, response.Answers, 2)
+	assert.Equal(t, "a.example.com", response.Answers[0].Name)
+	assert.Equal(t, TYPE_A, response.Answers[0].Type)
+	assert.Equal(t, "b.example.com", response.Answers[1].Name)
+	assert.Equal(t, TYPE_AAAA, response.Answers[1].Type)
+
+	partial := query(
+		Question{Name: "a.example.com", Type: TYPE_A, Class: CLASS_IN},
+		Question{Name: "broken.example.com", Type: TYPE_A, Class: CLASS_IN},
+	)
+	assert.Equal(t, RCODE_SERVER_FAILURE, partial.Header.ResponseCode(), "a failed question should fail the response")
+	assert.Len(t, partial.Answers, 1, "the answers that were found should be kept")
+}
+
+func TestListenAndServeSplitsMultiQuestionQuery(t *testing.T) {
+	resolver := startMockResolver(t, func(query Message) Message {
+		return answerWith(NewAAnswer(query.Questions[0].Name, net.ParseIP("192.0.2.1"), 300))(query)
+	})
+	// Pooled buffers put every part's read on the query's lease.
+	server := NewServer(Options{Resolver: resolver, ReuseBuffers: true})
+
+	var questions []Question
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"} {
+		questions = append(questions, Question{Name: name, Type: TYPE_A, Class: CLASS_IN})
+	}
+	msg := Message{Header: NewHeader(7, 0, uint16(len(questions)), 0, 0, 0), Questions: questions}
+	queryBytes, err := msg.MarshalBinary()
+	require.NoError(t, err)
+	conn := &mockPacketConn{
+		readData: [][]byte{queryBytes},
+		readAddr: []net.Addr{&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	server.ListenAndServe(ctx, conn)
+
+	responses := parseWritten(t, conn)
+	require.Len(t, responses, 1)
+	assert.Equal(t, RCODE_NO_ERROR, responses[0].Header.ResponseCode())
+	require.Len(t, responses[0].Answers, 4)
+	for i, answer := range responses[0].Answers {
+		assert.Equal(t, questions[i].Name, answer.Name)
+	}
+}
+
+func TestAuthenticDataBit(t *testing.T) {
+	var forwardedAD atomic.Bool
+	resolver := startMockResolver(t, func(query Message) Message {
+		forwardedAD.Store(query.Header.AuthenticData())
+		query = answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300))(query)
+		query.Header.SetAuthenticData(true)
+		return query
+	})
+	server := NewServer(Options{Resolver: resolver, CacheSize: 10})
+	zone := NewZone()
+	zone.Add(NewAAnswer("local.example", net.ParseIP("192.0.2.2"), 60))
+	local := NewServer(Options{Zone: zone})
+
+	query := func(server *Server, name string) Message {
+		msg := createTestQueryMessage(name)
+		msg.Header.SetAuthenticData(true)
+		queryBytes, err := msg.MarshalBinary()
+		require.NoError(t, err)
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		return response
+	}
+
+	forwarded := query(server, "example.com")
+	assert.True(t, forwardedAD.Load(), "the client's AD bit should be forwarded")
+	assert.True(t, forwarded.Header.AuthenticData(), "the resolver's AD bit should be relayed")
+	cached := query(server, "example.com")
+	assert.Equal(t, uint64(1), server.metrics.cacheHits.Load())
+	assert.True(t, cached.Header.AuthenticData(), "a cached answer should keep the resolver's AD bit")
+
+	zoneAnswer := query(local, "local.example")
+	require.Len(t, zoneAnswer.Answers, 1)
+	assert.False(t, zoneAnswer.Header.AuthenticData(), "the server doesn't validate its own answers")
+	synthesized := query(local, "unknown.example")
+	assert.False(t, synthesized.Header.AuthenticData())
+}
+
+func TestTTLByType(t *testing.T) {
+	zone := NewZone()
+	require.NoError(t, zone.Load(strings.NewReader("example.com. IN NS ns1.example.com.\nns1.example.com. IN A 192.0.2.53\nexample.com. IN MX 10 mail.example.com.\nfixed.example.com. 120 IN A 192.0.2.1\n"), ""))
+	opts := Options{Zone: zone, DefaultTTL: 600, TTLByType: map[uint16]uint32{TYPE_A: 30, TYPE_NS: 86400}}
+	server := NewServer(opts)
+
+	for qtype, want := range map[uint16]uint32{TYPE_A: 30, 65280: 600} {
+		response := queryType(t, server, "local.test.internal", qtype, nil)
+		require.Len(t, response.Answers, 1, typeName(qtype))
+		assert.Equal(t, want, response.Answers[0].TTL, "synthesized %s", typeName(qtype))
+	}
+
+	catchAll := NewServer(Options{CatchAllIP: "192.0.2.99", TTLByType: opts.TTLByType})
+	response := queryType(t, catchAll, "anything.internal", TYPE_A, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, uint32(30), response.Answers[0].TTL)
+
+	for name, want := range map[string]uint32{"ns1.example.com": 30, "fixed.example.com": 120} {
+		response := queryType(t, server, name, TYPE_A, nil)
+		require.Len(t, response.Answers, 1, name)
+		assert.Equal(t, want, response.Answers[0].TTL, "only zone records without a TTL inherit one: %s", name)
+	}
+	for qtype, want := range map[uint16]uint32{TYPE_NS: 86400, TYPE_MX: 600} {
+		response := queryType(t, server, "example.com", qtype, nil)
+		require.Len(t, response.Answers, 1, typeName(qtype))
+		assert.Equal(t, want, response.Answers[0].TTL, "zone %s without a TTL", typeName(qtype))
+	}
+
+	response = queryType(t, NewServer(Options{Zone: zone}), "example.com", TYPE_NS, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, uint32(defaultZoneTTL), response.Answers[0].TTL)
+}
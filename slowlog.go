@@ -0,0 +1,67 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// queryTiming collects where a query's handling time went, for the slow-query
+// log: the resolver its forwarded query went to last and the time spent
+// waiting on resolvers, over every attempt and split of the query.
+type queryTiming struct {
+	mu           sync.Mutex
+	upstream     string
+	upstreamTime time.Duration
+}
+
+type queryTimingKey struct{}
+
+func withQueryTiming(ctx context.Context) (context.Context, *queryTiming) {
+	timing := &queryTiming{}
+	return context.WithValue(ctx, queryTimingKey{}, timing), timing
+}
+
+// recordUpstreamTime adds an exchange with resolver that took elapsed to the
+// timing of ctx's query, when it has one.
+func recordUpstreamTime(ctx context.Context, resolver string, elapsed time.Duration) {
+	timing, _ := ctx.Value(queryTimingKey{}).(*queryTiming)
+	if timing == nil {
+		return
+	}
+	timing.mu.Lock()
+	defer timing.mu.Unlock()
+	timing.upstream = resolver
+	timing.upstreamTime += elapsed
+}
+
+// logSlowQuery logs query at warn level when handling it took longer than
+// SlowQueryThreshold, with what it asked and where the time went.
+func (s *Server) logSlowQuery(ctx context.Context, query Message, clientIP net.IP, transport Transport, responseBytes []byte, elapsed time.Duration, timing *queryTiming) {
+	if elapsed <= s.opts.SlowQueryThreshold {
+		return
+	}
+	name, qtype := "", ""
+	if len(query.Questions) > 0 {
+		name, qtype = query.Questions[0].Name, typeName(query.Questions[0].Type)
+	}
+	timing.mu.Lock()
+	upstream, upstreamTime := timing.upstream, timing.upstreamTime
+	timing.mu.Unlock()
+	attrs := []any{
+		"name", name,
+		"type", qtype,
+		"client", clientIP,
+		"transport", transport.String(),
+		"upstream", upstream,
+		"upstream_time", upstreamTime,
+		"local_time", elapsed - upstreamTime,
+		"total_time", elapsed,
+	}
+	// Dropped queries have no response to take an rcode from.
+	if header, err := NewHeaderFromBytes(responseBytes); err == nil {
+		attrs = append(attrs, "rcode", header.ResponseCode())
+	}
+	logger(ctx).Warn("Slow query", attrs...)
+}
@@ -0,0 +1,59 @@
+package dnsserver
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowQueryLog(t *testing.T) {
+	logs := captureLogs(t)
+	var elapsed atomic.Int64
+	start := time.Now()
+	clock := func() time.Time { return start.Add(time.Duration(elapsed.Load())) }
+
+	resolver := startMockResolver(t, func(query Message) Message {
+		elapsed.Add(int64(3 * time.Second))
+		return answerWith(NewAAnswer(query.Questions[0].Name, net.ParseIP("192.0.2.1"), 300))(query)
+	})
+	zone := NewZone()
+	zone.Add(NewAAnswer("fast.example.com", net.ParseIP("192.0.2.2"), 60))
+	server := NewServer(Options{Zone: zone, Resolver: resolver, SlowQueryThreshold: time.Second})
+	server.clock = clock
+	server.RegisterType(TYPE_TXT, func(q Question, clientIP net.IP) ([]Answer, uint8, error) {
+		elapsed.Add(int64(2 * time.Second))
+		return []Answer{NewTXTAnswer(q.Name, 60, "slow")}, RCODE_NO_ERROR, nil
+	})
+
+	client := net.ParseIP("198.51.100.7")
+	queryType(t, server, "fast.example.com", TYPE_A, client)
+	queryType(t, server, "slow.example.com", TYPE_TXT, client)
+	queryType(t, server, "upstream.example.com", TYPE_A, client)
+
+	var slow []map[string]any
+	for _, line := range logs.lines(t) {
+		if line["msg"] == "Slow query" {
+			slow = append(slow, line)
+		}
+	}
+	require.Len(t, slow, 2, "only the queries over the threshold should be logged")
+
+	assert.Equal(t, "WARN", slow[0]["level"])
+	assert.Equal(t, "slow.example.com", slow[0]["name"])
+	assert.Equal(t, "TXT", slow[0]["type"])
+	assert.Equal(t, "198.51.100.7", slow[0]["client"])
+	assert.Equal(t, "udp", slow[0]["transport"])
+	assert.Equal(t, float64(RCODE_NO_ERROR), slow[0]["rcode"])
+	assert.Equal(t, float64(2*time.Second), slow[0]["total_time"])
+	assert.Equal(t, "", slow[0]["upstream"])
+
+	assert.Equal(t, "upstream.example.com", slow[1]["name"])
+	assert.Equal(t, resolver, slow[1]["upstream"])
+	assert.Equal(t, float64(3*time.Second), slow[1]["upstream_time"])
+	assert.Equal(t, float64(0), slow[1]["local_time"])
+	assert.Equal(t, float64(3*time.Second), slow[1]["total_time"])
+}
@@ -0,0 +1,92 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// specialNameTTL is the TTL of answers for the special-use names of RFC 6761,
+// which never change.
+const specialNameTTL = 3600
+
+var (
+	localhostReverseV4 = "1.0.0.127.in-addr.arpa"
+	localhostReverseV6 = "1." + strings.Repeat("0.", 31) + "ip6.arpa"
+)
+
+// nxdomainSuffixes are the special-use domains that never exist (RFC 6761 and RFC 2606).
+var nxdomainSuffixes = []string{"invalid", "test", "example"}
+
+func (s *Server) handlesSpecialNames() bool {
+	return s.opts.HandleSpecialNames == nil || *s.opts.HandleSpecialNames
+}
+
+// specialName returns the local answers to a question about a special-use name
+// and the rcode to answer with, or false when the name isn't special.
+func specialName(q Question) ([]Answer, uint8, bool) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+
+	switch {
+	case name == "localhost" || strings.HasSuffix(name, ".localhost") || name == "localhost.localdomain":
+		answers := make([]Answer, 0)
+		if q.Type == TYPE_A || q.Type == TYPE_ANY {
+			answers = append(answers, NewAAnswer(q.Name, net.IPv4(127, 0, 0, 1), specialNameTTL))
+		}
+		if q.Type == TYPE_AAAA || q.Type == TYPE_ANY {
+			answers = append(answers, NewAAAAAnswer(q.Name, net.IPv6loopback, specialNameTTL))
+		}
+		return answers, RCODE_NO_ERROR, true
+	case name == localhostReverseV4 || name == localhostReverseV6:
+		answers := make([]Answer, 0)
+		if q.Type == TYPE_PTR || q.Type == TYPE_ANY {
+			data := appendName(nil, "localhost")
+			answers = append(answers, Answer{Name: q.Name, Type: TYPE_PTR, Class: CLASS_IN, TTL: specialNameTTL, Length: uint16(len(data)), Data: data})
+		}
+		return answers, RCODE_NO_ERROR, true
+	}
+
+	for _, suffix := range nxdomainSuffixes {
+		if nameMatches(name, suffix) {
+			return nil, RCODE_NAME_ERROR, true
+		}
+	}
+	return nil, 0, false
+}
+
+// lookupSpecialName returns the local answers to the query and its rcode, if
+// every question is about a special-use name.
+func (s *Server) lookupSpecialName(query Message) ([]Answer, uint8, bool) {
+	if !s.handlesSpecialNames() || len(query.Questions) == 0 {
+		return nil, 0, false
+	}
+
+	answers := make([]Answer, 0)
+	rcode := RCODE_NO_ERROR
+	for _, question := range query.Questions {
+		found, questionRcode, ok := specialName(question)
+		if !ok {
+			return nil, 0, false
+		}
+		if questionRcode != RCODE_NO_ERROR {
+			rcode = questionRcode
+		}
+		answers = append(answers, found...)
+	}
+	return answers, rcode, true
+}
+
+// handleSpecialNameQuery answers queries for the special-use names of RFC 6761
+// locally, so they are never leaked to the resolver.
+func (s *Server) handleSpecialNameQuery(ctx context.Context, msg Message, answers []Answer, rcode uint8, maxSize int) ([]byte, error) {
+	logger(ctx).Debug("Answering special-use name locally", "name", msg.Questions[0].Name, "rcode", rcode)
+	if rcode != RCODE_NO_ERROR {
+		msg.SetError(rcode, nil)
+		return marshalResponse(ctx, msg, maxSize)
+	}
+
+	msg.AddAnswers(answers)
+	msg.SetResponse(len(answers))
+	msg.Header.SetAuthoritative(true)
+	return marshalResponse(ctx, msg, maxSize)
+}
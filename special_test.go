@@ -0,0 +1,63 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpecialNamesLocalhost(t *testing.T) {
+	server := NewServer(Options{})
+
+	a := queryType(t, server, "localhost", TYPE_A, nil)
+	require.Len(t, a.Answers, 1)
+	assert.Equal(t, net.IPv4(127, 0, 0, 1).To4(), net.IP(a.Answers[0].Data))
+	assert.True(t, a.Header.Authoritative())
+
+	aaaa := queryType(t, server, "app.localhost", TYPE_AAAA, nil)
+	require.Len(t, aaaa.Answers, 1)
+	assert.Equal(t, net.IPv6loopback, net.IP(aaaa.Answers[0].Data))
+
+	mx := queryType(t, server, "localhost.localdomain", TYPE_MX, nil)
+	assert.Equal(t, RCODE_NO_ERROR, mx.Header.ResponseCode())
+	assert.Empty(t, mx.Answers)
+}
+
+func TestSpecialNamesReverseLocalhost(t *testing.T) {
+	server := NewServer(Options{})
+
+	response := queryType(t, server, "1.0.0.127.in-addr.arpa", TYPE_PTR, nil)
+
+	require.Len(t, response.Answers, 1)
+	name, _, err := readName(response.Answers[0].Data, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost", name)
+}
+
+func TestSpecialNamesNXDOMAINWithoutForwarding(t *testing.T) {
+	forwarded := false
+	resolver := startMockResolver(t, func(query Message) Message {
+		forwarded = true
+		return answerWith(NewAAnswer("something.invalid", net.ParseIP("192.0.2.1"), 60))(query)
+	})
+	server := NewServer(Options{Resolver: resolver})
+
+	for _, name := range []string{"something.invalid", "foo.test", "www.example"} {
+		response := queryType(t, server, name, TYPE_A, nil)
+		assert.Equal(t, RCODE_NAME_ERROR, response.Header.ResponseCode(), name)
+		assert.Empty(t, response.Answers)
+	}
+	assert.False(t, forwarded)
+}
+
+func TestSpecialNamesCanBeDisabled(t *testing.T) {
+	disabled := false
+	server := NewServer(Options{HandleSpecialNames: &disabled})
+
+	response := queryType(t, server, "localhost", TYPE_A, nil)
+
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{8, 8, 8, 8}, response.Answers[0].Data)
+}
@@ -0,0 +1,154 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// staleAnswerTTL is the TTL of records served stale, the 30 seconds RFC
+	// 8767 section 4 recommends, so clients come back soon for fresh ones.
+	staleAnswerTTL = 30
+	// defaultMaxStaleTTL is how long past their expiry records can be served
+	// stale when MaxStaleTTL isn't set, within the 1 to 3 days RFC 8767 suggests.
+	defaultMaxStaleTTL = 24 * time.Hour
+	// maxStaleEntries bounds how many responses are kept for serving stale.
+	maxStaleEntries = 10000
+)
+
+type staleEntry struct {
+	rcode       uint8
+	answers     []Answer
+	authorities []Answer
+	expires     time.Time
+}
+
+// staleStore keeps the last successful forwarded response to each question,
+// to answer with when the resolver later fails (RFC 8767). It is only a
+// fallback: queries are always forwarded first. A nil store keeps nothing.
+type staleStore struct {
+	mu       sync.Mutex
+	maxStale time.Duration
+	entries  map[questionKey]staleEntry
+}
+
+func newStaleStore(enabled bool, maxStale time.Duration) *staleStore {
+	if !enabled {
+		return nil
+	}
+	if maxStale <= 0 {
+		maxStale = defaultMaxStaleTTL
+	}
+	return &staleStore{maxStale: maxStale, entries: make(map[questionKey]staleEntry)}
+}
+
+// store remembers a response received at now. Only answers and NXDOMAIN are
+// kept, expiring with the lowest TTL among their records.
+func (s *staleStore) store(response Message, now time.Time) {
+	if s == nil {
+		return
+	}
+	key, ok := questionKeyOf(response)
+	rcode := response.Header.ResponseCode()
+	if !ok || response.Header.Truncated() ||
+		!(rcode == RCODE_NAME_ERROR || rcode == RCODE_NO_ERROR && len(response.Answers) > 0) {
+		return
+	}
+
+	entry := staleEntry{
+		rcode:       rcode,
+		answers:     cloneRecords(response.Answers),
+		authorities: cloneRecords(response.Authorities),
+	}
+	ttl, found := uint32(0), false
+	for _, section := range [][]Answer{entry.answers, entry.authorities} {
+		for _, record := range section {
+			if !found || record.TTL < ttl {
+				ttl, found = record.TTL, true
+			}
+		}
+	}
+	entry.expires = now.Add(time.Duration(ttl) * time.Second)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.entries[key]; !exists && len(s.entries) >= maxStaleEntries {
+		for k, e := range s.entries {
+			if now.After(e.expires.Add(s.maxStale)) {
+				delete(s.entries, k)
+			}
+		}
+		if len(s.entries) >= maxStaleEntries {
+			return
+		}
+	}
+	s.entries[key] = entry
+}
+
+// lookup returns the response stored for the query, if it expired no longer
+// than maxStale before now.
+func (s *staleStore) lookup(query Message, now time.Time) (staleEntry, bool) {
+	if s == nil {
+		return staleEntry{}, false
+	}
+	key, ok := questionKeyOf(query)
+	if !ok {
+		return staleEntry{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return staleEntry{}, false
+	}
+	if now.After(entry.expires.Add(s.maxStale)) {
+		delete(s.entries, key)
+		return staleEntry{}, false
+	}
+	return entry, true
+}
+
+// cloneRecords deep-copies records, whose data may point into a read buffer
+// that is about to be reused.
+func cloneRecords(records []Answer) []Answer {
+	cloned := make([]Answer, len(records))
+	for i, record := range records {
+		record.Data = append([]byte(nil), record.Data...)
+		cloned[i] = record
+	}
+	return cloned
+}
+
+// handleStaleQuery answers with the stored response to the query when the
+// resolver failed, its records lowered to staleAnswerTTL and flagged with a
+// stale answer Extended DNS Error. It reports false when nothing is stored.
+func (s *Server) handleStaleQuery(ctx context.Context, msg Message, clientIP net.IP, maxSize int) ([]byte, bool, error) {
+	entry, ok := s.stale.lookup(msg, s.now())
+	if !ok {
+		return nil, false, nil
+	}
+	s.metrics.stale.Add(1)
+	logger(ctx).Info("Resolver failed, serving stale answer", "name", msg.Questions[0].Name)
+
+	ede := &ExtendedError{Code: EDE_STALE_ANSWER}
+	if entry.rcode == RCODE_NAME_ERROR {
+		ede.Code = EDE_STALE_NXDOMAIN_ANSWER
+	}
+	msg.SetError(entry.rcode, ede)
+	msg.Answers = cloneRecords(entry.answers)
+	msg.Authorities = cloneRecords(entry.authorities)
+	for _, section := range [][]Answer{msg.Answers, msg.Authorities} {
+		for i := range section {
+			section[i].TTL = min(section[i].TTL, staleAnswerTTL)
+		}
+	}
+	msg.Header.AnswerCount = uint16(len(msg.Answers))
+	msg.Header.AuthorityCount = uint16(len(msg.Authorities))
+	s.filterAddresses(ctx, &msg, clientIP)
+
+	responseBytes, err := marshalResponse(ctx, msg, maxSize)
+	return responseBytes, true, err
+}
@@ -0,0 +1,110 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closedUDPAddr returns an address nothing listens on.
+func closedUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func queryStaleEDNS(t *testing.T, server *Server, name string) Message {
+	t.Helper()
+	query := NewQuery(name, TYPE_A, CLASS_IN)
+	query.SetOPT(OPT{UDPSize: 1232})
+	queryBytes, err := query.MarshalBinary()
+	require.NoError(t, err)
+	responseBytes, err := server.handleQuery(t.Context(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	return response
+}
+
+func TestStaleIfError(t *testing.T) {
+	resolver := startMockResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300)))
+	now := time.Now()
+	server := NewServer(Options{Resolver: resolver, StaleIfError: true, MaxStaleTTL: time.Hour})
+	server.clock = func() time.Time { return now }
+
+	fresh := queryStaleEDNS(t, server, "example.com")
+	require.Len(t, fresh.Answers, 1)
+	assert.Equal(t, uint32(300), fresh.Answers[0].TTL)
+	_, hasEDE := fresh.ExtendedError()
+	assert.False(t, hasEDE)
+
+	// Long after the records expired, the resolver stops answering.
+	server.UpdateOptions(Options{Resolver: closedUDPAddr(t)})
+	now = now.Add(30 * time.Minute)
+
+	stale := queryStaleEDNS(t, server, "example.com")
+	assert.Equal(t, RCODE_NO_ERROR, stale.Header.ResponseCode())
+	require.Len(t, stale.Answers, 1)
+	assert.Equal(t, "192.0.2.1", net.IP(stale.Answers[0].Data).String())
+	assert.Equal(t, uint32(staleAnswerTTL), stale.Answers[0].TTL)
+	ede, ok := stale.ExtendedError()
+	require.True(t, ok)
+	assert.Equal(t, EDE_STALE_ANSWER, ede.Code)
+	assert.Equal(t, uint64(1), server.metrics.stale.Load())
+
+	// Past MaxStaleTTL the records are gone for good.
+	now = now.Add(time.Hour)
+	failed := queryStaleEDNS(t, server, "example.com")
+	assert.Equal(t, RCODE_SERVER_FAILURE, failed.Header.ResponseCode())
+	assert.Empty(t, failed.Answers)
+}
+
+func TestStaleIfErrorPrefersFreshAnswers(t *testing.T) {
+	resolver := startMockResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300)))
+	server := NewServer(Options{Resolver: resolver, StaleIfError: true})
+
+	queryStaleEDNS(t, server, "example.com")
+	server.UpdateOptions(Options{Resolver: startMockResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.2"), 300)))})
+	response := queryStaleEDNS(t, server, "example.com")
+
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, "192.0.2.2", net.IP(response.Answers[0].Data).String())
+	assert.Equal(t, uint64(0), server.metrics.stale.Load())
+}
+
+func TestStaleIfErrorServesStaleNXDOMAIN(t *testing.T) {
+	resolver := startMockResolver(t, func(query Message) Message {
+		query.SetError(RCODE_NAME_ERROR, nil)
+		query.Authorities = []Answer{syntheticSOA("example.com")}
+		query.Header.AuthorityCount = 1
+		return query
+	})
+	server := NewServer(Options{Resolver: resolver, StaleIfError: true})
+
+	queryStaleEDNS(t, server, "missing.example.com")
+	server.UpdateOptions(Options{Resolver: closedUDPAddr(t)})
+	response := queryStaleEDNS(t, server, "missing.example.com")
+
+	assert.Equal(t, RCODE_NAME_ERROR, response.Header.ResponseCode())
+	require.Len(t, response.Authorities, 1)
+	ede, ok := response.ExtendedError()
+	require.True(t, ok)
+	assert.Equal(t, EDE_STALE_NXDOMAIN_ANSWER, ede.Code)
+}
+
+func TestStaleIfErrorDisabled(t *testing.T) {
+	resolver := startMockResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300)))
+	server := NewServer(Options{Resolver: resolver})
+
+	queryStaleEDNS(t, server, "example.com")
+	server.UpdateOptions(Options{Resolver: closedUDPAddr(t)})
+	response := queryStaleEDNS(t, server, "example.com")
+
+	assert.Equal(t, RCODE_SERVER_FAILURE, response.Header.ResponseCode())
+}
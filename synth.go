@@ -0,0 +1,80 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+)
+
+// Synthesizer builds the answers to a question programmatically, along with
+// the response code. An error makes the server answer SERVFAIL.
+type Synthesizer func(q Question, clientIP net.IP) ([]Answer, uint8, error)
+
+// RegisterType makes the server answer queries of qtype with fn when the zone
+// has no records for them, ahead of the special-use names, forwarding and the
+// local answers. Registering nil removes the type's synthesizer. It is safe to
+// call while the server is serving.
+func (s *Server) RegisterType(qtype uint16, fn Synthesizer) {
+	s.synthMu.Lock()
+	defer s.synthMu.Unlock()
+	if fn == nil {
+		delete(s.synthesizers, qtype)
+		return
+	}
+	if s.synthesizers == nil {
+		s.synthesizers = make(map[uint16]Synthesizer)
+	}
+	s.synthesizers[qtype] = fn
+}
+
+// synthesize runs the registered synthesizers for the query's questions. It
+// reports false unless every question's type has one. The synthesizers run
+// without the lock, so they may register types themselves.
+func (s *Server) synthesize(query Message, clientIP net.IP) ([]Answer, uint8, bool, error) {
+	fns, ok := s.synthesizersFor(query.Questions)
+	if !ok {
+		return nil, 0, false, nil
+	}
+
+	answers := make([]Answer, 0)
+	rcode := RCODE_NO_ERROR
+	for i, question := range query.Questions {
+		found, questionRcode, err := fns[i](question, clientIP)
+		if err != nil {
+			return nil, 0, true, err
+		}
+		if questionRcode != RCODE_NO_ERROR {
+			rcode = questionRcode
+		}
+		answers = append(answers, found...)
+	}
+	return answers, rcode, true, nil
+}
+
+// synthesizersFor returns the synthesizer registered for each question's
+// type, or false unless there is one for every question.
+func (s *Server) synthesizersFor(questions []Question) ([]Synthesizer, bool) {
+	s.synthMu.RLock()
+	defer s.synthMu.RUnlock()
+	if len(s.synthesizers) == 0 || len(questions) == 0 {
+		return nil, false
+	}
+
+	fns := make([]Synthesizer, len(questions))
+	for i, question := range questions {
+		fn, ok := s.synthesizers[question.Type]
+		if !ok {
+			return nil, false
+		}
+		fns[i] = fn
+	}
+	return fns, true
+}
+
+func (s *Server) handleSynthesizedQuery(ctx context.Context, msg Message, answers []Answer, rcode uint8, clientIP net.IP, maxSize int) ([]byte, error) {
+	msg.AddAnswers(answers)
+	msg.SetResponse(len(answers))
+	msg.Header.SetResponseCode(rcode)
+	s.filterAddresses(ctx, &msg, clientIP)
+	s.jitterTTLs(&msg)
+	return marshalResponse(ctx, msg, maxSize)
+}
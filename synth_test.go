@@ -0,0 +1,82 @@
+package dnsserver
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisteredTypeIsSynthesized(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewTXTAnswer("static.example.com", 60, "from the zone"))
+	server := NewServer(Options{Zone: zone})
+
+	now := time.Unix(1700000000, 0)
+	var gotClient net.IP
+	server.RegisterType(TYPE_TXT, func(q Question, clientIP net.IP) ([]Answer, uint8, error) {
+		gotClient = clientIP
+		return []Answer{NewTXTAnswer(q.Name, 0, strconv.FormatInt(now.Unix(), 10))}, RCODE_NO_ERROR, nil
+	})
+
+	response := queryType(t, server, "time.example.com", TYPE_TXT, net.ParseIP("192.0.2.7"))
+	require.Len(t, response.Answers, 1)
+	texts, err := readCharacterStrings(response.Answers[0].Data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1700000000"}, texts)
+	assert.Equal(t, net.ParseIP("192.0.2.7"), gotClient)
+
+	now = now.Add(time.Second)
+	texts, err = readCharacterStrings(queryType(t, server, "time.example.com", TYPE_TXT, nil).Answers[0].Data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1700000001"}, texts, "answers are built per query")
+
+	zoned := queryType(t, server, "static.example.com", TYPE_TXT, nil)
+	texts, err = readCharacterStrings(zoned.Answers[0].Data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"from the zone"}, texts, "the zone takes precedence")
+
+	other := queryType(t, server, "time.example.com", TYPE_A, nil)
+	assert.Equal(t, []byte{8, 8, 8, 8}, other.Answers[0].Data, "other types are unaffected")
+
+	server.RegisterType(TYPE_TXT, nil)
+	unregistered := queryType(t, server, "time.example.com", TYPE_TXT, nil)
+	assert.Equal(t, []byte{8, 8, 8, 8}, unregistered.Answers[0].Data)
+}
+
+func TestSynthesizerRcodeAndError(t *testing.T) {
+	server := NewServer(Options{})
+	server.RegisterType(TYPE_MX, func(q Question, clientIP net.IP) ([]Answer, uint8, error) {
+		return nil, RCODE_NAME_ERROR, nil
+	})
+	server.RegisterType(TYPE_SRV, func(q Question, clientIP net.IP) ([]Answer, uint8, error) {
+		return nil, 0, errors.New("backend down")
+	})
+
+	assert.Equal(t, RCODE_NAME_ERROR, queryType(t, server, "example.com", TYPE_MX, nil).Header.ResponseCode())
+	assert.Equal(t, RCODE_SERVER_FAILURE, queryType(t, server, "example.com", TYPE_SRV, nil).Header.ResponseCode())
+}
+
+func TestSynthesizerMayRegisterTypes(t *testing.T) {
+	server := NewServer(Options{})
+	server.RegisterType(TYPE_TXT, func(q Question, clientIP net.IP) ([]Answer, uint8, error) {
+		// Swapping synthesizers from inside one would deadlock under the lock.
+		server.RegisterType(TYPE_TXT, nil)
+		return []Answer{NewTXTAnswer(q.Name, 60, "once")}, RCODE_NO_ERROR, nil
+	})
+
+	done := make(chan Message)
+	go func() { done <- queryType(t, server, "once.example.com", TYPE_TXT, nil) }()
+	select {
+	case response := <-done:
+		require.Len(t, response.Answers, 1)
+	case <-time.After(time.Second):
+		t.Fatal("synthesizer registering a type deadlocked")
+	}
+	again := queryType(t, server, "once.example.com", TYPE_TXT, nil)
+	assert.Equal(t, []byte{8, 8, 8, 8}, again.Answers[0].Data, "the synthesizer should have unregistered itself")
+}
@@ -0,0 +1,45 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	// maxTarpitDuration caps how long a single query can be held.
+	maxTarpitDuration = 30 * time.Second
+	// maxTarpitted caps how many queries are held at once, so the tarpit itself
+	// can't be used to exhaust the server. Queries beyond it are dropped immediately.
+	maxTarpitted = 1024
+)
+
+func (s *Server) shouldTarpit(query Message) bool {
+	for _, q := range query.Questions {
+		for _, name := range s.opts.TarpitNames {
+			if nameMatches(q.Name, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tarpit holds the query for TarpitDuration, or until ctx is done, so the
+// caller can drop it afterwards.
+func (s *Server) tarpit(ctx context.Context, query Message, clientIP net.IP) {
+	logger(ctx).Info("Tarpitting query", "name", query.Questions[0].Name, "client", clientIP)
+
+	if s.tarpitted.Add(1) > maxTarpitted {
+		s.tarpitted.Add(-1)
+		return
+	}
+	defer s.tarpitted.Add(-1)
+
+	timer := time.NewTimer(min(s.opts.TarpitDuration, maxTarpitDuration))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
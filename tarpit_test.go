@@ -0,0 +1,68 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarpittedQueryIsDroppedAfterDelay(t *testing.T) {
+	server := NewServer(Options{TarpitNames: []string{"abuse.example"}, TarpitDuration: 100 * time.Millisecond})
+
+	start := time.Now()
+	responseBytes, err := server.handleQuery(context.Background(), createTestEDNSQuery("www.ABUSE.example"), nil, TransportUDP, maxUDPMessageSize)
+
+	assert.ErrorIs(t, err, errQueryDropped)
+	assert.Empty(t, responseBytes)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestTarpitRespectsContextCancellation(t *testing.T) {
+	server := NewServer(Options{TarpitNames: []string{"abuse.example"}, TarpitDuration: 10 * time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	responseBytes, err := server.handleQuery(ctx, createTestEDNSQuery("abuse.example"), nil, TransportUDP, maxUDPMessageSize)
+
+	assert.ErrorIs(t, err, errQueryDropped)
+	assert.Empty(t, responseBytes)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestTarpitDoesNotDelayOtherNames(t *testing.T) {
+	server := NewServer(Options{TarpitNames: []string{"abuse.example"}, TarpitDuration: 10 * time.Second})
+
+	start := time.Now()
+	responseBytes, err := server.handleQuery(context.Background(), createTestEDNSQuery("notabuse.example"), nil, TransportUDP, maxUDPMessageSize)
+
+	require.NoError(t, err)
+	assert.NotEmpty(t, responseBytes)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestListenAndServeKeepsAnsweringWhileTarpitting(t *testing.T) {
+	server := NewServer(Options{TarpitNames: []string{"abuse.example"}, TarpitDuration: 10 * time.Second})
+
+	tarpitted := createTestQueryMessage("abuse.example")
+	tarpittedBytes, err := tarpitted.MarshalBinary()
+	require.NoError(t, err)
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	conn := &mockPacketConn{
+		readData: [][]byte{tarpittedBytes, createTestQuery()},
+		readAddr: []net.Addr{addr, addr},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	server.ListenAndServe(ctx, conn)
+
+	assert.Len(t, conn.writtenData, 1)
+}
@@ -0,0 +1,217 @@
+package dnsserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// defaultTCPIdleTimeout is how long a TCP connection may wait for its next message.
+const defaultTCPIdleTimeout = 10 * time.Second
+
+var errEmptyTCPMessage = errors.New("zero-length TCP message")
+
+// ListenAndServeTCP serves DNS over TCP (RFC 7766) on ln until ctx is cancelled.
+// Every message on the stream is prefixed with its length as a 2-byte big-endian integer.
+// Connections over MaxTCPConns or MaxTCPAcceptRate are closed right away, so
+// a flood of connections can't make the server hold unbounded goroutines.
+func (s *Server) ListenAndServeTCP(ctx context.Context, ln net.Listener) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	opts := s.snapshot().opts
+	var slots chan struct{}
+	if opts.MaxTCPConns > 0 {
+		slots = make(chan struct{}, opts.MaxTCPConns)
+	}
+	limiter := newAcceptLimiter(opts.MaxTCPAcceptRate, s.now())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				slog.Info("Received interrupt signal, shutting down TCP listener...")
+				return
+			}
+			slog.Error("Error accepting TCP connection", "error", err)
+			return
+		}
+
+		if !limiter.allow(s.now()) {
+			s.rejectTCPConn(conn, "accept rate limit reached")
+			continue
+		}
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				s.rejectTCPConn(conn, "connection limit reached")
+				continue
+			}
+		}
+		go func() {
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			s.serveTCPConn(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) rejectTCPConn(conn net.Conn, reason string) {
+	slog.Debug("Closing TCP connection", "reason", reason, "addr", conn.RemoteAddr())
+	s.metrics.tcpRejected.Add(1)
+	conn.Close()
+}
+
+// acceptLimiter is a token bucket allowing rate connections per second, in
+// bursts of up to rate. A nil limiter allows everything. It is only used by
+// the accept loop, so it needs no locking.
+type acceptLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newAcceptLimiter(rate int, now time.Time) *acceptLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &acceptLimiter{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+func (l *acceptLimiter) allow(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func (s *Server) serveTCPConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	opts := s.snapshot().opts
+	idleTimeout := opts.TCPIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultTCPIdleTimeout
+	}
+
+	var r io.Reader = conn
+	clientAddr := conn.RemoteAddr()
+	if opts.ExpectProxyProtocol {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		buffered := bufio.NewReader(conn)
+		addr, err := readProxyHeader(buffered)
+		if err != nil {
+			slog.Debug("Error reading PROXY protocol header", "error", err, "addr", conn.RemoteAddr())
+			return
+		}
+		if addr != nil {
+			clientAddr = addr
+		}
+		r = buffered
+	}
+
+	for ctx.Err() == nil {
+		// The whole next message, length prefix and body, must arrive within the
+		// idle timeout, so a client announcing a length and then stalling can't
+		// hold the connection open.
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		queryBytes, err := readTCPMessage(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Debug("Error reading TCP message", "error", err, "addr", clientAddr)
+			}
+			return
+		}
+
+		queryCtx := withQueryID(ctx)
+		logger(queryCtx).Debug("Received TCP request", "n", len(queryBytes), "addr", clientAddr)
+		s.dnstap.log(dnstapClientQuery, dnstapTCP, clientAddr, conn.LocalAddr(), queryBytes)
+		s.metrics.querySize("tcp").observe(len(queryBytes))
+		responseBytes, err := s.handleQuery(queryCtx, queryBytes, addrIP(clientAddr), TransportTCP, maxTCPMessageSize)
+		if err != nil {
+			return
+		}
+		if err := writeTCPMessage(conn, responseBytes); err != nil {
+			logger(queryCtx).Debug("Error writing TCP message", "error", err, "addr", clientAddr)
+			return
+		}
+		s.dnstap.log(dnstapClientResponse, dnstapTCP, clientAddr, conn.LocalAddr(), responseBytes)
+		s.metrics.responses.Add(1)
+		s.metrics.responseSize("tcp").observe(len(responseBytes))
+	}
+}
+
+// readTCPMessage reads one length-prefixed message. The body buffer grows as
+// bytes actually arrive instead of being allocated from the announced length,
+// so a bogus prefix can't make the server reserve 64KiB per connection.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, errEmptyTCPMessage
+	}
+
+	var msg bytes.Buffer
+	n, err := msg.ReadFrom(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if n < int64(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return msg.Bytes(), nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > maxTCPMessageSize {
+		return errors.New("message too large for TCP")
+	}
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// forwardQueryTCP sends the query to the resolver over TCP. It is used when
+// ForwardProtocol asks for TCP, or when the resolver's UDP response came back
+// truncated and the client can take the full answer.
+func (s *Server) forwardQueryTCP(resolver string, queryBytes []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", resolver, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if err := writeTCPMessage(conn, queryBytes); err != nil {
+		return nil, err
+	}
+	s.dnstap.log(dnstapForwarderQuery, dnstapTCP, conn.LocalAddr(), conn.RemoteAddr(), queryBytes)
+
+	responseBytes, err := readTCPMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	s.dnstap.log(dnstapForwarderResponse, dnstapTCP, conn.LocalAddr(), conn.RemoteAddr(), responseBytes)
+	return responseBytes, nil
+}
@@ -0,0 +1,313 @@
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLargeQueryTruncatedOverUDPAndCompleteOverTCP(t *testing.T) {
+	server := NewServer(Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ListenAndServe(ctx, udpConn)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ListenAndServeTCP(ctx, ln)
+
+	query := createLargeTestQuery(30)
+	queryBytes, err := query.MarshalBinary()
+	require.NoError(t, err)
+
+	udpClient, err := net.Dial("udp", udpConn.LocalAddr().String())
+	require.NoError(t, err)
+	defer udpClient.Close()
+	udpClient.SetDeadline(time.Now().Add(time.Second))
+
+	_, err = udpClient.Write(queryBytes)
+	require.NoError(t, err)
+	buf := make([]byte, maxTCPMessageSize)
+	n, err := udpClient.Read(buf)
+	require.NoError(t, err)
+
+	udpHeader, err := NewHeaderFromBytes(buf[:n])
+	require.NoError(t, err)
+	assert.True(t, udpHeader.Truncated())
+	assert.LessOrEqual(t, n, maxUDPMessageSize)
+	assert.Less(t, udpHeader.AnswerCount, uint16(30))
+
+	tcpClient, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer tcpClient.Close()
+	tcpClient.SetDeadline(time.Now().Add(time.Second))
+
+	require.NoError(t, writeTCPMessage(tcpClient, queryBytes))
+	tcpResponse, err := readTCPMessage(tcpClient)
+	require.NoError(t, err)
+
+	tcpHeader, err := NewHeaderFromBytes(tcpResponse)
+	require.NoError(t, err)
+	assert.False(t, tcpHeader.Truncated())
+	assert.Equal(t, uint16(30), tcpHeader.AnswerCount)
+
+	query.ProcessQuestions()
+	want, err := query.MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, want, tcpResponse)
+}
+
+func TestTCPMessageRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go writeTCPMessage(client, []byte{1, 2, 3})
+
+	msg, err := readTCPMessage(server)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, msg)
+}
+
+func TestForwardQueryTCP(t *testing.T) {
+	server := NewServer(Options{Resolver: "127.0.0.1:53535"})
+
+	_, err := server.forwardQueryTCP(server.opts.Resolver, createTestQuery())
+
+	assert.Error(t, err)
+}
+
+func createLargeTestQuery(questions int) Message {
+	msg := Message{Header: NewHeader(4321, 0, uint16(questions), 0, 0, 0)}
+	for i := 0; i < questions; i++ {
+		msg.Questions = append(msg.Questions, Question{Name: fmt.Sprintf("host%02d.example.com", i), Type: 1, Class: 1})
+	}
+	return msg
+}
+
+func TestForwardProtocolTCPUsesTCPResolver(t *testing.T) {
+	resolver, exchanges := startMockTCPResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60)))
+	server := NewServer(Options{Resolver: resolver, ForwardProtocol: ForwardProtocolTCP})
+
+	response := queryType(t, server, "example.com", TYPE_A, nil)
+
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 1}, response.Answers[0].Data)
+	assert.Equal(t, int32(1), exchanges.Load())
+}
+
+func TestForwardProtocolUDPThenTCPRetriesFailedUDP(t *testing.T) {
+	resolver, exchanges := startMockTCPResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60)))
+	server := NewServer(Options{Resolver: resolver, ForwardProtocol: ForwardProtocolUDPThenTCP})
+
+	response := queryType(t, server, "example.com", TYPE_A, nil)
+
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, int32(1), exchanges.Load())
+}
+
+func TestForwardedResponseFillingBufferRetriesOverTCP(t *testing.T) {
+	respond := answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 60))
+	resolver, exchanges := startMockTCPResolver(t, respond)
+	conn, err := net.ListenPacket("udp", resolver)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxUDPMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := NewMessageFromBytes(buf[:n])
+			if err != nil {
+				continue
+			}
+			responseBytes, _ := respond(query).MarshalBinary()
+			conn.WriteTo(responseBytes, addr)
+		}
+	}()
+
+	// A read buffer smaller than the response stands in for one the resolver
+	// overflowed.
+	pool := &bufferPool{}
+	pool.responses.New = func() any {
+		buf := make([]byte, 32)
+		return &buf
+	}
+	lease := newBufferLease(pool, pool.get())
+	defer lease.release()
+	server := NewServer(Options{Resolver: resolver})
+
+	responseBytes, _, err := server.forwardQuery(withBufferLease(context.Background(), lease), createTestQuery(), maxUDPMessageSize)
+	require.NoError(t, err)
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 1}, response.Answers[0].Data)
+	assert.Equal(t, int32(1), exchanges.Load(), "the cut short UDP response should be retried over TCP")
+}
+
+// startMockTCPResolver runs a TCP resolver on a random local port that answers
+// every query with respond(query). It returns its address and a counter of the
+// queries it answered.
+func startMockTCPResolver(t *testing.T, respond func(query Message) Message) (string, *atomic.Int32) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	exchanges := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					queryBytes, err := readTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					query, err := NewMessageFromBytes(queryBytes)
+					if err != nil {
+						return
+					}
+					responseBytes, err := respond(query).MarshalBinary()
+					if err != nil {
+						return
+					}
+					exchanges.Add(1)
+					writeTCPMessage(conn, responseBytes)
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), exchanges
+}
+
+func TestTCPStalledMessageIsClosedAfterIdleTimeout(t *testing.T) {
+	server := NewServer(Options{TCPIdleTimeout: 100 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ListenAndServeTCP(ctx, ln)
+
+	before := runtime.NumGoroutine()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// announce a 65535 byte message and never send it
+	_, err = conn.Write([]byte{0xFF, 0xFF})
+	require.NoError(t, err)
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, os.ErrDeadlineExceeded, "server should close the connection before the client gives up")
+	assert.Less(t, time.Since(start), time.Second)
+
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= before
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTCPZeroLengthMessageIsRejected(t *testing.T) {
+	_, err := readTCPMessage(bytes.NewReader([]byte{0, 0}))
+
+	assert.ErrorIs(t, err, errEmptyTCPMessage)
+}
+
+func TestTCPShortMessageIsRejected(t *testing.T) {
+	_, err := readTCPMessage(bytes.NewReader([]byte{0, 10, 1, 2, 3}))
+
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestTCPConnectionsOverMaxTCPConnsAreClosed(t *testing.T) {
+	const limit = 3
+	server := NewServer(Options{MaxTCPConns: limit})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ListenAndServeTCP(ctx, ln)
+
+	before := runtime.NumGoroutine()
+	held := make([]net.Conn, 0, limit)
+	for range limit {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		held = append(held, conn)
+	}
+	// The held connections are served: each answers a query.
+	for _, conn := range held {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		require.NoError(t, writeTCPMessage(conn, createTestQuery()))
+		_, err := readTCPMessage(conn)
+		require.NoError(t, err)
+	}
+
+	for range 20 {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF, "excess connections are closed promptly")
+		conn.Close()
+	}
+	assert.Equal(t, uint64(20), server.metrics.tcpRejected.Load())
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before+limit+2)
+
+	// Closing a held connection frees its slot.
+	held[0].Close()
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if writeTCPMessage(conn, createTestQuery()) != nil {
+			return false
+		}
+		_, err = readTCPMessage(conn)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestAcceptLimiter(t *testing.T) {
+	start := time.Unix(0, 0)
+	limiter := newAcceptLimiter(2, start)
+
+	assert.True(t, limiter.allow(start))
+	assert.True(t, limiter.allow(start))
+	assert.False(t, limiter.allow(start), "the burst is used up")
+	assert.False(t, limiter.allow(start.Add(100*time.Millisecond)))
+	assert.True(t, limiter.allow(start.Add(600*time.Millisecond)), "tokens refill at the rate")
+	assert.True(t, newAcceptLimiter(0, start).allow(start))
+}
@@ -0,0 +1,80 @@
+package dnsserver
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// NameCount is how many queries asked about a name.
+type NameCount struct {
+	Name  string
+	Count uint64
+}
+
+// topNames tracks the most queried names with the Space-Saving algorithm: it
+// keeps at most capacity counters, and a name seen while they are all taken
+// replaces the least counted one, inheriting its count. Memory stays bounded
+// however many distinct names clients make up, at the cost of counts that can
+// overestimate names that entered late, by no more than the evicted count.
+// A nil tracker records nothing.
+type topNames struct {
+	mu       sync.Mutex
+	capacity int
+	counts   map[string]uint64
+}
+
+func newTopNames(capacity int) *topNames {
+	if capacity <= 0 {
+		return nil
+	}
+	return &topNames{capacity: capacity, counts: make(map[string]uint64, capacity)}
+}
+
+func (t *topNames) record(name string) {
+	if t == nil {
+		return
+	}
+	name = zoneKey(name)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.counts[name]; ok || len(t.counts) < t.capacity {
+		t.counts[name]++
+		return
+	}
+
+	var evicted string
+	least := ^uint64(0)
+	for candidate, count := range t.counts {
+		if count < least {
+			evicted, least = candidate, count
+		}
+	}
+	delete(t.counts, evicted)
+	t.counts[name] = least + 1
+}
+
+func (t *topNames) top(n int) []NameCount {
+	if t == nil || n <= 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	names := make([]NameCount, 0, len(t.counts))
+	for name, count := range t.counts {
+		names = append(names, NameCount{Name: name, Count: count})
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(names, func(a, b NameCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Name, b.Name))
+	})
+	return names[:min(n, len(names))]
+}
+
+// TopNames returns up to n of the most queried names, most queried first,
+// when TrackTopNames is set.
+func (s *Server) TopNames(n int) []NameCount {
+	return s.topNames.top(n)
+}
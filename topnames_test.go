@@ -0,0 +1,59 @@
+package dnsserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopNamesOrdersByQueryCount(t *testing.T) {
+	server := NewServer(Options{TrackTopNames: 100})
+	for name, count := range map[string]int{"a.example.com": 5, "b.example.com": 1, "C.example.com": 3} {
+		for range count {
+			queryType(t, server, name, TYPE_A, nil)
+		}
+	}
+
+	assert.Equal(t, []NameCount{
+		{Name: "a.example.com", Count: 5},
+		{Name: "c.example.com", Count: 3},
+	}, server.TopNames(2))
+	assert.Len(t, server.TopNames(10), 3)
+
+	base := startAdminHTTP(t, server)
+	resp, err := http.Get(base + "/topnames?n=1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "5 a.example.com.\n", string(body))
+	assert.Equal(t, http.StatusBadRequest, getStatus(t, base+"/topnames?n=x"))
+}
+
+func TestTopNamesStaysBounded(t *testing.T) {
+	tracker := newTopNames(10)
+	// Space-Saving keeps every name queried more often than once per
+	// capacity queries, however many one-off names come in between.
+	for i := range 1000 {
+		tracker.record(fmt.Sprintf("random%d.example.com", i))
+		if i%4 == 0 {
+			tracker.record("hot.example.com")
+		}
+	}
+
+	assert.Len(t, tracker.counts, 10)
+	top := tracker.top(1)
+	require.Len(t, top, 1)
+	assert.Equal(t, "hot.example.com", top[0].Name)
+}
+
+func TestTopNamesDisabledByDefault(t *testing.T) {
+	server := NewServer(Options{})
+	queryType(t, server, "example.com", TYPE_A, nil)
+
+	assert.Empty(t, server.TopNames(10))
+}
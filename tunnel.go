@@ -0,0 +1,140 @@
+package dnsserver
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TunnelDetection configures heuristic detection of DNS tunneling. Every query
+// under a parent domain (its last two labels) scores a point for each sign of
+// tunneling: a long subdomain not seen before in the window, a high-entropy
+// subdomain, and a TXT or NULL query type. Once a parent's score reaches
+// Threshold within Window, queries under it are refused for Cooldown.
+type TunnelDetection struct {
+	Threshold int // zero disables detection
+	Window    time.Duration
+	Cooldown  time.Duration
+}
+
+const (
+	tunnelMinSubdomainLength = 16
+	tunnelMinEntropy         = 3.5 // bits per character
+	tunnelMaxSeenPerParent   = 1024
+	tunnelMaxParents         = 10000
+	// tunnelEvictionInterval spaces out the scans for expired parents a full
+	// detector makes, so a flood of new parents doesn't scan on every query.
+	tunnelEvictionInterval = time.Second
+)
+
+type tunnelStats struct {
+	windowStart  time.Time
+	score        int
+	seen         map[string]struct{}
+	blockedUntil time.Time
+}
+
+type tunnelDetector struct {
+	opts    TunnelDetection
+	mu      sync.Mutex
+	parents map[string]*tunnelStats
+	// nextEviction is when a full detector may next scan for expired parents.
+	nextEviction time.Time
+}
+
+func newTunnelDetector(opts TunnelDetection) *tunnelDetector {
+	if opts.Threshold <= 0 {
+		return nil
+	}
+	return &tunnelDetector{opts: opts, parents: make(map[string]*tunnelStats)}
+}
+
+// observe records a query and reports whether its parent domain is currently blocked.
+func (d *tunnelDetector) observe(q Question, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+
+	labels := nameToLabels(strings.ToLower(q.Name))
+	if len(labels) <= 2 {
+		return false
+	}
+	parent := strings.Join(labels[len(labels)-2:], ".")
+	subdomain := strings.Join(labels[:len(labels)-2], ".")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats, ok := d.parents[parent]
+	if !ok {
+		if len(d.parents) >= tunnelMaxParents && !now.Before(d.nextEviction) {
+			d.evictExpired(now)
+			d.nextEviction = now.Add(tunnelEvictionInterval)
+		}
+		if len(d.parents) >= tunnelMaxParents {
+			// Parents beyond the cap go untracked until some expire.
+			return false
+		}
+		stats = &tunnelStats{windowStart: now, seen: make(map[string]struct{})}
+		d.parents[parent] = stats
+	}
+
+	if now.Before(stats.blockedUntil) {
+		return true
+	}
+	if now.Sub(stats.windowStart) > d.opts.Window {
+		stats.windowStart = now
+		stats.score = 0
+		stats.seen = make(map[string]struct{})
+	}
+
+	if _, seen := stats.seen[subdomain]; !seen {
+		if len(stats.seen) < tunnelMaxSeenPerParent {
+			stats.seen[subdomain] = struct{}{}
+		}
+		if len(subdomain) >= tunnelMinSubdomainLength {
+			stats.score++
+		}
+	}
+	if shannonEntropy(strings.ReplaceAll(subdomain, ".", "")) >= tunnelMinEntropy {
+		stats.score++
+	}
+	if q.Type == TYPE_TXT || q.Type == TYPE_NULL {
+		stats.score++
+	}
+
+	if stats.score >= d.opts.Threshold {
+		stats.blockedUntil = now.Add(d.opts.Cooldown)
+		stats.score = 0
+		stats.seen = make(map[string]struct{})
+	}
+	return false
+}
+
+// evictExpired drops parents that are neither blocked nor inside their window,
+// making room under tunnelMaxParents for new ones.
+func (d *tunnelDetector) evictExpired(now time.Time) {
+	for parent, stats := range d.parents {
+		if !now.Before(stats.blockedUntil) && now.Sub(stats.windowStart) > d.opts.Window {
+			delete(d.parents, parent)
+		}
+	}
+}
+
+func shannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	entropy := 0.0
+	total := float64(len(s))
+	for _, c := range counts {
+		p := float64(c) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
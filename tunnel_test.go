@@ -0,0 +1,81 @@
+package dnsserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelDetectionRefusesParentAfterHighEntropySubdomains(t *testing.T) {
+	now := time.Now()
+	server := NewServer(Options{TunnelDetection: TunnelDetection{Threshold: 10, Window: time.Minute, Cooldown: time.Minute}})
+	server.clock = func() time.Time { return now }
+
+	require.Equal(t, RCODE_NO_ERROR, queryRcode(t, server, randomLabel(t)+".tunnel.net"))
+	for i := 0; i < 9; i++ {
+		queryRcode(t, server, randomLabel(t)+".tunnel.net")
+	}
+
+	assert.Equal(t, RCODE_REFUSED, queryRcode(t, server, randomLabel(t)+".tunnel.net"))
+	assert.Equal(t, RCODE_REFUSED, queryRcode(t, server, "www.tunnel.net"))
+	assert.Equal(t, RCODE_NO_ERROR, queryRcode(t, server, "www.other.net"))
+
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, RCODE_NO_ERROR, queryRcode(t, server, "www.tunnel.net"))
+}
+
+func TestTunnelDetectionIgnoresOrdinaryQueries(t *testing.T) {
+	server := NewServer(Options{TunnelDetection: TunnelDetection{Threshold: 5, Window: time.Minute, Cooldown: time.Minute}})
+
+	for i := 0; i < 50; i++ {
+		require.Equal(t, RCODE_NO_ERROR, queryRcode(t, server, "www.example.com"))
+	}
+}
+
+func TestTunnelDetectionCapsTrackedParents(t *testing.T) {
+	detector := newTunnelDetector(TunnelDetection{Threshold: 10, Window: time.Minute, Cooldown: time.Minute})
+	now := time.Now()
+	question := func(parent int) Question {
+		return Question{Name: fmt.Sprintf("www.p%d.net", parent), Type: TYPE_A, Class: CLASS_IN}
+	}
+
+	for i := 0; i < tunnelMaxParents+100; i++ {
+		detector.observe(question(i), now)
+	}
+	assert.Len(t, detector.parents, tunnelMaxParents, "parents past the cap shouldn't be tracked while none expired")
+
+	now = now.Add(2 * time.Minute)
+	detector.observe(question(-1), now)
+	assert.Len(t, detector.parents, 1, "expired parents should make room for new ones")
+}
+
+func TestShannonEntropy(t *testing.T) {
+	assert.Equal(t, 0.0, shannonEntropy("aaaa"))
+	assert.Equal(t, 2.0, shannonEntropy("abcd"))
+}
+
+func randomLabel(t *testing.T) string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return hex.EncodeToString(b)
+}
+
+func queryRcode(t *testing.T, server *Server, name string) uint8 {
+	msg := createTestQueryMessage(name)
+	queryBytes, err := msg.MarshalBinary()
+	require.NoError(t, err)
+
+	responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+
+	h, err := NewHeaderFromBytes(responseBytes)
+	require.NoError(t, err)
+	return h.ResponseCode()
+}
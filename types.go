@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
 	"strings"
 )
 
@@ -43,6 +46,73 @@ func (h *Header) SetQuery(isQuery bool) {
 	}
 }
 
+// IsQuery reports whether the QR bit marks the message as a query.
+func (h Header) IsQuery() bool {
+	return h.Flags&(1<<15) == 0
+}
+
+// SetTruncated sets the TC (Truncation) bit in the DNS header flags.
+// A truncated response tells the client to retry the query over TCP.
+func (h *Header) SetTruncated(truncated bool) {
+	const tcMask uint16 = 1 << 9 // bit 9 is the TC bit
+	if truncated {
+		h.Flags |= tcMask
+	} else {
+		h.Flags &^= tcMask
+	}
+}
+
+// Truncated reports whether the TC bit is set.
+func (h Header) Truncated() bool {
+	return h.Flags&(1<<9) != 0
+}
+
+// SetRecursionDesired sets the RD (Recursion Desired) bit in the DNS header flags.
+func (h *Header) SetRecursionDesired(desired bool) {
+	const rdMask uint16 = 1 << 8 // bit 8 is the RD bit
+	if desired {
+		h.Flags |= rdMask
+	} else {
+		h.Flags &^= rdMask
+	}
+}
+
+// RecursionDesired reports whether the RD bit is set.
+func (h Header) RecursionDesired() bool {
+	return h.Flags&(1<<8) != 0
+}
+
+// SetAuthoritative sets the AA (Authoritative Answer) bit in the DNS header flags.
+func (h *Header) SetAuthoritative(authoritative bool) {
+	const aaMask uint16 = 1 << 10 // bit 10 is the AA bit
+	if authoritative {
+		h.Flags |= aaMask
+	} else {
+		h.Flags &^= aaMask
+	}
+}
+
+// Authoritative reports whether the AA bit is set.
+func (h Header) Authoritative() bool {
+	return h.Flags&(1<<10) != 0
+}
+
+// SetAuthenticData sets the AD (Authentic Data) bit in the DNS header flags.
+// A resolver sets it on responses it validated with DNSSEC.
+func (h *Header) SetAuthenticData(authentic bool) {
+	const adMask uint16 = 1 << 5 // bit 5 is the AD bit
+	if authentic {
+		h.Flags |= adMask
+	} else {
+		h.Flags &^= adMask
+	}
+}
+
+// AuthenticData reports whether the AD bit is set.
+func (h Header) AuthenticData() bool {
+	return h.Flags&(1<<5) != 0
+}
+
 var (
 	RCODE_NO_ERROR        = uint8(0)
 	RCODE_FORMAT_ERROR    = uint8(1)
@@ -63,17 +133,25 @@ func (h *Header) SetResponseCode(code uint8) {
 	h.Flags |= uint16(code)
 }
 
-// The Header struct has no padding at the moment, so this can parse without relying on that.
-// Future changes need to be aware of that.
+// ResponseCode returns the RCODE from the lowest 4 bits of the Flags field.
+func (h Header) ResponseCode() uint8 {
+	return uint8(h.Flags & 0x000F)
+}
+
 func (h Header) MarshalBinary() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0, 12))
-	err := binary.Write(buf, binary.BigEndian, h)
-	if err != nil {
-		return nil, err
+	return h.AppendBinary(nil)
+}
+
+// AppendBinary appends the encoded header to b, implementing encoding.BinaryAppender.
+func (h Header) AppendBinary(b []byte) ([]byte, error) {
+	for _, v := range []uint16{h.ID, h.Flags, h.QuestionsCount, h.AnswerCount, h.AuthorityCount, h.AdditionalCount} {
+		b = binary.BigEndian.AppendUint16(b, v)
 	}
-	return buf.Bytes(), nil
+	return b, nil
 }
 
+// The Header struct has no padding at the moment, so this can parse without relying on that.
+// Future changes need to be aware of that.
 func (h *Header) UnmarshalBinary(data []byte) error {
 	return binary.Read(bytes.NewReader(data), binary.BigEndian, h)
 }
@@ -87,27 +165,151 @@ func NewHeaderFromBytes(data []byte) (Header, error) {
 	return header, nil
 }
 
+var (
+	TYPE_A      = uint16(1)
+	TYPE_NS     = uint16(2)
+	TYPE_CNAME  = uint16(5)
+	TYPE_SOA    = uint16(6)
+	TYPE_NULL   = uint16(10)
+	TYPE_PTR    = uint16(12)
+	TYPE_HINFO  = uint16(13)
+	TYPE_MX     = uint16(15)
+	TYPE_TXT    = uint16(16)
+	TYPE_AAAA   = uint16(28)
+	TYPE_SRV    = uint16(33)
+	TYPE_DNAME  = uint16(39)
+	TYPE_OPT    = uint16(41)
+	TYPE_DS     = uint16(43)
+	TYPE_RRSIG  = uint16(46)
+	TYPE_NSEC   = uint16(47)
+	TYPE_DNSKEY = uint16(48)
+	TYPE_HTTPS  = uint16(65)
+	TYPE_AXFR   = uint16(252)
+	TYPE_ANY    = uint16(255)
+
+	CLASS_IN = uint16(1)
+	CLASS_CH = uint16(3)
+)
+
 type Question struct {
 	Name  string
 	Type  uint16
 	Class uint16
 }
 
+// nameToLabels splits a name into its labels. The root name ("" or ".")
+// has no labels and is encoded as the single terminating zero byte.
 func nameToLabels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
 	return strings.Split(name, ".")
 }
 
-func (q Question) MarshalBinary() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0, 12))
-	for _, label := range nameToLabels(q.Name) {
-		buf.WriteByte(byte(len(label)))
-		buf.WriteString(label)
+const (
+	maxLabelLength = 63
+	maxNameLength  = 255
+	// maxCompressionPointers bounds the pointers followed while reading a
+	// name. A name of maxNameLength has at most that many labels to point at,
+	// so more can only come from a loop.
+	maxCompressionPointers = maxNameLength / 2
+)
+
+var (
+	errLabelTooLong = errors.New("label exceeds 63 bytes")
+	errNameTooLong  = errors.New("name exceeds 255 bytes")
+	errEmptyLabel   = errors.New("name has an empty label")
+)
+
+// validateName checks that name can be encoded: every label must fit the 63
+// byte limit (and so the length byte), and the whole encoded name 255 bytes.
+func validateName(name string) error {
+	length := 1 // terminating zero byte
+	rest := strings.TrimSuffix(name, ".")
+	for more := rest != ""; more; {
+		var label string
+		label, rest, more = strings.Cut(rest, ".")
+		if label == "" {
+			return fmt.Errorf("%w: %q", errEmptyLabel, name)
+		}
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("%w: %q", errLabelTooLong, label)
+		}
+		length += 1 + len(label)
+	}
+	if length > maxNameLength {
+		return fmt.Errorf("%w: %q", errNameTooLong, name)
 	}
-	buf.WriteByte(0)
-	binary.Write(buf, binary.BigEndian, q.Type)
-	binary.Write(buf, binary.BigEndian, q.Class)
+	return nil
+}
 
-	return buf.Bytes(), nil
+// appendName appends the uncompressed wire encoding of name to b.
+func appendName(b []byte, name string) []byte {
+	for _, label := range nameToLabels(name) {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readName decodes the domain name starting at offset in msg, following
+// compression pointers (RFC 1035 4.1.4). It returns the name and the offset
+// right after the name as it appears at offset. Pointers that loop, which a
+// crafted message can use to hang the parser, are reported as an error.
+func readName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	pointers := 0
+
+	for {
+		if offset >= len(msg) {
+			return "", 0, errors.New("name exceeds message")
+		}
+		length := int(msg[offset])
+		offset++
+
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xC0 == 0xC0:
+			if offset >= len(msg) {
+				return "", 0, errors.New("compression pointer exceeds message")
+			}
+			if pointers++; pointers > maxCompressionPointers {
+				return "", 0, errors.New("too many compression pointers")
+			}
+			if next < 0 {
+				next = offset + 1
+			}
+			offset = (length&0x3F)<<8 | int(msg[offset])
+		case length&0xC0 != 0:
+			return "", 0, errors.New("unsupported label type")
+		default:
+			if offset+length > len(msg) {
+				return "", 0, errors.New("label exceeds message")
+			}
+			labels = append(labels, string(msg[offset:offset+length]))
+			offset += length
+		}
+	}
+}
+
+func (q Question) MarshalBinary() ([]byte, error) {
+	return q.AppendBinary(nil)
+}
+
+// AppendBinary appends the encoded question to b, implementing encoding.BinaryAppender.
+func (q Question) AppendBinary(b []byte) ([]byte, error) {
+	if err := validateName(q.Name); err != nil {
+		return nil, err
+	}
+	b = appendName(b, q.Name)
+	b = binary.BigEndian.AppendUint16(b, q.Type)
+	return binary.BigEndian.AppendUint16(b, q.Class), nil
 }
 
 func NewQuestionFromBytes(data []byte) (Question, int, error) {
@@ -117,25 +319,23 @@ func NewQuestionFromBytes(data []byte) (Question, int, error) {
 	if data[0] <= 0 {
 		return Question{}, 0, errors.New("invalid question")
 	}
+	return readQuestion(data, 0)
+}
 
-	var labels []string
-	offset := 0
-
-	for {
-		length := int(data[offset])
-		offset++
-		if length == 0 {
-			break
-		}
-
-		labels = append(labels, string(data[offset:offset+length]))
-		offset += length
+// readQuestion decodes the question at offset in msg and returns the offset after it.
+func readQuestion(msg []byte, offset int) (Question, int, error) {
+	name, offset, err := readName(msg, offset)
+	if err != nil {
+		return Question{}, 0, err
+	}
+	if offset+4 > len(msg) {
+		return Question{}, 0, errors.New("not enough data")
 	}
 
 	question := Question{
-		Name:  strings.Join(labels, "."),
-		Type:  binary.BigEndian.Uint16(data[offset : offset+2]),
-		Class: binary.BigEndian.Uint16(data[offset+2 : offset+4]),
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(msg[offset : offset+2]),
+		Class: binary.BigEndian.Uint16(msg[offset+2 : offset+4]),
 	}
 
 	return question, offset + 4, nil
@@ -151,25 +351,143 @@ type Answer struct {
 }
 
 func (a Answer) MarshalBinary() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0, 10))
-	for _, label := range nameToLabels(a.Name) {
-		buf.WriteByte(byte(len(label)))
-		buf.WriteString(label)
+	return a.AppendBinary(nil)
+}
+
+// AppendBinary appends the encoded record to b, implementing encoding.BinaryAppender.
+func (a Answer) AppendBinary(b []byte) ([]byte, error) {
+	if err := validateName(a.Name); err != nil {
+		return nil, err
+	}
+	if a.Type == TYPE_OPT {
+		b = append(b, 0)
+	} else {
+		b = appendName(b, a.Name)
+	}
+	b = binary.BigEndian.AppendUint16(b, a.Type)
+	b = binary.BigEndian.AppendUint16(b, a.Class)
+	b = binary.BigEndian.AppendUint32(b, a.TTL)
+	b = binary.BigEndian.AppendUint16(b, a.Length)
+	return append(b, a.Data...), nil
+}
+
+func NewAnswerFromBytes(data []byte) (Answer, int, error) {
+	return readRecord(data, 0)
+}
+
+// readRecord decodes the resource record at offset in msg and returns the offset after it.
+// Names inside the record data of well-known types are decompressed, so the
+// record can be re-encoded on its own.
+func readRecord(msg []byte, offset int) (Answer, int, error) {
+	name, offset, err := readName(msg, offset)
+	if err != nil {
+		return Answer{}, 0, err
+	}
+	if offset+10 > len(msg) {
+		return Answer{}, 0, errors.New("not enough data")
+	}
+
+	answer := Answer{
+		Name:   name,
+		Type:   binary.BigEndian.Uint16(msg[offset : offset+2]),
+		Class:  binary.BigEndian.Uint16(msg[offset+2 : offset+4]),
+		TTL:    binary.BigEndian.Uint32(msg[offset+4 : offset+8]),
+		Length: binary.BigEndian.Uint16(msg[offset+8 : offset+10]),
+	}
+	offset += 10
+
+	end := offset + int(answer.Length)
+	if end > len(msg) {
+		return Answer{}, 0, errors.New("record data exceeds message")
+	}
+	answer.Data, err = readRecordData(msg, offset, end, answer.Type)
+	if err != nil {
+		return Answer{}, 0, err
 	}
-	buf.WriteByte(0)
-	binary.Write(buf, binary.BigEndian, a.Type)
-	binary.Write(buf, binary.BigEndian, a.Class)
-	binary.Write(buf, binary.BigEndian, a.TTL)
-	binary.Write(buf, binary.BigEndian, a.Length)
-	buf.Write(a.Data)
+	answer.Length = uint16(len(answer.Data))
 
-	return buf.Bytes(), nil
+	return answer, end, nil
+}
+
+// readRecordData returns the record data between offset and end with any
+// embedded names expanded. Types not listed, including those the server knows
+// nothing about, are kept as the opaque bytes they came in (RFC 3597), so they
+// relay and cache unchanged; names in them are never compressed, as RFC 3597
+// section 4 requires of new types, so they are left alone.
+func readRecordData(msg []byte, offset, end int, recordType uint16) ([]byte, error) {
+	var prefix, names, suffix int
+	switch recordType {
+	case TYPE_NS, TYPE_CNAME, TYPE_PTR, TYPE_DNAME:
+		names = 1
+	case TYPE_MX:
+		prefix, names = 2, 1
+	case TYPE_SRV:
+		prefix, names = 6, 1
+	case TYPE_SOA:
+		names, suffix = 2, 20
+	default:
+		return append([]byte{}, msg[offset:end]...), nil
+	}
+
+	if offset+prefix > end {
+		return nil, errors.New("record data too short")
+	}
+	data := append([]byte{}, msg[offset:offset+prefix]...)
+	offset += prefix
+	for i := 0; i < names; i++ {
+		name, next, err := readName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next > end {
+			return nil, errors.New("name exceeds record data")
+		}
+		data = appendName(data, name)
+		offset = next
+	}
+	if offset+suffix != end {
+		return nil, errors.New("invalid record data length")
+	}
+	return append(data, msg[offset:end]...), nil
 }
 
 type Message struct {
-	Header    Header
-	Questions []Question
-	Answers   []Answer
+	Header      Header
+	Questions   []Question
+	Answers     []Answer
+	Authorities []Answer
+	Additionals []Answer
+}
+
+// NewQuery builds a standard recursive query for one question, with a random
+// nonzero ID and the RD bit set.
+func NewQuery(name string, qtype, qclass uint16) Message {
+	query := Message{
+		Header:    NewHeader(randomID(), 0, 1, 0, 0, 0),
+		Questions: []Question{{Name: name, Type: qtype, Class: qclass}},
+	}
+	query.Header.SetRecursionDesired(true)
+	return query
+}
+
+// randomID returns a random message ID, never 0.
+func randomID() uint16 {
+	return uint16(rand.UintN(1<<16-1) + 1)
+}
+
+// readRecords decodes count resource records starting at offset and returns
+// them along with the offset right after the last one.
+func readRecords(data []byte, offset int, count uint16) ([]Answer, int, error) {
+	var records []Answer
+	for i := 0; i < int(count); i++ {
+		record, next, err := readRecord(data, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, record)
+		offset = next
+	}
+	return records, offset, nil
 }
 
 func NewMessageFromBytes(data []byte) (Message, error) {
@@ -178,19 +496,36 @@ func NewMessageFromBytes(data []byte) (Message, error) {
 		return Message{}, err
 	}
 
+	offset := 12
 	questions := make([]Question, 0)
 	for i := 0; i < int(h.QuestionsCount); i++ {
-		q, n, err := NewQuestionFromBytes(data[12:])
+		q, next, err := readQuestion(data, offset)
 		if err != nil {
 			return Message{}, err
 		}
 		questions = append(questions, q)
-		data = data[n:]
+		offset = next
+	}
+
+	answers, offset, err := readRecords(data, offset, h.AnswerCount)
+	if err != nil {
+		return Message{}, err
+	}
+	authorities, offset, err := readRecords(data, offset, h.AuthorityCount)
+	if err != nil {
+		return Message{}, err
+	}
+	additionals, _, err := readRecords(data, offset, h.AdditionalCount)
+	if err != nil {
+		return Message{}, err
 	}
 
 	m := Message{
-		Header:    h,
-		Questions: questions,
+		Header:      h,
+		Questions:   questions,
+		Answers:     answers,
+		Authorities: authorities,
+		Additionals: additionals,
 	}
 
 	m.Header.QuestionsCount = uint16(len(questions))
@@ -198,30 +533,34 @@ func NewMessageFromBytes(data []byte) (Message, error) {
 }
 
 func (m Message) MarshalBinary() ([]byte, error) {
-	headerBytes, err := m.Header.MarshalBinary()
-	if err != nil {
-		return nil, err
-	}
-	buf := bytes.NewBuffer(make([]byte, 0, 100))
-	buf.Write(headerBytes)
+	return m.AppendBinary(nil)
+}
+
+// AppendBinary appends the encoded message to b, implementing
+// encoding.BinaryAppender, so callers can encode into a reused buffer.
+// Compression pointers are relative to the start of the appended message.
+func (m Message) AppendBinary(b []byte) ([]byte, error) {
+	e := newMessageEncoder(b)
+	defer e.release()
+	e.buf, _ = m.Header.AppendBinary(e.buf)
 
 	for _, q := range m.Questions {
-		questionBytes, err := q.MarshalBinary()
-		if err != nil {
+		if err := validateName(q.Name); err != nil {
 			return nil, err
 		}
-		buf.Write(questionBytes)
+		e.appendQuestion(q)
 	}
 
-	for _, answer := range m.Answers {
-		answerBytes, err := answer.MarshalBinary()
-		if err != nil {
-			return nil, err
+	for _, section := range [][]Answer{m.Answers, m.Authorities, m.Additionals} {
+		for _, answer := range section {
+			if err := validateName(answer.Name); err != nil {
+				return nil, err
+			}
+			e.appendRecord(answer)
 		}
-		buf.Write(answerBytes)
 	}
 
-	return buf.Bytes(), nil
+	return e.buf, nil
 }
 
 func (m *Message) ProcessQuestions() {
@@ -243,14 +582,94 @@ func (m *Message) ProcessQuestions() {
 	m.SetResponse(len(answers))
 }
 
+// SetResponse turns the query into a response with lenAnswers answers. The
+// query's additional records are dropped, but if it used EDNS the response
+// keeps an OPT record advertising the server's own UDP size. The AD bit a
+// client may set in its query is cleared, since the server didn't validate
+// the answers it adds.
 func (m *Message) SetResponse(lenAnswers int) {
+	_, hasOPT := m.OPT()
+
 	m.Header.SetQuery(false)
+	m.Header.SetAuthenticData(false)
 	m.Header.AnswerCount = uint16(lenAnswers)
+	m.Header.AdditionalCount = 0
+	m.Additionals = nil
 
-	// clear additional count because we don’t support EDNS; avoids malformed packet warnings in clients like dig
+	if hasOPT {
+		m.SetOPT(OPT{UDPSize: ednsUDPSize})
+	}
+}
+
+// SetError turns the message into a response with no records carrying rcode.
+// If the query used EDNS the response keeps an OPT record, with ede attached
+// as an Extended DNS Error (RFC 8914) when one is given. Like SetResponse, it
+// clears the AD bit.
+func (m *Message) SetError(rcode uint8, ede *ExtendedError) {
+	_, hasOPT := m.OPT()
+
+	m.Header.SetQuery(false)
+	m.Header.SetAuthenticData(false)
+	m.Header.SetResponseCode(rcode)
+	m.Header.AnswerCount = 0
+	m.Header.AuthorityCount = 0
 	m.Header.AdditionalCount = 0
+	m.Answers = nil
+	m.Authorities = nil
+	m.Additionals = nil
+
+	if hasOPT {
+		opt := OPT{UDPSize: ednsUDPSize}
+		if ede != nil {
+			opt.Options = append(opt.Options, ede.Option())
+		}
+		m.SetOPT(opt)
+	}
 }
 
 func (m *Message) AddAnswers(answers []Answer) {
 	m.Answers = answers
 }
+
+// MarshalTruncated encodes the message like MarshalBinary, but if the result
+// would exceed maxSize it drops the authority section and whole answers from
+// the end, keeping only the OPT record in the additional section, and sets the TC bit.
+// The message itself is left untouched, so the same response can still be
+// encoded in full for TCP.
+func (m Message) MarshalTruncated(maxSize int) ([]byte, error) {
+	full, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if len(full) <= maxSize {
+		return full, nil
+	}
+
+	truncated := Message{
+		Header:    m.Header,
+		Questions: m.Questions,
+	}
+	truncated.Header.SetTruncated(true)
+	truncated.Header.AuthorityCount = 0
+	truncated.Header.AdditionalCount = 0
+	if opt, ok := m.OPT(); ok {
+		truncated.SetOPT(opt)
+	}
+
+	// Compression makes each record's size depend on what precedes it, so search
+	// for the largest prefix of the answers that still fits.
+	fits := sort.Search(len(m.Answers)+1, func(n int) bool {
+		candidate := truncated
+		candidate.Answers = m.Answers[:n]
+		candidate.Header.AnswerCount = uint16(n)
+		buf, err := candidate.MarshalBinary()
+		return err != nil || len(buf) > maxSize
+	}) - 1
+	if fits < 0 {
+		fits = 0
+	}
+
+	truncated.Answers = m.Answers[:fits]
+	truncated.Header.AnswerCount = uint16(fits)
+	return truncated.MarshalBinary()
+}
@@ -1,6 +1,10 @@
 package dnsserver
 
 import (
+	"context"
+	"encoding"
+	"net"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -56,3 +60,253 @@ func TestMessageWithQuestionAndAnswer(t *testing.T) {
 	require.Equal(t, uint16(4), msg.Answers[0].Length)
 	require.Equal(t, []byte{8, 8, 8, 8}, msg.Answers[0].Data)
 }
+
+func TestMessageMarshalTruncated(t *testing.T) {
+	msg := Message{
+		Header: NewHeader(1234, 0, 1, 0, 0, 0),
+		Questions: []Question{
+			{Name: "google.com", Type: 1, Class: 1},
+		},
+	}
+	for i := 0; i < 40; i++ {
+		msg.Answers = append(msg.Answers, Answer{Name: "google.com", Type: 1, Class: 1, TTL: 60, Length: 4, Data: []byte{8, 8, 8, 8}})
+	}
+	msg.Header.AnswerCount = uint16(len(msg.Answers))
+
+	full, err := msg.MarshalBinary()
+	require.NoError(t, err)
+	require.Greater(t, len(full), maxUDPMessageSize)
+
+	buf, err := msg.MarshalTruncated(maxUDPMessageSize)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(buf), maxUDPMessageSize)
+
+	h, err := NewHeaderFromBytes(buf)
+	require.NoError(t, err)
+	require.True(t, h.Truncated())
+	require.Less(t, h.AnswerCount, uint16(40))
+	require.Len(t, msg.Answers, 40)
+
+	untouched, err := msg.MarshalTruncated(len(full))
+	require.NoError(t, err)
+	require.Equal(t, full, untouched)
+}
+
+func TestNewMessageFromBytesWithCompressedNames(t *testing.T) {
+	header, err := NewHeader(1, 0x8180, 1, 2, 0, 0).MarshalBinary()
+	require.NoError(t, err)
+
+	buf := append(header, appendName(nil, "www.example.com")...)
+	buf = append(buf, 0, 5, 0, 1) // CNAME IN
+	// www.example.com CNAME example.com, with both names compressed
+	buf = append(buf, 0xC0, 12, 0, 5, 0, 1, 0, 0, 0, 60, 0, 2, 0xC0, 16)
+	// example.com A 93.184.216.34
+	buf = append(buf, 0xC0, 16, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 93, 184, 216, 34)
+
+	msg, err := NewMessageFromBytes(buf)
+	require.NoError(t, err)
+	require.Len(t, msg.Answers, 2)
+	require.Equal(t, "www.example.com", msg.Answers[0].Name)
+	require.Equal(t, appendName(nil, "example.com"), msg.Answers[0].Data)
+	require.Equal(t, uint16(13), msg.Answers[0].Length)
+	require.Equal(t, "example.com", msg.Answers[1].Name)
+	require.Equal(t, []byte{93, 184, 216, 34}, msg.Answers[1].Data)
+
+	reencoded, err := msg.MarshalBinary()
+	require.NoError(t, err)
+	got, err := NewMessageFromBytes(reencoded)
+	require.NoError(t, err)
+	require.Equal(t, msg, got)
+}
+
+func TestReadNameRejectsCompressionLoops(t *testing.T) {
+	header, err := NewHeader(1, 0x8180, 1, 0, 0, 0).MarshalBinary()
+	require.NoError(t, err)
+
+	for name, encoded := range map[string][]byte{
+		"self":  {0xC0, 12},
+		"cycle": {3, 'w', 'w', 'w', 0xC0, 18, 0xC0, 12},
+	} {
+		_, _, err := readName(append(header, encoded...), 12)
+		require.Error(t, err, name)
+
+		_, err = NewMessageFromBytes(append(append(header, encoded...), 0, 1, 0, 1))
+		require.Error(t, err, name)
+	}
+}
+
+func FuzzReadName(f *testing.F) {
+	header, err := NewHeader(1, 0x8180, 1, 0, 0, 0).MarshalBinary()
+	require.NoError(f, err)
+	f.Add(append(header, appendName(nil, "www.example.com")...))
+	f.Add(append(header, 0xC0, 12))
+	f.Add(append(header, 3, 'w', 'w', 'w', 0xC0, 18, 0xC0, 12))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		name, next, err := readName(msg, min(12, len(msg)))
+		if err == nil {
+			require.LessOrEqual(t, next, len(msg))
+			require.LessOrEqual(t, len(name), len(msg)*maxCompressionPointers)
+		}
+	})
+}
+
+func TestMessageMarshalBinaryCompressesNames(t *testing.T) {
+	msg := Message{
+		Header:    NewHeader(1, 0x8180, 1, 2, 0, 0),
+		Questions: []Question{{Name: "www.example.com", Type: 1, Class: 1}},
+		Answers: []Answer{
+			{Name: "www.example.com", Type: 5, Class: 1, TTL: 60, Length: 13, Data: appendName(nil, "example.com")},
+			{Name: "example.com", Type: 1, Class: 1, TTL: 60, Length: 4, Data: []byte{93, 184, 216, 34}},
+		},
+	}
+
+	buf, err := msg.MarshalBinary()
+	require.NoError(t, err)
+
+	// header + question + (pointer + fixed fields + pointer) + (pointer + fixed fields + address)
+	require.Len(t, buf, 12+21+(2+10+2)+(2+10+4))
+
+	got, err := NewMessageFromBytes(buf)
+	require.NoError(t, err)
+	require.Equal(t, msg, got)
+}
+
+func TestMarshalBinaryRejectsOversizedNames(t *testing.T) {
+	longLabel := strings.Repeat("a", 64) + ".example.com"
+	longName := strings.Repeat(strings.Repeat("a", 63)+".", 4) + "com"
+
+	_, err := Question{Name: longLabel, Type: 1, Class: 1}.MarshalBinary()
+	require.ErrorIs(t, err, errLabelTooLong)
+
+	_, err = Answer{Name: longLabel, Type: 1, Class: 1, Length: 4, Data: []byte{1, 2, 3, 4}}.MarshalBinary()
+	require.ErrorIs(t, err, errLabelTooLong)
+
+	_, err = Question{Name: longName, Type: 1, Class: 1}.MarshalBinary()
+	require.ErrorIs(t, err, errNameTooLong)
+
+	msg := Message{
+		Header:  NewHeader(1, 0, 0, 1, 0, 0),
+		Answers: []Answer{{Name: longLabel, Type: 1, Class: 1, Length: 4, Data: []byte{1, 2, 3, 4}}},
+	}
+	_, err = msg.MarshalBinary()
+	require.ErrorIs(t, err, errLabelTooLong)
+
+	_, err = Question{Name: strings.Repeat("a", 63) + ".example.com.", Type: 1, Class: 1}.MarshalBinary()
+	require.NoError(t, err)
+}
+
+func TestNewMessageFromBytesDecodesQueryAuthorityAndAdditional(t *testing.T) {
+	query := []byte{
+		0x30, 0x39, 0x01, 0x00, 0, 1, 0, 0, 0, 1, 0, 1, // ID 12345, RD, 1 question, 1 authority, 1 additional
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1, // example.com A IN
+		0xC0, 12, 0, 6, 0, 1, 0, 0, 0, 60, 0, 24, // example.com SOA, as in an UPDATE-style prerequisite
+		0xC0, 12, 0xC0, 12, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0, 0, 0, 5,
+		0, 0, 41, 0x10, 0x00, 0, 0, 0x80, 0, 0, 4, 0, 3, 0, 0, // OPT: 4096 bytes, DO, empty NSID
+	}
+
+	msg, err := NewMessageFromBytes(query)
+	require.NoError(t, err)
+
+	require.Len(t, msg.Authorities, 1)
+	require.Equal(t, TYPE_SOA, msg.Authorities[0].Type)
+	opt, ok := msg.OPT()
+	require.True(t, ok)
+	require.Equal(t, uint16(4096), opt.UDPSize)
+	require.True(t, opt.DNSSECOK)
+	_, ok = opt.Option(EDNS_OPTION_NSID)
+	require.True(t, ok)
+
+	responseBytes, err := NewServer(Options{}).handleQuery(context.Background(), query, nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	responseOPT, ok := response.OPT()
+	require.True(t, ok, "a response to an EDNS query should carry an OPT record")
+	require.Equal(t, uint16(ednsUDPSize), responseOPT.UDPSize)
+}
+
+func TestAppendBinaryMatchesMarshalBinary(t *testing.T) {
+	msg := Message{
+		Header:    NewHeader(1234, 0x8180, 1, 0, 0, 0),
+		Questions: []Question{{Name: "www.example.com", Type: TYPE_A, Class: CLASS_IN}},
+	}
+	msg.AddAnswers([]Answer{
+		NewCNAMEAnswer("www.example.com", "web.example.com", 60),
+		NewAAnswer("web.example.com", net.ParseIP("192.0.2.1"), 60),
+	})
+	msg.SetOPT(OPT{UDPSize: 1232})
+
+	prefix := []byte("prefix")
+	for name, value := range map[string]interface {
+		encoding.BinaryMarshaler
+		encoding.BinaryAppender
+	}{
+		"header":   msg.Header,
+		"question": msg.Questions[0],
+		"answer":   msg.Answers[1],
+		"message":  msg,
+	} {
+		t.Run(name, func(t *testing.T) {
+			want, err := value.MarshalBinary()
+			require.NoError(t, err)
+
+			got, err := value.AppendBinary(append([]byte{}, prefix...))
+			require.NoError(t, err)
+			require.Equal(t, prefix, got[:len(prefix)])
+			require.Equal(t, want, got[len(prefix):], "compression pointers stay relative to the message")
+		})
+	}
+}
+
+func TestAppendBinaryReusedBufferDoesNotAllocate(t *testing.T) {
+	msg, err := NewMessageFromBytes(createTestQuery())
+	require.NoError(t, err)
+	msg.ProcessQuestions()
+	buf := make([]byte, 0, 512)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = msg.AppendBinary(buf[:0])
+	})
+	require.Zero(t, allocs)
+}
+
+func BenchmarkMessageEncoding(b *testing.B) {
+	msg, err := NewMessageFromBytes(createTestQuery())
+	require.NoError(b, err)
+	msg.ProcessQuestions()
+
+	b.Run("MarshalBinary", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := msg.MarshalBinary(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("AppendBinary", func(b *testing.B) {
+		buf := make([]byte, 0, 512)
+		b.ReportAllocs()
+		for b.Loop() {
+			var err error
+			if buf, err = msg.AppendBinary(buf[:0]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestNewQuery(t *testing.T) {
+	query := NewQuery("www.example.com", TYPE_AAAA, CLASS_IN)
+	queryBytes, err := query.MarshalBinary()
+	require.NoError(t, err)
+
+	parsed, err := NewMessageFromBytes(queryBytes)
+	require.NoError(t, err)
+	require.NotZero(t, parsed.Header.ID)
+	require.True(t, parsed.Header.IsQuery())
+	require.True(t, parsed.Header.RecursionDesired())
+	require.Equal(t, uint16(1), parsed.Header.QuestionsCount)
+	require.Equal(t, []Question{{Name: "www.example.com", Type: TYPE_AAAA, Class: CLASS_IN}}, parsed.Questions)
+}
@@ -0,0 +1,403 @@
+package dnsserver
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultResolverPort is the port of resolver addresses that don't give one.
+const defaultResolverPort = "53"
+
+// normalizeResolver turns a resolver address into the host:port form net.Dial
+// takes, adding port 53 when there is none. A bare IPv6 address, which is
+// ambiguous with a port appended such as 2001:db8::1:53, is always read as an
+// address without one; IPv6 addresses with a port need brackets.
+func normalizeResolver(addr string) (string, error) {
+	bare := addr
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		bare = addr[1 : len(addr)-1]
+	}
+	if ip := net.ParseIP(bare); ip != nil {
+		return net.JoinHostPort(ip.String(), defaultResolverPort), nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Contains(addr, ":") {
+			return "", fmt.Errorf("invalid resolver address %q: %w", addr, err)
+		}
+		host, port = addr, defaultResolverPort
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid resolver address %q: missing host", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid resolver address %q: bad port %q", addr, port)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// normalizeResolvers normalizes the configured resolver addresses, dropping
+// the invalid ones.
+func normalizeResolvers(opts *Options) {
+	normalize := func(addr string) string {
+		if addr == "" {
+			return ""
+		}
+		normalized, err := normalizeResolver(addr)
+		if err != nil {
+			slog.Error("Ignoring invalid resolver", "resolver", addr, "error", err)
+		}
+		return normalized
+	}
+	normalizeAll := func(addrs []string) []string {
+		normalized := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			if addr = normalize(addr); addr != "" {
+				normalized = append(normalized, addr)
+			}
+		}
+		return normalized
+	}
+
+	opts.Resolver = normalize(opts.Resolver)
+	opts.Resolvers = normalizeAll(opts.Resolvers)
+	groups := make([][]string, 0, len(opts.ResolverGroups))
+	for _, group := range opts.ResolverGroups {
+		if group = normalizeAll(group); len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	opts.ResolverGroups = groups
+}
+
+// forwardSlotWait is how long a query over MaxConcurrentForwards waits for
+// another forward to finish before it fails.
+const forwardSlotWait = 20 * time.Millisecond
+
+// acquireForwardSlot takes one of the MaxConcurrentForwards slots, returning
+// the function that gives it back, or errForwardLimit when none frees up in
+// time.
+func (s *Server) acquireForwardSlot(ctx context.Context) (func(), error) {
+	if s.forwardSlots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-s.forwardSlots }
+	select {
+	case s.forwardSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	timer := time.NewTimer(forwardSlotWait)
+	defer timer.Stop()
+	select {
+	case s.forwardSlots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errForwardLimit
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolverDownTime is how long a resolver that failed an exchange is tried
+// only after every other one.
+const resolverDownTime = 5 * time.Second
+
+// latencyWeight is the weight of each new exchange in a resolver's
+// exponentially weighted moving average latency.
+const latencyWeight = 0.2
+
+// UpstreamStats describes how forwarding to one resolver has gone, as
+// reported by Server.UpstreamStats.
+type UpstreamStats struct {
+	Resolver  string
+	Successes uint64
+	Failures  uint64
+	// Down reports that the resolver failed less than resolverDownTime ago,
+	// so it is tried only after the others.
+	Down bool
+	// Latency is the moving average of its successful exchanges' latency.
+	Latency   time.Duration
+	LastError string
+}
+
+// resolverHealth remembers which resolvers failed recently, and how their
+// exchanges went. Its zero value is ready to use and it is safe for
+// concurrent use.
+type resolverHealth struct {
+	mu        sync.Mutex
+	downUntil map[string]time.Time
+	stats     map[string]*UpstreamStats
+}
+
+// record counts an exchange with resolver that took latency and failed with
+// err, when not nil.
+func (h *resolverHealth) record(resolver string, latency time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stats == nil {
+		h.stats = make(map[string]*UpstreamStats)
+	}
+	stats, ok := h.stats[resolver]
+	if !ok {
+		stats = &UpstreamStats{Resolver: resolver}
+		h.stats[resolver] = stats
+	}
+	if err != nil {
+		stats.Failures++
+		stats.LastError = err.Error()
+		return
+	}
+	if stats.Successes == 0 {
+		stats.Latency = latency
+	} else {
+		stats.Latency += time.Duration(latencyWeight * float64(latency-stats.Latency))
+	}
+	stats.Successes++
+}
+
+// statsOf returns the stats of each of resolvers at now.
+func (h *resolverHealth) statsOf(resolvers []string, now time.Time) []UpstreamStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	all := make([]UpstreamStats, 0, len(resolvers))
+	for _, resolver := range resolvers {
+		stats := UpstreamStats{Resolver: resolver}
+		if recorded, ok := h.stats[resolver]; ok {
+			stats = *recorded
+		}
+		until, ok := h.downUntil[resolver]
+		stats.Down = ok && now.Before(until)
+		all = append(all, stats)
+	}
+	return all
+}
+
+func (h *resolverHealth) markDown(resolver string, until time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.downUntil == nil {
+		h.downUntil = make(map[string]time.Time)
+	}
+	h.downUntil[resolver] = until
+}
+
+func (h *resolverHealth) markUp(resolver string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.downUntil, resolver)
+}
+
+func (h *resolverHealth) isDown(resolver string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	until, ok := h.downUntil[resolver]
+	return ok && now.Before(until)
+}
+
+// allDownFor returns how long until the first of resolvers comes back up, or
+// false when one of them isn't down.
+func (h *resolverHealth) allDownFor(resolvers []string, now time.Time) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	soonest := time.Duration(-1)
+	for _, resolver := range resolvers {
+		until, ok := h.downUntil[resolver]
+		if !ok || !now.Before(until) {
+			return 0, false
+		}
+		if left := until.Sub(now); soonest < 0 || left < soonest {
+			soonest = left
+		}
+	}
+	return soonest, soonest >= 0
+}
+
+// circuitOpenError reports that every resolver was already marked down when
+// the query was forwarded, and failed again.
+type circuitOpenError struct {
+	// retryAfter is how long until the first resolver is tried first again.
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("every resolver is down: %v", e.err)
+}
+
+func (e *circuitOpenError) Unwrap() error { return e.err }
+
+// resolverGroups lists the groups of resolvers to forward to, in the order
+// they are tried: Resolver with Resolvers, then each of ResolverGroups.
+func (s *Server) resolverGroups() [][]string {
+	var first []string
+	if s.opts.Resolver != "" {
+		first = append(first, s.opts.Resolver)
+	}
+	for _, resolver := range s.opts.Resolvers {
+		if resolver != "" {
+			first = append(first, resolver)
+		}
+	}
+
+	groups := make([][]string, 0, 1+len(s.opts.ResolverGroups))
+	if len(first) > 0 {
+		groups = append(groups, first)
+	}
+	for _, group := range s.opts.ResolverGroups {
+		if len(group) > 0 {
+			groups = append(groups, slices.Clone(group))
+		}
+	}
+	return groups
+}
+
+// resolvers lists every resolver to forward to, group after group.
+func (s *Server) resolvers() []string {
+	return slices.Concat(s.resolverGroups()...)
+}
+
+// UpstreamStats reports how forwarding to each configured resolver has gone,
+// in the order they are configured.
+func (s *Server) UpstreamStats() []UpstreamStats {
+	return s.health.statsOf(s.snapshot().resolvers(), s.now())
+}
+
+// resolverOrder returns the resolvers in the order a query for name tries
+// them: every resolver of a group before those of the next one, each group
+// ordered on its own by groupOrder.
+func (s *Server) resolverOrder(name string, now time.Time) []string {
+	var order []string
+	for _, group := range s.resolverGroups() {
+		order = append(order, s.groupOrder(group, name, now)...)
+	}
+	return order
+}
+
+// groupOrder orders the resolvers of a group for a query for name. With
+// ResolverStrategyConsistentHash they are ranked by rendezvous hashing of the
+// name, so each name sticks to one resolver and only the names of a resolver
+// that goes down move, each to its next ranked one. Resolvers marked down come
+// last, in case none of the others answers either.
+func (s *Server) groupOrder(order []string, name string, now time.Time) []string {
+	if s.opts.ResolverStrategy == ResolverStrategyConsistentHash {
+		key := zoneKey(name)
+		scores := make(map[string]uint64, len(order))
+		for _, resolver := range order {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte{0})
+			h.Write([]byte(resolver))
+			scores[resolver] = h.Sum64()
+		}
+		slices.SortStableFunc(order, func(a, b string) int {
+			return cmp.Compare(scores[b], scores[a])
+		})
+	}
+
+	healthy := make([]string, 0, len(order))
+	var down []string
+	for _, resolver := range order {
+		if s.health.isDown(resolver, now) {
+			down = append(down, resolver)
+		} else {
+			healthy = append(healthy, resolver)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// forwardQuery exchanges the query with the resolvers, in the order
+// resolverOrder picks for its name, until one answers, and returns that
+// resolver's response. A resolver that fails is marked down for
+// resolverDownTime; when all of them were down already, the error is a
+// circuitOpenError. Over MaxConcurrentForwards, it fails with errForwardLimit
+// without trying any.
+//
+// The query goes out under an ID of its own, from IDStrategy, so clients
+// reusing IDs don't make forwarded queries easier to spoof, and the response
+// gets the client's back. Its OPT record offers the resolver UDPBufferSize,
+// whatever the client advertised. maxSize is the most the client takes,
+// deciding whether a truncated UDP response is worth retrying over TCP. A UDP
+// response is read into a buffer of the query's lease, when ctx has one.
+func (s *Server) forwardQuery(ctx context.Context, queryBytes []byte, maxSize int) ([]byte, string, error) {
+	name := ""
+	if q, _, err := readQuestion(queryBytes, 12); err == nil {
+		name = q.Name
+	}
+
+	header, err := NewHeaderFromBytes(queryBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	release, err := s.acquireForwardSlot(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer release()
+	queryBytes = append([]byte(nil), queryBytes...)
+	setMessageID(queryBytes, s.nextID())
+	offerUDPSize(queryBytes, s.udpSize)
+
+	now := s.now()
+	order := s.resolverOrder(name, now)
+	retryAfter, circuitOpen := s.health.allDownFor(order, now)
+
+	var lastErr error
+	for _, resolver := range order {
+		start, sent := time.Now(), s.now()
+		responseBytes, err := s.exchange(ctx, resolver, queryBytes, maxSize)
+		s.health.record(resolver, time.Since(start), err)
+		recordUpstreamTime(ctx, resolver, s.now().Sub(sent))
+		if err == nil {
+			s.health.markUp(resolver)
+			setMessageID(responseBytes, header.ID)
+			return responseBytes, resolver, nil
+		}
+		logger(ctx).Debug("Error forwarding query, trying the next resolver", "error", err, "resolver", resolver)
+		s.health.markDown(resolver, s.now().Add(resolverDownTime))
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errNoResolvers
+	}
+	if circuitOpen {
+		lastErr = &circuitOpenError{retryAfter: retryAfter, err: lastErr}
+	}
+	return nil, "", lastErr
+}
+
+// exchange sends the query to one resolver over the configured protocol.
+func (s *Server) exchange(ctx context.Context, resolver string, queryBytes []byte, maxSize int) ([]byte, error) {
+	if s.opts.ForwardProtocol == ForwardProtocolTCP {
+		return s.forwardQueryTCP(resolver, queryBytes)
+	}
+	responseBytes, err := s.forwardQueryUDP(ctx, resolver, queryBytes)
+	switch {
+	case err == nil && maxSize > maxUDPMessageSize && isTruncated(responseBytes):
+		logger(ctx).Debug("Forwarded response was truncated, retrying over TCP", "resolver", resolver)
+		return s.forwardQueryTCP(resolver, queryBytes)
+	case errors.Is(err, errForwardedTruncated):
+		logger(ctx).Debug("Forwarded response filled the read buffer, retrying over TCP", "resolver", resolver)
+		return s.forwardQueryTCP(resolver, queryBytes)
+	case err != nil && s.opts.ForwardProtocol == ForwardProtocolUDPThenTCP:
+		logger(ctx).Debug("Forwarding over UDP failed, retrying over TCP", "error", err, "resolver", resolver)
+		return s.forwardQueryTCP(resolver, queryBytes)
+	}
+	return responseBytes, err
+}
@@ -0,0 +1,282 @@
+package dnsserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolverOrderOrdered(t *testing.T) {
+	now := time.Now()
+	server := NewServer(Options{Resolver: "a:53", Resolvers: []string{"b:53", "c:53"}})
+	assert.Equal(t, []string{"a:53", "b:53", "c:53"}, server.resolverOrder("example.com", now))
+
+	server.health.markDown("a:53", now.Add(resolverDownTime))
+	assert.Equal(t, []string{"b:53", "c:53", "a:53"}, server.resolverOrder("example.com", now))
+	assert.Equal(t, []string{"a:53", "b:53", "c:53"}, server.resolverOrder("example.com", now.Add(resolverDownTime)), "a resolver comes back once its down time is over")
+}
+
+func TestResolverOrderConsistentHash(t *testing.T) {
+	now := time.Now()
+	server := NewServer(Options{
+		Resolvers:        []string{"a:53", "b:53", "c:53", "d:53"},
+		ResolverStrategy: ResolverStrategyConsistentHash,
+	})
+
+	picks := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("host%d.example.com", i)
+		picks[name] = server.resolverOrder(name, now)[0]
+		assert.Equal(t, picks[name], server.resolverOrder(name, now)[0], "a name should always go to the same resolver")
+	}
+	assert.Equal(t, picks["host1.example.com"], server.resolverOrder("HOST1.example.com", now)[0], "names should match case-insensitively")
+	used := make(map[string]bool)
+	for _, resolver := range picks {
+		used[resolver] = true
+	}
+	assert.Len(t, used, 4, "names should spread over every resolver")
+
+	server.health.markDown("a:53", now.Add(resolverDownTime))
+	moved := make(map[string]bool)
+	for name, was := range picks {
+		order := server.resolverOrder(name, now)
+		assert.Equal(t, "a:53", order[len(order)-1])
+		if was != "a:53" {
+			assert.Equal(t, was, order[0], "names of healthy resolvers shouldn't move")
+		} else {
+			moved[order[0]] = true
+		}
+	}
+	assert.Greater(t, len(moved), 1, "names of the down resolver should spread over the others")
+}
+
+func TestForwardQueryFailsOverAndRemembers(t *testing.T) {
+	var asked atomic.Int64
+	backup := startMockResolver(t, func(query Message) Message {
+		asked.Add(1)
+		return answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300))(query)
+	})
+	down := closedUDPAddr(t)
+	server := NewServer(Options{Resolver: down, Resolvers: []string{backup}})
+
+	for i := 0; i < 3; i++ {
+		responseBytes, resolver, err := server.forwardQuery(t.Context(), createTestQuery(), maxUDPMessageSize)
+		require.NoError(t, err)
+		assert.NotEmpty(t, responseBytes)
+		assert.Equal(t, backup, resolver)
+	}
+	assert.Equal(t, int64(3), asked.Load())
+	assert.Equal(t, []string{backup, down}, server.resolverOrder("example.com", time.Now()))
+}
+
+func TestResolverOrderGroups(t *testing.T) {
+	now := time.Now()
+	server := NewServer(Options{
+		Resolver:       "a:53",
+		Resolvers:      []string{"b:53"},
+		ResolverGroups: [][]string{{"c:53", "d:53"}, {}, {"e:53"}},
+	})
+	assert.Equal(t, []string{"a:53", "b:53", "c:53", "d:53", "e:53"}, server.resolverOrder("example.com", now))
+
+	server.health.markDown("a:53", now.Add(resolverDownTime))
+	server.health.markDown("c:53", now.Add(resolverDownTime))
+	assert.Equal(t, []string{"b:53", "a:53", "d:53", "c:53", "e:53"}, server.resolverOrder("example.com", now), "down resolvers should only move within their group")
+}
+
+func TestForwardQueryFailsOverToNextGroup(t *testing.T) {
+	secondary := startMockResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300)))
+	primaries := []string{closedUDPAddr(t), closedUDPAddr(t)}
+	server := NewServer(Options{ResolverGroups: [][]string{primaries, {secondary}}})
+
+	responseBytes, resolver, err := server.forwardQuery(t.Context(), createTestQuery(), maxUDPMessageSize)
+	require.NoError(t, err)
+	assert.NotEmpty(t, responseBytes)
+	assert.Equal(t, secondary, resolver)
+	for _, primary := range primaries {
+		assert.True(t, server.health.isDown(primary, time.Now()), "every primary should have been tried first")
+	}
+}
+
+func TestForwardQueryWithoutResolvers(t *testing.T) {
+	_, _, err := NewServer(Options{}).forwardQuery(t.Context(), createTestQuery(), maxUDPMessageSize)
+	assert.ErrorIs(t, err, errNoResolvers)
+}
+
+func TestNormalizeResolver(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"192.0.2.1", "192.0.2.1:53"},
+		{"192.0.2.1:5353", "192.0.2.1:5353"},
+		{"2001:db8::1", "[2001:db8::1]:53"},
+		{"2001:db8::1:53", "[2001:db8::1:53]:53"},
+		{"[2001:db8::1]", "[2001:db8::1]:53"},
+		{"[2001:db8::1]:5353", "[2001:db8::1]:5353"},
+		{"[2001:DB8:0::1]:53", "[2001:db8::1]:53"},
+		{"dns.example.com", "dns.example.com:53"},
+		{"dns.example.com:853", "dns.example.com:853"},
+	}
+	for _, tt := range tests {
+		got, err := normalizeResolver(tt.addr)
+		require.NoError(t, err, tt.addr)
+		assert.Equal(t, tt.want, got, tt.addr)
+	}
+
+	for _, addr := range []string{":53", "192.0.2.1:0", "192.0.2.1:dns", "192.0.2.1:70000", "[2001:db8::1", "a:b:c"} {
+		_, err := normalizeResolver(addr)
+		assert.Error(t, err, addr)
+	}
+}
+
+func TestNewServerNormalizesResolvers(t *testing.T) {
+	server := NewServer(Options{
+		Resolver:       "2001:db8::1",
+		Resolvers:      []string{"192.0.2.1", "192.0.2.2:99999", "[2001:db8::2]:5353"},
+		ResolverGroups: [][]string{{"bad:port:here"}, {"192.0.2.3"}},
+	})
+
+	assert.Equal(t, []string{"[2001:db8::1]:53", "192.0.2.1:53", "[2001:db8::2]:5353"}, server.resolverGroups()[0])
+	assert.Equal(t, [][]string{{"192.0.2.3:53"}}, server.resolverGroups()[1:], "groups left empty should be dropped")
+}
+
+func TestForwardingErrorsCarryEDE(t *testing.T) {
+	now := time.Now()
+	server := NewServer(Options{Resolver: closedUDPAddr(t)})
+	server.clock = func() time.Time { return now }
+
+	query := func() ExtendedError {
+		responseBytes, err := server.handleQuery(t.Context(), createTestEDNSQuery("example.com"), nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		require.Equal(t, RCODE_SERVER_FAILURE, response.Header.ResponseCode())
+		ede, ok := response.ExtendedError()
+		require.True(t, ok)
+		return ede
+	}
+
+	assert.Equal(t, EDE_NETWORK_ERROR, query().Code, "a resolver failing for the first time is a network error")
+
+	now = now.Add(2 * time.Second)
+	ede := query()
+	assert.Equal(t, EDE_NOT_READY, ede.Code, "every resolver being down already opens the circuit")
+	assert.Equal(t, "resolvers unavailable, retry after 3s", ede.Text)
+
+	now = now.Add(resolverDownTime)
+	assert.Equal(t, EDE_NETWORK_ERROR, query().Code, "the circuit closes once the down time is over")
+}
+
+func TestForwardQueryCircuitOpen(t *testing.T) {
+	backup := startMockResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300)))
+	down := closedUDPAddr(t)
+	server := NewServer(Options{Resolver: down, Resolvers: []string{backup}})
+	server.health.markDown(down, time.Now().Add(resolverDownTime))
+
+	_, resolver, err := server.forwardQuery(t.Context(), createTestQuery(), maxUDPMessageSize)
+	require.NoError(t, err, "a healthy resolver should keep the circuit closed")
+	assert.Equal(t, backup, resolver)
+
+	server = NewServer(Options{Resolver: down})
+	server.health.markDown(down, time.Now().Add(resolverDownTime))
+	_, _, err = server.forwardQuery(t.Context(), createTestQuery(), maxUDPMessageSize)
+	var open *circuitOpenError
+	require.ErrorAs(t, err, &open)
+	assert.ErrorIs(t, err, errResolverRefused)
+}
+
+func TestMaxConcurrentForwards(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	resolver := startMockResolver(t, func(query Message) Message {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+		return answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300))(query)
+	})
+	server := NewServer(Options{Resolver: resolver, MaxConcurrentForwards: 1})
+
+	first := make(chan error)
+	go func() {
+		_, _, err := server.forwardQuery(t.Context(), createTestQuery(), maxUDPMessageSize)
+		first <- err
+	}()
+	<-started
+
+	responseBytes, err := server.handleQuery(t.Context(), createTestEDNSQuery("example.com"), nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	close(release)
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+	assert.Equal(t, RCODE_SERVER_FAILURE, response.Header.ResponseCode(), "a query over the limit should fail")
+	ede, ok := response.ExtendedError()
+	require.True(t, ok)
+	assert.Equal(t, EDE_NOT_READY, ede.Code)
+	assert.False(t, server.health.isDown(resolver, time.Now()), "the resolver wasn't at fault")
+
+	require.NoError(t, <-first)
+	_, _, err = server.forwardQuery(t.Context(), createTestQuery(), maxUDPMessageSize)
+	assert.NoError(t, err, "the slot should be given back")
+}
+
+func TestUpstreamStats(t *testing.T) {
+	good := startMockResolver(t, answerWith(NewAAnswer("example.com", net.ParseIP("192.0.2.1"), 300)))
+	down := closedUDPAddr(t)
+	server := NewServer(Options{Resolver: down, Resolvers: []string{good, "192.0.2.53"}})
+
+	for i := 0; i < 3; i++ {
+		_, _, err := server.forwardQuery(t.Context(), createTestQuery(), maxUDPMessageSize)
+		require.NoError(t, err)
+	}
+
+	stats := server.UpstreamStats()
+	require.Len(t, stats, 3)
+	assert.Equal(t, down, stats[0].Resolver)
+	assert.Equal(t, uint64(0), stats[0].Successes)
+	assert.Equal(t, uint64(1), stats[0].Failures, "a down resolver should be tried only once the others fail")
+	assert.True(t, stats[0].Down)
+	assert.Contains(t, stats[0].LastError, errResolverRefused.Error())
+
+	assert.Equal(t, good, stats[1].Resolver)
+	assert.Equal(t, uint64(3), stats[1].Successes)
+	assert.Equal(t, uint64(0), stats[1].Failures)
+	assert.False(t, stats[1].Down)
+	assert.Positive(t, stats[1].Latency)
+	assert.Empty(t, stats[1].LastError)
+
+	assert.Equal(t, UpstreamStats{Resolver: "192.0.2.53:53"}, stats[2], "an unused resolver has no stats yet")
+
+	base := startAdminHTTP(t, server)
+	resp, err := http.Get(base + "/upstreams")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	require.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], down+" down 0 1 "), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], good+" up 3 0 "), lines[1])
+	assert.Equal(t, `192.0.2.53:53 up 0 0 0s ""`, lines[2])
+}
+
+func TestResolverHealthLatencyAverage(t *testing.T) {
+	var health resolverHealth
+	health.record("a:53", 100*time.Millisecond, nil)
+	health.record("a:53", 200*time.Millisecond, nil)
+	health.record("a:53", time.Second, errors.New("timeout"))
+
+	stats := health.statsOf([]string{"a:53"}, time.Now())
+	require.Len(t, stats, 1)
+	assert.Equal(t, 120*time.Millisecond, stats[0].Latency, "failures shouldn't count toward latency")
+	assert.Equal(t, "timeout", stats[0].LastError)
+}
@@ -0,0 +1,28 @@
+package dnsserver
+
+// zoneViews builds the snapshots answering from the zones s.opts.Views sets
+// for their transports, each s with its view as the zone.
+func zoneViews(s *Server) map[Transport]*Server {
+	if len(s.opts.Views) == 0 {
+		return nil
+	}
+	views := make(map[Transport]*Server, len(s.opts.Views))
+	for transport, zone := range s.opts.Views {
+		if zone == nil {
+			continue
+		}
+		view := *s
+		view.opts.Zone = zone
+		views[transport] = &view
+	}
+	return views
+}
+
+// view returns the snapshot queries over transport resolve against: its
+// view's, or s when the transport has none.
+func (s *Server) view(transport Transport) *Server {
+	if view, ok := s.views[transport]; ok {
+		return view
+	}
+	return s
+}
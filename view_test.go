@@ -0,0 +1,43 @@
+package dnsserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestViewsByTransport(t *testing.T) {
+	public, internal := NewZone(), NewZone()
+	public.Add(NewAAnswer("app.example.com", net.ParseIP("203.0.113.10"), 60))
+	public.Add(NewAAnswer("www.example.com", net.ParseIP("203.0.113.20"), 60))
+	internal.Add(NewAAnswer("app.example.com", net.ParseIP("10.0.0.10"), 60))
+	server := NewServer(Options{Zone: public, Views: map[Transport]*Zone{TransportDoH: internal}})
+
+	resolve := func(name string, transport Transport) Message {
+		queryBytes, err := createTestQueryMessage(name).MarshalBinary()
+		require.NoError(t, err)
+		responseBytes, err := server.handleQuery(t.Context(), queryBytes, nil, transport, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		return response
+	}
+
+	response := resolve("app.example.com", TransportUDP)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{203, 0, 113, 10}, response.Answers[0].Data)
+
+	response = resolve("app.example.com", TransportDoH)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{10, 0, 0, 10}, response.Answers[0].Data, "DoH clients should get the internal view")
+	assert.True(t, response.Header.Authoritative())
+
+	response = resolve("www.example.com", TransportDoH)
+	assert.False(t, response.Header.Authoritative(), "a view stands in for the zone rather than adding to it")
+
+	response = resolve("app.example.com", TransportTCP)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{203, 0, 113, 10}, response.Answers[0].Data, "transports without a view should use Zone")
+}
@@ -0,0 +1,422 @@
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ZoneRecord is a record served from a Zone.
+type ZoneRecord struct {
+	Answer
+	// Weight is the record's relative share of responses in which it is listed
+	// first among the A or AAAA records of its name. Zero counts as one.
+	Weight int
+	// InheritTTL marks a record loaded without a TTL of its own: it is served
+	// with the server's TTLByType or DefaultTTL for its type instead.
+	InheritTTL bool
+}
+
+// inheritedTTL gives the TTL of records of rtype marked InheritTTL. A nil
+// inheritedTTL leaves them with the TTL they were added with.
+type inheritedTTL func(rtype uint16) uint32
+
+// answer returns the record as served, given the inherited TTLs.
+func (record ZoneRecord) answer(ttl inheritedTTL) Answer {
+	if record.InheritTTL && ttl != nil {
+		record.TTL = ttl(record.Type)
+	}
+	return record.Answer
+}
+
+// rrset holds the records of one name and type, along with the state of the
+// smooth weighted round-robin that picks which address record leads.
+type rrset struct {
+	records []ZoneRecord
+	current []int
+}
+
+// rrsetKey identifies the records of one type and class at a name.
+type rrsetKey struct {
+	rrtype, class uint16
+}
+
+// Zone is an in-memory set of records the server answers authoritatively.
+// It is safe for concurrent use.
+type Zone struct {
+	// DefaultClass is given to added records whose Class is zero, defaulting
+	// to IN. It must be set before records are added.
+	DefaultClass uint16
+
+	mu    sync.Mutex
+	names map[string]map[rrsetKey]*rrset
+}
+
+func NewZone() *Zone {
+	return &Zone{names: make(map[string]map[rrsetKey]*rrset)}
+}
+
+// empty reports whether the zone has no records.
+func (z *Zone) empty() bool {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return len(z.names) == 0
+}
+
+func zoneKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Add adds records with the default weight.
+func (z *Zone) Add(answers ...Answer) {
+	for _, answer := range answers {
+		z.AddRecord(ZoneRecord{Answer: answer})
+	}
+}
+
+func (z *Zone) AddRecord(record ZoneRecord) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.addRecordLocked(record)
+}
+
+func (z *Zone) addRecords(records []ZoneRecord) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for _, record := range records {
+		z.addRecordLocked(record)
+	}
+}
+
+func (z *Zone) addRecordLocked(record ZoneRecord) {
+	if record.Class == 0 {
+		record.Class = z.DefaultClass
+		if record.Class == 0 {
+			record.Class = CLASS_IN
+		}
+	}
+
+	key := zoneKey(record.Name)
+	sets, ok := z.names[key]
+	if !ok {
+		sets = make(map[rrsetKey]*rrset)
+		z.names[key] = sets
+	}
+	set, ok := sets[rrsetKey{record.Type, record.Class}]
+	if !ok {
+		set = &rrset{}
+		sets[rrsetKey{record.Type, record.Class}] = set
+	}
+	set.records = append(set.records, record)
+	set.current = append(set.current, 0)
+}
+
+// replace swaps every record at or below origin for answers, so a transferred
+// copy of a zone never mixes with records from an older one.
+func (z *Zone) replace(origin string, answers []Answer) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	for name := range z.names {
+		if nameMatches(name, origin) {
+			delete(z.names, name)
+		}
+	}
+	for _, answer := range answers {
+		z.addRecordLocked(ZoneRecord{Answer: answer})
+	}
+}
+
+// Lookup returns the records for name, qtype and qclass, and whether the name
+// exists in the zone at all in that class. ANY returns every record of the name
+// in the class, and a name holding a CNAME answers any other type with it.
+// Records of another class are never returned.
+func (z *Zone) Lookup(name string, qtype, qclass uint16) ([]Answer, bool) {
+	return z.lookup(name, qtype, qclass, nil)
+}
+
+func (z *Zone) lookup(name string, qtype, qclass uint16, ttl inheritedTTL) ([]Answer, bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	exists := false
+	answers := make([]Answer, 0)
+	for key, set := range z.names[zoneKey(name)] {
+		if key.class != qclass {
+			continue
+		}
+		exists = true
+		if qtype == TYPE_ANY {
+			answers = append(answers, set.ordered(ttl)...)
+		}
+	}
+	if !exists || qtype == TYPE_ANY {
+		return answers, exists
+	}
+
+	sets := z.names[zoneKey(name)]
+	if set, ok := sets[rrsetKey{qtype, qclass}]; ok {
+		return set.ordered(ttl), true
+	}
+	if set, ok := sets[rrsetKey{TYPE_CNAME, qclass}]; ok {
+		return set.ordered(ttl), true
+	}
+	return nil, true
+}
+
+// defaultMaxChainDepth is how many CNAME records a zone answer may follow
+// when Options.MaxChainDepth is unset.
+const defaultMaxChainDepth = 16
+
+var (
+	errCNAMELoop         = errors.New("CNAME loop detected")
+	errCNAMEChainTooLong = errors.New("CNAME chain too long")
+)
+
+// lookupChain is Lookup, but when the answer is a CNAME whose target is also in
+// the zone it continues at the target (RFC 1034 section 4.3.2), returning every
+// link of the chain in order followed by the target's records. A target outside
+// the zone ends the chain at the last CNAME, for the client to follow. A chain
+// coming back to a name it already visited, or following more than maxDepth
+// CNAMEs, is an error.
+func (z *Zone) lookupChain(name string, qtype, qclass uint16, maxDepth int, ttl inheritedTTL) ([]Answer, bool, error) {
+	answers, exists := z.lookup(name, qtype, qclass, ttl)
+	if !exists || qtype == TYPE_CNAME || qtype == TYPE_ANY {
+		return answers, exists, nil
+	}
+
+	visited := map[string]bool{zoneKey(name): true}
+	for depth := 0; len(answers) > 0 && answers[len(answers)-1].Type == TYPE_CNAME; depth++ {
+		target, _, err := readName(answers[len(answers)-1].Data, 0)
+		if err != nil {
+			break
+		}
+		if visited[zoneKey(target)] {
+			return nil, true, errCNAMELoop
+		}
+		next, ok := z.lookup(target, qtype, qclass, ttl)
+		if !ok {
+			break
+		}
+		if depth == maxDepth {
+			return nil, true, errCNAMEChainTooLong
+		}
+		visited[zoneKey(target)] = true
+		answers = append(answers, next...)
+	}
+	return answers, true, nil
+}
+
+// signatures returns the RRSIG records at name that cover the covered type.
+func (z *Zone) signatures(name string, covered, class uint16) []Answer {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	set, ok := z.names[zoneKey(name)][rrsetKey{TYPE_RRSIG, class}]
+	if !ok {
+		return nil
+	}
+	answers := make([]Answer, 0)
+	for _, record := range set.records {
+		if len(record.Data) >= 2 && binary.BigEndian.Uint16(record.Data) == covered {
+			answers = append(answers, record.Answer)
+		}
+	}
+	return answers
+}
+
+// authority returns the NS records of the closest enclosing name of name that
+// has any, along with the zone's address records for those name servers.
+func (z *Zone) authority(name string, class uint16, ttl inheritedTTL) ([]Answer, []Answer) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	labels := nameToLabels(zoneKey(name))
+	for i := range labels {
+		set, ok := z.names[strings.Join(labels[i:], ".")][rrsetKey{TYPE_NS, class}]
+		if !ok {
+			continue
+		}
+
+		ns := make([]Answer, 0, len(set.records))
+		glue := make([]Answer, 0)
+		for _, record := range set.records {
+			ns = append(ns, record.answer(ttl))
+			target, _, err := readName(record.Data, 0)
+			if err != nil {
+				continue
+			}
+			for _, qtype := range []uint16{TYPE_A, TYPE_AAAA} {
+				if addrs, ok := z.names[zoneKey(target)][rrsetKey{qtype, class}]; ok {
+					for _, addr := range addrs.records {
+						glue = append(glue, addr.answer(ttl))
+					}
+				}
+			}
+		}
+		return ns, glue
+	}
+	return nil, nil
+}
+
+// ordered returns the set's records. Address records rotate so the leading one
+// is picked by smooth weighted round-robin: across queries, each record leads
+// in proportion to its weight, and equal weights give plain round-robin.
+func (set *rrset) ordered(ttl inheritedTTL) []Answer {
+	answers := make([]Answer, len(set.records))
+	for i, record := range set.records {
+		answers[i] = record.answer(ttl)
+	}
+	if len(answers) < 2 || (answers[0].Type != TYPE_A && answers[0].Type != TYPE_AAAA) {
+		return answers
+	}
+
+	lead, total := 0, 0
+	for i, record := range set.records {
+		weight := max(record.Weight, 1)
+		total += weight
+		set.current[i] += weight
+		if set.current[i] > set.current[lead] {
+			lead = i
+		}
+	}
+	set.current[lead] -= total
+
+	return append(answers[lead:], answers[:lead]...)
+}
+
+// lookupZone returns the zone's answers to the query, if the zone holds every name it asks about.
+// Signatures loaded with a signed zone follow the DO bit (RFC 4035 section 3.1.1): a query
+// setting it gets the RRSIG records covering each answer, and any other query gets no RRSIG
+// or NSEC records, as an ANY query would, unless it asks for that type by name.
+// A CNAME chain that loops or runs too deep is returned as an error.
+func (s *Server) lookupZone(query Message) ([]Answer, bool, error) {
+	if s.opts.Zone == nil || len(query.Questions) == 0 {
+		return nil, false, nil
+	}
+	maxDepth := s.opts.MaxChainDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxChainDepth
+	}
+	opt, hasOPT := query.OPT()
+	dnssecOK := hasOPT && opt.DNSSECOK
+
+	answers := make([]Answer, 0)
+	for _, question := range query.Questions {
+		found, ok, err := s.opts.Zone.lookupChain(question.Name, question.Type, question.Class, maxDepth, s.zoneTTL)
+		if err != nil {
+			return nil, true, err
+		}
+		if !ok {
+			return nil, false, nil
+		}
+		var signed []Answer
+		for _, answer := range found {
+			// Lookup already matches classes, this keeps a stray record of
+			// another class from ever reaching a response.
+			if answer.Class != question.Class {
+				continue
+			}
+			if (answer.Type == TYPE_RRSIG || answer.Type == TYPE_NSEC) && answer.Type != question.Type && !dnssecOK {
+				continue
+			}
+			answers = append(answers, answer)
+			if !slices.ContainsFunc(signed, func(a Answer) bool { return a.Type == answer.Type && zoneKey(a.Name) == zoneKey(answer.Name) }) {
+				signed = append(signed, answer)
+			}
+		}
+		if dnssecOK && question.Type != TYPE_ANY && question.Type != TYPE_RRSIG {
+			for _, answer := range signed {
+				answers = append(answers, s.opts.Zone.signatures(answer.Name, answer.Type, answer.Class)...)
+			}
+		}
+	}
+	return answers, true, nil
+}
+
+func (s *Server) handleZoneQuery(ctx context.Context, msg Message, answers []Answer, clientIP net.IP, maxSize int) ([]byte, error) {
+	opt, hasOPT := msg.OPT()
+	msg.AddAnswers(answers)
+	msg.SetResponse(len(answers))
+	msg.Header.SetAuthoritative(true)
+	if s.opts.IncludeAuthority && len(answers) > 0 && isAddressQuery(msg) {
+		ns, glue := s.opts.Zone.authority(msg.Questions[0].Name, msg.Questions[0].Class, s.zoneTTL)
+		if hasOPT && opt.DNSSECOK && len(ns) > 0 {
+			ns = append(ns, s.opts.Zone.signatures(ns[0].Name, TYPE_NS, ns[0].Class)...)
+		}
+		msg.Authorities = ns
+		msg.Header.AuthorityCount = uint16(len(ns))
+		msg.Additionals = append(glue, msg.Additionals...)
+		msg.Header.AdditionalCount = uint16(len(msg.Additionals))
+	}
+	if s.opts.AdditionalHTTPS && len(answers) > 0 && isAddressQuery(msg) {
+		https := s.httpsHints(msg.Questions, hasOPT && opt.DNSSECOK)
+		msg.Additionals = append(https, msg.Additionals...)
+		msg.Header.AdditionalCount = uint16(len(msg.Additionals))
+	}
+	if s.opts.PerClientRotation {
+		rotateForClient(msg.Answers, clientIP)
+	}
+	s.filterAddresses(ctx, &msg, clientIP)
+	s.capAnswers(ctx, &msg)
+	s.jitterTTLs(&msg)
+	return marshalResponse(ctx, msg, maxSize)
+}
+
+// httpsHints returns the zone's HTTPS records for the questions' names, with
+// their signatures when dnssecOK, for the additional section of an address
+// response: clients asking for the address usually want them next.
+func (s *Server) httpsHints(questions []Question, dnssecOK bool) []Answer {
+	hints := make([]Answer, 0)
+	for _, question := range questions {
+		found, _ := s.opts.Zone.lookup(question.Name, TYPE_HTTPS, question.Class, s.zoneTTL)
+		found = slices.DeleteFunc(found, func(a Answer) bool { return a.Type != TYPE_HTTPS })
+		hints = append(hints, found...)
+		if dnssecOK && len(found) > 0 {
+			hints = append(hints, s.opts.Zone.signatures(question.Name, TYPE_HTTPS, question.Class)...)
+		}
+	}
+	return hints
+}
+
+// rotateForClient puts each set of A or AAAA records among answers in an
+// order fixed by the client's address: the records are sorted, then rotated
+// by a hash of it. A client always sees the same lead record while different
+// clients spread over all of them. Records of a set are next to each other.
+func rotateForClient(answers []Answer, clientIP net.IP) {
+	// The same IPv4 client may come as 4 or 16 bytes depending on the transport.
+	if ip4 := clientIP.To4(); ip4 != nil {
+		clientIP = ip4
+	}
+	h := fnv.New32a()
+	h.Write(clientIP)
+	hash := h.Sum32()
+
+	for start := 0; start < len(answers); {
+		end := start + 1
+		for end < len(answers) && answers[end].Type == answers[start].Type && zoneKey(answers[end].Name) == zoneKey(answers[start].Name) {
+			end++
+		}
+		if set := answers[start:end]; len(set) > 1 && (set[0].Type == TYPE_A || set[0].Type == TYPE_AAAA) {
+			slices.SortFunc(set, func(a, b Answer) int { return bytes.Compare(a.Data, b.Data) })
+			lead := int(hash % uint32(len(set)))
+			copy(set, append(slices.Clone(set[lead:]), set[:lead]...))
+		}
+		start = end
+	}
+}
+
+func isAddressQuery(msg Message) bool {
+	for _, question := range msg.Questions {
+		if question.Type != TYPE_A && question.Type != TYPE_AAAA {
+			return false
+		}
+	}
+	return len(msg.Questions) > 0
+}
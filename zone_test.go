@@ -0,0 +1,286 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZoneAnswersAuthoritatively(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewAAnswer("www.example.com", net.ParseIP("192.0.2.1"), 300))
+	server := NewServer(Options{Zone: zone, Resolver: "127.0.0.1:53535"})
+
+	response := queryType(t, server, "WWW.example.com", TYPE_A, nil)
+
+	assert.True(t, response.Header.Authoritative())
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 1}, response.Answers[0].Data)
+
+	noData := queryType(t, server, "www.example.com", TYPE_AAAA, nil)
+	assert.Equal(t, RCODE_NO_ERROR, noData.Header.ResponseCode())
+	assert.Empty(t, noData.Answers)
+}
+
+func TestZoneFallsThroughForUnknownNames(t *testing.T) {
+	zone := NewZone()
+	zone.Add(NewAAnswer("www.example.com", net.ParseIP("192.0.2.1"), 300))
+	server := NewServer(Options{Zone: zone})
+
+	response := queryType(t, server, "other.example.com", TYPE_A, nil)
+
+	assert.False(t, response.Header.Authoritative())
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, []byte{8, 8, 8, 8}, response.Answers[0].Data)
+}
+
+func TestWeightedLeadRecordDistribution(t *testing.T) {
+	weights := map[byte]int{1: 1, 2: 3, 3: 6}
+	zone := NewZone()
+	for last, weight := range weights {
+		zone.AddRecord(ZoneRecord{Answer: NewAAnswer("lb.example.com", net.IPv4(192, 0, 2, last), 60), Weight: weight})
+	}
+	server := NewServer(Options{Zone: zone})
+
+	const queries = 1000
+	leads := make(map[byte]int)
+	for i := 0; i < queries; i++ {
+		response := queryType(t, server, "lb.example.com", TYPE_A, nil)
+		require.Len(t, response.Answers, 3)
+		leads[response.Answers[0].Data[3]]++
+	}
+
+	for last, weight := range weights {
+		want := float64(queries) * float64(weight) / 10
+		assert.InDelta(t, want, float64(leads[last]), want*0.05, "lead share of 192.0.2.%d", last)
+	}
+}
+
+func TestWeightedSelectionIsConcurrencySafe(t *testing.T) {
+	zone := NewZone()
+	zone.AddRecord(ZoneRecord{Answer: NewAAnswer("lb.example.com", net.ParseIP("192.0.2.1"), 60), Weight: 1})
+	zone.AddRecord(ZoneRecord{Answer: NewAAnswer("lb.example.com", net.ParseIP("192.0.2.2"), 60), Weight: 2})
+	server := NewServer(Options{Zone: zone})
+	queryBytes, err := createTestQueryMessage("lb.example.com").MarshalBinary()
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for j := 0; j < 100; j++ {
+				server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+			}
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+}
+
+func TestZoneIncludeAuthority(t *testing.T) {
+	zone := NewZone()
+	zone.Add(
+		NewAAnswer("www.example.com", net.ParseIP("192.0.2.1"), 300),
+		Answer{Name: "example.com", Type: TYPE_NS, Class: CLASS_IN, TTL: 3600, Data: appendName(nil, "ns1.example.com")},
+		NewAAnswer("ns1.example.com", net.ParseIP("192.0.2.53"), 3600),
+	)
+
+	responseSize := func(includeAuthority bool) (Message, int) {
+		server := NewServer(Options{Zone: zone, IncludeAuthority: includeAuthority})
+		queryBytes, err := createTestQueryMessage("www.example.com").MarshalBinary()
+		require.NoError(t, err)
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		return response, len(responseBytes)
+	}
+
+	lean, leanSize := responseSize(false)
+	assert.Len(t, lean.Answers, 1)
+	assert.Empty(t, lean.Authorities)
+	assert.Empty(t, lean.Additionals)
+
+	full, fullSize := responseSize(true)
+	assert.Len(t, full.Answers, 1)
+	require.Len(t, full.Authorities, 1)
+	assert.Equal(t, TYPE_NS, full.Authorities[0].Type)
+	require.Len(t, full.Additionals, 1)
+	assert.Equal(t, "ns1.example.com", full.Additionals[0].Name)
+
+	assert.Less(t, leanSize, fullSize)
+}
+
+func TestZoneNeverAnswersAcrossClasses(t *testing.T) {
+	zone := NewZone()
+	chaos := NewTXTAnswer("info.example.com", 60, "chaos")
+	chaos.Class = CLASS_CH
+	zone.Add(chaos, NewTXTAnswer("info.example.com", 60, "internet"))
+	server := NewServer(Options{Zone: zone})
+
+	for _, qtype := range []uint16{TYPE_TXT, TYPE_ANY} {
+		response := queryType(t, server, "info.example.com", qtype, nil)
+		require.Len(t, response.Answers, 1)
+		assert.Equal(t, CLASS_IN, response.Answers[0].Class)
+		assert.Equal(t, "\x08internet", string(response.Answers[0].Data))
+	}
+
+	answers, exists := zone.Lookup("info.example.com", TYPE_TXT, CLASS_CH)
+	assert.True(t, exists)
+	require.Len(t, answers, 1)
+	assert.Equal(t, CLASS_CH, answers[0].Class)
+}
+
+func TestZoneDefaultClass(t *testing.T) {
+	zone := NewZone()
+	zone.DefaultClass = CLASS_CH
+	zone.Add(Answer{Name: "version.example", Type: TYPE_TXT, TTL: 0, Data: appendCharacterString(nil, "1.0")})
+
+	_, inExists := zone.Lookup("version.example", TYPE_TXT, CLASS_IN)
+	answers, chExists := zone.Lookup("version.example", TYPE_TXT, CLASS_CH)
+
+	assert.False(t, inExists)
+	assert.True(t, chExists)
+	require.Len(t, answers, 1)
+	assert.Equal(t, CLASS_CH, answers[0].Class)
+}
+
+func TestZoneFollowsCNAMEChains(t *testing.T) {
+	zone := NewZone()
+	zone.Add(
+		NewCNAMEAnswer("a.example.com", "b.example.com", 300),
+		NewCNAMEAnswer("b.example.com", "c.example.com", 300),
+		NewAAnswer("c.example.com", net.ParseIP("192.0.2.1"), 300),
+		NewCNAMEAnswer("away.example.com", "www.example.net", 300),
+		NewCNAMEAnswer("loop1.example.com", "loop2.example.com", 300),
+		NewCNAMEAnswer("loop2.example.com", "loop1.example.com", 300),
+	)
+	server := NewServer(Options{Zone: zone})
+
+	names := func(response Message) []string {
+		got := make([]string, len(response.Answers))
+		for i, answer := range response.Answers {
+			got[i] = typeName(answer.Type) + " " + answer.Name
+		}
+		return got
+	}
+
+	response := queryType(t, server, "a.example.com", TYPE_A, nil)
+	assert.True(t, response.Header.Authoritative())
+	assert.Equal(t, []string{"CNAME a.example.com", "CNAME b.example.com", "A c.example.com"}, names(response))
+	assert.Equal(t, []byte{192, 0, 2, 1}, response.Answers[2].Data)
+
+	cname := queryType(t, server, "a.example.com", TYPE_CNAME, nil)
+	assert.Equal(t, []string{"CNAME a.example.com"}, names(cname), "a CNAME query gets only the CNAME")
+
+	away := queryType(t, server, "away.example.com", TYPE_A, nil)
+	assert.Equal(t, []string{"CNAME away.example.com"}, names(away), "targets outside the zone are left to the client")
+
+	loop := queryType(t, server, "loop1.example.com", TYPE_A, nil)
+	assert.Equal(t, RCODE_SERVER_FAILURE, loop.Header.ResponseCode())
+	assert.Empty(t, loop.Answers)
+}
+
+func TestZoneCNAMEChainDepthLimit(t *testing.T) {
+	zone := NewZone()
+	for i := range 5 {
+		zone.Add(NewCNAMEAnswer(fmt.Sprintf("c%d.example.com", i), fmt.Sprintf("c%d.example.com", i+1), 300))
+	}
+	zone.Add(NewAAnswer("c5.example.com", net.ParseIP("192.0.2.1"), 300))
+
+	deep := queryType(t, NewServer(Options{Zone: zone}), "c0.example.com", TYPE_A, nil)
+	assert.Equal(t, RCODE_NO_ERROR, deep.Header.ResponseCode())
+	assert.Len(t, deep.Answers, 6)
+
+	limited := NewServer(Options{Zone: zone, MaxChainDepth: 4})
+	assert.Len(t, queryType(t, limited, "c1.example.com", TYPE_A, nil).Answers, 5, "a chain of exactly MaxChainDepth links is followed")
+	response := queryType(t, limited, "c0.example.com", TYPE_A, nil)
+	assert.Equal(t, RCODE_SERVER_FAILURE, response.Header.ResponseCode())
+	assert.Empty(t, response.Answers)
+}
+
+func TestZoneCNAMELoopGetsBoundedServfail(t *testing.T) {
+	zone := NewZone()
+	zone.Add(
+		NewCNAMEAnswer("a.example.com", "b.example.com", 300),
+		NewCNAMEAnswer("b.example.com", "c.example.com", 300),
+		NewCNAMEAnswer("c.example.com", "A.example.com.", 300),
+	)
+	server := NewServer(Options{Zone: zone})
+
+	msg := Message{
+		Header:    NewHeader(1, 0, 1, 0, 0, 0),
+		Questions: []Question{{Name: "a.example.com", Type: TYPE_A, Class: CLASS_IN}},
+	}
+	msg.SetOPT(OPT{UDPSize: 1232})
+	queryBytes, err := msg.MarshalBinary()
+	require.NoError(t, err)
+
+	responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+	require.NoError(t, err)
+	response, err := NewMessageFromBytes(responseBytes)
+	require.NoError(t, err)
+
+	assert.Equal(t, RCODE_SERVER_FAILURE, response.Header.ResponseCode())
+	ede, ok := response.ExtendedError()
+	require.True(t, ok)
+	assert.Equal(t, EDE_OTHER, ede.Code)
+	assert.Equal(t, "CNAME loop detected", ede.Text)
+}
+
+func TestZoneAdditionalHTTPS(t *testing.T) {
+	// HTTPS 1 . alpn=h2, in wire form.
+	https := []byte{0, 1, 0, 0, 1, 0, 3, 2, 'h', '2'}
+	zone := NewZone()
+	zone.Add(
+		NewAAnswer("www.example.com", net.ParseIP("192.0.2.1"), 300),
+		Answer{Name: "www.example.com", Type: TYPE_HTTPS, Class: CLASS_IN, TTL: 300, Length: uint16(len(https)), Data: https},
+		NewAAnswer("plain.example.com", net.ParseIP("192.0.2.2"), 300),
+	)
+	server := NewServer(Options{Zone: zone, AdditionalHTTPS: true})
+
+	response := queryType(t, server, "www.example.com", TYPE_A, nil)
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, TYPE_A, response.Answers[0].Type)
+	require.Len(t, response.Additionals, 1)
+	assert.Equal(t, TYPE_HTTPS, response.Additionals[0].Type)
+	assert.Equal(t, "www.example.com", response.Additionals[0].Name)
+	assert.Equal(t, https, response.Additionals[0].Data)
+
+	plain := queryType(t, server, "plain.example.com", TYPE_A, nil)
+	assert.Len(t, plain.Answers, 1)
+	assert.Empty(t, plain.Additionals, "names without HTTPS records get no hint")
+
+	off := queryType(t, NewServer(Options{Zone: zone}), "www.example.com", TYPE_A, nil)
+	assert.Empty(t, off.Additionals)
+}
+
+func TestPerClientRotation(t *testing.T) {
+	zone := NewZone()
+	for last := byte(1); last <= 8; last++ {
+		zone.Add(NewAAnswer("lb.example.com", net.IPv4(192, 0, 2, last), 60))
+	}
+	server := NewServer(Options{Zone: zone, PerClientRotation: true})
+
+	lead := func(clientIP net.IP) byte {
+		response := queryType(t, server, "lb.example.com", TYPE_A, clientIP)
+		require.Len(t, response.Answers, 8)
+		return response.Answers[0].Data[3]
+	}
+
+	leads := make(map[byte]bool)
+	for i := 1; i <= 50; i++ {
+		client := net.IPv4(198, 51, 100, byte(i))
+		first := lead(client)
+		for j := 0; j < 5; j++ {
+			require.Equal(t, first, lead(client), "a client should keep its lead record")
+		}
+		leads[first] = true
+	}
+	assert.Greater(t, len(leads), 1, "different clients should get different leads")
+}
@@ -0,0 +1,602 @@
+package dnsserver
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zoneToken is one field of a zone file entry. Quoted fields keep their
+// spaces and can't be mistaken for names, numbers or directives.
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// zoneEntry is one logical line of a zone file, with parenthesized
+// continuations already joined.
+type zoneEntry struct {
+	line       int
+	tokens     []zoneToken
+	blankOwner bool // the line started with whitespace, reusing the previous owner
+}
+
+// maxZoneIncludeDepth bounds how deep $INCLUDE directives can nest.
+const maxZoneIncludeDepth = 8
+
+// ParseZone reads records in the master file format of RFC 1035 section 5.
+// Relative names are completed with origin, which $ORIGIN can change, and
+// records without a TTL take the one set by $TTL or the previous record's.
+// Records without a class are IN. $INCLUDE needs ParseZoneFile.
+func ParseZone(r io.Reader, origin string) ([]Answer, error) {
+	records, err := parseZone(r, origin, CLASS_IN, false)
+	return recordAnswers(records), err
+}
+
+// ParseZoneFile is like ParseZone for the zone file at path, and also follows
+// its $INCLUDE directives, reading the files they name relative to the
+// directory of the file including them.
+func ParseZoneFile(path, origin string) ([]Answer, error) {
+	records, err := parseZoneFile(path, origin, CLASS_IN, false)
+	return recordAnswers(records), err
+}
+
+func recordAnswers(records []ZoneRecord) []Answer {
+	if records == nil {
+		return nil
+	}
+	answers := make([]Answer, len(records))
+	for i, record := range records {
+		answers[i] = record.Answer
+	}
+	return answers
+}
+
+// parseZone parses a zone from r. With inheritTTL, records left without a TTL,
+// with no $TTL set, are kept for the server to give one instead of failing.
+func parseZone(r io.Reader, origin string, defaultClass uint16, inheritTTL bool) ([]ZoneRecord, error) {
+	p := zoneParser{class: defaultClass, inheritTTL: inheritTTL}
+	return p.parse(r, strings.TrimSuffix(origin, "."), 0, false)
+}
+
+func parseZoneFile(path, origin string, defaultClass uint16, inheritTTL bool) ([]ZoneRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := zoneParser{path: filepath.Clean(path), class: defaultClass, inheritTTL: inheritTTL}
+	return p.parse(f, strings.TrimSuffix(origin, "."), 0, false)
+}
+
+// zoneParser parses one zone file, empty path for one read from a reader.
+// including holds the files whose $INCLUDE led to it, outermost first, to
+// refuse cycles.
+type zoneParser struct {
+	path       string
+	class      uint16
+	inheritTTL bool
+	including  []string
+}
+
+// at names a line of the file for errors.
+func (p *zoneParser) at(line int) string {
+	return zoneLocation(p.path, line)
+}
+
+func zoneLocation(path string, line int) string {
+	if path == "" {
+		return fmt.Sprintf("zone line %d", line)
+	}
+	return fmt.Sprintf("zone %s line %d", path, line)
+}
+
+// parse reads the file's records, starting from the origin and default TTL
+// of the file including it, if any.
+func (p *zoneParser) parse(r io.Reader, origin string, defaultTTL uint32, hasTTL bool) ([]ZoneRecord, error) {
+	entries, err := scanZone(r, p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		records  []ZoneRecord
+		owner    string
+		hasOwner bool
+	)
+	for _, entry := range entries {
+		tokens := entry.tokens
+		if !entry.blankOwner && !tokens[0].quoted && strings.HasPrefix(tokens[0].text, "$") {
+			directive := strings.ToUpper(tokens[0].text)
+			if directive == "$INCLUDE" {
+				if len(tokens) != 2 && len(tokens) != 3 {
+					return nil, fmt.Errorf("%s: $INCLUDE takes a file name and an optional origin", p.at(entry.line))
+				}
+				includeOrigin := origin
+				if len(tokens) == 3 {
+					includeOrigin = absoluteName(tokens[2].text, origin)
+				}
+				included, err := p.include(entry.line, tokens[1].text, includeOrigin, defaultTTL, hasTTL)
+				if err != nil {
+					return nil, err
+				}
+				records = append(records, included...)
+				continue
+			}
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("%s: %s takes one argument", p.at(entry.line), tokens[0].text)
+			}
+			switch directive {
+			case "$ORIGIN":
+				origin = absoluteName(tokens[1].text, origin)
+			case "$TTL":
+				ttl, err := strconv.ParseUint(tokens[1].text, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("%s: invalid TTL %q", p.at(entry.line), tokens[1].text)
+				}
+				defaultTTL, hasTTL = uint32(ttl), true
+			default:
+				return nil, fmt.Errorf("%s: unsupported directive %s", p.at(entry.line), tokens[0].text)
+			}
+			continue
+		}
+
+		if !entry.blankOwner {
+			owner, hasOwner = absoluteName(tokens[0].text, origin), true
+			tokens = tokens[1:]
+		}
+		if !hasOwner {
+			return nil, fmt.Errorf("%s: record has no owner name", p.at(entry.line))
+		}
+
+		answer := Answer{Name: owner, Class: p.class, TTL: defaultTTL}
+		explicitTTL := false
+		for len(tokens) > 0 {
+			if ttl, err := strconv.ParseUint(tokens[0].text, 10, 32); err == nil && !explicitTTL {
+				answer.TTL, explicitTTL = uint32(ttl), true
+			} else if class, ok := parseClass(tokens[0].text); ok {
+				answer.Class = class
+			} else {
+				break
+			}
+			tokens = tokens[1:]
+		}
+		inherited := !explicitTTL && !hasTTL
+		if inherited && !p.inheritTTL {
+			return nil, fmt.Errorf("%s: record has no TTL and no $TTL is set", p.at(entry.line))
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("%s: missing record type", p.at(entry.line))
+		}
+
+		recordType, ok := parseType(tokens[0].text)
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown record type %q", p.at(entry.line), tokens[0].text)
+		}
+		answer.Type = recordType
+		answer.Data, err = parseRecordData(recordType, tokens[1:], origin)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s record: %w", p.at(entry.line), typeName(recordType), err)
+		}
+		answer.Length = uint16(len(answer.Data))
+
+		records = append(records, ZoneRecord{Answer: answer, InheritTTL: inherited})
+		if !inherited {
+			defaultTTL, hasTTL = answer.TTL, true
+		}
+	}
+	return records, nil
+}
+
+// include parses the file an $INCLUDE on the given line names. Like the
+// origin, the default TTL carries into the included file but changes to
+// either made there don't carry back.
+func (p *zoneParser) include(line int, name, origin string, defaultTTL uint32, hasTTL bool) ([]ZoneRecord, error) {
+	if p.path == "" {
+		return nil, fmt.Errorf("%s: $INCLUDE needs a zone read from a file", p.at(line))
+	}
+	// Clean paths only, so the cycle check can compare them.
+	path := filepath.Clean(name)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(p.path), name)
+	}
+	including := append(slices.Clone(p.including), p.path)
+	if slices.Contains(including, path) {
+		return nil, fmt.Errorf("%s: $INCLUDE cycle through %s", p.at(line), path)
+	}
+	if len(including) > maxZoneIncludeDepth {
+		return nil, fmt.Errorf("%s: $INCLUDE nested more than %d deep", p.at(line), maxZoneIncludeDepth)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.at(line), err)
+	}
+	defer f.Close()
+
+	included := zoneParser{path: path, class: p.class, inheritTTL: p.inheritTTL, including: including}
+	records, err := included.parse(f, origin, defaultTTL, hasTTL)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.at(line), err)
+	}
+	return records, nil
+}
+
+// Load adds the records of a zone file to the zone, like ParseZone but with
+// the zone's DefaultClass for records without a class. Records left without a
+// TTL, with no $TTL set, are added with InheritTTL rather than failing.
+func (z *Zone) Load(r io.Reader, origin string) error {
+	records, err := parseZone(r, origin, z.defaultClass(), true)
+	if err != nil {
+		return err
+	}
+	z.addRecords(records)
+	return nil
+}
+
+// LoadFile is like Load for the zone file at path, following its $INCLUDE
+// directives like ParseZoneFile.
+func (z *Zone) LoadFile(path, origin string) error {
+	records, err := parseZoneFile(path, origin, z.defaultClass(), true)
+	if err != nil {
+		return err
+	}
+	z.addRecords(records)
+	return nil
+}
+
+func (z *Zone) defaultClass() uint16 {
+	if z.DefaultClass == 0 {
+		return CLASS_IN
+	}
+	return z.DefaultClass
+}
+
+// scanZone splits a zone file into entries, dropping comments and blank lines
+// and joining lines continued inside parentheses.
+func scanZone(r io.Reader, path string) ([]zoneEntry, error) {
+	var (
+		entries []zoneEntry
+		current zoneEntry
+		depth   int
+	)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if depth == 0 {
+			current = zoneEntry{line: line, blankOwner: text != "" && (text[0] == ' ' || text[0] == '\t')}
+		}
+
+		for i := 0; i < len(text); i++ {
+			switch c := text[i]; {
+			case c == ';':
+				i = len(text)
+			case c == ' ' || c == '\t':
+			case c == '(':
+				depth++
+			case c == ')':
+				if depth == 0 {
+					return nil, fmt.Errorf("%s: unbalanced parenthesis", zoneLocation(path, line))
+				}
+				depth--
+			case c == '"':
+				var b strings.Builder
+				for i++; i < len(text) && text[i] != '"'; i++ {
+					if text[i] == '\\' && i+1 < len(text) {
+						i++
+					}
+					b.WriteByte(text[i])
+				}
+				if i == len(text) {
+					return nil, fmt.Errorf("%s: unterminated quoted string", zoneLocation(path, line))
+				}
+				current.tokens = append(current.tokens, zoneToken{text: b.String(), quoted: true})
+			default:
+				start := i
+				for i < len(text) && !strings.ContainsRune(" \t;()\"", rune(text[i])) {
+					i++
+				}
+				current.tokens = append(current.tokens, zoneToken{text: text[start:i]})
+				i--
+			}
+		}
+
+		if depth == 0 && len(current.tokens) > 0 {
+			entries = append(entries, current)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("%s: unbalanced parenthesis", zoneLocation(path, current.line))
+	}
+	return entries, nil
+}
+
+// absoluteName resolves a zone file name: "@" is the origin, names ending in a
+// dot are already absolute and any other name is relative to the origin.
+func absoluteName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	}
+	return name + "." + origin
+}
+
+func parseClass(s string) (uint16, bool) {
+	switch strings.ToUpper(s) {
+	case "IN":
+		return CLASS_IN, true
+	case "CH":
+		return CLASS_CH, true
+	}
+	return 0, false
+}
+
+// parseType accepts the mnemonics of typeNames and the generic TYPEnnn form of RFC 3597.
+func parseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for t, name := range typeNames {
+		if name == s {
+			return t, true
+		}
+	}
+	if n, ok := strings.CutPrefix(s, "TYPE"); ok {
+		t, err := strconv.ParseUint(n, 10, 16)
+		return uint16(t), err == nil
+	}
+	return 0, false
+}
+
+func parseRecordData(recordType uint16, tokens []zoneToken, origin string) ([]byte, error) {
+	if len(tokens) > 0 && tokens[0].text == `\#` && !tokens[0].quoted {
+		return parseGenericData(tokens[1:])
+	}
+
+	fields := make([]string, len(tokens))
+	for i, token := range tokens {
+		fields[i] = token.text
+	}
+	wantFields := func(n int) error {
+		if len(fields) != n {
+			return fmt.Errorf("want %d fields, got %d", n, len(fields))
+		}
+		return nil
+	}
+
+	switch recordType {
+	case TYPE_A, TYPE_AAAA:
+		if err := wantFields(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0])
+		if recordType == TYPE_A {
+			ip = ip.To4()
+		} else if ip != nil && ip.To4() != nil {
+			ip = nil
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", fields[0])
+		}
+		return append([]byte{}, ip...), nil
+	case TYPE_NS, TYPE_CNAME, TYPE_PTR, TYPE_DNAME:
+		if err := wantFields(1); err != nil {
+			return nil, err
+		}
+		return appendName(nil, absoluteName(fields[0], origin)), nil
+	case TYPE_MX:
+		if err := wantFields(2); err != nil {
+			return nil, err
+		}
+		data, err := appendUints(nil, 16, fields[:1])
+		if err != nil {
+			return nil, err
+		}
+		return appendName(data, absoluteName(fields[1], origin)), nil
+	case TYPE_SRV:
+		if err := wantFields(4); err != nil {
+			return nil, err
+		}
+		data, err := appendUints(nil, 16, fields[:3])
+		if err != nil {
+			return nil, err
+		}
+		return appendName(data, absoluteName(fields[3], origin)), nil
+	case TYPE_SOA:
+		if err := wantFields(7); err != nil {
+			return nil, err
+		}
+		data := appendName(nil, absoluteName(fields[0], origin))
+		data = appendName(data, absoluteName(fields[1], origin))
+		return appendUints(data, 32, fields[2:])
+	case TYPE_TXT:
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("want at least 1 field")
+		}
+		data := make([]byte, 0)
+		for _, field := range fields {
+			data = appendCharacterString(data, field)
+		}
+		return data, nil
+	case TYPE_HINFO:
+		if err := wantFields(2); err != nil {
+			return nil, err
+		}
+		return NewHINFOAnswer("", fields[0], fields[1], 0).Data, nil
+	case TYPE_DS:
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("want at least 4 fields, got %d", len(fields))
+		}
+		data, err := appendUints(nil, 16, fields[:1])
+		if err != nil {
+			return nil, err
+		}
+		if data, err = appendUints(data, 8, fields[1:3]); err != nil {
+			return nil, err
+		}
+		digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest: %w", err)
+		}
+		return append(data, digest...), nil
+	case TYPE_DNSKEY:
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("want at least 4 fields, got %d", len(fields))
+		}
+		data, err := appendUints(nil, 16, fields[:1])
+		if err != nil {
+			return nil, err
+		}
+		if data, err = appendUints(data, 8, fields[1:3]); err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %w", err)
+		}
+		return append(data, key...), nil
+	case TYPE_RRSIG:
+		if len(fields) < 9 {
+			return nil, fmt.Errorf("want at least 9 fields, got %d", len(fields))
+		}
+		covered, ok := parseType(fields[0])
+		if !ok {
+			return nil, fmt.Errorf("unknown covered type %q", fields[0])
+		}
+		data := binary.BigEndian.AppendUint16(nil, covered)
+		data, err := appendUints(data, 8, fields[1:3])
+		if err != nil {
+			return nil, err
+		}
+		if data, err = appendUints(data, 32, fields[3:4]); err != nil {
+			return nil, err
+		}
+		for _, field := range fields[4:6] {
+			at, err := parseSignatureTime(field)
+			if err != nil {
+				return nil, err
+			}
+			data = binary.BigEndian.AppendUint32(data, at)
+		}
+		if data, err = appendUints(data, 16, fields[6:7]); err != nil {
+			return nil, err
+		}
+		data = appendName(data, absoluteName(fields[7], origin))
+		signature, err := base64.StdEncoding.DecodeString(strings.Join(fields[8:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature: %w", err)
+		}
+		return append(data, signature...), nil
+	case TYPE_NSEC:
+		if len(fields) < 1 {
+			return nil, fmt.Errorf("want at least 1 field")
+		}
+		types := make([]uint16, 0, len(fields)-1)
+		for _, field := range fields[1:] {
+			t, ok := parseType(field)
+			if !ok {
+				return nil, fmt.Errorf("unknown type %q in type bit map", field)
+			}
+			types = append(types, t)
+		}
+		return appendTypeBitmap(appendName(nil, absoluteName(fields[0], origin)), types), nil
+	}
+	return nil, fmt.Errorf(`data must use the generic \# form`)
+}
+
+// parseGenericData decodes the RFC 3597 form "\# length hex...".
+func parseGenericData(tokens []zoneToken) ([]byte, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf(`missing \# data length`)
+	}
+	length, err := strconv.Atoi(tokens[0].text)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid \# data length %q`, tokens[0].text)
+	}
+	var digits strings.Builder
+	for _, token := range tokens[1:] {
+		digits.WriteString(token.text)
+	}
+	data, err := hex.DecodeString(digits.String())
+	if err != nil {
+		return nil, fmt.Errorf(`invalid \# data: %w`, err)
+	}
+	if len(data) != length {
+		return nil, fmt.Errorf(`\# data is %d bytes, declared %d`, len(data), length)
+	}
+	return data, nil
+}
+
+func appendUints(data []byte, bits int, fields []string) ([]byte, error) {
+	for _, field := range fields {
+		v, err := strconv.ParseUint(field, 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", field)
+		}
+		switch bits {
+		case 8:
+			data = append(data, uint8(v))
+		case 16:
+			data = binary.BigEndian.AppendUint16(data, uint16(v))
+		default:
+			data = binary.BigEndian.AppendUint32(data, uint32(v))
+		}
+	}
+	return data, nil
+}
+
+// parseSignatureTime reads an RRSIG expiration or inception, written either as
+// YYYYMMDDHHmmSS in UTC or as seconds since the epoch (RFC 4034 section 3.2).
+func parseSignatureTime(s string) (uint32, error) {
+	if len(s) == 14 {
+		at, err := time.Parse("20060102150405", s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid signature time %q", s)
+		}
+		// Signature times are serial numbers modulo 2^32 (RFC 4034 section 3.1.5).
+		return uint32(at.Unix()), nil
+	}
+	at, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid signature time %q", s)
+	}
+	return uint32(at), nil
+}
+
+// appendTypeBitmap appends the NSEC type bit map of RFC 4034 section 4.1.2:
+// one block per 256-type window holding a type, each as long as its
+// highest set bit needs.
+func appendTypeBitmap(data []byte, types []uint16) []byte {
+	slices.Sort(types)
+	types = slices.Compact(types)
+	for len(types) > 0 {
+		window := types[0] >> 8
+		var bitmap [32]byte
+		length := 0
+		for len(types) > 0 && types[0]>>8 == window {
+			low := types[0] & 0xff
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			length = int(low/8) + 1
+			types = types[1:]
+		}
+		data = append(data, byte(window), byte(length))
+		data = append(data, bitmap[:length]...)
+	}
+	return data
+}
@@ -0,0 +1,277 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testZoneFile = `$ORIGIN example.com.
+$TTL 3600
+@       IN  SOA ns1 hostmaster (
+                2024010101 ; serial
+                7200 900 1209600 300 )
+        IN  NS  ns1
+ns1     IN  A   192.0.2.53
+www 300 IN  A   192.0.2.1
+        IN  AAAA 2001:db8::1
+host    IN  HINFO "INTEL" "LINUX"   ; trailing comment
+txt     IN  TXT "hello world" "second"
+mail.example.com. MX 10 mx.example.net.
+_sip._tcp SRV 10 20 5060 sip
+blob    TYPE65280 \# 3 abcdef
+`
+
+func TestParseZone(t *testing.T) {
+	answers, err := ParseZone(strings.NewReader(testZoneFile), "")
+	require.NoError(t, err)
+
+	want := []string{
+		"example.com.\t3600\tIN\tSOA\tns1.example.com. hostmaster.example.com. 2024010101 7200 900 1209600 300",
+		"example.com.\t3600\tIN\tNS\tns1.example.com.",
+		"ns1.example.com.\t3600\tIN\tA\t192.0.2.53",
+		"www.example.com.\t300\tIN\tA\t192.0.2.1",
+		"www.example.com.\t300\tIN\tAAAA\t2001:db8::1",
+		"host.example.com.\t300\tIN\tHINFO\t\"INTEL\" \"LINUX\"",
+		"txt.example.com.\t300\tIN\tTXT\t\"hello world\" \"second\"",
+		"mail.example.com.\t300\tIN\tMX\t10 mx.example.net.",
+		"_sip._tcp.example.com.\t300\tIN\tSRV\t\\# 23 000a001413c40373697007657861" + "6d706c6503636f6d00",
+		"blob.example.com.\t300\tIN\tTYPE65280\t\\# 3 abcdef",
+	}
+	got := make([]string, len(answers))
+	for i, answer := range answers {
+		got[i] = answer.String()
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestZoneLoadServesRecords(t *testing.T) {
+	zone := NewZone()
+	require.NoError(t, zone.Load(strings.NewReader(testZoneFile), ""))
+	server := NewServer(Options{Zone: zone})
+
+	response := queryType(t, server, "www.example.com", TYPE_A, nil)
+
+	assert.True(t, response.Header.Authoritative())
+	require.Len(t, response.Answers, 1)
+	assert.Equal(t, net.ParseIP("192.0.2.1").To4(), net.IP(response.Answers[0].Data))
+
+	hinfo := queryType(t, server, "host.example.com", TYPE_HINFO, nil)
+	require.Len(t, hinfo.Answers, 1)
+	texts, err := readCharacterStrings(hinfo.Answers[0].Data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"INTEL", "LINUX"}, texts)
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	tests := map[string]string{
+		"no TTL":            "www.example.com. IN A 192.0.2.1\n",
+		"bad address":       "$TTL 60\nwww.example.com. IN A 2001:db8::1\n",
+		"unknown type":      "$TTL 60\nwww.example.com. IN BOGUS x\n",
+		"unbalanced":        "$TTL 60\nexample.com. IN SOA a b ( 1 2 3 4 5\n",
+		"unterminated":      "$TTL 60\nexample.com. IN TXT \"abc\n",
+		"no owner":          "$TTL 60\n  IN A 192.0.2.1\n",
+		"generic length":    "$TTL 60\nexample.com. IN TYPE65280 \\# 2 abcdef\n",
+		"unknown directive": "$BOGUS x\n",
+		"include no file":   "$INCLUDE other.zone\n",
+	}
+
+	for name, zone := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseZone(strings.NewReader(zone), "")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseZoneFileIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeZone := func(name, zone string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(zone), 0o644))
+		return path
+	}
+	writeZone("hosts/www.zone", "www IN A 192.0.2.1\n")
+	writeZone("mail.zone", "@ IN MX 10 mx\nmx IN A 192.0.2.25\n")
+	main := writeZone("example.zone", `$ORIGIN example.com.
+$TTL 300
+@ IN NS ns1
+$INCLUDE hosts/www.zone
+$INCLUDE mail.zone mail.example.com.
+ns1 IN A 192.0.2.53
+`)
+
+	zone := NewZone()
+	require.NoError(t, zone.LoadFile(main, ""))
+	server := NewServer(Options{Zone: zone})
+
+	for name, qtype := range map[string]uint16{
+		"example.com":         TYPE_NS,
+		"www.example.com":     TYPE_A,
+		"mail.example.com":    TYPE_MX,
+		"mx.mail.example.com": TYPE_A,
+		"ns1.example.com":     TYPE_A,
+	} {
+		response := queryType(t, server, name, qtype, nil)
+		require.Len(t, response.Answers, 1, name)
+		assert.Equal(t, uint32(300), response.Answers[0].TTL, name)
+	}
+}
+
+func TestParseZoneFileIncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeZone := func(name, zone string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(zone), 0o644))
+		return path
+	}
+
+	cycle := writeZone("a.zone", "$TTL 60\n$INCLUDE b.zone\n")
+	writeZone("b.zone", "www IN A 192.0.2.1\n$INCLUDE a.zone\n")
+	_, err := ParseZoneFile(cycle, "example.com")
+	assert.ErrorContains(t, err, "cycle")
+
+	self := writeZone("self.zone", "$INCLUDE self.zone\n")
+	_, err = ParseZoneFile(self, "example.com")
+	assert.ErrorContains(t, err, "cycle")
+
+	absolute := writeZone("absolute.zone", "$INCLUDE "+dir+"/./absolute.zone"+"\n")
+	_, err = ParseZoneFile(absolute, "example.com")
+	assert.EqualError(t, err, "zone "+absolute+" line 1: $INCLUDE cycle through "+absolute, "an uncleaned absolute path should be seen as the file itself")
+
+	missing := writeZone("missing.zone", "$TTL 60\n$INCLUDE nowhere.zone\n")
+	_, err = ParseZoneFile(missing, "example.com")
+	assert.ErrorContains(t, err, "missing.zone line 2")
+
+	broken := writeZone("broken.zone", "$TTL 60\nwww IN A 192.0.2.1\n$INCLUDE bad.zone\n")
+	writeZone("bad.zone", "www IN BOGUS x\n")
+	_, err = ParseZoneFile(broken, "example.com")
+	assert.ErrorContains(t, err, "broken.zone line 3: zone "+filepath.Join(dir, "bad.zone")+" line 1: unknown record type")
+}
+
+const testSignedZoneFile = `$ORIGIN example.com.
+$TTL 3600
+@       DNSKEY 257 3 13 ( mdsswUyr3DPW132mOi8V9xESWE8jTo0d
+                          xCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ== )
+        RRSIG DNSKEY 13 2 3600 20300101000000 20240101000000 2371 example.com. (
+                  aGVsbG8gc2lnbmF0dXJl )
+        NSEC www A NS SOA RRSIG NSEC DNSKEY
+www     A 192.0.2.1
+        RRSIG A 13 3 3600 1893456000 1704067200 2371 example.com. c2ln
+sub     DS 60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118
+`
+
+func TestParseSignedZone(t *testing.T) {
+	answers, err := ParseZone(strings.NewReader(testSignedZoneFile), "")
+	require.NoError(t, err)
+	require.Len(t, answers, 6)
+
+	dnskey := answers[0]
+	assert.Equal(t, TYPE_DNSKEY, dnskey.Type)
+	assert.Equal(t, []byte{0x01, 0x01, 3, 13}, dnskey.Data[:4])
+	assert.Len(t, dnskey.Data, 4+64)
+
+	rrsig := answers[1]
+	assert.Equal(t, TYPE_RRSIG, rrsig.Type)
+	want := []byte{0, 48, 13, 2, 0, 0, 0x0e, 0x10, 0x70, 0xdb, 0xd8, 0x80, 0x65, 0x92, 0x00, 0x80, 0x09, 0x43}
+	want = appendName(want, "example.com")
+	assert.Equal(t, append(want, "hello signature"...), rrsig.Data)
+
+	nsec := answers[2]
+	assert.Equal(t, TYPE_NSEC, nsec.Type)
+	assert.Equal(t, append(appendName(nil, "www.example.com"), 0, 7, 0x62, 0, 0, 0, 0, 0x03, 0x80), nsec.Data)
+
+	assert.Equal(t, answers[1].Data[4:16], answers[4].Data[4:16], "epoch and YYYYMMDDHHmmSS times agree")
+
+	ds := answers[5]
+	assert.Equal(t, TYPE_DS, ds.Type)
+	assert.Equal(t, []byte{0xec, 0x45, 5, 1, 0x2b, 0xb1}, ds.Data[:6])
+	assert.Len(t, ds.Data, 4+20)
+}
+
+func TestSignedZoneFollowsDOBit(t *testing.T) {
+	zone := NewZone()
+	require.NoError(t, zone.Load(strings.NewReader(testSignedZoneFile), ""))
+	server := NewServer(Options{Zone: zone})
+
+	query := func(name string, qtype uint16, dnssecOK bool) Message {
+		msg := Message{
+			Header:    NewHeader(1, 0, 1, 0, 0, 0),
+			Questions: []Question{{Name: name, Type: qtype, Class: CLASS_IN}},
+		}
+		msg.SetOPT(OPT{UDPSize: 1232, DNSSECOK: dnssecOK})
+		queryBytes, err := msg.MarshalBinary()
+		require.NoError(t, err)
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportUDP, maxUDPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		return response
+	}
+	types := func(answers []Answer) []uint16 {
+		got := make([]uint16, len(answers))
+		for i, answer := range answers {
+			got[i] = answer.Type
+		}
+		return got
+	}
+
+	signed := query("example.com", TYPE_DNSKEY, true)
+	assert.True(t, signed.Header.Authoritative())
+	assert.Equal(t, []uint16{TYPE_DNSKEY, TYPE_RRSIG}, types(signed.Answers))
+	assert.Equal(t, TYPE_DNSKEY, binary.BigEndian.Uint16(signed.Answers[1].Data), "the RRSIG covers DNSKEY")
+
+	assert.Equal(t, []uint16{TYPE_DNSKEY}, types(query("example.com", TYPE_DNSKEY, false).Answers))
+	assert.Equal(t, []uint16{TYPE_A, TYPE_RRSIG}, types(query("www.example.com", TYPE_A, true).Answers))
+	assert.Equal(t, []uint16{TYPE_RRSIG}, types(query("www.example.com", TYPE_RRSIG, false).Answers))
+	assert.Equal(t, []uint16{TYPE_DS}, types(query("sub.example.com", TYPE_DS, true).Answers))
+}
+
+func TestSignedZoneOmitsDNSSECRecordsWithoutDO(t *testing.T) {
+	zone := NewZone()
+	require.NoError(t, zone.Load(strings.NewReader(testSignedZoneFile+`
+@       NS ns.example.com.
+        RRSIG NS 13 2 3600 20300101000000 20240101000000 2371 example.com. c2ln
+`), ""))
+	server := NewServer(Options{Zone: zone, IncludeAuthority: true})
+
+	query := func(name string, qtype uint16, dnssecOK bool) Message {
+		msg := createTestQueryMessage(name)
+		msg.Questions[0].Type = qtype
+		msg.SetOPT(OPT{UDPSize: 1232, DNSSECOK: dnssecOK})
+		queryBytes, err := msg.MarshalBinary()
+		require.NoError(t, err)
+		responseBytes, err := server.handleQuery(context.Background(), queryBytes, nil, TransportTCP, maxTCPMessageSize)
+		require.NoError(t, err)
+		response, err := NewMessageFromBytes(responseBytes)
+		require.NoError(t, err)
+		return response
+	}
+	has := func(records []Answer, qtype uint16) bool {
+		return slices.ContainsFunc(records, func(a Answer) bool { return a.Type == qtype })
+	}
+
+	plain := query("example.com", TYPE_ANY, false)
+	assert.True(t, has(plain.Answers, TYPE_DNSKEY))
+	assert.False(t, has(plain.Answers, TYPE_RRSIG), "ANY without DO shouldn't get signatures")
+	assert.False(t, has(plain.Answers, TYPE_NSEC), "ANY without DO shouldn't get NSEC records")
+	assert.True(t, has(query("example.com", TYPE_NSEC, false).Answers, TYPE_NSEC), "NSEC asked for by type is still answered")
+
+	signed := query("example.com", TYPE_ANY, true)
+	assert.True(t, has(signed.Answers, TYPE_RRSIG))
+	assert.True(t, has(signed.Answers, TYPE_NSEC))
+
+	assert.False(t, has(query("www.example.com", TYPE_A, false).Authorities, TYPE_RRSIG))
+	authority := query("www.example.com", TYPE_A, true).Authorities
+	require.True(t, has(authority, TYPE_NS))
+	assert.True(t, has(authority, TYPE_RRSIG), "the NS records in the authority section should carry their signatures with DO")
+}
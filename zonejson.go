@@ -0,0 +1,83 @@
+package dnsserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// jsonRecord is one record of the JSON record format read by LoadRecordsJSON.
+type jsonRecord struct {
+	Name  string          `json:"name"`
+	Type  string          `json:"type"`
+	Class string          `json:"class"`
+	TTL   uint32          `json:"ttl"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// LoadRecordsJSON reads a zone from a JSON array of records such as
+//
+//	[{"name": "www.example.com", "type": "A", "ttl": 300, "data": "192.0.2.1"}]
+//
+// The class defaults to IN. Data takes the presentation format of the type,
+// as in a zone file, with names always absolute: an address for A and AAAA, a
+// name for CNAME, "10 mail.example.com" for MX and so on. It may also be an
+// array of fields, and a TXT record's string data is a single text.
+func LoadRecordsJSON(r io.Reader) (*Zone, error) {
+	var records []jsonRecord
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&records); err != nil {
+		return nil, err
+	}
+
+	zone := NewZone()
+	for i, record := range records {
+		answer, err := record.answer()
+		if err != nil {
+			return nil, fmt.Errorf("record %d (%s %s): %w", i, record.Name, record.Type, err)
+		}
+		zone.Add(answer)
+	}
+	return zone, nil
+}
+
+func (r jsonRecord) answer() (Answer, error) {
+	name := strings.TrimSuffix(r.Name, ".")
+	if err := validateName(name); err != nil {
+		return Answer{}, err
+	}
+	recordType, ok := parseType(r.Type)
+	if !ok {
+		return Answer{}, fmt.Errorf("unknown record type %q", r.Type)
+	}
+	class := CLASS_IN
+	if r.Class != "" {
+		if class, ok = parseClass(r.Class); !ok {
+			return Answer{}, fmt.Errorf("unknown class %q", r.Class)
+		}
+	}
+
+	var fields []string
+	var text string
+	if err := json.Unmarshal(r.Data, &text); err == nil {
+		if recordType == TYPE_TXT {
+			fields = []string{text}
+		} else {
+			fields = strings.Fields(text)
+		}
+	} else if err := json.Unmarshal(r.Data, &fields); err != nil {
+		return Answer{}, fmt.Errorf("data must be a string or an array of strings")
+	}
+
+	tokens := make([]zoneToken, len(fields))
+	for i, field := range fields {
+		tokens[i] = zoneToken{text: field}
+	}
+	data, err := parseRecordData(recordType, tokens, "")
+	if err != nil {
+		return Answer{}, err
+	}
+	return Answer{Name: name, Type: recordType, Class: class, TTL: r.TTL, Length: uint16(len(data)), Data: data}, nil
+}
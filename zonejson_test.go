@@ -0,0 +1,66 @@
+package dnsserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRecordsJSON = `[
+	{"name": "www.example.com", "type": "A", "ttl": 300, "data": "192.0.2.1"},
+	{"name": "www.example.com.", "type": "AAAA", "class": "IN", "ttl": 300, "data": "2001:db8::1"},
+	{"name": "alias.example.com", "type": "CNAME", "ttl": 60, "data": "www.example.com"},
+	{"name": "example.com", "type": "MX", "ttl": 3600, "data": "10 mail.example.com"},
+	{"name": "example.com", "type": "TXT", "ttl": 3600, "data": "v=spf1 -all"},
+	{"name": "multi.example.com", "type": "TXT", "ttl": 3600, "data": ["one", "two"]},
+	{"name": "version.example.com", "type": "TXT", "class": "CH", "ttl": 0, "data": "1.0"}
+]`
+
+func TestLoadRecordsJSON(t *testing.T) {
+	zone, err := LoadRecordsJSON(strings.NewReader(testRecordsJSON))
+	require.NoError(t, err)
+	server := NewServer(Options{Zone: zone})
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  string
+	}{
+		{"www.example.com", TYPE_A, "www.example.com.\t300\tIN\tA\t192.0.2.1"},
+		{"www.example.com", TYPE_AAAA, "www.example.com.\t300\tIN\tAAAA\t2001:db8::1"},
+		{"alias.example.com", TYPE_CNAME, "alias.example.com.\t60\tIN\tCNAME\twww.example.com."},
+		{"example.com", TYPE_MX, "example.com.\t3600\tIN\tMX\t10 mail.example.com."},
+		{"example.com", TYPE_TXT, "example.com.\t3600\tIN\tTXT\t\"v=spf1 -all\""},
+		{"multi.example.com", TYPE_TXT, "multi.example.com.\t3600\tIN\tTXT\t\"one\" \"two\""},
+	}
+	for _, tt := range tests {
+		response := queryType(t, server, tt.name, tt.qtype, nil)
+		require.Len(t, response.Answers, 1, tt.name)
+		assert.Equal(t, tt.want, response.Answers[0].String())
+	}
+
+	answers, exists := zone.Lookup("version.example.com", TYPE_TXT, CLASS_CH)
+	assert.True(t, exists)
+	require.Len(t, answers, 1)
+	assert.Equal(t, CLASS_CH, answers[0].Class)
+}
+
+func TestLoadRecordsJSONValidates(t *testing.T) {
+	tests := map[string]string{
+		"bad address":   `[{"name": "a.example.com", "type": "A", "data": "not-an-ip"}]`,
+		"unknown type":  `[{"name": "a.example.com", "type": "BOGUS", "data": "x"}]`,
+		"unknown class": `[{"name": "a.example.com", "type": "A", "class": "XX", "data": "192.0.2.1"}]`,
+		"long label":    `[{"name": "` + strings.Repeat("a", 64) + `.example.com", "type": "A", "data": "192.0.2.1"}]`,
+		"bad data":      `[{"name": "a.example.com", "type": "A", "data": 42}]`,
+		"unknown field": `[{"name": "a.example.com", "type": "A", "data": "192.0.2.1", "weight": 1}]`,
+	}
+
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadRecordsJSON(strings.NewReader(doc))
+			assert.Error(t, err)
+		})
+	}
+}